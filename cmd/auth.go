@@ -84,8 +84,9 @@ func enableAuth(domain, username, password string) error {
 	// Use htpasswd to create/update the password file
 	// -c creates the file (we use it always to ensure single user)
 	// -B uses bcrypt encryption (more secure)
-	cmd := fmt.Sprintf("htpasswd -cbB %s %s %s", htpasswdPath, username, password)
-	_, err := utils.RunShell(cmd)
+	// -i reads the password from stdin, keeping it off the command line
+	utils.RegisterSecret(password)
+	_, err := utils.RunCommandWithInput(password, "htpasswd", "-ciB", htpasswdPath, username)
 	if err != nil {
 		return fmt.Errorf("failed to create .htpasswd file: %v", err)
 	}
@@ -183,13 +184,10 @@ func checkAuth(domain string) error {
 
 	// Check nginx configuration
 	if utils.CheckFileExists(vhostPath) {
-		vhostContent, err := utils.RunShell(fmt.Sprintf("cat %s", vhostPath))
-		if err == nil {
-			if strings.Contains(vhostContent, "auth_basic") {
-				fmt.Printf("Nginx configuration: Configured\n")
-			} else {
-				utils.Warn("Nginx configuration missing auth_basic directives")
-			}
+		if vhostHasAuth(vhostPath) {
+			fmt.Printf("Nginx configuration: Configured\n")
+		} else {
+			utils.Warn("Nginx configuration missing auth_basic directives")
 		}
 	}
 
@@ -200,6 +198,23 @@ func checkAuth(domain string) error {
 	return nil
 }
 
+// vhostHasAuth reports whether a vhost has an auth_basic_user_file
+// directive; commented-out ones do not count
+func vhostHasAuth(vhostPath string) bool {
+	conf, err := web.ReadNginxConfig(vhostPath)
+	if err != nil {
+		return false
+	}
+	found := false
+	conf.Walk(func(d, parent *web.NginxDirective) bool {
+		if d.Name == "auth_basic_user_file" {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
 // updateNginxAuthConfig updates nginx configuration to add or remove basic auth
 func updateNginxAuthConfig(domain, htpasswdPath string, enable bool) error {
 	vhostPath := fmt.Sprintf("/etc/nginx/sites-available/%s.conf", domain)
@@ -210,62 +225,31 @@ func updateNginxAuthConfig(domain, htpasswdPath string, enable bool) error {
 
 	utils.Log("Updating nginx configuration...")
 
-	// Read current config
-	content, err := utils.RunShell(fmt.Sprintf("cat %s", vhostPath))
+	conf, err := web.ReadNginxConfig(vhostPath)
 	if err != nil {
-		return fmt.Errorf("failed to read vhost config: %v", err)
+		return err
 	}
 
-	lines := strings.Split(content, "\n")
-	var result []string
-	inServerBlock := false
-	serverBlockDepth := 0
-	authAlreadyExists := false
-
-	for i, line := range lines {
-		trimmedLine := strings.TrimSpace(line)
-
-		// Track server blocks
-		if strings.Contains(trimmedLine, "server {") {
-			inServerBlock = true
-			serverBlockDepth = 0
-		}
+	// Remove existing auth_basic directives wherever they are
+	authAlreadyExists := conf.RemoveAll(func(d *web.NginxDirective) bool {
+		return d.Name == "auth_basic" || d.Name == "auth_basic_user_file"
+	}) > 0
 
-		if inServerBlock {
-			serverBlockDepth += strings.Count(line, "{")
-			serverBlockDepth -= strings.Count(line, "}")
-		}
-
-		// Remove existing auth_basic directives
-		if strings.Contains(trimmedLine, "auth_basic") || strings.Contains(trimmedLine, "auth_basic_user_file") {
-			authAlreadyExists = true
-			continue // Skip this line
-		}
-
-		// Add auth directives after server_name in main server block (not in location blocks)
-		if enable && inServerBlock && serverBlockDepth == 1 && strings.Contains(trimmedLine, "server_name") && strings.Contains(trimmedLine, ";") {
-			result = append(result, line)
-			// Get the indentation of the current line
-			indent := strings.Repeat(" ", len(line)-len(strings.TrimLeft(line, " ")))
-			result = append(result, "")
-			result = append(result, fmt.Sprintf("%s# Basic Authentication", indent))
-			result = append(result, fmt.Sprintf("%sauth_basic \"Restricted Access\";", indent))
-			result = append(result, fmt.Sprintf("%sauth_basic_user_file %s;", indent, htpasswdPath))
-			continue
-		}
-
-		result = append(result, line)
-
-		// Check if server block ended
-		if inServerBlock && serverBlockDepth == 0 && i > 0 {
-			inServerBlock = false
+	// Add auth directives after server_name in each server block serving
+	// the site (redirects to HTTPS need none)
+	if enable {
+		for _, server := range conf.Servers() {
+			if redirectsToHTTPS(server) {
+				continue
+			}
+			authBasic := web.NewNginxDirective("auth_basic", "Restricted Access")
+			authBasic.Comment = "Basic Authentication"
+			server.InsertAfter(server.FindOne("server_name"), authBasic,
+				web.NewNginxDirective("auth_basic_user_file", htpasswdPath))
 		}
 	}
 
-	// Write updated config
-	newContent := strings.Join(result, "\n")
-	_, err = utils.RunShell(fmt.Sprintf("cat > %s <<'EOF'\n%s\nEOF", vhostPath, newContent))
-	if err != nil {
+	if err := conf.WriteFile(vhostPath); err != nil {
 		return fmt.Errorf("failed to write updated config: %v", err)
 	}
 
@@ -0,0 +1,571 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"svp/pkg/backup"
+	"svp/pkg/cms"
+	"svp/pkg/config"
+	"svp/pkg/database"
+	"svp/pkg/system"
+	"svp/pkg/utils"
+	"svp/types"
+	"time"
+)
+
+var validTargetName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Backup writes a backup set for one or all sites and prunes old sets
+func Backup(cfg *types.Config) error {
+	fmt.Println()
+	fmt.Println("==========================================================")
+	fmt.Println("  Site Backup")
+	fmt.Println("==========================================================")
+	fmt.Println()
+
+	if err := config.EnsureConfigDirs(); err != nil {
+		return err
+	}
+	if err := config.EnsureBackupConfig(); err != nil {
+		return err
+	}
+	if err := system.EnsurePackage("zstd"); err != nil {
+		return err
+	}
+
+	keep := config.ReadBackupConfig()
+	if cfg.KeepDaily >= 0 {
+		keep.KeepDaily = cfg.KeepDaily
+	}
+	if cfg.KeepWeekly >= 0 {
+		keep.KeepWeekly = cfg.KeepWeekly
+	}
+	if cfg.KeepMonthly >= 0 {
+		keep.KeepMonthly = cfg.KeepMonthly
+	}
+
+	// Archives are encrypted when recipients are configured
+	encrypt := len(config.ReadBackupRecipients()) > 0
+	if encrypt {
+		if err := system.EnsurePackage("age"); err != nil {
+			return err
+		}
+	}
+
+	var targets []*types.BackupTarget
+	if !cfg.BackupLocalOnly {
+		var err error
+		if targets, err = config.ListBackupTargets(); err != nil {
+			return err
+		}
+	}
+
+	domains := []string{cfg.PrimaryDomain}
+	if cfg.BackupAll {
+		var err error
+		domains, err = config.ListSites()
+		if err != nil {
+			return err
+		}
+		if len(domains) == 0 {
+			utils.Skip("No sites configured")
+			return nil
+		}
+	}
+
+	var failed []string
+	for _, domain := range domains {
+		set, err := backupSite(domain, keep, encrypt)
+		if err != nil {
+			utils.Err("%s: %v", domain, err)
+			failed = append(failed, domain)
+		}
+		// Scheduled runs are checked by 'svp list' and 'svp verify'
+		if _, cfgErr := config.ReadSiteConfig(domain); cfgErr == nil {
+			if statusErr := backup.RecordStatus(domain, set, err); statusErr != nil {
+				utils.Warn("%v", statusErr)
+			}
+		}
+
+		if err != nil || len(targets) == 0 {
+			continue
+		}
+		offsiteErr := uploadOffsite(set, targets, keep)
+		if offsiteErr != nil {
+			utils.Err("%s: %v", domain, offsiteErr)
+			failed = append(failed, domain+" (offsite)")
+		}
+		if statusErr := backup.RecordOffsite(domain, offsiteErr); statusErr != nil {
+			utils.Warn("%v", statusErr)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("backup failed for %d site(s): %v", len(failed), failed)
+	}
+	return nil
+}
+
+func backupSite(domain string, keep *types.BackupConfig, encrypt bool) (*backup.Set, error) {
+	utils.Section(fmt.Sprintf("Backing up %s", domain))
+
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return nil, fmt.Errorf("site config not found - domain may not be configured: %s", domain)
+	}
+
+	siteDir := siteDomainDir(site)
+	hostname, _ := os.Hostname()
+	now := time.Now()
+
+	setDir, err := backup.NewSetDir(domain, now)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &backup.Manifest{
+		Domain:     domain,
+		CMS:        detectSiteCMS(site),
+		PHPVersion: site.PHPVersion,
+		Webroot:    site.Webroot,
+		SiteDir:    siteDir,
+		Host:       hostname,
+		Created:    now.Format(time.RFC3339),
+	}
+
+	if err := writeBackupSet(setDir, site, manifest, encrypt); err != nil {
+		// Leave no incomplete set behind
+		_ = os.RemoveAll(setDir)
+		return nil, err
+	}
+
+	utils.Ok("Backup written: %s (%.1f MB)", setDir, float64(manifest.Size)/1024/1024)
+	set := &backup.Set{ID: filepath.Base(setDir), Domain: domain, Dir: setDir, Time: now, Manifest: manifest, Complete: true}
+
+	// A failed prune leaves extra sets behind but the backup itself is fine
+	removed, err := backup.Prune(domain, keep)
+	if err != nil {
+		utils.Warn("Failed to prune old backups: %v", err)
+	}
+	for _, id := range removed {
+		utils.Log("Pruned backup set %s", id)
+	}
+	if err == nil && len(removed) == 0 {
+		utils.Verify("Retention: nothing to prune (daily %d, weekly %d, monthly %d)", keep.KeepDaily, keep.KeepWeekly, keep.KeepMonthly)
+	}
+
+	return set, nil
+}
+
+// uploadOffsite copies a new set to every offsite target and applies the
+// retention policy there. A failing target does not stop the others.
+func uploadOffsite(set *backup.Set, targets []*types.BackupTarget, keep *types.BackupConfig) error {
+	var failed []string
+	for _, targetCfg := range targets {
+		target, err := backup.NewTarget(targetCfg)
+		if err == nil {
+			utils.Log("Uploading to %s (%s)...", targetCfg.Name, targetCfg.Type)
+			err = target.Upload(set)
+		}
+		if err != nil {
+			utils.Fail("Offsite target %s: %v", targetCfg.Name, err)
+			failed = append(failed, targetCfg.Name)
+			continue
+		}
+		utils.Ok("Uploaded to %s", targetCfg.Name)
+
+		removed, err := backup.PruneTarget(target, set.Domain, keep)
+		if err != nil {
+			utils.Warn("Failed to prune old backups on %s: %v", targetCfg.Name, err)
+		}
+		for _, id := range removed {
+			utils.Log("Pruned backup set %s on %s", id, targetCfg.Name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("offsite upload failed for %d target(s): %v", len(failed), failed)
+	}
+	return nil
+}
+
+func writeBackupSet(setDir string, site *types.SiteConfig, manifest *backup.Manifest, encrypt bool) error {
+	domain := site.Domain
+
+	if err := dumpSiteDatabase(setDir, domain, manifest); err != nil {
+		return err
+	}
+
+	// Upload directories
+	for _, dir := range cms.UploadDirs(manifest.CMS, site.Webroot) {
+		if rel, err := filepath.Rel(manifest.SiteDir, dir); err == nil {
+			manifest.Uploads = append(manifest.Uploads, rel)
+		}
+	}
+	if len(manifest.Uploads) > 0 {
+		utils.Log("Archiving uploads: %s", strings.Join(manifest.Uploads, ", "))
+		if err := backup.ArchivePaths(filepath.Join(setDir, backup.UploadsFile), manifest.SiteDir, manifest.Uploads); err != nil {
+			return err
+		}
+		utils.Ok("Uploads archived")
+	} else {
+		utils.Skip("No upload directories found")
+	}
+
+	configPaths := siteConfigPaths(domain, site.PHPVersion, manifest.SiteDir)
+	if err := archiveConfigFiles(filepath.Join(setDir, backup.ConfigFile), configPaths); err != nil {
+		return err
+	}
+
+	if encrypt {
+		for _, name := range []string{backup.DatabaseFile, backup.UploadsFile, backup.ConfigFile} {
+			path := filepath.Join(setDir, name)
+			if !utils.CheckFileExists(path) {
+				continue
+			}
+			if _, err := backup.EncryptFile(path, config.BackupRecipientsFile); err != nil {
+				return err
+			}
+		}
+		manifest.Encrypted = true
+		utils.Ok("Archives encrypted to the recipients in %s", config.BackupRecipientsFile)
+	}
+
+	return backup.Finalize(setDir, manifest)
+}
+
+// dumpSiteDatabase writes the site's database dump into a set, if the site
+// has a database
+func dumpSiteDatabase(setDir, domain string, manifest *backup.Manifest) error {
+	dbName, dbUser, dbPass, exists := database.ReadDatabaseCredentials(domain, config.SitesDir)
+	if !exists {
+		utils.Skip("No database credentials found for %s", domain)
+		return nil
+	}
+	engine := database.ReadDatabaseEngine(domain, config.SitesDir)
+	if err := database.DumpDatabase(engine, database.ReadDatabaseServer(domain, config.SitesDir), dbName, dbUser, dbPass, filepath.Join(setDir, backup.DatabaseFile)); err != nil {
+		return err
+	}
+	manifest.Database = dbName
+	manifest.DBEngine = engine
+	return nil
+}
+
+// siteConfigPaths returns the existing svp, nginx and PHP-FPM config files
+// of a site. phpVersion may be the pattern "*" for the pools of all versions.
+func siteConfigPaths(domain, phpVersion, siteDir string) []string {
+	var paths []string
+	for _, pattern := range []string{
+		fmt.Sprintf("%s/%s.conf", config.SitesDir, domain),
+		fmt.Sprintf("%s/%s.db.txt", config.SitesDir, domain),
+		fmt.Sprintf("/etc/nginx/sites-available/%s.conf", domain),
+		fmt.Sprintf("%s/%s.d/*/*.conf", config.SitesDir, domain),
+		fmt.Sprintf("/etc/php/%s/fpm/pool.d/%s.conf", phpVersion, domain),
+		filepath.Join(siteDir, ".htpasswd"),
+	} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	return paths
+}
+
+// archiveConfigFiles writes config files to an archive, stored with their
+// path relative to /
+func archiveConfigFiles(outFile string, paths []string) error {
+	var rel []string
+	for _, path := range paths {
+		rel = append(rel, strings.TrimPrefix(path, "/"))
+	}
+	if err := backup.ArchivePaths(outFile, "/", rel); err != nil {
+		return err
+	}
+	utils.Ok("Configuration archived (%d files)", len(rel))
+	return nil
+}
+
+// BackupSchedule installs or removes the systemd timer that backs up a site
+func BackupSchedule(cfg *types.Config) error {
+	domain := cfg.PrimaryDomain
+	utils.Section(fmt.Sprintf("Backup Schedule for %s", domain))
+
+	if _, err := config.ReadSiteConfig(domain); err != nil {
+		return fmt.Errorf("site config not found - domain may not be configured: %s", domain)
+	}
+
+	if cfg.BackupDisable {
+		if err := backup.RemoveSchedule(domain); err != nil {
+			return err
+		}
+		utils.Ok("Scheduled backups of %s disabled (existing backups are kept)", domain)
+		return nil
+	}
+
+	onCalendar := cfg.BackupCalendar
+	if cfg.BackupDaily != "" {
+		var err error
+		if onCalendar, err = backup.DailyCalendar(cfg.BackupDaily); err != nil {
+			return err
+		}
+	}
+	if onCalendar == "" {
+		return fmt.Errorf("a schedule is required: --daily HH:MM or --on-calendar EXPR")
+	}
+
+	// The timer runs this binary, wherever it is installed
+	svpPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the svp binary: %v", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(svpPath); err == nil {
+		svpPath = resolved
+	}
+
+	if err := config.EnsureBackupConfig(); err != nil {
+		return err
+	}
+	if err := backup.InstallSchedule(domain, onCalendar, svpPath, cfg.BackupVerify); err != nil {
+		return err
+	}
+
+	utils.Ok("Backups of %s scheduled: %s", domain, onCalendar)
+	if cfg.BackupVerify {
+		utils.Ok("Each new set is verified by trial restore")
+	}
+	fmt.Println()
+	fmt.Printf("Next run:    systemctl list-timers %s.timer\n", backup.TimerName(domain))
+	fmt.Printf("Run now:     systemctl start %s.service\n", backup.TimerName(domain))
+	fmt.Printf("Logs:        journalctl -u %s.service\n", backup.TimerName(domain))
+	fmt.Println("Last status: svp list")
+	return nil
+}
+
+// BackupEncrypt configures the public keys backups are encrypted to
+func BackupEncrypt(cfg *types.Config) error {
+	utils.Section("Backup Encryption")
+
+	if cfg.BackupDisable {
+		if err := config.RemoveBackupRecipients(); err != nil {
+			return err
+		}
+		utils.Ok("Backup encryption disabled (existing encrypted sets stay encrypted)")
+		return nil
+	}
+
+	if cfg.BackupRecipients == "" {
+		recipients := config.ReadBackupRecipients()
+		if len(recipients) == 0 {
+			utils.Skip("Backups are not encrypted")
+			return nil
+		}
+		utils.Verify("Backups are encrypted to %d recipient(s):", len(recipients))
+		for _, recipient := range recipients {
+			fmt.Printf("  %s\n", recipient)
+		}
+		return nil
+	}
+
+	if err := system.EnsurePackage("age"); err != nil {
+		return err
+	}
+	var recipients []string
+	for _, recipient := range strings.Split(cfg.BackupRecipients, ",") {
+		recipient = strings.TrimSpace(recipient)
+		if recipient == "" {
+			continue
+		}
+		if err := backup.CheckRecipient(recipient); err != nil {
+			return err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	if err := config.SaveBackupRecipients(recipients); err != nil {
+		return err
+	}
+	utils.Ok("Backups will be encrypted to %d recipient(s)", len(recipients))
+	fmt.Println()
+	fmt.Println("Restores need the matching private key: svp restore DOMAIN --from ID --identity KEYFILE")
+	return nil
+}
+
+// BackupTarget manages the offsite targets that every backup is uploaded to
+func BackupTarget(cfg *types.Config) error {
+	switch cfg.TargetAction {
+	case "add":
+		return addBackupTarget(&cfg.Target)
+	case "remove":
+		if err := config.RemoveBackupTarget(cfg.Target.Name); err != nil {
+			return err
+		}
+		utils.Ok("Backup target %s removed (backups already uploaded are kept)", cfg.Target.Name)
+		return nil
+	case "list":
+		return listBackupTargets()
+	case "test":
+		target, err := config.ReadBackupTarget(cfg.Target.Name)
+		if err != nil {
+			return err
+		}
+		return testBackupTarget(target)
+	default:
+		return fmt.Errorf("unknown target action: %s (must be add, remove, list or test)", cfg.TargetAction)
+	}
+}
+
+func addBackupTarget(target *types.BackupTarget) error {
+	utils.Section(fmt.Sprintf("Adding Backup Target %s", target.Name))
+
+	if !validTargetName.MatchString(target.Name) {
+		return fmt.Errorf("invalid target name: %s (use letters, digits, '-' and '_')", target.Name)
+	}
+
+	switch target.Type {
+	case "s3":
+		if target.Endpoint == "" || target.Bucket == "" {
+			return fmt.Errorf("s3 targets need --endpoint and --bucket")
+		}
+		if target.AccessKey == "" {
+			fmt.Print("Access key: ")
+			fmt.Scanln(&target.AccessKey)
+		}
+		// Prompted rather than passed as a flag, so it stays out of shell history
+		if target.SecretKey == "" {
+			fmt.Print("Secret key: ")
+			fmt.Scanln(&target.SecretKey)
+		}
+		if target.AccessKey == "" || target.SecretKey == "" {
+			return fmt.Errorf("s3 targets need an access key and a secret key")
+		}
+	case "sftp":
+		if target.Host == "" {
+			return fmt.Errorf("sftp targets need --host")
+		}
+		if err := system.EnsurePackage("openssh-client"); err != nil {
+			return err
+		}
+	case "local":
+		if !filepath.IsAbs(target.Path) {
+			return fmt.Errorf("local targets need an absolute --path")
+		}
+	}
+	if target.Type != "sftp" {
+		// --port defaults to 22 and only applies to SFTP
+		target.Port = ""
+	}
+
+	// Also rejects unknown types
+	if _, err := backup.NewTarget(target); err != nil {
+		return err
+	}
+	if err := testBackupTarget(target); err != nil {
+		return err
+	}
+
+	if err := config.SaveBackupTarget(target); err != nil {
+		return err
+	}
+	utils.Ok("Backup target saved: %s/%s.conf", config.BackupTargetsDir, target.Name)
+	fmt.Println()
+	fmt.Println("Every 'svp backup' now uploads new sets to this target and prunes it")
+	fmt.Println("with the retention policy from /etc/svp/backup.conf.")
+	return nil
+}
+
+func testBackupTarget(target *types.BackupTarget) error {
+	client, err := backup.NewTarget(target)
+	if err != nil {
+		return err
+	}
+	utils.Log("Checking %s (%s)...", target.Name, target.Type)
+	if err := client.Check(); err != nil {
+		return fmt.Errorf("backup target %s is not usable: %v", target.Name, err)
+	}
+	utils.Ok("Backup target %s is reachable and writable", target.Name)
+	return nil
+}
+
+// listBackupTargets prints the configured targets without their credentials
+func listBackupTargets() error {
+	targets, err := config.ListBackupTargets()
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		utils.Skip("No backup targets configured")
+		return nil
+	}
+
+	fmt.Printf("%-16s %-6s %s\n", "NAME", "TYPE", "DESTINATION")
+	for _, target := range targets {
+		var destination string
+		switch target.Type {
+		case "s3":
+			destination = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(target.Endpoint, "/"), target.Bucket, target.Path)
+		case "sftp":
+			destination = fmt.Sprintf("%s:%s", target.Host, target.Path)
+			if target.User != "" {
+				destination = target.User + "@" + destination
+			}
+		default:
+			destination = target.Path
+		}
+		fmt.Printf("%-16s %-6s %s\n", target.Name, target.Type, strings.TrimSuffix(destination, "/"))
+	}
+	return nil
+}
+
+// backupHealth summarizes the backups of a site. stale is true for sites
+// that are scheduled or were backed up before but have no recent success.
+func backupHealth(domain string, staleAfterHours int) (summary string, stale bool) {
+	schedule, scheduled := backup.ReadSchedule(domain)
+	status, err := backup.ReadStatus(domain)
+	if err != nil {
+		return err.Error(), true
+	}
+
+	var parts []string
+	age, ok := status.LastSuccessAge()
+	switch {
+	case status == nil:
+		parts = append(parts, "never")
+	case !ok:
+		parts = append(parts, "no successful backup")
+	default:
+		parts = append(parts, fmt.Sprintf("%s ago, %.1f MB", formatAge(age), float64(status.LastSize)/1024/1024))
+	}
+	if status != nil && status.Result == "failed" {
+		parts = append(parts, "last run failed")
+	}
+	if status != nil && status.Offsite == "failed" {
+		parts = append(parts, "offsite failed")
+	}
+	if status != nil && status.VerifyResult == "failed" {
+		parts = append(parts, "verify failed")
+	}
+	if status != nil && status.VerifyResult == "checksums" {
+		parts = append(parts, "verified checksums only")
+	}
+	if scheduled {
+		parts = append(parts, "schedule "+schedule)
+	}
+
+	if status != nil || scheduled {
+		stale = !ok || age > time.Duration(staleAfterHours)*time.Hour
+	}
+	return strings.Join(parts, ", "), stale
+}
+
+// formatAge renders a duration as minutes, hours or days
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
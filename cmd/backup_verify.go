@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"svp/pkg/backup"
+	"svp/pkg/config"
+	"svp/pkg/database"
+	"svp/pkg/system"
+	"svp/pkg/utils"
+	"svp/types"
+)
+
+// keyTables must be present in the database dump of a CMS. WordPress
+// tables carry a configurable prefix (wp_ by default).
+var keyTables = map[string][]string{
+	"drupal":    {"users", "node"},
+	"wordpress": {"posts", "options", "users"},
+}
+
+// BackupVerify checks a backup set by trial restore: checksums, archive
+// integrity and an import of the dump into a scratch database
+func BackupVerify(cfg *types.Config) error {
+	domain := cfg.PrimaryDomain
+	utils.Section(fmt.Sprintf("Verifying Backup of %s", domain))
+
+	var setDir string
+	var manifest *backup.Manifest
+	if cfg.RestoreFrom == "" {
+		set, err := backup.LatestSet(domain)
+		if err != nil {
+			return err
+		}
+		setDir, manifest = set.Dir, set.Manifest
+	} else {
+		var err error
+		if setDir, manifest, err = backup.FindSet(domain, cfg.RestoreFrom); err != nil {
+			return err
+		}
+	}
+	id := filepath.Base(setDir)
+	utils.Log("Backup set: %s (created %s)", id, manifest.Created)
+
+	// An encrypted set can only be opened with its private key, which
+	// the server normally does not hold
+	checksumsOnly := manifest.Encrypted && cfg.IdentityFile == ""
+	err := verifyBackupSet(setDir, manifest, cfg.IdentityFile)
+
+	// 'svp list' and 'svp verify' report the last trial restore
+	if _, cfgErr := config.ReadSiteConfig(domain); cfgErr == nil {
+		if statusErr := backup.RecordVerify(domain, id, checksumsOnly, err); statusErr != nil {
+			utils.Warn("%v", statusErr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if checksumsOnly {
+		utils.Warn("Backup set %s is encrypted: only the checksums were compared - pass --identity for the trial restore", id)
+		return nil
+	}
+	utils.Ok("Backup set %s verified", id)
+	return nil
+}
+
+// verifyBackupSet compares the checksums of a set and, unless it is
+// encrypted and no identity is given, test-reads its archives and restores
+// the dump into a scratch database
+func verifyBackupSet(setDir string, manifest *backup.Manifest, identityFile string) error {
+	if err := backup.VerifyChecksums(setDir, manifest); err != nil {
+		return err
+	}
+	utils.Ok("Checksums match the manifest (%d files)", len(manifest.Files))
+
+	dataDir := setDir
+	if manifest.Encrypted {
+		if identityFile == "" {
+			utils.Skip("Archives are encrypted - pass --identity for the integrity checks and trial restore")
+			return nil
+		}
+		if err := system.EnsurePackage("age"); err != nil {
+			return err
+		}
+		var err error
+		if dataDir, err = os.MkdirTemp(backup.Root, ".verify-"); err != nil {
+			return fmt.Errorf("failed to create decryption directory: %v", err)
+		}
+		defer os.RemoveAll(dataDir)
+
+		if err := backup.DecryptSet(setDir, manifest, identityFile, dataDir); err != nil {
+			return err
+		}
+		utils.Ok("All archives decrypted")
+	}
+
+	for _, name := range []string{backup.DatabaseFile, backup.UploadsFile, backup.ConfigFile} {
+		if !manifest.HasFile(name) {
+			continue
+		}
+		if err := backup.TestArchive(filepath.Join(dataDir, name)); err != nil {
+			return err
+		}
+		utils.Ok("%s is readable", name)
+	}
+
+	if !manifest.HasFile(backup.DatabaseFile) {
+		utils.Skip("No database dump in this set")
+		return nil
+	}
+	return trialRestore(filepath.Join(dataDir, backup.DatabaseFile), manifest.CMS, manifest.Engine())
+}
+
+// trialRestore imports a dump into a scratch database, checks its tables
+// and drops it again
+func trialRestore(dumpFile, siteCMS, dbEngine string) error {
+	utils.Log("Restoring the dump into a scratch %s database...", dbEngine)
+	dbName, err := database.CreateScratchDatabase(dbEngine)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := database.DropScratchDatabase(dbEngine, dbName); err != nil {
+			utils.Warn("%v", err)
+			return
+		}
+		utils.Ok("Scratch database %s dropped", dbName)
+	}()
+
+	if err := database.ImportScratchDatabase(dbEngine, dumpFile, dbName); err != nil {
+		return err
+	}
+	tables, err := database.ListTables(dbEngine, database.Server{}, dbName)
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return fmt.Errorf("the dump restored no tables")
+	}
+	utils.Ok("Dump restored: %d tables", len(tables))
+
+	var missing []string
+	for _, name := range keyTables[siteCMS] {
+		table := findKeyTable(tables, name, siteCMS == "wordpress")
+		if table == "" {
+			if siteCMS == "wordpress" {
+				name = "*_" + name
+			}
+			utils.Fail("Table %s is missing", name)
+			missing = append(missing, name)
+			continue
+		}
+		rows, err := database.CountRows(dbEngine, dbName, table)
+		if err != nil {
+			return err
+		}
+		utils.Verify("%s: %d rows", table, rows)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("key tables missing from the dump: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// findKeyTable returns the table called name, or with prefixed, the
+// wp_-prefixed table or the first table with any prefix
+func findKeyTable(tables []string, name string, prefixed bool) string {
+	var match string
+	for _, table := range tables {
+		switch {
+		case !prefixed && table == name, prefixed && table == "wp_"+name:
+			return table
+		case prefixed && match == "" && strings.HasSuffix(table, "_"+name):
+			match = table
+		}
+	}
+	return match
+}
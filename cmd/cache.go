@@ -0,0 +1,330 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"svp/pkg/cache"
+	"svp/pkg/cms"
+	"svp/pkg/config"
+	"svp/pkg/utils"
+	"svp/pkg/web"
+	"svp/types"
+	"time"
+)
+
+// Cache runs a site cache action
+func Cache(cfg *types.Config) error {
+	switch cfg.CacheAction {
+	case "enable", "disable":
+		title := "Object Cache"
+		if cfg.Cache == cache.BackendPage {
+			title = "Page Cache"
+		}
+		fmt.Println()
+		fmt.Println("==========================================================")
+		fmt.Println("  " + title)
+		fmt.Println("==========================================================")
+		fmt.Println()
+		if cfg.CacheAction == "disable" {
+			return disablePageCache(cfg.PrimaryDomain)
+		}
+		return enableSiteCache(cfg.PrimaryDomain, cfg.Cache)
+	case "purge":
+		return purgePageCache(cfg.PrimaryDomain, cfg.CachePath)
+	case "stats":
+		return pageCacheStats(cfg)
+	default:
+		return fmt.Errorf("unknown cache action: %s", cfg.CacheAction)
+	}
+}
+
+// enableSiteCache enables a cache backend of a site
+func enableSiteCache(domain, backend string) error {
+	switch backend {
+	case cache.BackendRedis:
+		return enableRedisCache(domain)
+	case cache.BackendPage:
+		return enablePageCache(domain)
+	default:
+		return fmt.Errorf("unknown cache backend: %s (must be 'redis' or 'page')", backend)
+	}
+}
+
+// enableRedisCache gives a site its own Redis database and ACL user, loads
+// the PHP extension and configures the CMS to keep its cache there
+func enableRedisCache(domain string) error {
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found: %s", domain)
+	}
+	siteCMS := detectSiteCMS(site)
+	if siteCMS != "drupal" && siteCMS != "wordpress" {
+		return fmt.Errorf("cannot configure the cache of %s: unknown CMS", domain)
+	}
+
+	utils.Section("Redis")
+	if err := cache.InstallRedis(false); err != nil {
+		return err
+	}
+	sc, err := cache.EnableSiteRedis(domain)
+	if err != nil {
+		return err
+	}
+
+	utils.Section(fmt.Sprintf("PHP %s Redis Extension", site.PHPVersion))
+	if err := web.InstallPHPExtension(site.PHPVersion, "redis", false); err != nil {
+		return err
+	}
+
+	utils.Section(fmt.Sprintf("%s Cache Settings", siteCMS))
+	switch siteCMS {
+	case "drupal":
+		err = cms.EnableDrupalRedis(domain, site.Webroot, config.SiteRunUser(site), sc)
+	case "wordpress":
+		err = cms.EnableWordPressRedis(site.Webroot, config.SiteRunUser(site), sc)
+	}
+	if err != nil {
+		return err
+	}
+
+	utils.Section("Checking Cache")
+	return checkSiteCache(site, sc)
+}
+
+// checkSiteCache confirms that a site stores its cache in Redis: its key
+// prefix holds keys. A cache that is still empty is warmed up with a
+// request to the site first.
+func checkSiteCache(site *types.SiteConfig, sc *cache.SiteCache) error {
+	used, err := sc.HasKeys()
+	if err != nil {
+		return err
+	}
+	if !used {
+		if err := probeSite(site); err != nil {
+			return err
+		}
+		if used, err = sc.HasKeys(); err != nil {
+			return err
+		}
+	}
+	if !used {
+		return fmt.Errorf("no keys under %s: in Redis database %d - %s is not using its cache", sc.Prefix, sc.Database, site.Domain)
+	}
+	utils.Verify("%s uses its Redis cache (database %d, prefix %s)", site.Domain, sc.Database, sc.Prefix)
+	return nil
+}
+
+// enablePageCache lets nginx cache the pages PHP renders for anonymous
+// visitors of a site. Its bypass rules depend on the CMS, so other sites
+// are refused.
+func enablePageCache(domain string) error {
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found: %s", domain)
+	}
+	siteCMS := detectSiteCMS(site)
+	if siteCMS != "drupal" && siteCMS != "wordpress" {
+		return fmt.Errorf("cannot cache the pages of %s: unknown CMS, so logged-in users could not be told apart", domain)
+	}
+
+	utils.Section("Nginx Page Cache")
+	if site.PageCache {
+		utils.Verify("Page cache already enabled for %s", domain)
+	}
+	site.CMS = siteCMS
+	site.PageCache = true
+	if err := writeSiteVhost(site); err != nil {
+		// Leave the site as it was rather than with a broken vhost
+		site.PageCache = false
+		if rollbackErr := writeSiteVhost(site); rollbackErr != nil {
+			utils.Warn("Failed to restore the vhost of %s: %v", domain, rollbackErr)
+		}
+		return err
+	}
+	utils.Ok("Page cache enabled for %s (%s)", domain, web.PageCachePath(domain))
+
+	utils.Section("Checking Cache")
+	return checkPageCache(site)
+}
+
+// disablePageCache regenerates a site's vhost without the page cache and
+// removes its cached pages
+func disablePageCache(domain string) error {
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found: %s", domain)
+	}
+	if !site.PageCache {
+		utils.Verify("Page cache not enabled for %s", domain)
+		return nil
+	}
+
+	site.PageCache = false
+	if err := writeSiteVhost(site); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(web.PageCachePath(domain)); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", web.PageCachePath(domain), err)
+	}
+	utils.Ok("Page cache disabled for %s", domain)
+	return nil
+}
+
+// writeSiteVhost saves a site's config, regenerates its vhost from it and
+// reloads nginx
+func writeSiteVhost(site *types.SiteConfig) error {
+	if err := config.SaveSiteConfig(site); err != nil {
+		return err
+	}
+	if err := web.CreateNginxVhost(site); err != nil {
+		return err
+	}
+	return web.ReloadNginx()
+}
+
+// checkPageCache requests a site's home page until the cache answers it.
+// The first request may be a MISS that fills the cache.
+func checkPageCache(site *types.SiteConfig) error {
+	var code, status string
+	for attempt := 0; attempt < 3; attempt++ {
+		var err error
+		if code, status, err = pageCacheStatus(site); err != nil {
+			return err
+		}
+		if status == "HIT" {
+			utils.Verify("%s serves its home page from the page cache", site.Domain)
+			return nil
+		}
+	}
+
+	switch {
+	case code == "401":
+		utils.Skip("Cannot check the page cache of %s behind basic authentication", site.Domain)
+		return nil
+	case status == "":
+		return fmt.Errorf("no X-Cache-Status header from %s (HTTP %s) - regenerate its vhost with 'svp cache enable %s page'", site.Domain, code, site.Domain)
+	case status == "BYPASS":
+		return fmt.Errorf("the home page of %s bypasses the page cache (HTTP %s)", site.Domain, code)
+	default:
+		return fmt.Errorf("the home page of %s is not cached (%s, HTTP %s) - it probably sets a cookie", site.Domain, status, code)
+	}
+}
+
+// pageCacheStatus requests a site's home page through the local nginx and
+// returns the HTTP status and X-Cache-Status header of the response
+func pageCacheStatus(site *types.SiteConfig) (code, status string, err error) {
+	scheme, port := "http", "80"
+	if site.SSLEnabled {
+		scheme, port = "https", "443"
+	}
+	// -k: this checks the cache, not the certificate
+	curlCmd := fmt.Sprintf("curl -sk -o /dev/null -D - -m 15 --resolve %s:%s:127.0.0.1 %s://%s/",
+		site.Domain, port, scheme, site.Domain)
+	headers, err := utils.RunShell(curlCmd)
+	if err != nil {
+		return "", "", fmt.Errorf("%s did not respond", site.Domain)
+	}
+
+	for _, line := range strings.Split(headers, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "HTTP/") {
+			if fields := strings.Fields(line); len(fields) > 1 {
+				code = fields[1]
+			}
+		} else if name, value, found := strings.Cut(line, ":"); found && strings.EqualFold(name, "X-Cache-Status") {
+			status = strings.TrimSpace(value)
+		}
+	}
+	return code, status, nil
+}
+
+// purgePageCache removes all cached pages of a site, or those of one path
+func purgePageCache(domain, target string) error {
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found: %s", domain)
+	}
+	if !site.PageCache {
+		return fmt.Errorf("%s has no page cache - run 'svp cache enable %s page' first", domain, domain)
+	}
+
+	removed, err := web.PurgePageCache(site, target)
+	if err != nil {
+		return err
+	}
+	switch {
+	case target == "":
+		utils.Ok("Purged the page cache of %s (%d entries)", domain, removed)
+	case removed == 0:
+		utils.Verify("%s was not cached", target)
+	default:
+		utils.Ok("Purged %s (%d entries)", target, removed)
+	}
+	return nil
+}
+
+// pageCacheStats prints the size and hit ratio of a site's page cache
+func pageCacheStats(cfg *types.Config) error {
+	domain := cfg.PrimaryDomain
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found: %s", domain)
+	}
+	if !site.PageCache {
+		return fmt.Errorf("%s has no page cache - run 'svp cache enable %s page' first", domain, domain)
+	}
+	window, err := parseWindow(cfg.CacheSince)
+	if err != nil {
+		return err
+	}
+
+	since := time.Now().Add(-window).Truncate(time.Second)
+	stats, err := web.ReadPageCacheStats(domain, since)
+	if err != nil {
+		return err
+	}
+
+	if cfg.CacheJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+
+	fmt.Printf("Page cache of %s since %s\n", domain, since.Format("2006-01-02 15:04"))
+
+	utils.Section("Storage")
+	fmt.Printf("Entries: %d\n", stats.Entries)
+	fmt.Printf("Size:    %.1f MB of %s\n", float64(stats.Bytes)/(1024*1024), stats.MaxSize)
+
+	utils.Section("Requests")
+	if len(stats.Statuses) == 0 {
+		utils.Skip("No PHP requests logged in %s", web.PageCacheLogFile(domain))
+		return nil
+	}
+	statuses := make([]string, 0, len(stats.Statuses))
+	for status := range stats.Statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if stats.Statuses[statuses[i]] != stats.Statuses[statuses[j]] {
+			return stats.Statuses[statuses[i]] > stats.Statuses[statuses[j]]
+		}
+		return statuses[i] < statuses[j]
+	})
+	for _, status := range statuses {
+		fmt.Printf("%-12s %d\n", status, stats.Statuses[status])
+	}
+	fmt.Printf("Hit ratio:   %.1f%%\n", stats.HitRatio*100)
+
+	if len(stats.TopMisses) > 0 {
+		utils.Section("Most Missed Paths")
+		fmt.Printf("%-8s %s\n", "COUNT", "PATH")
+		for _, miss := range stats.TopMisses {
+			fmt.Printf("%-8d %s\n", miss.Count, shorten(miss.Path, 100))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"svp/pkg/cms"
+	"svp/pkg/config"
+	"svp/pkg/database"
+	"svp/pkg/system"
+	"svp/pkg/utils"
+	"svp/types"
+	"time"
+)
+
+// DB runs a site database action
+func DB(cfg *types.Config) error {
+	switch cfg.DBAction {
+	case "rotate":
+		return rotateDatabasePassword(cfg.PrimaryDomain)
+	case "export":
+		return exportDatabase(cfg)
+	case "import":
+		return importDatabase(cfg)
+	case "tune":
+		return tuneDatabase(cfg)
+	default:
+		return fmt.Errorf("unknown db action: %s", cfg.DBAction)
+	}
+}
+
+// rotateDatabasePassword gives a site's database user a new password and
+// points the credentials file and the CMS settings at it. If the site no
+// longer bootstraps afterwards, the old password is put back everywhere.
+func rotateDatabasePassword(domain string) error {
+	fmt.Println()
+	fmt.Println("==========================================================")
+	fmt.Println("  Database Password Rotation")
+	fmt.Println("==========================================================")
+	fmt.Println()
+
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found: %s", domain)
+	}
+	siteCMS := detectSiteCMS(site)
+	if siteCMS != "drupal" && siteCMS != "wordpress" {
+		return fmt.Errorf("cannot update the database settings of %s: unknown CMS", domain)
+	}
+	dbName, dbUser, oldPass, exists := database.ReadDatabaseCredentials(domain, config.SitesDir)
+	if !exists {
+		return fmt.Errorf("database credentials not found in %s/%s.db.txt", config.SitesDir, domain)
+	}
+	engine := database.ReadDatabaseEngine(domain, config.SitesDir)
+	dbServer := database.ReadDatabaseServer(domain, config.SitesDir)
+
+	// A site that is already broken would make the rotation look failed
+	utils.Section("Checking Site")
+	if engine == database.EngineMariaDB {
+		if err := database.CheckSiteConnection(dbServer, dbName, dbUser, oldPass); err != nil {
+			return fmt.Errorf("%v - fix the site before rotating its password", err)
+		}
+		utils.Ok("Database login works with the current password")
+	}
+	if err := checkSiteBootstrap(site, siteCMS); err != nil {
+		return fmt.Errorf("%v - fix the site before rotating its password", err)
+	}
+
+	newPass, err := database.GeneratePassword(24)
+	if err != nil {
+		return fmt.Errorf("failed to generate password: %v", err)
+	}
+
+	utils.Section("Rotating Password")
+	if err := database.SetUserPassword(engine, dbServer, dbUser, newPass); err != nil {
+		return err
+	}
+	utils.Ok("Password of database user %s changed", dbUser)
+
+	// The new password must work on the server before the site switches to it
+	err = nil
+	if engine == database.EngineMariaDB {
+		err = database.CheckSiteConnection(dbServer, dbName, dbUser, newPass)
+	}
+	if err == nil {
+		err = applySitePassword(site, siteCMS, dbName, dbUser, newPass)
+	}
+	if err == nil {
+		err = checkSiteBootstrap(site, siteCMS)
+	}
+	if err != nil {
+		utils.Fail("%v", err)
+		utils.Section("Reverting")
+		if revertErr := database.SetUserPassword(engine, dbServer, dbUser, oldPass); revertErr != nil {
+			return fmt.Errorf("rotation failed (%v) and the old password could not be restored: %v", err, revertErr)
+		}
+		if revertErr := applySitePassword(site, siteCMS, dbName, dbUser, oldPass); revertErr != nil {
+			return fmt.Errorf("rotation failed (%v) and the site settings could not be restored: %v", err, revertErr)
+		}
+		utils.Ok("Previous password restored")
+		return fmt.Errorf("rotation failed: %v", err)
+	}
+
+	utils.Ok("Database password of %s rotated", domain)
+	return nil
+}
+
+// applySitePassword writes a database password to the credentials file and
+// the CMS settings, then reloads PHP-FPM so no worker keeps the old one
+func applySitePassword(site *types.SiteConfig, siteCMS, dbName, dbUser, dbPass string) error {
+	if err := database.UpdateCredentialsPassword(site.Domain, config.SitesDir, dbPass); err != nil {
+		return err
+	}
+	utils.Ok("Credentials updated in %s/%s.db.txt", config.SitesDir, site.Domain)
+
+	var err error
+	switch siteCMS {
+	case "drupal":
+		err = cms.UpdateDrupalDatabaseCredentials(site.Webroot, dbName, dbUser, dbPass)
+	case "wordpress":
+		err = cms.UpdateWordPressDatabasePassword(site.Webroot, dbPass)
+	}
+	if err != nil {
+		return err
+	}
+
+	return system.ReloadService(fmt.Sprintf("php%s-fpm", site.PHPVersion))
+}
+
+// checkSiteBootstrap checks that the CMS can connect to its database from
+// the command line and that the site responds through nginx
+func checkSiteBootstrap(site *types.SiteConfig, siteCMS string) error {
+	switch siteCMS {
+	case "drupal":
+		drushCmd := fmt.Sprintf("drush-%s", site.Domain)
+		if !utils.CommandExists(drushCmd) {
+			utils.Skip("%s not found - checking over HTTP only", drushCmd)
+			break
+		}
+		output, err := utils.RunCommand(drushCmd, "status", "--field=bootstrap")
+		if err != nil || !strings.Contains(output, "Successful") {
+			return fmt.Errorf("Drupal does not bootstrap")
+		}
+		utils.Ok("Drupal bootstraps")
+	case "wordpress":
+		wpCmd := fmt.Sprintf("cd %s && sudo -u %s wp option get home", site.Webroot, config.SiteRunUser(site))
+		if _, err := utils.RunShell(wpCmd); err != nil {
+			return fmt.Errorf("WordPress cannot connect to its database: %v", err)
+		}
+		utils.Ok("WordPress connects to its database")
+	}
+
+	return probeSite(site)
+}
+
+// exportDatabase dumps a live site database to a file, compressed according
+// to its extension
+func exportDatabase(cfg *types.Config) error {
+	domain := cfg.PrimaryDomain
+	dbName, dbUser, dbPass, exists := database.ReadDatabaseCredentials(domain, config.SitesDir)
+	if !exists {
+		return fmt.Errorf("database credentials not found in %s/%s.db.txt", config.SitesDir, domain)
+	}
+	engine := database.ReadDatabaseEngine(domain, config.SitesDir)
+
+	outFile := cfg.DBExportFile
+	if outFile == "" {
+		outFile = fmt.Sprintf("%s-%s.sql.gz", domain, time.Now().Format("20060102-150405"))
+	}
+	if utils.CheckFileExists(outFile) {
+		return fmt.Errorf("%s already exists", outFile)
+	}
+
+	if err := database.DumpDatabase(engine, database.ReadDatabaseServer(domain, config.SitesDir), dbName, dbUser, dbPass, outFile); err != nil {
+		_ = os.Remove(outFile)
+		return err
+	}
+
+	info, err := os.Stat(outFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", outFile, err)
+	}
+	absPath, _ := filepath.Abs(outFile)
+	utils.Ok("Exported %s to %s (%.1f MB)", domain, absPath, float64(info.Size())/(1<<20))
+	return nil
+}
+
+// importDatabase loads a dump into a live site database and runs the CMS
+// database updates
+func importDatabase(cfg *types.Config) error {
+	fmt.Println()
+	fmt.Println("==========================================================")
+	fmt.Println("  Database Import")
+	fmt.Println("==========================================================")
+	fmt.Println()
+
+	domain := cfg.PrimaryDomain
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found: %s", domain)
+	}
+	if !utils.CheckFileExists(cfg.DBImport) {
+		return fmt.Errorf("database file not found: %s", cfg.DBImport)
+	}
+	dbName, dbUser, dbPass, exists := database.ReadDatabaseCredentials(domain, config.SitesDir)
+	if !exists {
+		return fmt.Errorf("database credentials not found in %s/%s.db.txt", config.SitesDir, domain)
+	}
+	engine := database.ReadDatabaseEngine(domain, config.SitesDir)
+	dbServer := database.ReadDatabaseServer(domain, config.SitesDir)
+
+	fmt.Printf("Import:   %s\n", cfg.DBImport)
+	fmt.Printf("Into:     %s (%s database %s on %s)\n", domain, engine, dbName, dbServer)
+	if cfg.DBDropTables {
+		fmt.Println("  • All existing tables are dropped first")
+	} else {
+		fmt.Println("  • Tables in the dump replace existing ones; other tables are kept")
+	}
+	fmt.Println()
+	if !cfg.AssumeYes {
+		fmt.Print("Continue? [y/N]: ")
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			utils.Skip("Import cancelled")
+			return nil
+		}
+	}
+
+	if !cfg.NoSnapshot {
+		if err := takeSnapshot(domain, siteDomainDir(site), "db-import", false); err != nil {
+			return err
+		}
+	}
+
+	utils.Section("Importing Database")
+	if cfg.DBDropTables {
+		utils.Log("Dropping all tables in %s...", dbName)
+		if err := database.DropAllTables(engine, dbServer, dbName, dbUser, dbPass); err != nil {
+			return err
+		}
+		utils.Ok("Tables dropped")
+	}
+	if err := database.ImportDatabase(engine, dbServer, cfg.DBImport, dbName, dbUser, dbPass); err != nil {
+		return err
+	}
+
+	utils.Section("Updating Site")
+	site.CMS = detectSiteCMS(site)
+	if site.CMS == "drupal" {
+		drushCmd := fmt.Sprintf("drush-%s", domain)
+		if utils.CommandExists(drushCmd) {
+			utils.Log("Running database updates...")
+			if _, err := utils.RunCommand(drushCmd, "updb", "-y"); err != nil {
+				utils.Warn("Database updates failed: %v", err)
+			} else {
+				utils.Ok("Database updates applied")
+			}
+		}
+	}
+	clearSiteCache(site)
+	if err := probeSite(site); err != nil {
+		return err
+	}
+
+	utils.Ok("Database of %s imported from %s", domain, filepath.Base(cfg.DBImport))
+	return nil
+}
+
+// tuneDatabase writes the MariaDB tuning file, or previews it with --show.
+// A --profile override is saved for later runs of setup and verify.
+func tuneDatabase(cfg *types.Config) error {
+	profile := cfg.TuningProfile
+	if profile == "" {
+		profile = config.ReadTuningProfile()
+	}
+	if !database.ValidTuningProfile(profile) {
+		return fmt.Errorf("invalid profile %q (use small, medium, large or auto)", profile)
+	}
+
+	ramMB, err := database.TotalMemoryMB()
+	if err != nil {
+		return err
+	}
+	sites := tuningSiteCount()
+
+	if cfg.TuningShow {
+		tuning := database.NewMariaDBTuning(profile, ramMB, sites)
+		fmt.Printf("%s:\n\n%s\n", database.MariaDBTuningFile, tuning.Render())
+		if drift := tuning.Drift(); len(drift) > 0 {
+			fmt.Println("Changes to the current file:")
+			for _, line := range drift {
+				fmt.Printf("  • %s\n", line)
+			}
+		} else {
+			utils.Verify("The current file matches")
+		}
+		return nil
+	}
+
+	if !utils.CheckPackageInstalled("mariadb-server") {
+		return fmt.Errorf("MariaDB is not installed")
+	}
+	if cfg.TuningProfile != "" {
+		if err := config.SaveTuningProfile(profile); err != nil {
+			return err
+		}
+		utils.Ok("Tuning profile set to %s in %s", profile, config.DatabaseConfigFile)
+	}
+	return database.TuneMariaDB(profile, sites, false)
+}
+
+// tuningSiteCount returns the number of configured sites plus the given
+// domains that are not configured yet
+func tuningSiteCount(domains ...string) int {
+	sites := make(map[string]bool)
+	existing, _ := config.ListSites()
+	for _, domain := range append(existing, domains...) {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			sites[domain] = true
+		}
+	}
+	return len(sites)
+}
@@ -0,0 +1,265 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"svp/pkg/cms"
+	"svp/pkg/config"
+	"svp/pkg/ssl"
+	"svp/pkg/utils"
+	"svp/pkg/web"
+	"svp/types"
+)
+
+// Domain handles domain alias operations: add, remove, canonical, policy, list
+func Domain(cfg *types.Config) error {
+	domain := cfg.PrimaryDomain
+	alias := strings.ToLower(strings.TrimSpace(cfg.DomainAlias))
+
+	utils.Section(fmt.Sprintf("Domain Aliases for %s", domain))
+
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found - domain may not be configured: %s", domain)
+	}
+
+	switch cfg.DomainAction {
+	case "add":
+		return addDomainAlias(site, alias, cfg.DomainCanonical)
+	case "remove":
+		return removeDomainAlias(site, alias)
+	case "canonical":
+		return setCanonicalHost(site, alias)
+	case "policy":
+		return setCanonicalPolicy(site, alias)
+	case "list":
+		return listDomainAliases(site)
+	default:
+		return fmt.Errorf("invalid action: %s (must be add, remove, canonical, policy, or list)", cfg.DomainAction)
+	}
+}
+
+func addDomainAlias(site *types.SiteConfig, alias string, canonical bool) error {
+	utils.Section("Adding Domain Alias")
+
+	if alias == "" {
+		return fmt.Errorf("alias hostname is required")
+	}
+	if !config.ValidHostname(alias) {
+		return fmt.Errorf("invalid alias hostname: %s", alias)
+	}
+
+	for _, name := range site.Hostnames() {
+		if name == alias {
+			utils.Verify("%s is already served by %s", alias, site.Domain)
+			if canonical {
+				return setCanonicalHost(site, alias)
+			}
+			return nil
+		}
+	}
+
+	// An alias must not belong to another site
+	owner, err := config.FindSiteByHostname(alias)
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		return fmt.Errorf("%s is already served by site %s", alias, owner.Domain)
+	}
+
+	site.Aliases = append(site.Aliases, alias)
+	if canonical {
+		site.CanonicalHost = alias
+		site.CanonicalPolicy = ""
+	}
+
+	if err := applyDomainChanges(site); err != nil {
+		return err
+	}
+
+	utils.Ok("Alias %s added to %s", alias, site.Domain)
+	printDomainSummary(site)
+	return nil
+}
+
+func removeDomainAlias(site *types.SiteConfig, alias string) error {
+	utils.Section("Removing Domain Alias")
+
+	if alias == "" {
+		return fmt.Errorf("alias hostname is required")
+	}
+
+	if alias == site.Domain {
+		return fmt.Errorf("cannot remove the primary domain %s", site.Domain)
+	}
+
+	var remaining []string
+	for _, name := range site.Aliases {
+		if name != alias {
+			remaining = append(remaining, name)
+		}
+	}
+
+	if len(remaining) == len(site.Aliases) {
+		utils.Warn("%s is not an alias of %s", alias, site.Domain)
+		return nil
+	}
+
+	site.Aliases = remaining
+	if site.CanonicalHost == alias {
+		utils.Warn("%s was the canonical hostname - redirects disabled", alias)
+		site.CanonicalHost = ""
+		site.CanonicalPolicy = ""
+	}
+
+	if err := applyDomainChanges(site); err != nil {
+		return err
+	}
+
+	utils.Ok("Alias %s removed from %s", alias, site.Domain)
+	printDomainSummary(site)
+	return nil
+}
+
+func setCanonicalHost(site *types.SiteConfig, hostname string) error {
+	utils.Section("Setting Canonical Hostname")
+
+	if hostname == "" || hostname == "none" {
+		site.CanonicalHost = ""
+	} else {
+		found := false
+		for _, name := range site.Hostnames() {
+			if name == hostname {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s is not served by %s (add it first with: svp domain add %s %s)", hostname, site.Domain, site.Domain, hostname)
+		}
+		site.CanonicalHost = hostname
+	}
+	site.CanonicalPolicy = ""
+
+	if err := applyDomainChanges(site); err != nil {
+		return err
+	}
+
+	if site.CanonicalHost == "" {
+		utils.Ok("Canonical hostname cleared - all names are served directly")
+	} else {
+		utils.Ok("Canonical hostname set to %s", site.CanonicalHost)
+	}
+	printDomainSummary(site)
+	return nil
+}
+
+func setCanonicalPolicy(site *types.SiteConfig, policy string) error {
+	utils.Section("Setting Canonical Host Policy")
+
+	if err := config.ApplyCanonicalPolicy(site, policy); err != nil {
+		return err
+	}
+
+	if err := applyDomainChanges(site); err != nil {
+		return err
+	}
+
+	utils.Ok("Canonical host policy set to %s", policy)
+	printDomainSummary(site)
+	return nil
+}
+
+func listDomainAliases(site *types.SiteConfig) error {
+	printDomainSummary(site)
+	return nil
+}
+
+// applyDomainChanges saves the site config and brings nginx, the SSL
+// certificate and the CMS configuration in line with the site's hostnames
+func applyDomainChanges(site *types.SiteConfig) error {
+	if err := config.SaveSiteConfig(site); err != nil {
+		return err
+	}
+
+	// Regenerate vhost with the new server names
+	utils.Section("Updating Nginx Configuration")
+	if err := web.CreateNginxVhost(site); err != nil {
+		return fmt.Errorf("failed to update Nginx vhost: %v", err)
+	}
+	if err := web.ReloadNginx(); err != nil {
+		return err
+	}
+
+	// Certificate must cover every name; nginx now answers on the new names
+	// so certbot can validate them. The vhost already points at the
+	// certificate, so a reload picks up the expanded one
+	if site.SSLEnabled {
+		utils.Section("Updating SSL Certificate")
+		if err := ssl.ExpandCertificate(site.Domain, site.Hostnames()); err != nil {
+			utils.Warn("Failed to update SSL certificate: %v", err)
+			utils.Warn("Browsers will show certificate warnings for names the certificate does not cover")
+		}
+	}
+
+	// Update CMS configuration
+	utils.Section("Updating CMS Configuration")
+	switch detectSiteCMS(site) {
+	case "drupal":
+		if err := cms.UpdateDrupalTrustedHosts(site.Webroot, site.Hostnames()); err != nil {
+			utils.Warn("Failed to update Drupal trusted hosts: %v", err)
+		}
+	case "wordpress":
+		baseHost := site.CanonicalHost
+		if baseHost == "" {
+			baseHost = site.Domain
+		}
+		protocol := "http"
+		if site.SSLEnabled {
+			protocol = "https"
+		}
+		if err := cms.UpdateWordPressURL(site.Webroot, config.SiteRunUser(site), fmt.Sprintf("%s://%s", protocol, baseHost)); err != nil {
+			utils.Warn("Failed to update WordPress URL: %v", err)
+		}
+	default:
+		utils.Skip("Unknown CMS, skipping CMS configuration")
+	}
+
+	utils.Section("Reloading Nginx")
+	return web.ReloadNginx()
+}
+
+// detectSiteCMS returns the site's CMS, detecting it from the webroot
+// for sites provisioned before the CMS was recorded in the site config
+func detectSiteCMS(site *types.SiteConfig) string {
+	if site.CMS != "" {
+		return site.CMS
+	}
+	if utils.CheckFileExists(fmt.Sprintf("%s/wp-config.php", site.Webroot)) {
+		return "wordpress"
+	}
+	if utils.CheckDirExists(fmt.Sprintf("%s/sites/default", site.Webroot)) {
+		return "drupal"
+	}
+	return ""
+}
+
+func printDomainSummary(site *types.SiteConfig) {
+	fmt.Println()
+	fmt.Printf("Primary domain: %s\n", site.Domain)
+	if len(site.Aliases) > 0 {
+		fmt.Printf("Aliases: %s\n", strings.Join(site.Aliases, ", "))
+	} else {
+		fmt.Println("Aliases: none")
+	}
+	if site.CanonicalPolicy != "" {
+		fmt.Printf("Policy: %s\n", site.CanonicalPolicy)
+	}
+	if site.CanonicalHost != "" {
+		fmt.Printf("Canonical: %s (other names redirect with 301)\n", site.CanonicalHost)
+	} else {
+		fmt.Println("Canonical: none (all names served directly)")
+	}
+	fmt.Println()
+}
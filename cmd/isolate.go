@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"svp/pkg/cms"
+	"svp/pkg/config"
+	"svp/pkg/system"
+	"svp/pkg/utils"
+	"svp/pkg/web"
+	"svp/types"
+)
+
+// Isolate moves existing sites to (or back from) their own system user
+func Isolate(cfg *types.Config) error {
+	fmt.Println()
+	fmt.Println("==========================================================")
+	fmt.Println("  Site Isolation")
+	fmt.Println("==========================================================")
+	fmt.Println()
+
+	domains := []string{cfg.PrimaryDomain}
+	if cfg.IsolateAll {
+		var err error
+		domains, err = config.ListSites()
+		if err != nil {
+			return err
+		}
+		if len(domains) == 0 {
+			utils.Skip("No sites configured")
+			return nil
+		}
+	}
+
+	var failed []string
+	for _, domain := range domains {
+		var err error
+		if cfg.IsolateRevert {
+			err = revertSiteIsolation(domain)
+		} else {
+			err = isolateSite(domain)
+		}
+		if err != nil {
+			utils.Err("%s: %v", domain, err)
+			failed = append(failed, domain)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("isolation failed for %d site(s): %v", len(failed), failed)
+	}
+	return nil
+}
+
+func isolateSite(domain string) error {
+	utils.Section(fmt.Sprintf("Isolating %s", domain))
+
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found - domain may not be configured: %s", domain)
+	}
+
+	domainDir := siteDomainDir(site)
+	if !utils.CheckDirExists(domainDir) {
+		return fmt.Errorf("site directory not found: %s", domainDir)
+	}
+
+	if site.SiteUser != "" {
+		utils.Verify("%s already runs as %s - reapplying ownership and pool", domain, site.SiteUser)
+	} else {
+		site.SiteUser = system.SiteUsername(domain)
+	}
+
+	if err := system.EnsureSiteUser(site.SiteUser, domainDir); err != nil {
+		return err
+	}
+
+	if err := system.SetSiteOwnership(domainDir, site.Webroot, site.SiteUser); err != nil {
+		return err
+	}
+
+	// The pool restart switches running PHP workers to the new user
+	if err := web.CreatePHPPool(domain, site.PHPVersion, site.Webroot, site.SiteUser); err != nil {
+		return err
+	}
+
+	if err := config.SaveSiteConfig(site); err != nil {
+		return err
+	}
+
+	updateDrushWrapper(site)
+
+	utils.Ok("%s now runs as %s", domain, site.SiteUser)
+	fmt.Printf("Run CLI tools as the site user: sudo -u %s wp|drush ...\n", site.SiteUser)
+	return nil
+}
+
+func revertSiteIsolation(domain string) error {
+	utils.Section(fmt.Sprintf("Reverting Isolation for %s", domain))
+
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found - domain may not be configured: %s", domain)
+	}
+
+	if site.SiteUser == "" {
+		utils.Skip("%s is not isolated", domain)
+		return nil
+	}
+
+	siteUser := site.SiteUser
+	domainDir := siteDomainDir(site)
+	adminUser := config.GetAdminUser()
+
+	if err := system.SetSharedOwnership(domainDir, adminUser); err != nil {
+		return err
+	}
+
+	site.SiteUser = ""
+	if err := web.CreatePHPPool(domain, site.PHPVersion, site.Webroot, ""); err != nil {
+		return err
+	}
+
+	if err := config.SaveSiteConfig(site); err != nil {
+		return err
+	}
+
+	updateDrushWrapper(site)
+
+	// Pool workers are gone after the restart, so the user can be removed
+	_, _ = utils.RunCommand("rm", "-rf", fmt.Sprintf("%s/%s", system.SiteTempRoot, domain))
+	if _, err := utils.RunCommand("userdel", siteUser); err != nil {
+		utils.Warn("Failed to remove site user %s: %v", siteUser, err)
+	}
+
+	utils.Ok("%s runs in the shared www-data pool again", domain)
+	return nil
+}
+
+// updateDrushWrapper points an existing drush-DOMAIN wrapper at the
+// site's current run user
+func updateDrushWrapper(site *types.SiteConfig) {
+	if !utils.CheckFileExists(fmt.Sprintf("/usr/local/bin/drush-%s", site.Domain)) {
+		return
+	}
+
+	// Drush aliases use PROJECT/web as the Drupal root
+	projectDir := filepath.Dir(site.Webroot)
+	if err := cms.CreateDrushWrapper(site.Domain, projectDir, site.SiteUser); err != nil {
+		utils.Warn("Failed to update Drush wrapper: %v", err)
+	}
+}
+
+// siteDomainDir returns the directory holding all of a site's files: the
+// ancestor of the webroot named after the domain (e.g. /var/www/example.com)
+func siteDomainDir(site *types.SiteConfig) string {
+	for dir := site.Webroot; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if filepath.Base(dir) == site.Domain {
+			return dir
+		}
+	}
+	return filepath.Join("/var/www", site.Domain)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"svp/pkg/config"
+	"svp/pkg/utils"
+	"svp/types"
+)
+
+// List prints the configured sites with their backup status
+func List(cfg *types.Config) error {
+	domains, err := config.ListSites()
+	if err != nil {
+		return err
+	}
+	if len(domains) == 0 {
+		utils.Skip("No sites configured")
+		return nil
+	}
+
+	staleAfter := config.ReadBackupConfig().StaleAfterHours
+
+	fmt.Printf("%-32s %-10s %-5s %-4s %-9s %s\n", "DOMAIN", "CMS", "PHP", "SSL", "USER", "LAST BACKUP")
+	staleCount := 0
+	for _, domain := range domains {
+		site, err := config.ReadSiteConfig(domain)
+		if err != nil {
+			fmt.Printf("%-32s %v\n", domain, err)
+			continue
+		}
+
+		sslState := "off"
+		if site.SSLEnabled {
+			sslState = "on"
+		}
+		user := "shared"
+		if site.SiteUser != "" {
+			user = "isolated"
+		}
+
+		summary, stale := backupHealth(domain, staleAfter)
+		if stale {
+			summary = "STALE: " + summary
+			staleCount++
+		}
+
+		fmt.Printf("%-32s %-10s %-5s %-4s %-9s %s\n", domain, detectSiteCMS(site), site.PHPVersion, sslState, user, summary)
+	}
+
+	if staleCount > 0 {
+		fmt.Println()
+		utils.Warn("%d site(s) without a successful backup in the last %d hours", staleCount, staleAfter)
+	}
+	return nil
+}
@@ -0,0 +1,470 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"svp/pkg/config"
+	"svp/pkg/database"
+	"svp/pkg/system"
+	"svp/pkg/utils"
+	"svp/pkg/web"
+	"svp/types"
+	"time"
+)
+
+// migrateSource describes a site found on the source server of a migration
+type migrateSource struct {
+	Host       string // user@host
+	Port       string
+	Sudo       bool
+	SVP        bool   // the source server is managed by svp
+	SiteDir    string // directory copied to /var/www/DOMAIN
+	Webroot    string
+	PHPVersion string
+	CMS        string
+	DumpCmd    string // prints an SQL dump of the site database on stdout
+}
+
+// Files holding database credentials of the source server. A delta sync
+// never overwrites the local versions written by setup.
+var migrateLocalFiles = []string{"settings.php", "settings.svp.php", "wp-config.php"}
+
+// inspectScript runs on the source server and prints KEY=value lines
+const inspectScript = `DOMAIN='%s'
+SUDO='%s'
+conf="/etc/svp/sites/$DOMAIN.conf"
+if $SUDO test -f "$conf"; then
+  $SUDO cat "$conf" | sed -n 's/^\(PHP_VERSION\|WEBROOT\|CMS\)=/SVP_\1=/p'
+  $SUDO cat "/etc/svp/sites/$DOMAIN.db.txt" 2>/dev/null | sed -n 's/^Database: */DB_NAME=/p; s/^Username: */DB_USER=/p; s/^Password: */DB_PASS=/p; s/^Engine: */DB_ENGINE=/p; s/^Host: */DB_HOST=/p; s/^Port: */DB_PORT=/p; s/^TLS: */DB_TLS=/p'
+fi
+vhost=$($SUDO grep -lsE "server_name[^;]*[[:space:]]$DOMAIN[[:space:];]" /etc/nginx/sites-enabled/* /etc/nginx/conf.d/*.conf | head -n1)
+if [ -n "$vhost" ]; then
+  echo "NGINX_ROOT=$($SUDO sed -nE 's/^[[:space:]]*root[[:space:]]+([^;]+);.*/\1/p' "$vhost" | head -n1)"
+  echo "NGINX_PHP=$($SUDO grep -oE 'php[0-9]+\.[0-9]+' "$vhost" | head -n1 | sed 's/php//')"
+fi
+echo "PHP_CLI=$(php -r 'echo PHP_MAJOR_VERSION.".".PHP_MINOR_VERSION;' 2>/dev/null)"
+`
+
+// probeScript detects the CMS and project root of a webroot on a source
+// server that is not managed by svp
+const probeScript = `ROOT=%s
+SUDO='%s'
+if $SUDO test -f "$ROOT/wp-config.php" || $SUDO test -f "$ROOT/wp-load.php"; then
+  echo "CMS=wordpress"
+  echo "PROJECT=$ROOT"
+elif $SUDO test -f "$ROOT/core/lib/Drupal.php"; then
+  echo "CMS=drupal"
+  if $SUDO test -f "$ROOT/../composer.json"; then
+    echo "PROJECT=$(cd "$ROOT/.." && pwd)"
+  else
+    echo "PROJECT=$ROOT"
+  fi
+fi
+`
+
+// Migrate copies a site from another server over SSH. The first run
+// provisions the site locally; --final re-syncs files and database for the
+// cutover.
+func Migrate(cfg *types.Config) error {
+	domain := strings.ToLower(strings.TrimSpace(cfg.PrimaryDomain))
+	if !config.ValidHostname(domain) {
+		return fmt.Errorf("invalid domain: %s", cfg.PrimaryDomain)
+	}
+	if cfg.MigrateFrom == "" {
+		return fmt.Errorf("--from user@host is required")
+	}
+
+	src := &migrateSource{Host: cfg.MigrateFrom, Port: cfg.MigrateSSHPort, Sudo: cfg.MigrateSudo}
+	if src.Port == "" {
+		src.Port = "22"
+	}
+	if !strings.Contains(src.Host, "@") {
+		src.Host = "root@" + src.Host
+	}
+	if !strings.HasPrefix(src.Host, "root@") && !src.Sudo {
+		utils.Log("Connecting as a non-root user; add --sudo if files or configs are not readable")
+	}
+
+	if err := system.EnsurePackage("rsync"); err != nil {
+		return err
+	}
+
+	utils.Section(fmt.Sprintf("Inspecting %s on %s", domain, src.Host))
+	if _, err := src.run("true"); err != nil {
+		return fmt.Errorf("cannot connect to %s (svp needs key-based SSH as root, see ssh-copy-id): %v", src.Host, err)
+	}
+	if err := src.inspect(domain); err != nil {
+		return err
+	}
+	if cfg.PHPVersion != "" {
+		src.PHPVersion = cfg.PHPVersion
+	}
+
+	fmt.Printf("Source:   %s:%s\n", src.Host, src.SiteDir)
+	fmt.Printf("Webroot:  %s\n", src.Webroot)
+	fmt.Printf("CMS:      %s\n", src.CMS)
+	fmt.Printf("PHP:      %s\n", src.PHPVersion)
+	fmt.Println()
+
+	if cfg.MigrateFinal {
+		return finalMigrationSync(domain, src)
+	}
+	return initialMigration(domain, src)
+}
+
+func initialMigration(domain string, src *migrateSource) error {
+	siteDir := filepath.Join("/var/www", domain)
+
+	// Never overwrite an existing site; the delta sync is for that
+	if _, err := config.ReadSiteConfig(domain); err == nil {
+		return fmt.Errorf("site %s already exists on this server - use --final to sync changes", domain)
+	}
+	if utils.CheckDirExists(siteDir) {
+		entries, _ := os.ReadDir(siteDir)
+		if len(entries) > 0 {
+			return fmt.Errorf("site directory %s already exists and is not empty", siteDir)
+		}
+	}
+
+	utils.Section("Preparing Server")
+	if err := config.EnsureConfigDirs(); err != nil {
+		return err
+	}
+	if err := system.EnsureBasePackages(false); err != nil {
+		return err
+	}
+	if err := config.EnsureAdminUser(false); err != nil {
+		return err
+	}
+
+	workDir, err := os.MkdirTemp("/var/tmp", "svp-migrate-")
+	if err != nil {
+		return fmt.Errorf("failed to create work directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	utils.Section("Copying Files")
+	if err := src.syncFiles(siteDir, false); err != nil {
+		return err
+	}
+
+	dumpFile := ""
+	if src.DumpCmd != "" {
+		utils.Section("Copying Database")
+		dumpFile = filepath.Join(workDir, "database.sql.gz")
+		if err := src.dumpDatabase(dumpFile); err != nil {
+			return err
+		}
+	} else {
+		utils.Warn("No database credentials found on the source - provisioning an empty database")
+	}
+
+	// Provision PHP, database and nginx around the copied files
+	setupCfg := &types.Config{
+		Mode:          "setup",
+		CMS:           src.CMS,
+		PHPVersion:    src.PHPVersion,
+		PrimaryDomain: domain,
+		Webroot:       "/var/www",
+		DBEngine:      "mariadb",
+		DBImport:      dumpFile,
+		CreateSwap:    "auto",
+		UFWEnable:     true,
+		ReuseFiles:    true,
+	}
+	if src.CMS == "drupal" {
+		if rel, err := filepath.Rel(src.SiteDir, src.Webroot); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			setupCfg.Docroot = rel
+		}
+	}
+
+	if err := FullSetup(setupCfg); err != nil {
+		return err
+	}
+
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return err
+	}
+	clearSiteCache(site)
+
+	utils.Ok("Site %s migrated from %s", domain, src.Host)
+	fmt.Println()
+	fmt.Println("Cutover:")
+	fmt.Println("  1. Test the site here, e.g. with a hosts file entry")
+	fmt.Println("  2. Put the source site into maintenance mode")
+	fmt.Printf("  3. svp site migrate %s --from %s --final\n", domain, src.Host)
+	fmt.Println("  4. Point DNS at this server")
+	fmt.Printf("  5. svp update-ssl %s enable --le-email your@email.com\n", domain)
+	return nil
+}
+
+func finalMigrationSync(domain string, src *migrateSource) error {
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site %s is not configured here - run the migration without --final first", domain)
+	}
+	siteDir := siteDomainDir(site)
+	start := time.Now()
+
+	utils.Section("Syncing Changed Files")
+	if err := src.syncFiles(siteDir, true); err != nil {
+		return err
+	}
+	if site.SiteUser != "" {
+		err = system.SetSiteOwnership(siteDir, site.Webroot, site.SiteUser)
+	} else {
+		err = system.SetSharedOwnership(siteDir, config.GetAdminUser())
+	}
+	if err != nil {
+		return err
+	}
+
+	if src.DumpCmd != "" {
+		utils.Section("Syncing Database")
+		dbName, dbUser, dbPass, exists := database.ReadDatabaseCredentials(domain, config.SitesDir)
+		if !exists {
+			return fmt.Errorf("no local database credentials found for %s", domain)
+		}
+
+		workDir, err := os.MkdirTemp("/var/tmp", "svp-migrate-")
+		if err != nil {
+			return fmt.Errorf("failed to create work directory: %v", err)
+		}
+		defer os.RemoveAll(workDir)
+
+		// The local database is only replaced once the dump arrived completely
+		dumpFile := filepath.Join(workDir, "database.sql.gz")
+		if err := src.dumpDatabase(dumpFile); err != nil {
+			return err
+		}
+
+		// Recreating the database drops tables removed on the source
+		if err := database.RecreateDatabase(database.EngineMariaDB, database.Server{}, dbName, dbUser, dbPass); err != nil {
+			return err
+		}
+		if err := database.ImportDatabase(database.EngineMariaDB, database.Server{}, dumpFile, dbName, dbUser, dbPass); err != nil {
+			return err
+		}
+	}
+
+	clearSiteCache(site)
+
+	utils.Ok("Delta sync of %s finished in %s", domain, time.Since(start).Round(time.Second))
+	fmt.Println("Point DNS at this server to complete the cutover")
+	return nil
+}
+
+// inspect detects the site layout, PHP version and database of the source
+func (src *migrateSource) inspect(domain string) error {
+	out, err := src.runScript(fmt.Sprintf(inspectScript, domain, src.sudo()))
+	if err != nil {
+		return fmt.Errorf("failed to inspect source server: %v", err)
+	}
+	values := parseKeyValues(out)
+
+	if values["SVP_WEBROOT"] != "" {
+		utils.Verify("Source site is managed by svp")
+		src.SVP = true
+		src.Webroot = values["SVP_WEBROOT"]
+		src.CMS = values["SVP_CMS"]
+		src.PHPVersion = values["SVP_PHP_VERSION"]
+		src.SiteDir = siteDomainDir(&types.SiteConfig{Domain: domain, Webroot: src.Webroot})
+	} else {
+		src.Webroot = values["NGINX_ROOT"]
+		if src.Webroot == "" {
+			return fmt.Errorf("no nginx server block for %s found on the source", domain)
+		}
+		utils.Verify("Docroot from nginx: %s", src.Webroot)
+
+		probe, err := src.runScript(fmt.Sprintf(probeScript, utils.ShellQuote(src.Webroot), src.sudo()))
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s: %v", src.Webroot, err)
+		}
+		probeValues := parseKeyValues(probe)
+		src.CMS = probeValues["CMS"]
+		src.SiteDir = probeValues["PROJECT"]
+		if src.CMS == "" {
+			return fmt.Errorf("no Drupal or WordPress site found in %s", src.Webroot)
+		}
+		utils.Verify("Detected %s in %s", src.CMS, src.SiteDir)
+	}
+	if src.CMS == "" {
+		src.CMS = "drupal"
+	}
+	if src.SiteDir == "" || src.SiteDir == "/" {
+		return fmt.Errorf("refusing to migrate site directory %q", src.SiteDir)
+	}
+
+	// The FPM socket in the vhost beats the CLI version
+	if src.PHPVersion == "" {
+		src.PHPVersion = values["NGINX_PHP"]
+	}
+	if src.PHPVersion == "" {
+		src.PHPVersion = values["PHP_CLI"]
+	}
+	if src.PHPVersion == "" {
+		src.PHPVersion = "8.4"
+		utils.Warn("Could not detect the PHP version of the source - using %s", src.PHPVersion)
+	}
+
+	if values["DB_ENGINE"] == database.EnginePostgreSQL {
+		return fmt.Errorf("migrating PostgreSQL sites is not supported - use 'svp site export' and 'svp site import'")
+	}
+
+	// Dumps are streamed to stdout so nothing is written on the source
+	switch {
+	case values["DB_NAME"] != "":
+		utils.RegisterSecret(values["DB_PASS"])
+		// Sites on an external database server are dumped from it through the source
+		server := ""
+		if host := values["DB_HOST"]; host != "" && host != "localhost" {
+			server = fmt.Sprintf(" -h %s -P %s", utils.ShellQuote(host), utils.ShellQuote(values["DB_PORT"]))
+			if values["DB_TLS"] == "yes" {
+				server += " --ssl"
+			}
+		}
+		src.DumpCmd = fmt.Sprintf("MYSQL_PWD=%s mysqldump%s -u%s --single-transaction --quick --routines --triggers --no-tablespaces %s",
+			utils.ShellQuote(values["DB_PASS"]), server, utils.ShellQuote(values["DB_USER"]), utils.ShellQuote(values["DB_NAME"]))
+	case src.CMS == "wordpress":
+		src.DumpCmd = fmt.Sprintf("cd %s && %swp db export - --single-transaction --quick --allow-root", utils.ShellQuote(src.Webroot), src.sudo())
+	case src.CMS == "drupal":
+		src.DumpCmd = fmt.Sprintf("cd %s && if [ -x vendor/bin/drush ]; then %svendor/bin/drush sql:dump; else %sdrush sql:dump; fi",
+			utils.ShellQuote(src.SiteDir), src.sudo(), src.sudo())
+	}
+
+	return nil
+}
+
+// syncFiles copies the source site directory to siteDir. The delta sync
+// deletes files removed on the source but keeps the local credential files.
+func (src *migrateSource) syncFiles(siteDir string, delta bool) error {
+	if err := utils.EnsureDir(siteDir); err != nil {
+		return fmt.Errorf("failed to create %s: %v", siteDir, err)
+	}
+
+	args := []string{"-aHz", "--delete", "--no-owner", "--no-group", "--stats",
+		"-e", "ssh " + strings.Join(src.sshOptions(), " ")}
+	if src.Sudo {
+		args = append(args, "--rsync-path=sudo -n rsync")
+	}
+	if delta {
+		for _, name := range migrateLocalFiles {
+			args = append(args, "--exclude="+name)
+		}
+	}
+	args = append(args, fmt.Sprintf("%s:%s/", src.Host, src.SiteDir), siteDir+"/")
+
+	utils.Log("Syncing %s:%s to %s...", src.Host, src.SiteDir, siteDir)
+	out, err := utils.RunCommand("rsync", args...)
+	if err != nil {
+		return fmt.Errorf("failed to sync files (is rsync installed on the source?): %v", err)
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "Number of regular files transferred") || strings.HasPrefix(line, "Total transferred file size") {
+			utils.Log("%s", strings.TrimSpace(line))
+		}
+	}
+	utils.Ok("Files synced")
+	return nil
+}
+
+// dumpDatabase streams the source database over SSH into a compressed file
+func (src *migrateSource) dumpDatabase(outFile string) error {
+	utils.Log("Streaming database dump from %s...", src.Host)
+
+	// The dump command may hold the database password, so it is sent as a
+	// script on stdin rather than on the ssh command line
+	script, err := os.CreateTemp("", "svp-migrate-dump-")
+	if err != nil {
+		return fmt.Errorf("failed to create dump script: %v", err)
+	}
+	defer os.Remove(script.Name())
+	_, err = fmt.Fprintf(script, "set -o pipefail\n%s | gzip -c\n", src.DumpCmd)
+	script.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write dump script: %v", err)
+	}
+
+	sshArgs := append(src.sshOptions(), src.Host, utils.ShellQuote("bash -s"))
+	dumpCmd := fmt.Sprintf("set -o pipefail; ssh %s < %s > %s", strings.Join(sshArgs, " "), script.Name(), outFile)
+	if _, err := utils.RunShell(dumpCmd); err != nil {
+		return fmt.Errorf("failed to dump source database: %v", err)
+	}
+
+	_, _ = utils.RunCommand("chmod", "600", outFile)
+	utils.Ok("Database dump received")
+	return nil
+}
+
+// run executes a command on the source server
+func (src *migrateSource) run(command string) (string, error) {
+	args := append(src.sshOptions(), src.Host, command)
+	return utils.RunCommand("ssh", args...)
+}
+
+// runScript executes a bash script on the source server
+func (src *migrateSource) runScript(script string) (string, error) {
+	args := append(src.sshOptions(), src.Host, "bash -s")
+	return utils.RunCommandWithInput(script, "ssh", args...)
+}
+
+func (src *migrateSource) sshOptions() []string {
+	return []string{"-p", src.Port, "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=accept-new"}
+}
+
+func (src *migrateSource) sudo() string {
+	if src.Sudo {
+		return "sudo -n "
+	}
+	return ""
+}
+
+// clearSiteCache rebuilds the CMS caches of a site and empties its page
+// cache, which would keep serving pages of the old content
+func clearSiteCache(site *types.SiteConfig) {
+	if site.PageCache {
+		if removed, err := web.PurgePageCache(site, ""); err != nil {
+			utils.Warn("Failed to purge the page cache: %v", err)
+		} else {
+			utils.Ok("Page cache purged (%d entries)", removed)
+		}
+	}
+
+	switch site.CMS {
+	case "drupal":
+		drushCmd := fmt.Sprintf("drush-%s", site.Domain)
+		if utils.CommandExists(drushCmd) {
+			utils.Log("Clearing Drupal cache...")
+			if _, err := utils.RunCommand(drushCmd, "cr"); err != nil {
+				utils.Warn("Failed to clear cache: %v", err)
+				return
+			}
+			utils.Ok("Cache cleared")
+		}
+	case "wordpress":
+		utils.Log("Flushing WordPress cache...")
+		cmd := fmt.Sprintf("cd %s && sudo -u %s wp cache flush --quiet", utils.ShellQuote(site.Webroot), config.SiteRunUser(site))
+		if _, err := utils.RunShell(cmd); err != nil {
+			utils.Warn("Failed to flush cache: %v", err)
+			return
+		}
+		utils.Ok("Cache flushed")
+	}
+}
+
+// parseKeyValues parses KEY=value lines, stripping quotes around values
+func parseKeyValues(content string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found || key == "" {
+			continue
+		}
+		values[key] = strings.Trim(strings.TrimSpace(value), "'\"")
+	}
+	return values
+}
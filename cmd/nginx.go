@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"svp/pkg/config"
+	"svp/pkg/utils"
+	"svp/pkg/web"
+	"svp/types"
+)
+
+// snippetNameRegex matches the name of a snippet, the file name without .conf
+var snippetNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Nginx manages the custom nginx snippets of a site
+func Nginx(cfg *types.Config) error {
+	switch cfg.NginxAction {
+	case "edit":
+		return editSiteSnippet(cfg.PrimaryDomain, cfg.NginxSnippet, cfg.NginxHTTP)
+	default:
+		return fmt.Errorf("invalid action: %s (must be edit)", cfg.NginxAction)
+	}
+}
+
+// editSiteSnippet opens a snippet of a site in an editor and installs the
+// result if nginx accepts it. A rejected edit is kept next to the snippet
+// as NAME.conf.rejected and the previous version is restored.
+func editSiteSnippet(domain, name string, httpLevel bool) error {
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found: %s", domain)
+	}
+	name = strings.TrimSuffix(name, ".conf")
+	if !snippetNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid snippet name %q (letters, digits, _ and - only)", name)
+	}
+
+	level := "server"
+	if httpLevel {
+		level = "http"
+	}
+	utils.Section(fmt.Sprintf("Nginx Snippet %s (%s level)", name, level))
+
+	// Vhosts generated before the snippet directories existed do not
+	// include them yet
+	regenerated := false
+	if !web.VhostHasSiteIncludes(domain) {
+		utils.Log("Adding the snippet includes to the vhost of %s", domain)
+		if err := web.CreateNginxVhost(site); err != nil {
+			return err
+		}
+		regenerated = true
+	} else if err := web.EnsureSiteIncludeDirs(domain); err != nil {
+		return err
+	}
+
+	// A rejected edit must be the edit's fault
+	if err := web.TestNginxConfig(); err != nil {
+		return fmt.Errorf("%v - fix the nginx configuration before editing snippets", err)
+	}
+
+	snippetPath := filepath.Join(web.SiteIncludeDir(domain, level), name+".conf")
+	original, err := os.ReadFile(snippetPath)
+	existed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %v", snippetPath, err)
+	}
+	if !existed {
+		original = []byte(snippetTemplate(domain, level))
+	}
+
+	edited, err := editInTerminal(original)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, original) {
+		utils.Verify("No changes to %s", snippetPath)
+		if regenerated {
+			return web.ReloadNginx()
+		}
+		return nil
+	}
+
+	// An emptied snippet is removed
+	if len(bytes.TrimSpace(edited)) == 0 {
+		err = os.Remove(snippetPath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		err = utils.WriteFileAtomic(snippetPath, edited, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", snippetPath, err)
+	}
+
+	if testErr := web.TestNginxConfig(); testErr != nil {
+		utils.Err("%v", testErr)
+		if existed {
+			err = utils.WriteFileAtomic(snippetPath, original, 0644)
+		} else {
+			err = os.Remove(snippetPath)
+		}
+		if err != nil {
+			return fmt.Errorf("nginx rejected the edit and %s could not be restored: %v", snippetPath, err)
+		}
+		rejectedPath := snippetPath + ".rejected"
+		if err := os.WriteFile(rejectedPath, edited, 0644); err != nil {
+			utils.Warn("Failed to keep the rejected edit: %v", err)
+		} else {
+			utils.Log("Your edit is in %s", rejectedPath)
+		}
+		return fmt.Errorf("nginx rejected the edit - %s was rolled back", snippetPath)
+	}
+	_ = os.Remove(snippetPath + ".rejected")
+
+	if err := web.ReloadNginx(); err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(edited)) == 0 {
+		utils.Ok("Removed %s", snippetPath)
+	} else {
+		utils.Ok("Saved %s", snippetPath)
+	}
+	return nil
+}
+
+// snippetTemplate returns the content of a new snippet
+func snippetTemplate(domain, level string) string {
+	if level == "http" {
+		return fmt.Sprintf(`# Custom http level directives for %s, e.g. maps and upstreams.
+# Names must not clash with other sites: prefix them with the site.
+#
+# map $request_uri $example_redirect {
+#     /old-page /new-page;
+# }
+`, domain)
+	}
+	return fmt.Sprintf(`# Custom directives for %s, included in each of its server blocks.
+# Do not define "location /", which the generated vhost already has.
+#
+# location = /old-page {
+#     return 301 /new-page;
+# }
+# add_header X-Robots-Tag "noindex" always;
+`, domain)
+}
+
+// editInTerminal opens content in the user's editor ($VISUAL, $EDITOR or
+// nano) and returns the saved result
+func editInTerminal(content []byte) ([]byte, error) {
+	tmp, err := os.CreateTemp("", "svp-nginx-*.conf")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to write temporary file: %v", err)
+	}
+	tmp.Close()
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "nano"
+	}
+	// The editor may come with arguments, e.g. "code --wait"
+	args := append(strings.Fields(editor), tmp.Name())
+	if err := utils.RunInteractive(args[0], args[1:]...); err != nil {
+		return nil, fmt.Errorf("editor %s failed: %v", args[0], err)
+	}
+
+	edited, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the edited file: %v", err)
+	}
+	return edited, nil
+}
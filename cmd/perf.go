@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"svp/pkg/config"
+	"svp/pkg/database"
+	"svp/pkg/utils"
+	"svp/pkg/web"
+	"svp/types"
+	"time"
+)
+
+// perfReport is the output of 'svp perf'. A section that could not be read
+// has an error instead of entries.
+type perfReport struct {
+	Domain string    `json:"domain"`
+	Since  time.Time `json:"since"`
+
+	Database         string               `json:"database,omitempty"`
+	SlowQueries      []database.SlowQuery `json:"slow_queries"`
+	SlowQueriesError string               `json:"slow_queries_error,omitempty"`
+
+	PHPSlowlog      string          `json:"php_slowlog"`
+	SlowTraces      []web.SlowTrace `json:"slow_traces"`
+	SlowTracesError string          `json:"slow_traces_error,omitempty"`
+}
+
+// maxTraceFrames is how much of a stack trace the text report shows
+const maxTraceFrames = 8
+
+// Perf summarizes the slow queries and slow PHP requests of a site
+func Perf(cfg *types.Config) error {
+	domain := cfg.PrimaryDomain
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found: %s", domain)
+	}
+	window, err := parseWindow(cfg.PerfSince)
+	if err != nil {
+		return err
+	}
+
+	report := perfReport{Domain: domain, Since: time.Now().Add(-window).Truncate(time.Second)}
+
+	dbName, dbUser, _, exists := database.ReadDatabaseCredentials(domain, config.SitesDir)
+	dbServer := database.ReadDatabaseServer(domain, config.SitesDir)
+	switch {
+	case !exists:
+		report.SlowQueriesError = "the site has no database"
+	case database.ReadDatabaseEngine(domain, config.SitesDir) != database.EngineMariaDB:
+		report.SlowQueriesError = "the slow query log is only read for MariaDB"
+	case dbServer.IsRemote():
+		report.SlowQueriesError = fmt.Sprintf("the slow query log is on the external server %s", dbServer)
+	default:
+		report.Database = dbName
+		report.SlowQueries, err = database.SlowQueries(dbName, dbUser, report.Since)
+		if err != nil {
+			report.SlowQueriesError = fmt.Sprintf("%v - run 'svp db tune' to enable the slow query log", err)
+		}
+	}
+
+	report.PHPSlowlog = web.PHPSlowLogFile(site.PHPVersion, domain)
+	report.SlowTraces, err = web.SlowTraces(site.PHPVersion, domain, report.Since)
+	if err != nil {
+		report.SlowTracesError = fmt.Sprintf("%v - run 'svp php-update %s --php-version %s' to enable the slowlog of the pool", err, domain, site.PHPVersion)
+	}
+
+	if cfg.PerfLimit > 0 {
+		if len(report.SlowQueries) > cfg.PerfLimit {
+			report.SlowQueries = report.SlowQueries[:cfg.PerfLimit]
+		}
+		if len(report.SlowTraces) > cfg.PerfLimit {
+			report.SlowTraces = report.SlowTraces[:cfg.PerfLimit]
+		}
+	}
+
+	if cfg.PerfJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	printPerfReport(&report)
+	return nil
+}
+
+// printPerfReport prints the text form of a report
+func printPerfReport(report *perfReport) {
+	fmt.Printf("Performance of %s since %s\n", report.Domain, report.Since.Format("2006-01-02 15:04"))
+
+	utils.Section("Slow Queries")
+	switch {
+	case report.SlowQueriesError != "":
+		utils.Skip("%s", report.SlowQueriesError)
+	case len(report.SlowQueries) == 0:
+		utils.Ok("No slow queries in %s", report.Database)
+	default:
+		fmt.Printf("%-6s %-9s %-8s %-14s %s\n", "COUNT", "TOTAL", "MAX", "ROWS EXAMINED", "QUERY")
+		for _, q := range report.SlowQueries {
+			fmt.Printf("%-6d %-9s %-8s %-14d %s\n", q.Count,
+				fmt.Sprintf("%.1fs", q.TotalSeconds), fmt.Sprintf("%.1fs", q.MaxSeconds),
+				q.RowsExamined, shorten(q.Fingerprint, 100))
+		}
+	}
+
+	utils.Section("Slow PHP Requests")
+	switch {
+	case report.SlowTracesError != "":
+		utils.Skip("%s", report.SlowTracesError)
+	case len(report.SlowTraces) == 0:
+		utils.Ok("No PHP requests slower than %s", web.PHPSlowlogTimeout)
+	default:
+		fmt.Printf("Requests slower than %s, most frequent first:\n", web.PHPSlowlogTimeout)
+		for _, trace := range report.SlowTraces {
+			fmt.Printf("\n%dx %s (last %s)\n", trace.Count, trace.Script, trace.LastSeen.Format("2006-01-02 15:04"))
+			for i, frame := range trace.Frames {
+				if i == maxTraceFrames {
+					fmt.Printf("    ... %d more\n", len(trace.Frames)-maxTraceFrames)
+					break
+				}
+				fmt.Printf("    %s\n", frame)
+			}
+		}
+	}
+}
+
+// parseWindow parses a time window such as 30m, 24h or 7d
+func parseWindow(s string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(s, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid time window %q (use e.g. 30m, 24h or 7d)", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	window, err := time.ParseDuration(s)
+	if err != nil || window <= 0 {
+		return 0, fmt.Errorf("invalid time window %q (use e.g. 30m, 24h or 7d)", s)
+	}
+	return window, nil
+}
+
+// shorten cuts a string to n characters for a table column
+func shorten(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
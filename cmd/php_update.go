@@ -3,8 +3,9 @@ package cmd
 import (
 	"fmt"
 	"strings"
+	"svp/pkg/cache"
 	"svp/pkg/config"
-	"svp/pkg/ssl"
+	"svp/pkg/database"
 	"svp/pkg/system"
 	"svp/pkg/utils"
 	"svp/pkg/web"
@@ -60,12 +61,32 @@ func PHPUpdate(cfg *types.Config) error {
 		return nil
 	}
 
+	if !cfg.NoSnapshot {
+		if err := takeSnapshot(domain, siteDomainDir(siteConfig), "php-update", false); err != nil {
+			return err
+		}
+	}
+
 	// Install new PHP version if not already installed
 	utils.Section(fmt.Sprintf("Installing PHP %s", newPHPVersion))
 	if err := web.InstallPHP(newPHPVersion, false); err != nil {
 		return fmt.Errorf("failed to install PHP %s: %v", newPHPVersion, err)
 	}
 
+	// PostgreSQL sites need the pgsql extension of the new version
+	if database.ReadDatabaseEngine(domain, config.SitesDir) == database.EnginePostgreSQL {
+		if err := system.EnsurePackage(fmt.Sprintf("php%s-pgsql", newPHPVersion)); err != nil {
+			return err
+		}
+	}
+
+	// Sites with a Redis cache need the redis extension of the new version
+	if _, ok := cache.ReadSiteCache(domain); ok {
+		if err := system.EnsurePackage(fmt.Sprintf("php%s-redis", newPHPVersion)); err != nil {
+			return err
+		}
+	}
+
 	// Harden PHP configuration
 	if err := web.HardenPHPIni(newPHPVersion, false); err != nil {
 		utils.Warn("Failed to harden PHP configuration: %v", err)
@@ -73,7 +94,7 @@ func PHPUpdate(cfg *types.Config) error {
 
 	// Create new PHP-FPM pool for this domain with new version
 	utils.Section("Creating PHP-FPM Pool")
-	if err := web.CreatePHPPool(domain, newPHPVersion, siteConfig.Webroot); err != nil {
+	if err := web.CreatePHPPool(domain, newPHPVersion, siteConfig.Webroot, siteConfig.SiteUser); err != nil {
 		return fmt.Errorf("failed to create PHP-FPM pool: %v", err)
 	}
 
@@ -100,17 +121,12 @@ func PHPUpdate(cfg *types.Config) error {
 	}
 
 	// Update Nginx vhost to use new PHP version
-	if err := web.CreateNginxVhost(domain, siteConfig.Webroot, newPHPVersion); err != nil {
+	vhostSite := *siteConfig
+	vhostSite.PHPVersion = newPHPVersion
+	if err := web.CreateNginxVhost(&vhostSite); err != nil {
 		return fmt.Errorf("failed to update Nginx vhost: %v", err)
 	}
 
-	// Reconfigure SSL if certificate exists (vhost recreation removes SSL config)
-	utils.Section("Restoring SSL Configuration")
-	if err := ssl.ReconfigureSSL(domain); err != nil {
-		utils.Warn("Failed to reconfigure SSL: %v", err)
-		utils.Warn("You may need to run manually: certbot install --nginx -d %s --cert-name %s --redirect", domain, domain)
-	}
-
 	// Update site configuration
 	utils.Section("Updating Site Configuration")
 	if err := config.WriteSiteConfig(domain, newPHPVersion, siteConfig.Webroot); err != nil {
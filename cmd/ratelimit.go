@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"svp/pkg/config"
+	"svp/pkg/utils"
+	"svp/pkg/web"
+	"svp/types"
+	"time"
+)
+
+// RateLimit handles the rate limits of a site: set, disable, check
+func RateLimit(cfg *types.Config) error {
+	domain := cfg.PrimaryDomain
+	utils.Section(fmt.Sprintf("Rate Limits for %s", domain))
+
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found: %s", domain)
+	}
+
+	switch cfg.RateLimitAction {
+	case "set":
+		return setRateLimits(site, cfg)
+	case "disable":
+		return disableRateLimits(site)
+	case "check":
+		return checkRateLimits(site, cfg.RateLimitSince)
+	default:
+		return fmt.Errorf("invalid action: %s (must be set, disable, or check)", cfg.RateLimitAction)
+	}
+}
+
+// setRateLimits applies the given limits and lists on top of the site's
+// current ones and regenerates its vhost. A vhost nginx rejects is rolled
+// back.
+func setRateLimits(site *types.SiteConfig, cfg *types.Config) error {
+	previous := *site
+
+	if cfg.RateLimitRate != "" {
+		if err := web.ValidateRate(cfg.RateLimitRate); err != nil {
+			return err
+		}
+		site.RateLimitRate = cfg.RateLimitRate
+	}
+	if cfg.RateLimitLoginRate != "" {
+		if err := web.ValidateRate(cfg.RateLimitLoginRate); err != nil {
+			return err
+		}
+		site.RateLimitLoginRate = cfg.RateLimitLoginRate
+	}
+	if cfg.RateLimitConnections < 0 {
+		return fmt.Errorf("invalid connection limit: %d", cfg.RateLimitConnections)
+	}
+	if cfg.RateLimitConnections > 0 {
+		site.RateLimitConnections = cfg.RateLimitConnections
+	}
+	if cfg.RateLimitPaths != "" {
+		paths, err := rateLimitList(cfg.RateLimitPaths, web.ValidateLimitPath)
+		if err != nil {
+			return err
+		}
+		site.RateLimitPaths = paths
+	}
+	if cfg.RateLimitAgents != "" {
+		agents, err := rateLimitList(cfg.RateLimitAgents, web.ValidateUserAgent)
+		if err != nil {
+			return err
+		}
+		site.BlockedAgents = agents
+	}
+
+	// The login paths limited by default depend on the CMS
+	if site.CMS == "" {
+		site.CMS = detectSiteCMS(site)
+	}
+	site.RateLimit = true
+
+	if err := writeSiteVhost(site); err != nil {
+		if rollbackErr := writeSiteVhost(&previous); rollbackErr != nil {
+			utils.Warn("Failed to restore the vhost of %s: %v", site.Domain, rollbackErr)
+		}
+		return err
+	}
+	utils.Ok("Rate limits applied to %s", site.Domain)
+	printRateLimits(site)
+	return nil
+}
+
+// rateLimitList splits a comma-separated list given to set, checking each
+// entry. "none" is the empty list.
+func rateLimitList(value string, validate func(string) error) ([]string, error) {
+	if value == "none" {
+		return nil, nil
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if err := validate(item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// disableRateLimits removes the rate limits from a site's vhost. The
+// site's own limits and lists are kept for a later set.
+func disableRateLimits(site *types.SiteConfig) error {
+	if !site.RateLimit {
+		utils.Verify("Rate limits not enabled for %s", site.Domain)
+		return nil
+	}
+	site.RateLimit = false
+	if err := writeSiteVhost(site); err != nil {
+		return err
+	}
+	utils.Ok("Rate limits removed from %s", site.Domain)
+	return nil
+}
+
+// checkRateLimits prints a site's rate limits and the requests they
+// rejected within a time window
+func checkRateLimits(site *types.SiteConfig, since string) error {
+	if !site.RateLimit {
+		utils.Log("Rate limits not enabled for %s", site.Domain)
+		fmt.Printf("\nTo enable: svp ratelimit %s set\n", site.Domain)
+		return nil
+	}
+	if !web.VhostHasRateLimits(site.Domain) {
+		utils.Warn("Rate limits enabled but missing from the vhost - run 'svp ratelimit %s set' to regenerate it", site.Domain)
+	}
+	printRateLimits(site)
+
+	window, err := parseWindow(since)
+	if err != nil {
+		return err
+	}
+	start := time.Now().Add(-window).Truncate(time.Second)
+	rejections, err := web.ReadRateLimitRejections(site.Domain, start)
+	if err != nil {
+		return err
+	}
+
+	utils.Section(fmt.Sprintf("Rejected Since %s", start.Format("2006-01-02 15:04")))
+	if len(rejections.Limits) == 0 {
+		utils.Ok("No requests rejected")
+		return nil
+	}
+	for _, limit := range []string{"requests", "login", "connections"} {
+		if n := rejections.Limits[limit]; n > 0 {
+			fmt.Printf("%-12s %d\n", limit, n)
+		}
+	}
+	fmt.Println()
+	fmt.Printf("%-8s %s\n", "COUNT", "CLIENT")
+	for _, client := range rejections.TopClients {
+		fmt.Printf("%-8d %s\n", client.Count, client.IP)
+	}
+	return nil
+}
+
+// printRateLimits prints the effective limits of a site
+func printRateLimits(site *types.SiteConfig) {
+	limits := web.SiteRateLimits(site)
+	fmt.Println()
+	fmt.Printf("Requests per IP:    %s\n", limits.Rate)
+	fmt.Printf("Connections per IP: %d\n", limits.Connections)
+	fmt.Printf("Login paths:        %s per IP\n", limits.LoginRate)
+	for _, path := range limits.Paths {
+		fmt.Printf("  %s\n", path)
+	}
+	if len(limits.BlockedAgents) > 0 {
+		fmt.Println("Blocked user agents:")
+		for _, agent := range limits.BlockedAgents {
+			fmt.Printf("  %s\n", agent)
+		}
+	}
+}
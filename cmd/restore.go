@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"svp/pkg/backup"
+	"svp/pkg/cms"
+	"svp/pkg/config"
+	"svp/pkg/database"
+	"svp/pkg/system"
+	"svp/pkg/utils"
+	"svp/types"
+)
+
+// Restore replaces the database and uploads of a site with a backup set,
+// optionally into another configured site
+func Restore(cfg *types.Config) error {
+	fmt.Println()
+	fmt.Println("==========================================================")
+	fmt.Println("  Site Restore")
+	fmt.Println("==========================================================")
+	fmt.Println()
+
+	if cfg.RestoreDBOnly && cfg.RestoreFilesOnly {
+		return fmt.Errorf("use either --db-only or --files-only, not both")
+	}
+
+	setDir, manifest, err := backup.FindSet(cfg.PrimaryDomain, cfg.RestoreFrom)
+	if err != nil {
+		return err
+	}
+
+	domain := cfg.PrimaryDomain
+	if cfg.RestoreTo != "" {
+		domain = cfg.RestoreTo
+	}
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found: %s - provision it first with 'svp setup %s --cms %s --php-version %s'",
+			domain, domain, manifest.CMS, manifest.PHPVersion)
+	}
+	siteCMS := detectSiteCMS(site)
+	if manifest.CMS != "" && siteCMS != "" && manifest.CMS != siteCMS {
+		return fmt.Errorf("backup set is a %s site but %s runs %s", manifest.CMS, domain, siteCMS)
+	}
+
+	if manifest.Encrypted && cfg.IdentityFile == "" {
+		return fmt.Errorf("backup set is encrypted - pass the private key with --identity FILE")
+	}
+
+	restoreDB := !cfg.RestoreFilesOnly && manifest.HasFile(backup.DatabaseFile)
+	if engine := database.ReadDatabaseEngine(domain, config.SitesDir); restoreDB && manifest.Engine() != engine {
+		return fmt.Errorf("backup set holds a %s dump but %s uses %s", manifest.Engine(), domain, engine)
+	}
+	restoreFiles := !cfg.RestoreDBOnly && manifest.HasFile(backup.UploadsFile)
+	if !restoreDB && !restoreFiles {
+		utils.Skip("Nothing to restore: the backup set has no matching database dump or uploads")
+		return nil
+	}
+
+	fmt.Printf("Backup set: %s (%s, created %s on %s)\n", filepath.Base(setDir), manifest.Domain, manifest.Created, manifest.Host)
+	fmt.Printf("Restore to: %s\n", domain)
+	if restoreDB {
+		fmt.Println("  • Database: dropped, recreated and imported from the dump")
+		if !cfg.NoSnapshot {
+			fmt.Println("    (the current database is saved in a safety snapshot first)")
+		}
+	}
+	if restoreFiles {
+		fmt.Printf("  • Uploads: %s replaced\n", strings.Join(manifest.Uploads, ", "))
+	}
+	fmt.Println()
+	if !cfg.AssumeYes {
+		fmt.Print("Continue? [y/N]: ")
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			utils.Skip("Restore cancelled")
+			return nil
+		}
+	}
+
+	utils.Section("Verifying Backup Set")
+	if err := backup.VerifyChecksums(setDir, manifest); err != nil {
+		return err
+	}
+	utils.Ok("Checksums match the manifest (%d files)", len(manifest.Files))
+
+	// Decrypt every archive before changing anything, so a wrong key or
+	// a damaged archive aborts the restore
+	dataDir := setDir
+	if manifest.Encrypted {
+		if err := system.EnsurePackage("age"); err != nil {
+			return err
+		}
+		dataDir, err = os.MkdirTemp(backup.Root, ".restore-")
+		if err != nil {
+			return fmt.Errorf("failed to create decryption directory: %v", err)
+		}
+		defer os.RemoveAll(dataDir)
+
+		if err := backup.DecryptSet(setDir, manifest, cfg.IdentityFile, dataDir); err != nil {
+			return err
+		}
+		utils.Ok("All archives decrypted")
+	}
+
+	// The database is dropped before the import, so keep the current one
+	if restoreDB && !cfg.NoSnapshot {
+		if err := takeSnapshot(domain, siteDomainDir(site), "restore", false); err != nil {
+			return err
+		}
+	}
+
+	if restoreDB {
+		if err := restoreDatabase(site, siteCMS, filepath.Join(dataDir, backup.DatabaseFile)); err != nil {
+			return err
+		}
+		if manifest.Domain != domain {
+			updateImportedDomain(site, manifest.Domain)
+		}
+	}
+
+	if restoreFiles {
+		if err := restoreUploads(site, filepath.Join(dataDir, backup.UploadsFile), manifest.Uploads); err != nil {
+			return err
+		}
+	}
+
+	utils.Section("Finishing Restore")
+	clearSiteCache(site)
+	if err := probeSite(site); err != nil {
+		return err
+	}
+
+	utils.Ok("Restored %s from %s", domain, filepath.Base(setDir))
+	return nil
+}
+
+// restoreDatabase recreates a site's database, points the CMS settings at
+// the new credentials and imports a dump
+func restoreDatabase(site *types.SiteConfig, siteCMS, dumpFile string) error {
+	utils.Section("Restoring Database")
+
+	// DropDatabase removes the credentials file the server is read from
+	engine := database.ReadDatabaseEngine(site.Domain, config.SitesDir)
+	dbServer := database.ReadDatabaseServer(site.Domain, config.SitesDir)
+	if err := database.DropDatabase(site.Domain, config.SitesDir); err != nil {
+		return err
+	}
+	dbName, dbUser, dbPass, err := database.CreateDatabase(site.Domain, config.SitesDir, engine, dbServer)
+	if err != nil {
+		return err
+	}
+
+	// CreateDatabase generates a new password
+	switch siteCMS {
+	case "drupal":
+		err = cms.UpdateDrupalDatabaseCredentials(site.Webroot, dbName, dbUser, dbPass)
+	case "wordpress":
+		err = cms.UpdateWordPressDatabaseCredentials(site.Webroot, dbName, dbUser, dbPass, dbServer)
+	default:
+		utils.Warn("Unknown CMS - update the database password in the site settings from %s/%s.db.txt", config.SitesDir, site.Domain)
+	}
+	if err != nil {
+		return err
+	}
+
+	return database.ImportDatabase(engine, dbServer, dumpFile, dbName, dbUser, dbPass)
+}
+
+// restoreUploads replaces a site's upload directories with the ones in an
+// uploads archive. The archive is unpacked next to them first, so a failed
+// extraction leaves the live directories untouched.
+func restoreUploads(site *types.SiteConfig, archive string, uploads []string) error {
+	utils.Section("Restoring Uploads")
+
+	siteDir := siteDomainDir(site)
+	staging, err := os.MkdirTemp(siteDir, ".svp-restore-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(staging)
+
+	utils.Log("Extracting %s...", filepath.Base(archive))
+	if _, err := utils.RunCommand("tar", "--zstd", "-xf", archive, "-C", staging, "--no-same-owner"); err != nil {
+		return fmt.Errorf("failed to extract uploads: %v", err)
+	}
+
+	for _, rel := range uploads {
+		src := filepath.Join(staging, rel)
+		dest := filepath.Join(siteDir, rel)
+		if !utils.CheckDirExists(src) {
+			utils.Warn("%s is missing from the archive", rel)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %v", filepath.Dir(dest), err)
+		}
+		old := filepath.Join(staging, ".old")
+		if utils.CheckDirExists(dest) {
+			if err := os.Rename(dest, old); err != nil {
+				return fmt.Errorf("failed to move %s aside: %v", dest, err)
+			}
+		}
+		if err := os.Rename(src, dest); err != nil {
+			_ = os.Rename(old, dest)
+			return fmt.Errorf("failed to restore %s: %v", rel, err)
+		}
+		_ = os.RemoveAll(old)
+
+		if site.SiteUser != "" {
+			err = system.SetSiteOwnership(dest, site.Webroot, site.SiteUser)
+		} else {
+			err = system.SetSharedOwnership(dest, config.GetAdminUser())
+		}
+		if err != nil {
+			return err
+		}
+		utils.Ok("Restored %s", rel)
+	}
+	return nil
+}
+
+// probeSite requests the site's home page through the local nginx and fails
+// on server errors
+func probeSite(site *types.SiteConfig) error {
+	utils.Log("Probing %s...", site.Domain)
+
+	scheme, port := "http", "80"
+	if site.SSLEnabled {
+		scheme, port = "https", "443"
+	}
+	// -k: this checks the application, not the certificate
+	curlCmd := fmt.Sprintf("curl -sk -o /dev/null -w '%%{http_code}' -m 15 --resolve %s:%s:127.0.0.1 %s://%s/",
+		site.Domain, port, scheme, site.Domain)
+	httpCode, err := utils.RunShell(curlCmd)
+	httpCode = strings.TrimSpace(httpCode)
+	if err != nil || httpCode == "" || httpCode == "000" {
+		return fmt.Errorf("health check failed: %s did not respond", site.Domain)
+	}
+
+	switch httpCode[0] {
+	case '2':
+		utils.Ok("Site responds (HTTP %s)", httpCode)
+	case '5':
+		fmt.Println()
+		fmt.Println("Troubleshooting steps:")
+		fmt.Printf("  1. Check PHP-FPM logs: tail -f /var/log/php%s-fpm-%s-error.log\n", site.PHPVersion, site.Domain)
+		fmt.Printf("  2. Check Nginx logs: tail -f /var/log/nginx/%s-error.log\n", site.Domain)
+		return fmt.Errorf("health check failed: %s returned HTTP %s", site.Domain, httpCode)
+	default:
+		// Redirects and auth prompts (basic auth) still prove PHP and nginx work
+		utils.Verify("Site responds (HTTP %s)", httpCode)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"svp/pkg/cache"
 	"svp/pkg/cms"
 	"svp/pkg/config"
 	"svp/pkg/database"
@@ -33,6 +34,7 @@ func FullSetup(cfg *types.Config) error {
 		ConfigImported  bool
 		InstallFailed   bool
 		SettingsSVPAdded bool
+		CachesEnabled   []string
 	}
 	var setupResults []DomainSetupResult
 
@@ -68,11 +70,29 @@ func FullSetup(cfg *types.Config) error {
 		return err
 	}
 
-	// Install database
+	// Install database, unless the sites use an external server
 	utils.Section("Database")
-	if err := database.InstallMariaDB(cfg.DBEngine, cfg.VerifyOnly); err != nil {
+	dbServer, err := setupDatabaseServer(cfg)
+	if err != nil {
 		return err
 	}
+	if dbServer.IsRemote() {
+		utils.Ok("Using the external database server %s (grants for %s)", dbServer, dbServer.GrantHost)
+	} else if err := database.InstallEngine(cfg.DBEngine, cfg.VerifyOnly); err != nil {
+		return err
+	}
+	if cfg.DBEngine == database.EngineMariaDB && !dbServer.IsRemote() {
+		sites := tuningSiteCount(append([]string{cfg.PrimaryDomain}, strings.Split(cfg.ExtraDomains, ",")...)...)
+		if err := database.TuneMariaDBIfMissing(config.ReadTuningProfile(), sites, cfg.VerifyOnly); err != nil {
+			return err
+		}
+	}
+	if cfg.DBEngine == database.EnginePostgreSQL && !cfg.VerifyOnly {
+		if err := system.EnsurePackage(fmt.Sprintf("php%s-pgsql", cfg.PHPVersion)); err != nil {
+			return err
+		}
+		_ = system.RestartService(fmt.Sprintf("php%s-fpm", cfg.PHPVersion))
+	}
 
 	// Install Composer
 	utils.Section("Composer")
@@ -150,16 +170,30 @@ func FullSetup(cfg *types.Config) error {
 	settingsSVPByDomain := make(map[string]bool)
 
 	for _, domain := range domains {
+		// The installers may delete the site directory and drop or empty
+		// the database of an existing site. The site directory is large
+		// and usually in git, so it is only archived on request.
+		if !cfg.NoSnapshot {
+			siteDir := filepath.Join(cfg.Webroot, domain)
+			withFiles := cfg.SnapshotFiles && !cfg.ReuseFiles
+			if err := takeSnapshot(domain, siteDir, "setup", withFiles); err != nil {
+				return err
+			}
+			if !withFiles && !cfg.ReuseFiles && !dirEmpty(siteDir) {
+				utils.Log("The snapshot leaves out %s - pass --snapshot-files to include it", siteDir)
+			}
+		}
+
 		if cfg.CMS == "drupal" {
 			settingsSVPAdded, err := cms.InstallDrupal(domain, cfg.Webroot, cfg.GitRepo, cfg.GitBranch,
-				cfg.DrupalRoot, cfg.Docroot, config.SitesDir, dbImportPath, cfg.KeepExistingDB)
+				cfg.DrupalRoot, cfg.Docroot, config.SitesDir, cfg.DBEngine, dbServer, dbImportPath, cfg.KeepExistingDB, cfg.ReuseFiles)
 			if err != nil {
 				return fmt.Errorf("failed to install Drupal for %s: %v", domain, err)
 			}
 			// Store whether settings.svp.php was added for this domain
 			settingsSVPByDomain[domain] = settingsSVPAdded
 		} else if cfg.CMS == "wordpress" {
-			err := cms.InstallWordPress(domain, cfg.Webroot, cfg.GitRepo, cfg.GitBranch, config.SitesDir)
+			err := cms.InstallWordPress(domain, cfg.Webroot, cfg.GitRepo, cfg.GitBranch, config.SitesDir, dbServer, dbImportPath, cfg.ReuseFiles)
 			if err != nil {
 				return fmt.Errorf("failed to install WordPress for %s: %v", domain, err)
 			}
@@ -268,18 +302,46 @@ func FullSetup(cfg *types.Config) error {
 
 		utils.Log("Configuring site: %s", domain)
 
-		// Write site config
-		if err := config.WriteSiteConfig(domain, cfg.PHPVersion, siteWebroot); err != nil {
+		// Write site config (keeps aliases and other settings on reprovisioning)
+		site, err := config.ReadSiteConfig(domain)
+		if err != nil {
+			site = &types.SiteConfig{Domain: domain}
+		}
+		site.PHPVersion = cfg.PHPVersion
+		site.Webroot = siteWebroot
+		site.CMS = cfg.CMS
+		// Once isolated, a site keeps its own user on reprovisioning
+		if cfg.IsolateSites && site.SiteUser == "" {
+			site.SiteUser = system.SiteUsername(domain)
+		}
+		if site.SiteUser != "" {
+			if err := system.EnsureSiteUser(site.SiteUser, domainDir); err != nil {
+				return err
+			}
+		}
+		if cfg.CanonicalPolicy != "" && domain == cfg.PrimaryDomain {
+			if err := config.ApplyCanonicalPolicy(site, cfg.CanonicalPolicy); err != nil {
+				return err
+			}
+		}
+		if err := config.SaveSiteConfig(site); err != nil {
 			return err
 		}
 
+		// Reapply trusted hosts for aliases added with 'svp domain add'
+		if cfg.CMS == "drupal" && len(site.Aliases) > 0 {
+			if err := cms.UpdateDrupalTrustedHosts(siteWebroot, site.Hostnames()); err != nil {
+				utils.Warn("Failed to update trusted hosts for aliases: %v", err)
+			}
+		}
+
 		// Create PHP-FPM pool
-		if err := web.CreatePHPPool(domain, cfg.PHPVersion, siteWebroot); err != nil {
+		if err := web.CreatePHPPool(domain, cfg.PHPVersion, siteWebroot, site.SiteUser); err != nil {
 			return err
 		}
 
 		// Create Nginx vhost
-		if err := web.CreateNginxVhost(domain, siteWebroot, cfg.PHPVersion); err != nil {
+		if err := web.CreateNginxVhost(site); err != nil {
 			return err
 		}
 
@@ -320,7 +382,7 @@ func FullSetup(cfg *types.Config) error {
 				}
 			}
 			
-			if err := cms.CreateDrushAlias(domain, drushDir, adminUser); err != nil {
+			if err := cms.CreateDrushAlias(domain, drushDir, adminUser, site.SiteUser); err != nil {
 				utils.Warn("Failed to create Drush alias: %v", err)
 			}
 			
@@ -344,6 +406,13 @@ func FullSetup(cfg *types.Config) error {
 			}
 		}
 
+		// Hand the files to the site user once installation is done
+		if site.SiteUser != "" {
+			if err := system.SetSiteOwnership(domainDir, site.Webroot, site.SiteUser); err != nil {
+				utils.Warn("Failed to set site ownership: %v", err)
+			}
+		}
+
 		// Save result for this domain
 		setupResults = append(setupResults, result)
 	}
@@ -479,76 +548,44 @@ func FullSetup(cfg *types.Config) error {
 		// Obtain/reconfigure certificates for all domains
 		for i, domain := range domains {
 			domainDir := filepath.Join(cfg.Webroot, domain)
-			
-			// Determine webroot for this domain (same logic as earlier)
-			siteWebroot := domainDir
-			if cfg.CMS == "drupal" {
-				if cfg.DrupalRoot != "" {
-					siteWebroot = filepath.Join(siteWebroot, cfg.DrupalRoot)
-				} else {
-					for _, subdir := range []string{"drupal/web", "app/web", "backend/web", "web"} {
-						potentialPath := filepath.Join(domainDir, subdir)
-						if utils.CheckFileExists(filepath.Join(potentialPath, "index.php")) {
-							siteWebroot = potentialPath
-							break
-						}
-					}
-				}
-				if cfg.Docroot != "" {
-					siteWebroot = filepath.Join(domainDir, cfg.Docroot)
-				}
+
+			site, err := config.ReadSiteConfig(domain)
+			if err != nil {
+				utils.Warn("Failed to read site config for %s: %v", domain, err)
+				continue
 			}
-			
-			// Check if certificate already exists
-			certPath := fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", domain)
-			if utils.CheckFileExists(certPath) {
-				utils.Log("Reconfiguring nginx with existing SSL certificate for %s", domain)
-				// Use certbot install to reconfigure nginx (since we recreated vhost)
-				cmd := fmt.Sprintf("certbot install --nginx --cert-name %s --non-interactive --redirect", domain)
-				if _, err := utils.RunShell(cmd); err != nil {
-					utils.Warn("Failed to reconfigure SSL for %s: %v", domain, err)
-					continue
-				}
-				utils.Ok("SSL reconfigured for %s", domain)
-				setupResults[i].SSLConfigured = true
-			} else {
-				// PHASE 1: Obtain certificate (doesn't modify nginx)
-				if err := ssl.ObtainCertificate(domain, cfg.LEEmail); err != nil {
-					// Check if user chose to skip SSL or abort
-					if strings.Contains(err.Error(), "skipping SSL: DNS not configured") {
-						utils.Warn("Skipping SSL for %s - continuing with HTTP only", domain)
-						continue
-					}
-					if strings.Contains(err.Error(), "setup aborted by user") {
-						return fmt.Errorf("setup aborted: %v", err)
-					}
-					// Other errors (rate limits, network issues, etc.)
-					// IMPORTANT: nginx remains unchanged, site continues on HTTP
-					utils.Warn("Failed to obtain SSL for %s: %v", domain, err)
-					utils.Warn("Site will remain HTTP only - nginx not modified")
+
+			// PHASE 1: Obtain certificate for all of the site's hostnames
+			// (doesn't modify nginx; expands an existing certificate if needed)
+			if err := ssl.ObtainCertificateNames(domain, site.Hostnames(), cfg.LEEmail); err != nil {
+				// Check if user chose to skip SSL or abort
+				if strings.Contains(err.Error(), "skipping SSL: DNS not configured") {
+					utils.Warn("Skipping SSL for %s - continuing with HTTP only", domain)
 					continue
 				}
-				
-				// PHASE 2: Configure nginx with the certificate
-				if err := ssl.ConfigureNginxSSL(domain); err != nil {
-					utils.Warn("Failed to configure nginx SSL for %s: %v", domain, err)
-					utils.Warn("Certificate obtained but nginx not configured - you can manually configure later")
-					continue
+				if strings.Contains(err.Error(), "setup aborted by user") {
+					return fmt.Errorf("setup aborted: %v", err)
 				}
-				
-				// Both phases succeeded
-				setupResults[i].SSLConfigured = true
+				// Other errors (rate limits, network issues, etc.)
+				// IMPORTANT: nginx remains unchanged, site continues on HTTP
+				utils.Warn("Failed to obtain SSL for %s: %v", domain, err)
+				utils.Warn("Site will remain HTTP only - nginx not modified")
+				continue
 			}
 
-			// Fix SSL docroot to match HTTP docroot
-			if err := ssl.FixSSLDocroot(domain, siteWebroot); err != nil {
-				utils.Warn("Failed to fix SSL docroot for %s: %v", domain, err)
+			// PHASE 2: Regenerate the vhost with HTTPS server blocks
+			// svp writes these itself so the canonical host redirects are kept
+			site.SSLEnabled = true
+			if err := config.SaveSiteConfig(site); err != nil {
+				return err
 			}
-
-			// Enhance SSL configuration with better security settings
-			if err := ssl.EnhanceSSLConfig(domain); err != nil {
-				utils.Warn("Failed to enhance SSL config for %s: %v", domain, err)
+			if err := web.CreateNginxVhost(site); err != nil {
+				utils.Warn("Failed to configure nginx SSL for %s: %v", domain, err)
+				utils.Warn("Certificate obtained but nginx not configured - you can manually configure later")
+				continue
 			}
+			utils.Ok("SSL configured for %s", domain)
+			setupResults[i].SSLConfigured = true
 
 			// Update drush.yml to use HTTPS for Drupal sites
 			if cfg.CMS == "drupal" {
@@ -647,6 +684,28 @@ func FullSetup(cfg *types.Config) error {
 		return err
 	}
 
+	// Caches, once the sites are installed and reachable
+	if cfg.Cache != "" {
+		backends, err := cache.ParseBackends(cfg.Cache)
+		if err != nil {
+			return err
+		}
+		utils.Section("Caches")
+		for i := range setupResults {
+			if setupResults[i].InstallFailed {
+				utils.Skip("Skipping the cache of %s (installation incomplete)", setupResults[i].Domain)
+				continue
+			}
+			for _, backend := range backends {
+				if err := enableSiteCache(setupResults[i].Domain, backend); err != nil {
+					utils.Warn("Failed to enable the %s cache of %s: %v", backend, setupResults[i].Domain, err)
+					continue
+				}
+				setupResults[i].CachesEnabled = append(setupResults[i].CachesEnabled, backend)
+			}
+		}
+	}
+
 	// Print summary
 	fmt.Println()
 	fmt.Println("==========================================================")
@@ -686,6 +745,10 @@ func FullSetup(cfg *types.Config) error {
 		} else {
 			fmt.Println("SSL/HTTPS: Not configured (HTTP only)")
 		}
+
+		if len(result.CachesEnabled) > 0 {
+			fmt.Printf("Caches: %s\n", strings.Join(result.CachesEnabled, ", "))
+		}
 		fmt.Println()
 		
 		// Generate appropriate URLs
@@ -737,6 +800,11 @@ func FullSetup(cfg *types.Config) error {
 						}
 					}
 				}
+
+				// Isolated sites are only readable by their own user
+				if site, err := config.ReadSiteConfig(result.Domain); err == nil && site.SiteUser != "" {
+					adminUser = site.SiteUser
+				}
 				
 				// Generate and display one-time login link
 				loginLink, err := cms.GetDrupalLoginLink(drushDir, adminUser)
@@ -773,3 +841,34 @@ func FullSetup(cfg *types.Config) error {
 
 	return nil
 }
+
+// setupDatabaseServer returns the database server of the sites being set
+// up: the local one, or the external server of --db-host once the admin
+// connection to it works. Admin credentials given on the command line are
+// saved for later runs and for 'svp db', backup and restore.
+func setupDatabaseServer(cfg *types.Config) (database.Server, error) {
+	srv := database.Server{Host: cfg.DBHost, Port: cfg.DBPort, TLS: cfg.DBTLS || cfg.DBCA != ""}
+	if !srv.IsRemote() {
+		return database.Server{}, nil
+	}
+	if cfg.DBCA != "" {
+		ca, err := filepath.Abs(cfg.DBCA)
+		if err != nil {
+			return srv, fmt.Errorf("invalid CA path %s: %v", cfg.DBCA, err)
+		}
+		srv.CA = ca
+	} else if srv.TLS {
+		srv.CA = database.DefaultCAFile
+	}
+
+	if cfg.DBAdminPass != "" && !cfg.VerifyOnly {
+		if err := database.SaveServerAdmin(srv, cfg.DBAdminUser, cfg.DBAdminPass); err != nil {
+			return srv, err
+		}
+		utils.Ok("Admin credentials for %s saved in %s", srv, srv.AdminFile())
+	}
+	if err := database.ConnectServer(&srv); err != nil {
+		return srv, err
+	}
+	return srv, nil
+}
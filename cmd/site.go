@@ -0,0 +1,549 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"svp/pkg/bundle"
+	"svp/pkg/cms"
+	"svp/pkg/config"
+	"svp/pkg/database"
+	"svp/pkg/system"
+	"svp/pkg/utils"
+	"svp/pkg/web"
+	"svp/types"
+	"time"
+)
+
+// Site handles site bundle operations (export, import) and migrations
+func Site(cfg *types.Config) error {
+	switch cfg.SiteAction {
+	case "export":
+		return exportSite(cfg.PrimaryDomain, cfg.BundleFile, cfg.BundleGitOnly)
+	case "import":
+		return importSite(cfg)
+	case "migrate":
+		return Migrate(cfg)
+	default:
+		return fmt.Errorf("invalid action: %s (must be export, import or migrate)", cfg.SiteAction)
+	}
+}
+
+func exportSite(domain, outFile string, gitOnly bool) error {
+	utils.Section(fmt.Sprintf("Exporting %s", domain))
+
+	site, err := config.ReadSiteConfig(domain)
+	if err != nil {
+		return fmt.Errorf("site config not found - domain may not be configured: %s", domain)
+	}
+
+	siteDir := siteDomainDir(site)
+	if !utils.CheckDirExists(siteDir) {
+		return fmt.Errorf("site directory not found: %s", siteDir)
+	}
+
+	if outFile == "" {
+		outFile = fmt.Sprintf("%s-%s.tar.zst", domain, time.Now().Format("20060102-150405"))
+	}
+	outFile, err = filepath.Abs(outFile)
+	if err != nil {
+		return fmt.Errorf("failed to resolve output path: %v", err)
+	}
+
+	if err := system.EnsurePackage("zstd"); err != nil {
+		return err
+	}
+
+	stagingDir, err := os.MkdirTemp("/var/tmp", "svp-export-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	hostname, _ := os.Hostname()
+	webroot, _ := filepath.Rel(siteDir, site.Webroot)
+	vhostPath := fmt.Sprintf("/etc/nginx/sites-available/%s.conf", domain)
+	htpasswdPath := filepath.Join(siteDir, ".htpasswd")
+
+	manifest := &bundle.Manifest{
+		FormatVersion:   bundle.FormatVersion,
+		Domain:          domain,
+		CMS:             detectSiteCMS(site),
+		PHPVersion:      site.PHPVersion,
+		Webroot:         webroot,
+		Aliases:         site.Aliases,
+		CanonicalHost:   site.CanonicalHost,
+		CanonicalPolicy: site.CanonicalPolicy,
+		SSL:             site.SSLEnabled,
+		Isolated:        site.SiteUser != "",
+		BasicAuth:       vhostHasAuth(vhostPath) && utils.CheckFileExists(htpasswdPath),
+		Code:            "full",
+		SourceHost:      hostname,
+		Created:         time.Now().Format(time.RFC3339),
+	}
+
+	if manifest.CMS == "" {
+		return fmt.Errorf("could not detect the CMS of %s", domain)
+	}
+
+	for _, dir := range cms.UploadDirs(manifest.CMS, site.Webroot) {
+		rel, err := filepath.Rel(siteDir, dir)
+		if err == nil {
+			manifest.Uploads = append(manifest.Uploads, rel)
+		}
+	}
+
+	// Codebase
+	utils.Section("Codebase")
+	if gitOnly {
+		src, err := gitSource(siteDir)
+		if err != nil {
+			return err
+		}
+		manifest.Code = "git"
+		manifest.Git = src
+		utils.Ok("Codebase: %s @ %s", src.Remote, src.Commit)
+	} else {
+		utils.Ok("Codebase: full copy of %s", siteDir)
+	}
+
+	// Database
+	utils.Section("Database")
+	if dbName, dbUser, dbPass, exists := database.ReadDatabaseCredentials(domain, config.SitesDir); exists {
+		engine := database.ReadDatabaseEngine(domain, config.SitesDir)
+		if err := database.DumpDatabase(engine, database.ReadDatabaseServer(domain, config.SitesDir), dbName, dbUser, dbPass, filepath.Join(stagingDir, bundle.DatabaseFile)); err != nil {
+			return err
+		}
+		manifest.Database = bundle.DatabaseFile
+		manifest.DBEngine = engine
+	} else {
+		utils.Skip("No database credentials found for %s", domain)
+	}
+
+	// Configuration
+	utils.Section("Configuration")
+	configDir := filepath.Join(stagingDir, bundle.ConfigDir)
+	if err := utils.EnsureDir(configDir); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+	configFiles := map[string]string{
+		fmt.Sprintf("%s/%s.conf", config.SitesDir, domain): "site.conf",
+		vhostPath: "nginx.conf",
+		fmt.Sprintf("/etc/php/%s/fpm/pool.d/%s.conf", site.PHPVersion, domain): "php-fpm-pool.conf",
+	}
+	if manifest.BasicAuth {
+		configFiles[htpasswdPath] = "htpasswd"
+	}
+	for src, name := range configFiles {
+		if !utils.CheckFileExists(src) {
+			continue
+		}
+		if _, err := utils.RunCommand("cp", src, filepath.Join(configDir, name)); err != nil {
+			return fmt.Errorf("failed to copy %s: %v", src, err)
+		}
+		utils.Verify("Included %s", src)
+	}
+
+	if err := bundle.WriteManifest(stagingDir, manifest); err != nil {
+		return err
+	}
+
+	// Archive
+	utils.Section("Writing Bundle")
+	if err := bundle.Pack(outFile, stagingDir, siteDir, !gitOnly, manifest.Uploads); err != nil {
+		return err
+	}
+
+	// The bundle holds the database and credentials
+	_, _ = utils.RunCommand("chmod", "600", outFile)
+
+	size := ""
+	if info, err := os.Stat(outFile); err == nil {
+		size = fmt.Sprintf(" (%.1f MB)", float64(info.Size())/1024/1024)
+	}
+	utils.Ok("Site exported to %s%s", outFile, size)
+	fmt.Println()
+	fmt.Printf("Import on another server with: svp site import %s\n", filepath.Base(outFile))
+
+	return nil
+}
+
+func importSite(cfg *types.Config) error {
+	utils.Section("Importing Site Bundle")
+
+	bundleFile, err := filepath.Abs(cfg.BundleFile)
+	if err != nil {
+		return fmt.Errorf("failed to resolve bundle path: %v", err)
+	}
+
+	if err := system.EnsurePackage("zstd"); err != nil {
+		return err
+	}
+
+	workDir, err := os.MkdirTemp("/var/tmp", "svp-import-")
+	if err != nil {
+		return fmt.Errorf("failed to create work directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	if err := bundle.Unpack(bundleFile, workDir); err != nil {
+		return err
+	}
+
+	manifest, err := bundle.ReadManifest(workDir)
+	if err != nil {
+		return err
+	}
+	if err := validateManifest(manifest); err != nil {
+		return fmt.Errorf("invalid bundle manifest: %v", err)
+	}
+
+	domain := manifest.Domain
+	if cfg.ImportDomain != "" {
+		domain = strings.ToLower(strings.TrimSpace(cfg.ImportDomain))
+		if !config.ValidHostname(domain) {
+			return fmt.Errorf("invalid domain: %s", cfg.ImportDomain)
+		}
+	}
+	renamed := domain != manifest.Domain
+	siteDir := filepath.Join("/var/www", domain)
+
+	fmt.Printf("Bundle:   %s (%s, PHP %s, exported from %s on %s)\n", manifest.Domain, manifest.CMS, manifest.PHPVersion, manifest.SourceHost, manifest.Created)
+	fmt.Printf("Codebase: %s\n", manifest.Code)
+	fmt.Printf("Target:   %s\n", domain)
+	fmt.Println()
+
+	// Never overwrite an existing site
+	if _, err := config.ReadSiteConfig(domain); err == nil {
+		return fmt.Errorf("site %s already exists on this server", domain)
+	}
+	if utils.CheckDirExists(siteDir) {
+		entries, _ := os.ReadDir(siteDir)
+		if len(entries) > 0 {
+			return fmt.Errorf("site directory %s already exists and is not empty", siteDir)
+		}
+	}
+
+	// Git and the admin user are needed before the full setup runs
+	utils.Section("Preparing Server")
+	if err := config.EnsureConfigDirs(); err != nil {
+		return err
+	}
+	if err := system.EnsureBasePackages(false); err != nil {
+		return err
+	}
+	if err := config.EnsureAdminUser(false); err != nil {
+		return err
+	}
+	if err := utils.EnsureDir(filepath.Dir(siteDir)); err != nil {
+		return fmt.Errorf("failed to create webroot: %v", err)
+	}
+
+	// Put the codebase in place; setup reuses it instead of installing fresh
+	utils.Section("Restoring Codebase")
+	switch manifest.Code {
+	case "full":
+		_ = os.Remove(siteDir)
+		if _, err := utils.RunCommand("mv", filepath.Join(workDir, bundle.CodeDir), siteDir); err != nil {
+			return fmt.Errorf("failed to restore codebase: %v", err)
+		}
+		utils.Ok("Codebase restored to %s", siteDir)
+	case "git":
+		if manifest.Git == nil {
+			return fmt.Errorf("git bundle has no git source in its manifest")
+		}
+		if err := cloneGitSource(manifest.Git, siteDir); err != nil {
+			return err
+		}
+		for _, rel := range manifest.Uploads {
+			src := filepath.Join(workDir, bundle.UploadsDir, rel)
+			if !utils.CheckDirExists(src) {
+				continue
+			}
+			dest := filepath.Join(siteDir, rel)
+			if err := utils.EnsureDir(dest); err != nil {
+				return fmt.Errorf("failed to create %s: %v", dest, err)
+			}
+			if _, err := utils.RunCommand("cp", "-a", src+"/.", dest); err != nil {
+				return fmt.Errorf("failed to restore uploads to %s: %v", dest, err)
+			}
+			utils.Ok("Uploads restored: %s", rel)
+		}
+		if manifest.BasicAuth {
+			_, _ = utils.RunCommand("cp", filepath.Join(workDir, bundle.ConfigDir, "htpasswd"), filepath.Join(siteDir, ".htpasswd"))
+		}
+	default:
+		return fmt.Errorf("unknown codebase type in manifest: %s", manifest.Code)
+	}
+
+	// Site config is written first so setup keeps aliases and isolation
+	site := &types.SiteConfig{
+		Domain:     domain,
+		PHPVersion: manifest.PHPVersion,
+		Webroot:    filepath.Join(siteDir, manifest.Webroot),
+		CMS:        manifest.CMS,
+	}
+	if !renamed {
+		site.Aliases = manifest.Aliases
+		site.CanonicalHost = manifest.CanonicalHost
+		site.CanonicalPolicy = manifest.CanonicalPolicy
+	} else {
+		if manifest.CanonicalPolicy == "apex" || manifest.CanonicalPolicy == "www" {
+			if err := config.ApplyCanonicalPolicy(site, manifest.CanonicalPolicy); err != nil {
+				return err
+			}
+		}
+		if len(manifest.Aliases) > 0 {
+			utils.Warn("Aliases of %s were not carried over: %s", manifest.Domain, strings.Join(manifest.Aliases, ", "))
+		}
+	}
+	if manifest.Isolated {
+		site.SiteUser = system.SiteUsername(domain)
+	}
+	if err := config.SaveSiteConfig(site); err != nil {
+		return err
+	}
+
+	// Provision PHP, database, nginx and SSL
+	setupCfg := &types.Config{
+		Mode:          "setup",
+		CMS:           manifest.CMS,
+		PHPVersion:    manifest.PHPVersion,
+		PrimaryDomain: domain,
+		Webroot:       filepath.Dir(siteDir),
+		DBEngine:      database.EngineMariaDB,
+		CreateSwap:    "auto",
+		UFWEnable:     true,
+		LEEmail:       cfg.LEEmail,
+		SSLEnable:     cfg.LEEmail != "",
+		IsolateSites:  manifest.Isolated,
+		ReuseFiles:    true,
+	}
+	if manifest.Database != "" {
+		setupCfg.DBImport = filepath.Join(workDir, manifest.Database)
+	}
+	if manifest.DBEngine != "" {
+		setupCfg.DBEngine = manifest.DBEngine
+	}
+	if manifest.Git != nil {
+		setupCfg.GitRepo = manifest.Git.Remote
+		setupCfg.GitBranch = manifest.Git.Branch
+	}
+
+	if err := FullSetup(setupCfg); err != nil {
+		return err
+	}
+
+	site, err = config.ReadSiteConfig(domain)
+	if err != nil {
+		return err
+	}
+
+	// Point the CMS at its new hostname
+	utils.Section("Finishing Import")
+	if renamed {
+		updateImportedDomain(site, manifest.Domain)
+	}
+	if manifest.CMS == "wordpress" {
+		host := site.CanonicalHost
+		if host == "" {
+			host = domain
+		}
+		protocol := "http"
+		if site.SSLEnabled {
+			protocol = "https"
+		}
+		if err := cms.UpdateWordPressURL(site.Webroot, config.SiteRunUser(site), fmt.Sprintf("%s://%s", protocol, host)); err != nil {
+			utils.Warn("Failed to update WordPress URL: %v", err)
+		}
+	}
+
+	if manifest.BasicAuth {
+		if err := updateNginxAuthConfig(domain, filepath.Join(siteDir, ".htpasswd"), true); err != nil {
+			utils.Warn("Failed to restore basic authentication: %v", err)
+		} else if err := web.ReloadNginx(); err != nil {
+			return err
+		}
+	}
+
+	// Hand-made nginx/pool changes cannot be merged automatically
+	reviewDir := filepath.Join(config.SitesDir, domain+".import")
+	if _, err := utils.RunCommand("cp", "-a", filepath.Join(workDir, bundle.ConfigDir), reviewDir); err == nil {
+		_, _ = utils.RunCommand("chmod", "-R", "go-rwx", reviewDir)
+		utils.Log("Original nginx and PHP-FPM configs saved to %s for review", reviewDir)
+	}
+
+	if manifest.SSL && !site.SSLEnabled {
+		utils.Warn("%s used SSL on the source server", manifest.Domain)
+		utils.Log("Once DNS points here, run: svp update-ssl %s enable --le-email your@email.com", domain)
+	}
+
+	utils.Ok("Site %s imported", domain)
+	return nil
+}
+
+// updateImportedDomain rewrites references to the bundle's domain after
+// importing it under a new one
+func updateImportedDomain(site *types.SiteConfig, oldDomain string) {
+	switch site.CMS {
+	case "wordpress":
+		utils.Log("Replacing %s with %s in the database...", oldDomain, site.Domain)
+		cmd := fmt.Sprintf("cd %s && sudo -u %s wp search-replace '//%s' '//%s' --all-tables --skip-columns=guid --quiet",
+			site.Webroot, config.SiteRunUser(site), oldDomain, site.Domain)
+		if _, err := utils.RunShell(cmd); err != nil {
+			utils.Warn("Failed to replace domain in database: %v", err)
+		} else {
+			utils.Ok("Database URLs updated")
+		}
+	case "drupal":
+		drushYml := filepath.Join(filepath.Dir(site.Webroot), "drush", "drush.yml")
+		content, err := os.ReadFile(drushYml)
+		if err != nil {
+			return
+		}
+		updated := strings.ReplaceAll(string(content), "://"+oldDomain, "://"+site.Domain)
+		if err := os.WriteFile(drushYml, []byte(updated), 0644); err != nil {
+			utils.Warn("Failed to update drush.yml: %v", err)
+		} else {
+			utils.Ok("Drush URI updated")
+		}
+	}
+}
+
+// gitSource returns the remote, branch and commit of a site's checkout
+func gitSource(siteDir string) (*bundle.GitSource, error) {
+	git := func(args ...string) (string, error) {
+		out, err := utils.RunCommand("git", append([]string{"-c", "safe.directory=*", "-C", siteDir}, args...)...)
+		return strings.TrimSpace(out), err
+	}
+
+	if !utils.CheckDirExists(filepath.Join(siteDir, ".git")) {
+		return nil, fmt.Errorf("%s is not a git checkout - export the full codebase instead", siteDir)
+	}
+
+	remote, err := git("remote", "get-url", "origin")
+	if err != nil || remote == "" {
+		return nil, fmt.Errorf("no origin remote configured in %s", siteDir)
+	}
+
+	commit, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read current commit: %v", err)
+	}
+
+	branch, _ := git("rev-parse", "--abbrev-ref", "HEAD")
+	if branch == "HEAD" {
+		branch = ""
+	}
+
+	if status, err := git("status", "--porcelain", "--untracked-files=no"); err == nil && status != "" {
+		utils.Warn("%s has uncommitted changes - they are not included in a git bundle", siteDir)
+	}
+
+	// The commit must be reachable from the remote for the import to check it out
+	if contains, err := git("branch", "-r", "--contains", commit); err == nil && contains == "" {
+		utils.Warn("Commit %s has not been pushed to %s", commit[:12], remote)
+	}
+
+	return &bundle.GitSource{Remote: remote, Branch: branch, Commit: commit}, nil
+}
+
+// cloneGitSource clones a bundle's repository as the admin user and checks
+// out the exported commit
+func cloneGitSource(src *bundle.GitSource, siteDir string) error {
+	adminUser := config.GetAdminUser()
+
+	if !strings.HasPrefix(src.Remote, "https://") && !strings.HasPrefix(src.Remote, "http://") {
+		if err := config.EnsureAdminSSHKey(adminUser); err != nil {
+			return err
+		}
+	}
+
+	if err := utils.EnsureDir(siteDir); err != nil {
+		return fmt.Errorf("failed to create site directory: %v", err)
+	}
+	_, _ = utils.RunCommand("chown", fmt.Sprintf("%s:www-data", adminUser), siteDir)
+
+	utils.Log("Cloning %s...", src.Remote)
+	if _, err := utils.RunCommand("sudo", "-u", adminUser, "git", "clone", "--", src.Remote, siteDir); err != nil {
+		return fmt.Errorf("failed to clone repository: %v", err)
+	}
+
+	checkout := []string{"-u", adminUser, "git", "-C", siteDir, "checkout", "-q", src.Commit}
+	if src.Branch != "" {
+		checkout = []string{"-u", adminUser, "git", "-C", siteDir, "checkout", "-q", "-B", src.Branch, src.Commit}
+	}
+	if _, err := utils.RunCommand("sudo", checkout...); err != nil {
+		return fmt.Errorf("failed to check out %s: %v", src.Commit, err)
+	}
+
+	utils.Ok("Repository cloned at %s", src.Commit[:12])
+	return nil
+}
+
+// gitCommitRegex matches a full commit hash
+var gitCommitRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// gitRemoteRegex matches https and scp-style (git@host:org/repo.git)
+// remotes without spaces or shell characters
+var gitRemoteRegex = regexp.MustCompile(`^[A-Za-z0-9@:/._~+%=-]+$`)
+
+// gitBranchRegex matches the branch names a bundle may check out
+var gitBranchRegex = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+
+// phpVersionRegex matches a PHP version such as 8.3
+var phpVersionRegex = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+
+// validateManifest checks the fields of a bundle manifest that end up in
+// paths, configs and commands. Bundles may come from anywhere.
+func validateManifest(m *bundle.Manifest) error {
+	if !config.ValidHostname(m.Domain) {
+		return fmt.Errorf("invalid domain: %q", m.Domain)
+	}
+	if m.CMS != "drupal" && m.CMS != "wordpress" {
+		return fmt.Errorf("invalid cms: %q", m.CMS)
+	}
+	if !phpVersionRegex.MatchString(m.PHPVersion) {
+		return fmt.Errorf("invalid PHP version: %q", m.PHPVersion)
+	}
+	if m.DBEngine != "" && m.DBEngine != database.EngineMariaDB && m.DBEngine != database.EnginePostgreSQL {
+		return fmt.Errorf("invalid database engine: %q", m.DBEngine)
+	}
+
+	// Paths are relative to the site directory and must stay in it
+	if m.Webroot != "" && !filepath.IsLocal(m.Webroot) {
+		return fmt.Errorf("webroot %q leaves the site directory", m.Webroot)
+	}
+	for _, rel := range m.Uploads {
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("upload directory %q leaves the site directory", rel)
+		}
+	}
+	if m.Database != "" && !filepath.IsLocal(m.Database) {
+		return fmt.Errorf("database dump %q leaves the bundle", m.Database)
+	}
+
+	for _, alias := range m.Aliases {
+		if !config.ValidHostname(alias) {
+			return fmt.Errorf("invalid alias: %q", alias)
+		}
+	}
+	if m.CanonicalHost != "" && !config.ValidHostname(m.CanonicalHost) {
+		return fmt.Errorf("invalid canonical host: %q", m.CanonicalHost)
+	}
+
+	if m.Git != nil {
+		if !gitRemoteRegex.MatchString(m.Git.Remote) || strings.HasPrefix(m.Git.Remote, "-") || strings.Contains(m.Git.Remote, "::") {
+			return fmt.Errorf("invalid git remote: %q", m.Git.Remote)
+		}
+		if m.Git.Branch != "" && (!gitBranchRegex.MatchString(m.Git.Branch) || strings.HasPrefix(m.Git.Branch, "-")) {
+			return fmt.Errorf("invalid git branch: %q", m.Git.Branch)
+		}
+		if !gitCommitRegex.MatchString(m.Git.Commit) {
+			return fmt.Errorf("invalid git commit: %q (must be 40 hex characters)", m.Git.Commit)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"svp/pkg/backup"
+	"svp/pkg/config"
+	"svp/pkg/database"
+	"svp/pkg/system"
+	"svp/pkg/utils"
+	"svp/pkg/web"
+	"svp/types"
+	"time"
+)
+
+// takeSnapshot saves a site's database and config files before a
+// destructive operation, with withFiles also its whole site directory, and
+// prunes old snapshots. Sites with nothing to save yet (new sites) are
+// skipped silently.
+func takeSnapshot(domain, siteDir, reason string, withFiles bool) error {
+	if err := saveSnapshot(domain, siteDir, reason, withFiles); err != nil {
+		return err
+	}
+	pruneSnapshots(domain)
+	return nil
+}
+
+// saveSnapshot writes a snapshot of a site without pruning old ones
+func saveSnapshot(domain, siteDir, reason string, withFiles bool) error {
+	manifest := &backup.Manifest{
+		Domain:  domain,
+		SiteDir: siteDir,
+		Reason:  reason,
+	}
+	var configPaths []string
+	if site, err := config.ReadSiteConfig(domain); err == nil {
+		manifest.CMS = detectSiteCMS(site)
+		manifest.PHPVersion = site.PHPVersion
+		manifest.Webroot = site.Webroot
+		configPaths = append(configPaths, cmsSettingsPaths(site.Webroot)...)
+	}
+	// Pools of every PHP version, so an undo can drop one added since
+	configPaths = append(siteConfigPaths(domain, "*", siteDir), configPaths...)
+
+	hasDB := utils.CheckFileExists(fmt.Sprintf("%s/%s.db.txt", config.SitesDir, domain))
+	withFiles = withFiles && !dirEmpty(siteDir)
+	if !hasDB && len(configPaths) == 0 && !withFiles {
+		return nil
+	}
+	utils.Section(fmt.Sprintf("Safety Snapshot of %s", domain))
+
+	now := time.Now()
+	dir, err := backup.NewSnapshotDir(domain, now)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	manifest.Host = hostname
+	manifest.Created = now.Format(time.RFC3339)
+
+	if err := writeSnapshot(dir, manifest, configPaths, withFiles); err != nil {
+		// Leave no incomplete snapshot behind
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("failed to take safety snapshot (skip it with --no-snapshot): %v", err)
+	}
+
+	id := filepath.Base(dir)
+	utils.Ok("Snapshot %s saved (%.1f MB) - undo with: svp snapshot undo %s %s",
+		id, float64(manifest.Size)/(1<<20), domain, id)
+	return nil
+}
+
+func writeSnapshot(dir string, manifest *backup.Manifest, configPaths []string, withFiles bool) error {
+	if err := dumpSiteDatabase(dir, manifest.Domain, manifest); err != nil {
+		return err
+	}
+
+	if len(configPaths) > 0 {
+		if err := archiveConfigFiles(filepath.Join(dir, backup.ConfigFile), configPaths); err != nil {
+			return err
+		}
+	}
+
+	if withFiles {
+		utils.Log("Archiving %s...", manifest.SiteDir)
+		parent, base := filepath.Split(manifest.SiteDir)
+		if err := backup.ArchivePaths(filepath.Join(dir, backup.SiteFile), parent, []string{base}); err != nil {
+			return err
+		}
+		utils.Ok("Site directory archived")
+	}
+
+	return backup.Finalize(dir, manifest)
+}
+
+// pruneSnapshots keeps the newest SNAPSHOT_KEEP snapshots of a site
+func pruneSnapshots(domain string) {
+	keep := config.ReadBackupConfig().SnapshotKeep
+	if keep < 1 {
+		keep = 1
+	}
+	removed, err := backup.PruneSnapshots(domain, keep)
+	if err != nil {
+		utils.Warn("Failed to prune old snapshots: %v", err)
+	}
+	for _, id := range removed {
+		utils.Log("Pruned snapshot %s", id)
+	}
+}
+
+// cmsSettingsPaths returns the CMS settings files of a site, which hold its
+// database credentials
+func cmsSettingsPaths(webroot string) []string {
+	var paths []string
+	for _, pattern := range []string{
+		filepath.Join(webroot, "sites", "*", "settings*.php"),
+		filepath.Join(webroot, "wp-config.php"),
+	} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	return paths
+}
+
+func dirEmpty(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	return err != nil || len(entries) == 0
+}
+
+// Snapshot lists safety snapshots or rolls a site back to one
+func Snapshot(cfg *types.Config) error {
+	switch cfg.SnapshotAction {
+	case "list":
+		return listSnapshots(cfg.PrimaryDomain)
+	case "undo":
+		return undoSnapshot(cfg)
+	default:
+		return fmt.Errorf("unknown snapshot action: %s", cfg.SnapshotAction)
+	}
+}
+
+func listSnapshots(domain string) error {
+	var sets []*backup.Set
+	var err error
+	if domain == "" {
+		sets, err = backup.ListAllSnapshots()
+	} else {
+		sets, err = backup.ListSnapshots(domain)
+	}
+	if err != nil {
+		return err
+	}
+	if len(sets) == 0 {
+		utils.Skip("No snapshots in %s", backup.SnapshotRoot)
+		return nil
+	}
+
+	fmt.Printf("%-32s %-15s %-12s %-9s %s\n", "DOMAIN", "ID", "REASON", "SIZE", "CONTENTS")
+	for _, set := range sets {
+		if !set.Complete {
+			fmt.Printf("%-32s %-15s %s\n", set.Domain, set.ID, "incomplete")
+			continue
+		}
+		m := set.Manifest
+		var contents []string
+		if m.HasFile(backup.DatabaseFile) {
+			contents = append(contents, "database")
+		}
+		if m.HasFile(backup.ConfigFile) {
+			contents = append(contents, "config")
+		}
+		if m.HasFile(backup.SiteFile) {
+			contents = append(contents, "files")
+		}
+		fmt.Printf("%-32s %-15s %-12s %-9s %s\n", set.Domain, set.ID, m.Reason,
+			fmt.Sprintf("%.1f MB", float64(m.Size)/(1<<20)), strings.Join(contents, ", "))
+	}
+	return nil
+}
+
+// undoSnapshot puts a site back the way a snapshot recorded it: site
+// directory, config files and database
+func undoSnapshot(cfg *types.Config) error {
+	fmt.Println()
+	fmt.Println("==========================================================")
+	fmt.Println("  Snapshot Undo")
+	fmt.Println("==========================================================")
+	fmt.Println()
+
+	domain := cfg.PrimaryDomain
+	set, err := backup.FindSnapshot(domain, cfg.SnapshotID)
+	if err != nil {
+		return err
+	}
+	m := set.Manifest
+
+	fmt.Printf("Snapshot: %s of %s (taken before %s, %s)\n", set.ID, domain, m.Reason, m.Created)
+	if m.HasFile(backup.SiteFile) {
+		fmt.Printf("  • Site directory: %s replaced\n", m.SiteDir)
+	}
+	if m.HasFile(backup.ConfigFile) {
+		fmt.Println("  • Config files: svp site config, nginx vhost, PHP-FPM pool and CMS settings restored")
+	}
+	if m.HasFile(backup.DatabaseFile) {
+		fmt.Printf("  • Database: %s dropped, recreated and imported from the snapshot\n", m.Database)
+	}
+	fmt.Println()
+	if !cfg.AssumeYes {
+		fmt.Print("Continue? [y/N]: ")
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			utils.Skip("Undo cancelled")
+			return nil
+		}
+	}
+
+	if err := backup.VerifyChecksums(set.Dir, m); err != nil {
+		return err
+	}
+	utils.Ok("Checksums match the manifest (%d files)", len(m.Files))
+
+	// The undo can be undone too. Old snapshots are pruned only at the end,
+	// so the one being restored is not removed underneath us.
+	if !cfg.NoSnapshot {
+		if err := saveSnapshot(domain, m.SiteDir, "undo", m.HasFile(backup.SiteFile)); err != nil {
+			return err
+		}
+	}
+
+	if m.HasFile(backup.SiteFile) {
+		if err := undoSiteFiles(m.SiteDir, filepath.Join(set.Dir, backup.SiteFile)); err != nil {
+			return err
+		}
+	}
+
+	phpVersions := make(map[string]bool)
+	if m.HasFile(backup.ConfigFile) {
+		if err := undoConfigFiles(domain, filepath.Join(set.Dir, backup.ConfigFile), phpVersions); err != nil {
+			return err
+		}
+	}
+
+	if m.HasFile(backup.DatabaseFile) {
+		utils.Section("Restoring Database")
+		dbName, dbUser, dbPass, exists := database.ReadDatabaseCredentials(domain, config.SitesDir)
+		if !exists {
+			return fmt.Errorf("database credentials not found in %s/%s.db.txt", config.SitesDir, domain)
+		}
+		dbServer := database.ReadDatabaseServer(domain, config.SitesDir)
+		if err := database.RecreateDatabase(m.Engine(), dbServer, dbName, dbUser, dbPass); err != nil {
+			return err
+		}
+		if err := database.ImportDatabase(m.Engine(), dbServer, filepath.Join(set.Dir, backup.DatabaseFile), dbName, dbUser, dbPass); err != nil {
+			return err
+		}
+	}
+
+	utils.Section("Reloading Services")
+	site, err := config.ReadSiteConfig(domain)
+	if err == nil {
+		phpVersions[site.PHPVersion] = true
+	}
+	for version := range phpVersions {
+		if err := system.RestartService(fmt.Sprintf("php%s-fpm", version)); err != nil {
+			utils.Warn("%v", err)
+		}
+	}
+	if err := web.ReloadNginx(); err != nil {
+		return err
+	}
+
+	if site != nil {
+		clearSiteCache(site)
+		if err := probeSite(site); err != nil {
+			return err
+		}
+	}
+
+	pruneSnapshots(domain)
+	utils.Ok("%s restored from snapshot %s", domain, set.ID)
+	return nil
+}
+
+// undoSiteFiles replaces a site directory with the one in a snapshot. The
+// archive is unpacked next to it first, so a failed extraction leaves the
+// live directory untouched.
+func undoSiteFiles(siteDir, archive string) error {
+	utils.Section("Restoring Site Directory")
+
+	parent := filepath.Dir(siteDir)
+	staging, err := os.MkdirTemp(parent, ".svp-undo-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(staging)
+
+	utils.Log("Extracting %s...", filepath.Base(archive))
+	if _, err := utils.RunCommand("tar", "--zstd", "-xf", archive, "-C", staging); err != nil {
+		return fmt.Errorf("failed to extract site directory: %v", err)
+	}
+
+	src := filepath.Join(staging, filepath.Base(siteDir))
+	old := filepath.Join(staging, ".old")
+	if utils.CheckDirExists(siteDir) {
+		if err := os.Rename(siteDir, old); err != nil {
+			return fmt.Errorf("failed to move %s aside: %v", siteDir, err)
+		}
+	}
+	if err := os.Rename(src, siteDir); err != nil {
+		_ = os.Rename(old, siteDir)
+		return fmt.Errorf("failed to restore %s: %v", siteDir, err)
+	}
+	utils.Ok("Restored %s", siteDir)
+	return nil
+}
+
+// undoConfigFiles extracts a snapshot's config archive over / and removes
+// the site's PHP-FPM pools for versions the snapshot did not have. The PHP
+// versions whose pools changed are added to phpVersions.
+func undoConfigFiles(domain, archive string, phpVersions map[string]bool) error {
+	utils.Section("Restoring Config Files")
+
+	listing, err := utils.RunCommand("tar", "--zstd", "-tf", archive)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", filepath.Base(archive), err)
+	}
+	inSnapshot := make(map[string]bool)
+	for _, line := range strings.Split(listing, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			inSnapshot["/"+line] = true
+		}
+	}
+
+	if _, err := utils.RunCommand("tar", "--zstd", "-xf", archive, "-C", "/"); err != nil {
+		return fmt.Errorf("failed to extract config files: %v", err)
+	}
+	utils.Ok("Config files restored (%d files)", len(inSnapshot))
+
+	pools, _ := filepath.Glob(fmt.Sprintf("/etc/php/*/fpm/pool.d/%s.conf", domain))
+	for _, pool := range pools {
+		// /etc/php/VERSION/fpm/pool.d/DOMAIN.conf
+		version := filepath.Base(filepath.Dir(filepath.Dir(filepath.Dir(pool))))
+		phpVersions[version] = true
+		if inSnapshot[pool] {
+			continue
+		}
+		if err := os.Remove(pool); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", pool, err)
+		}
+		utils.Ok("Removed PHP %s pool added after the snapshot", version)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"strings"
+	"svp/pkg/config"
 	"svp/pkg/ssl"
 	"svp/pkg/utils"
 	"svp/pkg/web"
@@ -39,6 +40,11 @@ func UpdateSSL(cfg *types.Config) error {
 func enableSSL(domain, email string) error {
 	utils.Section("Enabling SSL")
 
+	// Sites registered with svp get their HTTPS server blocks from the vhost generator
+	if site, err := config.ReadSiteConfig(domain); err == nil {
+		return enableSiteSSL(site, email)
+	}
+
 	// Check if certificate already exists
 	certPath := fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", domain)
 	if utils.CheckFileExists(certPath) {
@@ -60,14 +66,9 @@ func enableSSL(domain, email string) error {
 	}
 
 	// Email is required for obtaining new certificates
-	if email == "" {
-		fmt.Print("Please enter an email address for Let's Encrypt notifications: ")
-		var userEmail string
-		fmt.Scanln(&userEmail)
-		if userEmail == "" {
-			return fmt.Errorf("email address is required to obtain SSL certificate")
-		}
-		email = userEmail
+	email, err := promptLEEmail(email)
+	if err != nil {
+		return err
 	}
 
 	// Obtain certificate
@@ -108,9 +109,90 @@ func enableSSL(domain, email string) error {
 	return nil
 }
 
+// enableSiteSSL obtains a certificate covering every hostname of the site
+// and regenerates the vhost with its HTTPS server blocks
+func enableSiteSSL(site *types.SiteConfig, email string) error {
+	certPath := fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", site.Domain)
+	if !utils.CheckFileExists(certPath) {
+		var err error
+		if email, err = promptLEEmail(email); err != nil {
+			return err
+		}
+	}
+
+	if err := ssl.ObtainCertificateNames(site.Domain, site.Hostnames(), email); err != nil {
+		return err
+	}
+
+	site.SSLEnabled = true
+	if err := config.SaveSiteConfig(site); err != nil {
+		return err
+	}
+
+	if err := web.CreateNginxVhost(site); err != nil {
+		return fmt.Errorf("failed to update Nginx vhost: %v", err)
+	}
+
+	if err := web.ReloadNginx(); err != nil {
+		return err
+	}
+
+	// Setup auto-renewal
+	if err := ssl.SetupAutoRenewal(false); err != nil {
+		utils.Warn("Failed to setup auto-renewal: %v", err)
+	}
+
+	host := site.CanonicalHost
+	if host == "" {
+		host = site.Domain
+	}
+
+	utils.Ok("SSL enabled for %s", site.Domain)
+	fmt.Println()
+	fmt.Printf("Your site is now available at https://%s\n", host)
+
+	return nil
+}
+
+// promptLEEmail asks for a Let's Encrypt email address when none was given
+func promptLEEmail(email string) (string, error) {
+	if email != "" {
+		return email, nil
+	}
+
+	fmt.Print("Please enter an email address for Let's Encrypt notifications: ")
+	var userEmail string
+	fmt.Scanln(&userEmail)
+	if userEmail == "" {
+		return "", fmt.Errorf("email address is required to obtain SSL certificate")
+	}
+	return userEmail, nil
+}
+
 func disableSSL(domain string) error {
 	utils.Section("Disabling SSL")
 
+	// Sites registered with svp: regenerate the vhost without HTTPS server blocks
+	if site, err := config.ReadSiteConfig(domain); err == nil {
+		site.SSLEnabled = false
+		if err := config.SaveSiteConfig(site); err != nil {
+			return err
+		}
+		if err := web.CreateNginxVhost(site); err != nil {
+			return fmt.Errorf("failed to update Nginx vhost: %v", err)
+		}
+		if err := web.ReloadNginx(); err != nil {
+			return err
+		}
+
+		utils.Ok("SSL disabled for %s", domain)
+		if utils.CheckFileExists(fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", domain)) {
+			utils.Warn("Certificate files remain in /etc/letsencrypt/live/%s", domain)
+		}
+		utils.Log("To re-enable SSL, run: svp update-ssl %s enable", domain)
+		return nil
+	}
+
 	// Check if certificate exists
 	certPath := fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", domain)
 	if !utils.CheckFileExists(certPath) {
@@ -126,64 +208,144 @@ func disableSSL(domain string) error {
 		return fmt.Errorf("nginx vhost not found: %s", vhostPath)
 	}
 
-	// Read current config
-	content, err := utils.RunShell(fmt.Sprintf("cat %s", vhostPath))
+	conf, err := web.ReadNginxConfig(vhostPath)
 	if err != nil {
-		return fmt.Errorf("failed to read vhost config: %v", err)
+		return err
+	}
+	stripNginxSSL(conf)
+	if err := conf.WriteFile(vhostPath); err != nil {
+		return fmt.Errorf("failed to write updated config: %v", err)
 	}
 
-	// Remove SSL server blocks (port 443) and keep only HTTP (port 80)
-	lines := strings.Split(content, "\n")
-	var result []string
-	inSSLBlock := false
-	braceCount := 0
+	// Reload nginx
+	if err := web.ReloadNginx(); err != nil {
+		return err
+	}
 
-	for _, line := range lines {
-		// Detect start of SSL server block
-		if strings.Contains(line, "listen 443") || strings.Contains(line, "listen [::]:443") {
-			inSSLBlock = true
-			braceCount = 0
-		}
+	utils.Ok("SSL disabled for %s", domain)
+	utils.Warn("Certificate files remain in /etc/letsencrypt/live/%s", domain)
+	utils.Log("To re-enable SSL, run: svp update-ssl %s enable", domain)
+	fmt.Println()
+	fmt.Printf("Your site is now available at http://%s\n", domain)
 
-		// Count braces if in SSL block
-		if inSSLBlock {
-			braceCount += strings.Count(line, "{")
-			braceCount -= strings.Count(line, "}")
+	return nil
+}
 
-			// Skip lines in SSL block
-			if braceCount == 0 && strings.Contains(line, "}") {
-				inSSLBlock = false
+// stripNginxSSL turns a vhost back into HTTP only. A 443 server block with
+// an HTTP twin serving the same names is removed. One without (certbot moves
+// the site to 443 and leaves a redirect on port 80) is moved to port 80, and
+// the redirects to HTTPS are removed. Certificate directives and HSTS go
+// everywhere.
+func stripNginxSSL(conf *web.NginxConfig) {
+	httpServed := make(map[string]bool)
+	for _, server := range conf.ServersListening("80") {
+		if !redirectsToHTTPS(server) {
+			for _, name := range serverNames(server) {
+				httpServed[name] = true
 			}
+		}
+	}
+
+	for _, server := range conf.ServersListening("443") {
+		names := serverNames(server)
+		if redirectsToHTTPS(server) || (len(names) > 0 && httpServed[names[0]]) {
+			conf.Remove(server)
 			continue
 		}
+		for _, listen := range server.Find("listen") {
+			if port := listenPort(listen); port == "443" {
+				listen.Args = httpListenArgs(listen.Args)
+			}
+		}
+		for _, name := range names {
+			httpServed[name] = true
+		}
+	}
 
-		// Keep non-SSL lines, but remove SSL-related directives from HTTP block
-		if !strings.Contains(line, "ssl_certificate") &&
-		   !strings.Contains(line, "ssl_") &&
-		   !strings.Contains(line, "Strict-Transport-Security") {
-			result = append(result, line)
+	for _, server := range conf.ServersListening("80") {
+		if redirectsToHTTPS(server) && len(conf.Servers()) > 1 {
+			conf.Remove(server)
 		}
 	}
 
-	// Write updated config
-	newContent := strings.Join(result, "\n")
-	_, err = utils.RunShell(fmt.Sprintf("cat > %s <<'EOF'\n%s\nEOF", vhostPath, newContent))
-	if err != nil {
-		return fmt.Errorf("failed to write updated config: %v", err)
+	conf.RemoveAll(func(d *web.NginxDirective) bool {
+		switch {
+		case strings.HasPrefix(d.Name, "ssl_"), d.Name == "http2":
+			return true
+		case d.Name == "include" && len(d.Args) == 1 && d.Args[0] == "/etc/letsencrypt/options-ssl-nginx.conf":
+			return true
+		case d.Name == "add_header" && len(d.Args) > 0 && strings.EqualFold(d.Args[0], "Strict-Transport-Security"):
+			return true
+		}
+		return false
+	})
+}
+
+// serverNames returns the server_name hostnames of a server block
+func serverNames(server *web.NginxDirective) []string {
+	var names []string
+	for _, d := range server.Find("server_name") {
+		names = append(names, d.Args...)
 	}
+	return names
+}
 
-	// Reload nginx
-	if err := web.ReloadNginx(); err != nil {
-		return err
+// redirectsToHTTPS reports whether a server block only redirects: it serves
+// no files, and a return in it or in its if/location blocks points at
+// https://
+func redirectsToHTTPS(server *web.NginxDirective) bool {
+	toHTTPS := false
+	var check func(block *web.NginxDirective) bool
+	check = func(block *web.NginxDirective) bool {
+		for _, d := range block.Children {
+			switch d.Name {
+			case "listen", "server_name", "access_log", "error_log", "include",
+				"ssl_certificate", "ssl_certificate_key", "ssl_dhparam":
+			case "return":
+				for _, arg := range d.Args {
+					if strings.HasPrefix(arg, "https://") {
+						toHTTPS = true
+					}
+				}
+			case "if", "location":
+				if !check(d) {
+					return false
+				}
+			default:
+				return false
+			}
+		}
+		return true
 	}
+	return check(server) && toHTTPS
+}
 
-	utils.Ok("SSL disabled for %s", domain)
-	utils.Warn("Certificate files remain in /etc/letsencrypt/live/%s", domain)
-	utils.Log("To re-enable SSL, run: svp update-ssl %s enable", domain)
-	fmt.Println()
-	fmt.Printf("Your site is now available at http://%s\n", domain)
+// listenPort returns the port of a listen directive (80 if only an address
+// is given)
+func listenPort(listen *web.NginxDirective) string {
+	if len(listen.Args) == 0 {
+		return ""
+	}
+	addr := listen.Args[0]
+	if i := strings.LastIndex(addr, ":"); i >= 0 && !strings.HasSuffix(addr, "]") {
+		return addr[i+1:]
+	}
+	if strings.Trim(addr, "0123456789") == "" {
+		return addr
+	}
+	return "80"
+}
 
-	return nil
+// httpListenArgs returns the arguments of a 443 listen directive moved to
+// port 80, without its TLS and HTTP/2 parameters
+func httpListenArgs(args []string) []string {
+	http := []string{strings.TrimSuffix(args[0], "443") + "80"}
+	for _, arg := range args[1:] {
+		if arg != "ssl" && arg != "http2" && arg != "quic" {
+			http = append(http, arg)
+		}
+	}
+	return http
 }
 
 func renewSSL(domain string) error {
@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"svp/pkg/backup"
+	"svp/pkg/cache"
 	"svp/pkg/config"
 	"svp/pkg/database"
 	"svp/pkg/ssl"
@@ -53,10 +56,45 @@ func Verify(cfg *types.Config) error {
 		utils.Warn("No PHP version configured")
 	}
 
-	// Check database
+	// Check the database engines the sites use
 	utils.Section("Database")
-	if err := database.InstallMariaDB(cfg.DBEngine, true); err != nil {
-		errors = append(errors, err)
+	for _, srv := range externalDatabaseServers() {
+		if err := database.ConnectServer(&srv); err != nil {
+			utils.Fail("%v", err)
+			errors = append(errors, err)
+			continue
+		}
+		utils.Verify("External database server %s reachable", srv)
+	}
+	for _, engine := range siteDatabaseEngines() {
+		if err := database.InstallEngine(engine, true); err != nil {
+			errors = append(errors, err)
+			continue
+		}
+		if engine == database.EngineMariaDB {
+			if err := database.TuneMariaDB(config.ReadTuningProfile(), tuningSiteCount(), true); err != nil {
+				errors = append(errors, err)
+			}
+		}
+	}
+	errors = append(errors, checkSiteDatabaseLogins()...)
+
+	// Check the object caches of the sites that have one
+	if caches := cache.ListSiteCaches(); len(caches) > 0 {
+		utils.Section("Object Cache")
+		if err := cache.InstallRedis(true); err != nil {
+			errors = append(errors, err)
+		}
+		errors = append(errors, checkSiteCaches(caches)...)
+	}
+	if sites := pageCachedSites(); len(sites) > 0 {
+		utils.Section("Page Cache")
+		for _, site := range sites {
+			if err := checkPageCache(site); err != nil {
+				utils.Fail("%v", err)
+				errors = append(errors, err)
+			}
+		}
 	}
 
 	// Check Composer
@@ -88,6 +126,45 @@ func Verify(cfg *types.Config) error {
 		}
 	}
 
+	// Check backups of sites that are scheduled or were backed up before
+	if domains, err := config.ListSites(); err == nil && len(domains) > 0 {
+		utils.Section("Backups")
+		staleAfter := config.ReadBackupConfig().StaleAfterHours
+		if recipients := config.ReadBackupRecipients(); len(recipients) > 0 {
+			if utils.CommandExists("age") {
+				utils.Verify("Encryption: %d recipient(s) in %s", len(recipients), config.BackupRecipientsFile)
+			} else {
+				utils.Fail("Encryption is configured but age is not installed")
+				errors = append(errors, fmt.Errorf("age is not installed - encrypted backups will fail"))
+			}
+		}
+		for _, domain := range domains {
+			summary, stale := backupHealth(domain, staleAfter)
+			switch {
+			case stale:
+				utils.Fail("%s: %s", domain, summary)
+				errors = append(errors, fmt.Errorf("no successful backup of %s in the last %d hours", domain, staleAfter))
+			case summary == "never":
+				utils.Skip("%s: no backups", domain)
+			default:
+				utils.Verify("%s: %s", domain, summary)
+			}
+
+			status, _ := backup.ReadStatus(domain)
+			if status != nil && status.Offsite == "failed" {
+				utils.Fail("%s: offsite upload failed: %s", domain, status.OffsiteError)
+				errors = append(errors, fmt.Errorf("offsite upload of the last backup of %s failed", domain))
+			}
+			if status != nil && status.VerifyResult == "failed" {
+				utils.Fail("%s: trial restore of %s failed: %s", domain, status.VerifySet, status.VerifyError)
+				errors = append(errors, fmt.Errorf("trial restore of the backup of %s failed", domain))
+			}
+			if status != nil && status.VerifyResult == "checksums" {
+				utils.Warn("%s: %s is encrypted and was not trial-restored - run 'svp backup verify %s --identity KEYFILE'", domain, status.VerifySet, domain)
+			}
+		}
+	}
+
 	// Print summary
 	fmt.Println()
 	fmt.Println("==========================================================")
@@ -109,3 +186,106 @@ func Verify(cfg *types.Config) error {
 
 	return nil
 }
+
+// siteDatabaseEngines returns the database engines of the configured sites
+// on this server, MariaDB if there are none
+func siteDatabaseEngines() []string {
+	used := make(map[string]bool)
+	var engines []string
+	domains, _ := config.ListSites()
+	for _, domain := range domains {
+		if !utils.CheckFileExists(fmt.Sprintf("%s/%s.db.txt", config.SitesDir, domain)) {
+			continue
+		}
+		if database.ReadDatabaseServer(domain, config.SitesDir).IsRemote() {
+			continue
+		}
+		engine := database.ReadDatabaseEngine(domain, config.SitesDir)
+		if !used[engine] {
+			used[engine] = true
+			engines = append(engines, engine)
+		}
+	}
+	if len(engines) == 0 && len(externalDatabaseServers()) == 0 {
+		engines = append(engines, database.EngineMariaDB)
+	}
+	return engines
+}
+
+// checkSiteDatabaseLogins logs in to each MariaDB site database with the
+// credentials of the site, which catches passwords that drifted from the
+// server as well as unreachable servers
+func checkSiteDatabaseLogins() []error {
+	var failed []error
+	domains, _ := config.ListSites()
+	for _, domain := range domains {
+		dbName, dbUser, dbPass, exists := database.ReadDatabaseCredentials(domain, config.SitesDir)
+		if !exists || database.ReadDatabaseEngine(domain, config.SitesDir) != database.EngineMariaDB {
+			continue
+		}
+		srv := database.ReadDatabaseServer(domain, config.SitesDir)
+		err := database.CheckSiteConnection(srv, dbName, dbUser, dbPass)
+		switch {
+		case err == nil:
+			utils.Verify("Database login works for %s", domain)
+			continue
+		case errors.Is(err, database.ErrAccessDenied):
+			utils.Fail("Database login of %s denied - the password in %s/%s.db.txt does not match the server", domain, config.SitesDir, domain)
+		case errors.Is(err, database.ErrUnknownDatabase):
+			utils.Fail("Database %s of %s does not exist", dbName, domain)
+		default:
+			utils.Fail("Database login of %s failed: %v", domain, err)
+		}
+		failed = append(failed, fmt.Errorf("database login of %s failed: %v", domain, err))
+	}
+	return failed
+}
+
+// checkSiteCaches checks that each site with a Redis cache has the PHP
+// extension loaded and actually keeps its cache in Redis
+func checkSiteCaches(caches []*cache.SiteCache) []error {
+	var failed []error
+	for _, sc := range caches {
+		site, err := config.ReadSiteConfig(sc.Domain)
+		if err != nil {
+			continue
+		}
+		if err := web.InstallPHPExtension(site.PHPVersion, "redis", true); err != nil {
+			failed = append(failed, err)
+			continue
+		}
+		if err := checkSiteCache(site, sc); err != nil {
+			utils.Fail("%v", err)
+			failed = append(failed, err)
+		}
+	}
+	return failed
+}
+
+// pageCachedSites returns the sites whose pages nginx caches
+func pageCachedSites() []*types.SiteConfig {
+	var sites []*types.SiteConfig
+	domains, _ := config.ListSites()
+	for _, domain := range domains {
+		if site, err := config.ReadSiteConfig(domain); err == nil && site.PageCache {
+			sites = append(sites, site)
+		}
+	}
+	return sites
+}
+
+// externalDatabaseServers returns the external database servers the
+// configured sites use
+func externalDatabaseServers() []database.Server {
+	used := make(map[string]bool)
+	var servers []database.Server
+	domains, _ := config.ListSites()
+	for _, domain := range domains {
+		srv := database.ReadDatabaseServer(domain, config.SitesDir)
+		if srv.IsRemote() && !used[srv.String()] {
+			used[srv.String()] = true
+			servers = append(servers, srv)
+		}
+	}
+	return servers
+}
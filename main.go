@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"svp/cmd"
 	"svp/pkg/utils"
 	"svp/types"
@@ -57,6 +58,30 @@ func main() {
 		updateSSLCommand()
 	case "auth":
 		authCommand()
+	case "domain":
+		domainCommand()
+	case "isolate":
+		isolateCommand()
+	case "site":
+		siteCommand()
+	case "backup":
+		backupCommand()
+	case "restore":
+		restoreCommand()
+	case "snapshot":
+		snapshotCommand()
+	case "db":
+		dbCommand()
+	case "list":
+		listCommand()
+	case "perf":
+		perfCommand()
+	case "cache":
+		cacheCommand()
+	case "ratelimit":
+		ratelimitCommand()
+	case "nginx":
+		nginxCommand()
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", command)
 		showGeneralHelp()
@@ -78,6 +103,18 @@ func showGeneralHelp() {
 	fmt.Println("  php-update   Update PHP version for a specific domain")
 	fmt.Println("  update-ssl   Manage SSL certificates (enable, disable, renew, check)")
 	fmt.Println("  auth         Manage basic authentication (enable, disable, check)")
+	fmt.Println("  domain       Manage domain aliases (add, remove, canonical, policy, list)")
+	fmt.Println("  isolate      Run a site's PHP-FPM pool as its own system user")
+	fmt.Println("  site         Export, import or migrate sites between servers")
+	fmt.Println("  backup       Back up site databases, uploads and configs, or schedule backups")
+	fmt.Println("  restore      Restore a site's database and uploads from a backup set")
+	fmt.Println("  snapshot     List safety snapshots or undo the last destructive change")
+	fmt.Println("  db           Export, import or rotate site databases, tune MariaDB")
+	fmt.Println("  list         List sites with their last backup")
+	fmt.Println("  perf         Summarize a site's slow queries and slow PHP requests")
+	fmt.Println("  cache        Manage a site's Redis object cache and nginx page cache")
+	fmt.Println("  ratelimit    Limit request rates per IP and block user agents (set, disable, check)")
+	fmt.Println("  nginx        Edit a site's custom nginx snippets, kept across vhost rewrites")
 	fmt.Println()
 	fmt.Println("Global Flags:")
 	fmt.Println("  --version     Show version information")
@@ -111,13 +148,24 @@ func setupCommand() {
 	fs.StringVar(&cfg.GitBranch, "git-branch", "", "Git branch (uses repository default if not specified)")
 	fs.StringVar(&cfg.DrupalRoot, "drupal-root", "", "Drupal root path (relative to repo)")
 	fs.StringVar(&cfg.Docroot, "docroot", "", "Custom docroot path")
-	fs.StringVar(&cfg.DBEngine, "db-engine", "mariadb", "Database engine: mariadb or none")
+	fs.StringVar(&cfg.DBEngine, "db-engine", "mariadb", "Database engine: mariadb, postgresql or none")
 	fs.StringVar(&cfg.DBImport, "db", "", "Path to database file for import")
+	fs.StringVar(&cfg.DBHost, "db-host", "", "External database server (default: local MariaDB)")
+	fs.StringVar(&cfg.DBPort, "db-port", "3306", "Port of the external database server")
+	fs.BoolVar(&cfg.DBTLS, "db-tls", false, "Connect to the external database server with TLS")
+	fs.StringVar(&cfg.DBCA, "db-ca", "", "CA certificate verifying the database server (implies --db-tls)")
+	fs.StringVar(&cfg.DBAdminUser, "db-admin-user", "root", "Admin user creating site databases on the external server")
+	fs.StringVar(&cfg.DBAdminPass, "db-admin-pass", "", "Password of the admin user (or SVP_DB_ADMIN_PASSWORD)")
 	fs.StringVar(&cfg.CreateSwap, "create-swap", "auto", "Create swap: yes, no, or auto")
 	fs.BoolVar(&cfg.UFWEnable, "firewall", true, "Enable UFW firewall")
 	fs.BoolVar(&cfg.SSLEnable, "ssl", false, "Enable SSL/HTTPS with Let's Encrypt")
 	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
 	fs.BoolVar(&cfg.KeepExistingDB, "keep-existing-db", false, "Keep existing database and drop tables")
+	fs.BoolVar(&cfg.NoSnapshot, "no-snapshot", false, "Skip the safety snapshot of existing sites")
+	fs.BoolVar(&cfg.SnapshotFiles, "snapshot-files", false, "Include the site directory in the safety snapshot")
+	fs.StringVar(&cfg.CanonicalPolicy, "canonical-host", "", "Canonical host policy: apex, www, or none")
+	fs.BoolVar(&cfg.IsolateSites, "isolate", false, "Run each site as its own system user")
+	fs.StringVar(&cfg.Cache, "cache", "", "Cache backends: redis, page or redis,page")
 
 	fs.Usage = func() {
 		fmt.Printf("Simple VPS Provisioner (svp) v%s - Setup Command\n\n", version)
@@ -146,10 +194,24 @@ func setupCommand() {
 		fmt.Println("Optional Flags:")
 		fmt.Println("  --extra-domains string")
 		fmt.Println("        Additional domains, comma-separated")
+		fmt.Println("  --canonical-host string")
+		fmt.Println("        www/non-www policy: apex (redirect www to apex), www, or none")
+		fmt.Println("  --isolate")
+		fmt.Println("        Run each site's PHP-FPM pool and files as its own system user")
+		fmt.Println("  --cache string")
+		fmt.Println("        Caches to enable: redis (object cache), page (nginx FastCGI page")
+		fmt.Println("        cache) or both as redis,page (see 'svp cache --help')")
 		fmt.Println("  --db string")
-		fmt.Println("        Path to database backup file for import")
+		fmt.Println("        Path to database backup file for import (.sql, compressed with gzip,")
+		fmt.Println("        zstd, bzip2 or xz, or a tar/zip archive holding one .sql; with")
+		fmt.Println("        PostgreSQL also pg_dump custom-format archives)")
 		fmt.Println("  --keep-existing-db")
 		fmt.Println("        Keep existing database and reuse credentials (default: false)")
+		fmt.Println("  --no-snapshot")
+		fmt.Println("        Skip the safety snapshot of existing sites (see 'svp snapshot --help')")
+		fmt.Println("  --snapshot-files")
+		fmt.Println("        Also archive the site directory in the safety snapshot (default: only")
+		fmt.Println("        the database and config files)")
 		fmt.Println("  --webroot string")
 		fmt.Println("        Parent directory for sites (default \"/var/www\")")
 		fmt.Println("  --drupal-root string")
@@ -157,7 +219,26 @@ func setupCommand() {
 		fmt.Println("  --docroot string")
 		fmt.Println("        Custom document root path")
 		fmt.Println("  --db-engine string")
-		fmt.Println("        Database engine: mariadb or none (default \"mariadb\")")
+		fmt.Println("        Database engine: mariadb, postgresql (Drupal only) or none (default \"mariadb\")")
+		fmt.Println()
+		fmt.Println("External Database Flags:")
+		fmt.Println("  --db-host string")
+		fmt.Println("        Create the site databases on an external MySQL/MariaDB server or")
+		fmt.Println("        managed database instead of installing MariaDB locally")
+		fmt.Println("  --db-port string")
+		fmt.Println("        Port of the external server (default \"3306\")")
+		fmt.Println("  --db-tls")
+		fmt.Println("        Connect with TLS and verify the server certificate")
+		fmt.Println("  --db-ca string")
+		fmt.Println("        CA certificate to verify the server with (implies --db-tls;")
+		fmt.Println("        default: the system CA bundle)")
+		fmt.Println("  --db-admin-user string")
+		fmt.Println("        Admin user that creates site databases and users (default \"root\")")
+		fmt.Println("  --db-admin-pass string")
+		fmt.Println("        Admin password, saved root-only in /etc/svp/db-servers/ for later")
+		fmt.Println("        runs (or set SVP_DB_ADMIN_PASSWORD)")
+		fmt.Println()
+		fmt.Println("Other Flags:")
 		fmt.Println("  --create-swap string")
 		fmt.Println("        Create swap: yes, no, or auto (default \"auto\")")
 		fmt.Println("  --firewall")
@@ -183,6 +264,14 @@ func setupCommand() {
 		fmt.Println("  svp setup example.com --cms drupal \\")
 		fmt.Println("    --db /path/to/backup.sql.gz --le-email admin@example.com")
 		fmt.Println()
+		fmt.Println("  # Drupal on PostgreSQL, importing a pg_dump archive:")
+		fmt.Println("  svp setup example.com --cms drupal --db-engine postgresql \\")
+		fmt.Println("    --db /path/to/backup.dump")
+		fmt.Println()
+		fmt.Println("  # WordPress on a managed database with TLS:")
+		fmt.Println("  SVP_DB_ADMIN_PASSWORD=secret svp setup example.com --cms wordpress \\")
+		fmt.Println("    --db-host db.example.net --db-port 25060 --db-admin-user doadmin --db-tls")
+		fmt.Println()
 		fmt.Println("  # Multiple domains:")
 		fmt.Println("  svp setup example.com --cms drupal \\")
 		fmt.Println("    --extra-domains \"staging.example.com,dev.example.com\" \\")
@@ -215,6 +304,40 @@ func setupCommand() {
 		os.Exit(1)
 	}
 
+	// Validate database engine
+	if cfg.DBEngine != "mariadb" && cfg.DBEngine != "postgresql" && cfg.DBEngine != "none" {
+		utils.Err("Invalid database engine: %s (must be 'mariadb', 'postgresql' or 'none')", cfg.DBEngine)
+		os.Exit(1)
+	}
+	if cfg.DBEngine == "postgresql" && cfg.CMS != "drupal" {
+		utils.Err("PostgreSQL is only supported for Drupal (WordPress requires MySQL/MariaDB)")
+		os.Exit(1)
+	}
+	if cfg.DBHost != "" && cfg.DBEngine != "mariadb" {
+		utils.Err("--db-host is only supported with --db-engine mariadb")
+		os.Exit(1)
+	}
+	if cfg.DBAdminPass == "" {
+		cfg.DBAdminPass = os.Getenv("SVP_DB_ADMIN_PASSWORD")
+	}
+	utils.RegisterSecret(cfg.DBAdminPass)
+
+	// Validate cache backends
+	if cfg.Cache != "" {
+		for _, backend := range strings.Split(cfg.Cache, ",") {
+			if backend != "redis" && backend != "page" {
+				utils.Err("Invalid cache backend: %s (must be 'redis' or 'page')", backend)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// Validate canonical host policy
+	if cfg.CanonicalPolicy != "" && cfg.CanonicalPolicy != "apex" && cfg.CanonicalPolicy != "www" && cfg.CanonicalPolicy != "none" {
+		utils.Err("Invalid canonical host policy: %s (must be 'apex', 'www' or 'none')", cfg.CanonicalPolicy)
+		os.Exit(1)
+	}
+
 	// Handle SSL configuration
 	// If --le-email is provided, automatically enable SSL
 	if cfg.LEEmail != "" && !cfg.SSLEnable {
@@ -268,10 +391,11 @@ func verifyCommand() {
 		fmt.Println("  • Base system packages")
 		fmt.Println("  • Nginx installation and status")
 		fmt.Println("  • PHP-FPM installation and status")
-		fmt.Println("  • MariaDB installation and status")
+		fmt.Println("  • MariaDB and/or PostgreSQL installation and status (the engines sites use)")
 		fmt.Println("  • Composer installation")
 		fmt.Println("  • Firewall configuration")
 		fmt.Println("  • SSL certificates (if configured)")
+		fmt.Println("  • Site backups (flags sites without a recent successful backup)")
 		fmt.Println()
 		fmt.Println("Example:")
 		fmt.Println("  svp verify")
@@ -345,6 +469,7 @@ func phpUpdateCommand() {
 	fs := flag.NewFlagSet("php-update", flag.ExitOnError)
 
 	fs.StringVar(&cfg.PHPVersion, "php-version", "", "New PHP version (required)")
+	fs.BoolVar(&cfg.NoSnapshot, "no-snapshot", false, "Skip the safety snapshot")
 	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
 
 	fs.Usage = func() {
@@ -364,10 +489,13 @@ func phpUpdateCommand() {
 		fmt.Println("        New PHP version (8.1, 8.2, 8.3, or 8.4)")
 		fmt.Println()
 		fmt.Println("Optional Flags:")
+		fmt.Println("  --no-snapshot")
+		fmt.Println("        Skip the safety snapshot (see 'svp snapshot --help')")
 		fmt.Println("  --debug")
 		fmt.Println("        Enable debug mode")
 		fmt.Println()
 		fmt.Println("What it does:")
+		fmt.Println("  • Takes a safety snapshot of the database and config files")
 		fmt.Println("  • Installs the new PHP version if needed")
 		fmt.Println("  • Creates new PHP-FPM pool for the domain")
 		fmt.Println("  • Updates Nginx configuration")
@@ -603,3 +731,1369 @@ func authCommand() {
 		os.Exit(1)
 	}
 }
+
+func domainCommand() {
+	cfg := &types.Config{Mode: "domain"}
+	fs := flag.NewFlagSet("domain", flag.ExitOnError)
+
+	fs.BoolVar(&cfg.DomainCanonical, "canonical", false, "Make the alias the canonical hostname")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
+
+	fs.Usage = func() {
+		fmt.Printf("Simple VPS Provisioner (svp) v%s - Domain Alias Command\n\n", version)
+		fmt.Println("Usage:")
+		fmt.Println("  svp domain ACTION DOMAIN [ALIAS] [options]")
+		fmt.Println()
+		fmt.Println("Description:")
+		fmt.Println("  Manage additional hostnames served by an existing site.")
+		fmt.Println("  Unlike --extra-domains, aliases share the site's files, database and PHP pool.")
+		fmt.Println()
+		fmt.Println("Arguments:")
+		fmt.Println("  ACTION")
+		fmt.Println("        Action to perform (required)")
+		fmt.Println("        - add:       Serve ALIAS from the site")
+		fmt.Println("        - remove:    Stop serving ALIAS")
+		fmt.Println("        - canonical: Redirect all other names to ALIAS (use 'none' to disable)")
+		fmt.Println("        - policy:    Set the www/non-www policy (apex, www, or none)")
+		fmt.Println("        - list:      Show the site's hostnames")
+		fmt.Println("  DOMAIN")
+		fmt.Println("        Primary domain of the site (required)")
+		fmt.Println("  ALIAS")
+		fmt.Println("        Hostname to add, remove or make canonical (policy name for policy)")
+		fmt.Println("        Letters, digits, dots and dashes only; wildcards are not supported")
+		fmt.Println()
+		fmt.Println("Optional Flags:")
+		fmt.Println("  --canonical")
+		fmt.Println("        With add: make the new alias the canonical hostname")
+		fmt.Println("  --debug")
+		fmt.Println("        Enable debug mode")
+		fmt.Println()
+		fmt.Println("What it does:")
+		fmt.Println("  • Updates server_name in the site's Nginx vhost")
+		fmt.Println("  • Expands the SSL certificate to cover the alias (if SSL is enabled)")
+		fmt.Println("  • Updates Drupal trusted_host_patterns or the WordPress site URL")
+		fmt.Println("  • Adds 301 redirects to the canonical hostname (if set)")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  # Serve www.example.com and redirect it to example.com:")
+		fmt.Println("  svp domain policy example.com apex")
+		fmt.Println()
+		fmt.Println("  # Add a vanity domain and make it canonical:")
+		fmt.Println("  svp domain add example.com example.org --canonical")
+		fmt.Println()
+		fmt.Println("  # Remove an alias:")
+		fmt.Println("  svp domain remove example.com example.org")
+		fmt.Println()
+		fmt.Printf("Documentation: %s\n", documentationURL)
+	}
+
+	// Check if help is requested or arguments are missing
+	if len(os.Args) < 4 || os.Args[2] == "--help" || os.Args[2] == "-help" {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	// Parse action, domain and optional alias from positional arguments
+	cfg.DomainAction = os.Args[2]
+	cfg.PrimaryDomain = os.Args[3]
+	flagArgs := os.Args[4:]
+	if len(flagArgs) > 0 && !strings.HasPrefix(flagArgs[0], "-") {
+		cfg.DomainAlias = flagArgs[0]
+		flagArgs = flagArgs[1:]
+	}
+
+	fs.Parse(flagArgs)
+
+	// Enable debug mode if requested
+	if cfg.Debug {
+		os.Setenv("DEBUG", "1")
+		fmt.Println("DEBUG MODE ENABLED")
+	}
+
+	// Validate action
+	validActions := map[string]bool{
+		"add":       true,
+		"remove":    true,
+		"canonical": true,
+		"policy":    true,
+		"list":      true,
+	}
+	if !validActions[cfg.DomainAction] {
+		utils.Err("Invalid action: %s", cfg.DomainAction)
+		fmt.Println("\nValid actions: add, remove, canonical, policy, list")
+		fmt.Println("Run 'svp domain --help' for more information")
+		os.Exit(1)
+	}
+
+	if cfg.DomainAction != "list" && cfg.DomainAlias == "" {
+		utils.Err("Alias hostname is required for %s", cfg.DomainAction)
+		fmt.Printf("\nUsage: svp domain %s DOMAIN ALIAS\n", cfg.DomainAction)
+		os.Exit(1)
+	}
+
+	// Execute domain management
+	if err := cmd.Domain(cfg); err != nil {
+		utils.Err("Domain management failed: %v", err)
+		os.Exit(1)
+	}
+}
+
+func isolateCommand() {
+	cfg := &types.Config{Mode: "isolate"}
+	fs := flag.NewFlagSet("isolate", flag.ExitOnError)
+
+	fs.BoolVar(&cfg.IsolateAll, "all", false, "Isolate every configured site")
+	fs.BoolVar(&cfg.IsolateRevert, "revert", false, "Move the site back to the shared www-data pool")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
+
+	fs.Usage = func() {
+		fmt.Printf("Simple VPS Provisioner (svp) v%s - Isolate Command\n\n", version)
+		fmt.Println("Usage:")
+		fmt.Println("  svp isolate DOMAIN [options]")
+		fmt.Println("  svp isolate --all [options]")
+		fmt.Println()
+		fmt.Println("Description:")
+		fmt.Println("  Move an existing site to its own system user and group, so a compromised")
+		fmt.Println("  site cannot read other sites' files or credentials.")
+		fmt.Println()
+		fmt.Println("Arguments:")
+		fmt.Println("  DOMAIN")
+		fmt.Println("        Domain to isolate (required unless --all is given)")
+		fmt.Println()
+		fmt.Println("Optional Flags:")
+		fmt.Println("  --all")
+		fmt.Println("        Apply to every configured site")
+		fmt.Println("  --revert")
+		fmt.Println("        Move the site back to the shared www-data pool and remove its user")
+		fmt.Println("  --debug")
+		fmt.Println("        Enable debug mode")
+		fmt.Println()
+		fmt.Println("What it does:")
+		fmt.Println("  • Creates a system user and group named web_DOMAIN (no login shell)")
+		fmt.Println("  • Hands the site's files to the user; other users get no access")
+		fmt.Println("  • Lets nginx (www-data) read the webroot through ACLs; credential files")
+		fmt.Println("    (wp-config.php, settings.php, .env) are readable by the user only")
+		fmt.Println("  • Runs the site's PHP-FPM pool as the user")
+		fmt.Println("  • Restricts open_basedir, temp and session files to the site")
+		fmt.Println("  • Makes the drush-DOMAIN wrapper run as the user")
+		fmt.Println()
+		fmt.Println("Shared sites:")
+		fmt.Println("  Sites that are not isolated run PHP as www-data, the user nginx reads")
+		fmt.Println("  webroots as. Their code can read the webroot of isolated sites, but not")
+		fmt.Println("  credential files or anything outside the webroot. Isolate every site")
+		fmt.Println("  with --all to close this.")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  # Isolate one site:")
+		fmt.Println("  svp isolate example.com")
+		fmt.Println()
+		fmt.Println("  # Isolate every site on the server:")
+		fmt.Println("  svp isolate --all")
+		fmt.Println()
+		fmt.Println("  # Undo isolation:")
+		fmt.Println("  svp isolate example.com --revert")
+		fmt.Println()
+		fmt.Printf("Documentation: %s\n", documentationURL)
+	}
+
+	// Check if help is requested or arguments are missing
+	if len(os.Args) < 3 || os.Args[2] == "--help" || os.Args[2] == "-help" {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	// Domain is optional when --all is given
+	flagArgs := os.Args[2:]
+	if !strings.HasPrefix(flagArgs[0], "-") {
+		cfg.PrimaryDomain = flagArgs[0]
+		flagArgs = flagArgs[1:]
+	}
+
+	fs.Parse(flagArgs)
+
+	// Enable debug mode if requested
+	if cfg.Debug {
+		os.Setenv("DEBUG", "1")
+		fmt.Println("DEBUG MODE ENABLED")
+	}
+
+	if cfg.PrimaryDomain == "" && !cfg.IsolateAll {
+		utils.Err("Domain is required (or use --all)")
+		fmt.Println("\nUsage: svp isolate DOMAIN [--revert]")
+		fmt.Println("Run 'svp isolate --help' for more information")
+		os.Exit(1)
+	}
+
+	if cfg.PrimaryDomain != "" && cfg.IsolateAll {
+		utils.Err("Use either a domain or --all, not both")
+		os.Exit(1)
+	}
+
+	// Execute isolation
+	if err := cmd.Isolate(cfg); err != nil {
+		utils.Err("Site isolation failed: %v", err)
+		os.Exit(1)
+	}
+}
+
+func siteCommand() {
+	cfg := &types.Config{Mode: "site"}
+	fs := flag.NewFlagSet("site", flag.ExitOnError)
+
+	fs.StringVar(&cfg.BundleFile, "o", "", "Bundle file to write (export)")
+	fs.BoolVar(&cfg.BundleGitOnly, "git", false, "Store the git remote and commit instead of the codebase (export)")
+	fs.StringVar(&cfg.ImportDomain, "domain", "", "Import the site under a different domain (import)")
+	fs.StringVar(&cfg.LEEmail, "le-email", "", "Let's Encrypt email to re-issue SSL (import)")
+	fs.StringVar(&cfg.MigrateFrom, "from", "", "Source server as user@host (migrate)")
+	fs.StringVar(&cfg.MigrateSSHPort, "ssh-port", "22", "SSH port of the source server (migrate)")
+	fs.BoolVar(&cfg.MigrateSudo, "sudo", false, "Use sudo on the source server (migrate)")
+	fs.BoolVar(&cfg.MigrateFinal, "final", false, "Final delta sync of files and database (migrate)")
+	fs.StringVar(&cfg.PHPVersion, "php-version", "", "Override the detected PHP version (migrate)")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
+
+	fs.Usage = func() {
+		fmt.Printf("Simple VPS Provisioner (svp) v%s - Site Command\n\n", version)
+		fmt.Println("Usage:")
+		fmt.Println("  svp site export DOMAIN [-o FILE] [--git]")
+		fmt.Println("  svp site import FILE [--domain NEWDOMAIN] [--le-email EMAIL]")
+		fmt.Println("  svp site migrate DOMAIN --from USER@HOST [--final] [--sudo] [--ssh-port PORT]")
+		fmt.Println()
+		fmt.Println("Description:")
+		fmt.Println("  Move a site between servers with a self-describing bundle (tar.zst),")
+		fmt.Println("  or pull it directly from the old server over SSH.")
+		fmt.Println()
+		fmt.Println("Arguments:")
+		fmt.Println("  ACTION")
+		fmt.Println("        Action to perform (required)")
+		fmt.Println("        - export: Write DOMAIN to a bundle")
+		fmt.Println("        - import: Provision a site from a bundle")
+		fmt.Println("        - migrate: Copy DOMAIN from another server over SSH")
+		fmt.Println()
+		fmt.Println("Export Flags:")
+		fmt.Println("  -o string")
+		fmt.Println("        Bundle file to write (default DOMAIN-TIMESTAMP.tar.zst)")
+		fmt.Println("  --git")
+		fmt.Println("        Store only the git remote and commit, plus uploads, instead of the codebase")
+		fmt.Println()
+		fmt.Println("Import Flags:")
+		fmt.Println("  --domain string")
+		fmt.Println("        Import the site under a different domain")
+		fmt.Println("  --le-email string")
+		fmt.Println("        Let's Encrypt email; re-issues SSL for the imported site")
+		fmt.Println()
+		fmt.Println("Migrate Flags:")
+		fmt.Println("  --from string")
+		fmt.Println("        Source server as user@host (required; key-based SSH)")
+		fmt.Println("  --ssh-port string")
+		fmt.Println("        SSH port of the source server (default: 22)")
+		fmt.Println("  --sudo")
+		fmt.Println("        Use passwordless sudo on the source to read files and configs")
+		fmt.Println("  --php-version string")
+		fmt.Println("        Override the PHP version detected on the source")
+		fmt.Println("  --final")
+		fmt.Println("        Re-sync changed files and the database for the cutover")
+		fmt.Println()
+		fmt.Println("  --debug")
+		fmt.Println("        Enable debug mode")
+		fmt.Println()
+		fmt.Println("Bundle contents:")
+		fmt.Println("  • manifest.json (domain, CMS, PHP version, aliases, SSL, isolation)")
+		fmt.Println("  • Database dump")
+		fmt.Println("  • Codebase, or git remote and commit plus upload directories")
+		fmt.Println("  • svp site config, Nginx vhost, PHP-FPM pool and .htpasswd")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  # Export a site:")
+		fmt.Println("  svp site export example.com -o example.tar.zst")
+		fmt.Println()
+		fmt.Println("  # Import it on the new server with SSL:")
+		fmt.Println("  svp site import example.tar.zst --le-email admin@example.com")
+		fmt.Println()
+		fmt.Println("  # Import as a staging copy:")
+		fmt.Println("  svp site import example.tar.zst --domain staging.example.com")
+		fmt.Println()
+		fmt.Println("  # Migrate from the old server, then sync the last changes at cutover:")
+		fmt.Println("  svp site migrate example.com --from root@old.example.net")
+		fmt.Println("  svp site migrate example.com --from root@old.example.net --final")
+		fmt.Println()
+		fmt.Printf("Documentation: %s\n", documentationURL)
+	}
+
+	// Check if help is requested or arguments are missing
+	if len(os.Args) < 4 || os.Args[2] == "--help" || os.Args[2] == "-help" {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	// Parse action and domain (export, migrate) or bundle file (import)
+	cfg.SiteAction = os.Args[2]
+	if cfg.SiteAction != "export" && cfg.SiteAction != "import" && cfg.SiteAction != "migrate" {
+		utils.Err("Invalid action: %s", cfg.SiteAction)
+		fmt.Println("\nValid actions: export, import, migrate")
+		fmt.Println("Run 'svp site --help' for more information")
+		os.Exit(1)
+	}
+
+	fs.Parse(os.Args[4:])
+
+	if cfg.SiteAction == "import" {
+		cfg.BundleFile = os.Args[3]
+	} else {
+		cfg.PrimaryDomain = os.Args[3]
+	}
+
+	// Enable debug mode if requested
+	if cfg.Debug {
+		os.Setenv("DEBUG", "1")
+		fmt.Println("DEBUG MODE ENABLED")
+	}
+
+	// Execute site operation
+	if err := cmd.Site(cfg); err != nil {
+		utils.Err("Site %s failed: %v", cfg.SiteAction, err)
+		os.Exit(1)
+	}
+}
+
+func backupCommand() {
+	cfg := &types.Config{Mode: "backup"}
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+
+	fs.BoolVar(&cfg.BackupAll, "all", false, "Back up every configured site")
+	fs.IntVar(&cfg.KeepDaily, "keep-daily", -1, "Daily backup sets to keep")
+	fs.IntVar(&cfg.KeepWeekly, "keep-weekly", -1, "Weekly backup sets to keep")
+	fs.IntVar(&cfg.KeepMonthly, "keep-monthly", -1, "Monthly backup sets to keep")
+	fs.StringVar(&cfg.BackupDaily, "daily", "", "Back up daily at HH:MM (schedule)")
+	fs.StringVar(&cfg.BackupCalendar, "on-calendar", "", "systemd OnCalendar expression (schedule)")
+	fs.BoolVar(&cfg.BackupDisable, "disable", false, "Remove the backup schedule or turn off encryption")
+	fs.BoolVar(&cfg.BackupLocalOnly, "local-only", false, "Do not upload to offsite backup targets")
+	fs.BoolVar(&cfg.BackupVerify, "verify", false, "Verify each backup by trial restore (schedule)")
+	fs.StringVar(&cfg.IdentityFile, "identity", "", "Private key for encrypted sets (verify)")
+	fs.StringVar(&cfg.BackupRecipients, "recipient", "", "Public keys to encrypt backups to, comma-separated (encrypt)")
+	fs.StringVar(&cfg.Target.Type, "type", "", "Target type: s3, sftp or local (target add)")
+	fs.StringVar(&cfg.Target.Endpoint, "endpoint", "", "S3 endpoint URL (target add)")
+	fs.StringVar(&cfg.Target.Region, "region", "", "S3 region (target add)")
+	fs.StringVar(&cfg.Target.Bucket, "bucket", "", "S3 bucket (target add)")
+	fs.StringVar(&cfg.Target.AccessKey, "access-key", "", "S3 access key (target add)")
+	fs.BoolVar(&cfg.Target.PathStyle, "path-style", true, "Use path-style S3 URLs (target add)")
+	fs.StringVar(&cfg.Target.Host, "host", "", "SFTP host (target add)")
+	fs.StringVar(&cfg.Target.Port, "port", "22", "SFTP port (target add)")
+	fs.StringVar(&cfg.Target.User, "user", "", "SFTP user (target add)")
+	fs.StringVar(&cfg.Target.IdentityFile, "identity-file", "", "SSH private key for SFTP (target add)")
+	fs.StringVar(&cfg.Target.Path, "path", "", "Directory or S3 key prefix (target add)")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
+
+	fs.Usage = func() {
+		fmt.Printf("Simple VPS Provisioner (svp) v%s - Backup Command\n\n", version)
+		fmt.Println("Usage:")
+		fmt.Println("  svp backup DOMAIN [options]")
+		fmt.Println("  svp backup --all [options]")
+		fmt.Println("  svp backup schedule DOMAIN --daily HH:MM | --on-calendar EXPR | --disable")
+		fmt.Println("  svp backup target add NAME --type s3|sftp|local [target flags]")
+		fmt.Println("  svp backup target list | remove NAME | test NAME")
+		fmt.Println("  svp backup encrypt [--recipient KEY[,KEY...] | --disable]")
+		fmt.Println("  svp backup verify DOMAIN [ID] [--identity KEYFILE]")
+		fmt.Println()
+		fmt.Println("Description:")
+		fmt.Println("  Write a timestamped backup set of a site to /var/backups/svp/DOMAIN/")
+		fmt.Println("  and prune old sets according to the retention policy. New sets are")
+		fmt.Println("  uploaded to every offsite target, which is pruned the same way.")
+		fmt.Println()
+		fmt.Println("Arguments:")
+		fmt.Println("  DOMAIN")
+		fmt.Println("        Domain to back up (required unless --all is given)")
+		fmt.Println()
+		fmt.Println("Optional Flags:")
+		fmt.Println("  --all")
+		fmt.Println("        Back up every configured site")
+		fmt.Println("  --keep-daily int")
+		fmt.Println("        Daily sets to keep (default from /etc/svp/backup.conf: 7)")
+		fmt.Println("  --keep-weekly int")
+		fmt.Println("        Weekly sets to keep (default from /etc/svp/backup.conf: 4)")
+		fmt.Println("  --keep-monthly int")
+		fmt.Println("        Monthly sets to keep (default from /etc/svp/backup.conf: 6)")
+		fmt.Println("  --local-only")
+		fmt.Println("        Skip the upload to offsite targets")
+		fmt.Println("  --debug")
+		fmt.Println("        Enable debug mode")
+		fmt.Println()
+		fmt.Println("Schedule Flags:")
+		fmt.Println("  --daily string")
+		fmt.Println("        Back up every day at HH:MM (e.g. 03:00)")
+		fmt.Println("  --on-calendar string")
+		fmt.Println("        Any systemd OnCalendar expression (e.g. \"*-*-* 00/6:00:00\")")
+		fmt.Println("  --verify")
+		fmt.Println("        Run 'svp backup verify' after each scheduled backup")
+		fmt.Println("  --disable")
+		fmt.Println("        Remove the schedule; existing backups are kept")
+		fmt.Println()
+		fmt.Println("Verify Flags (verify):")
+		fmt.Println("  ID")
+		fmt.Println("        Backup set to verify (default: the newest complete set)")
+		fmt.Println("  --identity string")
+		fmt.Println("        age private key file; encrypted sets get only a checksum check without it,")
+		fmt.Println("        which 'svp list' shows as \"verified checksums only\"")
+		fmt.Println()
+		fmt.Println("Encryption Flags (encrypt):")
+		fmt.Println("  --recipient string")
+		fmt.Println("        age public keys (age1...) or SSH public keys, comma-separated; archives")
+		fmt.Println("        of new sets are encrypted to them. Without flags, shows the recipients.")
+		fmt.Println("  --disable")
+		fmt.Println("        Stop encrypting new sets")
+		fmt.Println()
+		fmt.Println("Target Flags (target add):")
+		fmt.Println("  --type string")
+		fmt.Println("        s3 (any S3-compatible storage), sftp or local")
+		fmt.Println("  --endpoint string")
+		fmt.Println("        S3 endpoint URL (e.g. https://s3.eu-central-1.amazonaws.com, http://127.0.0.1:9000)")
+		fmt.Println("  --bucket string")
+		fmt.Println("        S3 bucket")
+		fmt.Println("  --region string")
+		fmt.Println("        S3 region (default: us-east-1)")
+		fmt.Println("  --access-key string")
+		fmt.Println("        S3 access key; the secret key is always prompted for")
+		fmt.Println("  --path-style")
+		fmt.Println("        Use path-style URLs (default: true; --path-style=false for virtual-hosted buckets)")
+		fmt.Println("  --host string")
+		fmt.Println("        SFTP host")
+		fmt.Println("  --port string")
+		fmt.Println("        SFTP port (default: 22)")
+		fmt.Println("  --user string")
+		fmt.Println("        SFTP user")
+		fmt.Println("  --identity-file string")
+		fmt.Println("        SSH private key for SFTP (key-based login is required)")
+		fmt.Println("  --path string")
+		fmt.Println("        Directory (sftp, local) or key prefix (s3) for the backups")
+		fmt.Println()
+		fmt.Println("Backup set contents:")
+		fmt.Println("  • database.sql.gz (dump with the credentials in /etc/svp/sites/DOMAIN.db.txt)")
+		fmt.Println("  • uploads.tar.zst (Drupal sites/*/files, WordPress wp-content/uploads)")
+		fmt.Println("  • config.tar.zst (svp site config, Nginx vhost, PHP-FPM pool, .htpasswd)")
+		fmt.Println("  • manifest.json (site details, file sizes and SHA-256 checksums)")
+		fmt.Println()
+		fmt.Println("Retention:")
+		fmt.Println("  The newest set of each of the last N days, ISO weeks and months is kept;")
+		fmt.Println("  everything else is pruned after each backup. The newest set is never pruned.")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  # Back up one site:")
+		fmt.Println("  svp backup example.com")
+		fmt.Println()
+		fmt.Println("  # Back up every site, keeping two weeks of dailies:")
+		fmt.Println("  svp backup --all --keep-daily 14")
+		fmt.Println()
+		fmt.Println("  # Back up every night at 03:00 with a systemd timer:")
+		fmt.Println("  svp backup schedule example.com --daily 03:00 --verify")
+		fmt.Println()
+		fmt.Println("  # Upload every backup to a MinIO bucket:")
+		fmt.Println("  svp backup target add offsite --type s3 --endpoint http://10.0.0.5:9000 \\")
+		fmt.Println("    --bucket backups --access-key svp")
+		fmt.Println()
+		fmt.Println("  # Encrypt backups to a key whose private half stays offline:")
+		fmt.Println("  svp backup encrypt --recipient age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p")
+		fmt.Println()
+		fmt.Println("  # Trial-restore the newest set into a scratch database:")
+		fmt.Println("  svp backup verify example.com")
+		fmt.Println()
+		fmt.Printf("Documentation: %s\n", documentationURL)
+	}
+
+	// Check if help is requested or arguments are missing
+	if len(os.Args) < 3 || os.Args[2] == "--help" || os.Args[2] == "-help" {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	// Domain is optional when --all is given
+	flagArgs := os.Args[2:]
+	if flagArgs[0] == "schedule" {
+		cfg.BackupAction = "schedule"
+		flagArgs = flagArgs[1:]
+		if len(flagArgs) == 0 || strings.HasPrefix(flagArgs[0], "-") {
+			utils.Err("Domain is required")
+			fmt.Println("\nUsage: svp backup schedule DOMAIN --daily HH:MM")
+			os.Exit(1)
+		}
+	}
+	if flagArgs[0] == "encrypt" {
+		cfg.BackupAction = "encrypt"
+		flagArgs = flagArgs[1:]
+	} else if flagArgs[0] == "verify" {
+		cfg.BackupAction = "verify"
+		flagArgs = flagArgs[1:]
+		if len(flagArgs) == 0 || strings.HasPrefix(flagArgs[0], "-") {
+			utils.Err("Domain is required")
+			fmt.Println("\nUsage: svp backup verify DOMAIN [ID]")
+			os.Exit(1)
+		}
+		cfg.PrimaryDomain = flagArgs[0]
+		flagArgs = flagArgs[1:]
+		if len(flagArgs) > 0 && !strings.HasPrefix(flagArgs[0], "-") {
+			cfg.RestoreFrom = flagArgs[0]
+			flagArgs = flagArgs[1:]
+		}
+	} else if flagArgs[0] == "target" {
+		cfg.BackupAction = "target"
+		flagArgs = flagArgs[1:]
+		if len(flagArgs) == 0 || strings.HasPrefix(flagArgs[0], "-") {
+			utils.Err("Target action is required (add, list, remove or test)")
+			fmt.Println("\nUsage: svp backup target add NAME --type s3|sftp|local")
+			os.Exit(1)
+		}
+		cfg.TargetAction = flagArgs[0]
+		flagArgs = flagArgs[1:]
+		if cfg.TargetAction != "list" {
+			if len(flagArgs) == 0 || strings.HasPrefix(flagArgs[0], "-") {
+				utils.Err("Target name is required")
+				fmt.Printf("\nUsage: svp backup target %s NAME\n", cfg.TargetAction)
+				os.Exit(1)
+			}
+			cfg.Target.Name = flagArgs[0]
+			flagArgs = flagArgs[1:]
+		}
+	} else if !strings.HasPrefix(flagArgs[0], "-") {
+		cfg.PrimaryDomain = flagArgs[0]
+		flagArgs = flagArgs[1:]
+	}
+
+	fs.Parse(flagArgs)
+
+	// Enable debug mode if requested
+	if cfg.Debug {
+		os.Setenv("DEBUG", "1")
+		fmt.Println("DEBUG MODE ENABLED")
+	}
+
+	if cfg.BackupAction == "schedule" {
+		if err := cmd.BackupSchedule(cfg); err != nil {
+			utils.Err("Backup schedule failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.BackupAction == "verify" {
+		if err := cmd.BackupVerify(cfg); err != nil {
+			utils.Err("Backup verification failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.BackupAction == "encrypt" {
+		if err := cmd.BackupEncrypt(cfg); err != nil {
+			utils.Err("Backup encryption failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.BackupAction == "target" {
+		if err := cmd.BackupTarget(cfg); err != nil {
+			utils.Err("Backup target %s failed: %v", cfg.TargetAction, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.PrimaryDomain == "" && !cfg.BackupAll {
+		utils.Err("Domain is required (or use --all)")
+		fmt.Println("\nUsage: svp backup DOMAIN")
+		fmt.Println("Run 'svp backup --help' for more information")
+		os.Exit(1)
+	}
+
+	if cfg.PrimaryDomain != "" && cfg.BackupAll {
+		utils.Err("Use either a domain or --all, not both")
+		os.Exit(1)
+	}
+
+	// Execute backup
+	if err := cmd.Backup(cfg); err != nil {
+		utils.Err("Backup failed: %v", err)
+		os.Exit(1)
+	}
+}
+
+func restoreCommand() {
+	cfg := &types.Config{Mode: "restore"}
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+
+	fs.StringVar(&cfg.RestoreFrom, "from", "", "Backup set ID or directory")
+	fs.StringVar(&cfg.RestoreTo, "to", "", "Restore into another configured site")
+	fs.BoolVar(&cfg.RestoreDBOnly, "db-only", false, "Restore only the database")
+	fs.BoolVar(&cfg.RestoreFilesOnly, "files-only", false, "Restore only the uploads")
+	fs.StringVar(&cfg.IdentityFile, "identity", "", "Private key file for encrypted backups")
+	fs.BoolVar(&cfg.NoSnapshot, "no-snapshot", false, "Skip the safety snapshot of the current database")
+	fs.BoolVar(&cfg.AssumeYes, "yes", false, "Do not ask for confirmation")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
+
+	fs.Usage = func() {
+		fmt.Printf("Simple VPS Provisioner (svp) v%s - Restore Command\n\n", version)
+		fmt.Println("Usage:")
+		fmt.Println("  svp restore DOMAIN --from ID|DIR [options]")
+		fmt.Println()
+		fmt.Println("Description:")
+		fmt.Println("  Restore the database and uploads of a site from a backup set written by")
+		fmt.Println("  'svp backup'. Checksums are verified first; afterwards the CMS cache is")
+		fmt.Println("  cleared and the site is probed over HTTP.")
+		fmt.Println()
+		fmt.Println("Arguments:")
+		fmt.Println("  DOMAIN")
+		fmt.Println("        Domain the backup set belongs to (required)")
+		fmt.Println()
+		fmt.Println("Required Flags:")
+		fmt.Println("  --from string")
+		fmt.Println("        Backup set ID (e.g. 20240131-030000, see /var/backups/svp/DOMAIN/)")
+		fmt.Println("        or the directory of a set (e.g. copied from an offsite target)")
+		fmt.Println()
+		fmt.Println("Optional Flags:")
+		fmt.Println("  --to string")
+		fmt.Println("        Restore into another site that svp already manages (e.g. a test domain)")
+		fmt.Println("  --db-only")
+		fmt.Println("        Restore only the database")
+		fmt.Println("  --files-only")
+		fmt.Println("        Restore only the upload directories")
+		fmt.Println("  --identity string")
+		fmt.Println("        age private key file (required for encrypted backup sets)")
+		fmt.Println("  --no-snapshot")
+		fmt.Println("        Skip the safety snapshot of the current database (see 'svp snapshot --help')")
+		fmt.Println("  --yes")
+		fmt.Println("        Do not ask for confirmation")
+		fmt.Println("  --debug")
+		fmt.Println("        Enable debug mode")
+		fmt.Println()
+		fmt.Println("What it does:")
+		fmt.Println("  • Takes a safety snapshot of the current database and config files")
+		fmt.Println("  • Drops and recreates the site database and user, updates the credentials")
+		fmt.Println("    in settings.svp.php or wp-config.php, and imports the dump")
+		fmt.Println("  • Replaces the upload directories and resets their ownership")
+		fmt.Println("  • Decrypts every archive of encrypted sets before changing anything")
+		fmt.Println("  • Replaces the old domain in WordPress URLs when restoring with --to")
+		fmt.Println("  • Clears the Drupal or WordPress cache and checks the site responds")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  # Restore the database of a site:")
+		fmt.Println("  svp restore example.com --from 20240131-030000 --db-only")
+		fmt.Println()
+		fmt.Println("  # Test the latest backup on a staging site:")
+		fmt.Println("  svp restore example.com --from 20240131-030000 --to restore-test.example.com --yes")
+		fmt.Println()
+		fmt.Printf("Documentation: %s\n", documentationURL)
+	}
+
+	// Check if help is requested or arguments are missing
+	if len(os.Args) < 3 || os.Args[2] == "--help" || os.Args[2] == "-help" {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	cfg.PrimaryDomain = os.Args[2]
+	if strings.HasPrefix(cfg.PrimaryDomain, "-") {
+		utils.Err("Domain is required")
+		fmt.Println("\nUsage: svp restore DOMAIN --from ID")
+		os.Exit(1)
+	}
+	fs.Parse(os.Args[3:])
+
+	// Enable debug mode if requested
+	if cfg.Debug {
+		os.Setenv("DEBUG", "1")
+		fmt.Println("DEBUG MODE ENABLED")
+	}
+
+	if cfg.RestoreFrom == "" {
+		utils.Err("--from is required")
+		fmt.Println("\nUsage: svp restore DOMAIN --from ID")
+		fmt.Println("Run 'svp restore --help' for more information")
+		os.Exit(1)
+	}
+
+	if err := cmd.Restore(cfg); err != nil {
+		utils.Err("Restore failed: %v", err)
+		os.Exit(1)
+	}
+}
+
+func snapshotCommand() {
+	cfg := &types.Config{Mode: "snapshot"}
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+
+	fs.BoolVar(&cfg.AssumeYes, "yes", false, "Do not ask for confirmation")
+	fs.BoolVar(&cfg.NoSnapshot, "no-snapshot", false, "Skip the snapshot of the current state before an undo")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
+
+	fs.Usage = func() {
+		fmt.Printf("Simple VPS Provisioner (svp) v%s - Snapshot Command\n\n", version)
+		fmt.Println("Usage:")
+		fmt.Println("  svp snapshot list [DOMAIN]")
+		fmt.Println("  svp snapshot undo DOMAIN [ID] [options]")
+		fmt.Println()
+		fmt.Println("Description:")
+		fmt.Println("  svp takes a safety snapshot of an existing site before commands that can")
+		fmt.Println("  destroy data: 'svp setup' (which may delete the site directory, drop the")
+		fmt.Println("  database or empty it with --keep-existing-db), 'svp php-update' (which")
+		fmt.Println("  rewrites the vhost and PHP-FPM pool), 'svp db import' and 'svp restore'.")
+		fmt.Println("  Snapshots are kept in /var/backups/svp-snapshots/DOMAIN/; the newest")
+		fmt.Println("  SNAPSHOT_KEEP (default 5) per site are kept, see /etc/svp/backup.conf.")
+		fmt.Println()
+		fmt.Println("Actions:")
+		fmt.Println("  list [DOMAIN]")
+		fmt.Println("        List the snapshots of all sites or one site, newest first")
+		fmt.Println("  undo DOMAIN [ID]")
+		fmt.Println("        Put the site back the way the snapshot recorded it (default: newest)")
+		fmt.Println()
+		fmt.Println("Optional Flags:")
+		fmt.Println("  --yes")
+		fmt.Println("        Do not ask for confirmation")
+		fmt.Println("  --no-snapshot")
+		fmt.Println("        Do not snapshot the current state before the undo")
+		fmt.Println("  --debug")
+		fmt.Println("        Enable debug mode")
+		fmt.Println()
+		fmt.Println("What undo does:")
+		fmt.Println("  • Snapshots the current state first, so the undo can be undone too")
+		fmt.Println("  • Replaces the site directory, if the snapshot holds it")
+		fmt.Println("  • Restores the svp site config, database credentials, nginx vhost,")
+		fmt.Println("    PHP-FPM pool and CMS settings files")
+		fmt.Println("  • Recreates the database with its old credentials and imports the dump")
+		fmt.Println("  • Restarts PHP-FPM, reloads Nginx and checks the site responds")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  # Show recent snapshots:")
+		fmt.Println("  svp snapshot list")
+		fmt.Println()
+		fmt.Println("  # Undo the last setup or php-update of a site:")
+		fmt.Println("  svp snapshot undo example.com")
+		fmt.Println()
+		fmt.Println("  # Go back to a specific snapshot:")
+		fmt.Println("  svp snapshot undo example.com 20240131-142500")
+		fmt.Println()
+		fmt.Printf("Documentation: %s\n", documentationURL)
+	}
+
+	// Check if help is requested or the action is missing
+	if len(os.Args) < 3 || os.Args[2] == "--help" || os.Args[2] == "-help" {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	cfg.SnapshotAction = os.Args[2]
+	args := os.Args[3:]
+	var positional []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	fs.Parse(args)
+
+	// Enable debug mode if requested
+	if cfg.Debug {
+		os.Setenv("DEBUG", "1")
+		fmt.Println("DEBUG MODE ENABLED")
+	}
+
+	switch {
+	case cfg.SnapshotAction == "list" && len(positional) <= 1:
+		if len(positional) == 1 {
+			cfg.PrimaryDomain = positional[0]
+		}
+	case cfg.SnapshotAction == "undo" && len(positional) >= 1 && len(positional) <= 2:
+		cfg.PrimaryDomain = positional[0]
+		if len(positional) == 2 {
+			cfg.SnapshotID = positional[1]
+		}
+	default:
+		utils.Err("Invalid snapshot arguments")
+		fmt.Println("\nUsage: svp snapshot list [DOMAIN] | svp snapshot undo DOMAIN [ID]")
+		fmt.Println("Run 'svp snapshot --help' for more information")
+		os.Exit(1)
+	}
+
+	if err := cmd.Snapshot(cfg); err != nil {
+		utils.Err("Snapshot %s failed: %v", cfg.SnapshotAction, err)
+		os.Exit(1)
+	}
+}
+
+func dbCommand() {
+	cfg := &types.Config{Mode: "db"}
+	fs := flag.NewFlagSet("db", flag.ExitOnError)
+
+	fs.StringVar(&cfg.DBExportFile, "o", "", "Export to this file")
+	fs.StringVar(&cfg.DBExportFile, "output", "", "Export to this file")
+	fs.BoolVar(&cfg.DBDropTables, "drop-tables", false, "Drop all tables before the import")
+	fs.BoolVar(&cfg.AssumeYes, "yes", false, "Do not ask for confirmation")
+	fs.BoolVar(&cfg.NoSnapshot, "no-snapshot", false, "Skip the safety snapshot before an import")
+	fs.StringVar(&cfg.TuningProfile, "profile", "", "MariaDB tuning profile: small, medium, large or auto")
+	fs.BoolVar(&cfg.TuningShow, "show", false, "Preview the MariaDB tuning file without writing it")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
+
+	fs.Usage = func() {
+		fmt.Printf("Simple VPS Provisioner (svp) v%s - Database Command\n\n", version)
+		fmt.Println("Usage:")
+		fmt.Println("  svp db export DOMAIN [-o FILE]")
+		fmt.Println("  svp db import DOMAIN FILE [options]")
+		fmt.Println("  svp db rotate DOMAIN [options]")
+		fmt.Println("  svp db tune [--show] [--profile small|medium|large|auto]")
+		fmt.Println()
+		fmt.Println("Description:")
+		fmt.Println("  Manage the database of a site provisioned by svp. Export and import")
+		fmt.Println("  work on live sites.")
+		fmt.Println()
+		fmt.Println("Actions:")
+		fmt.Println("  export DOMAIN")
+		fmt.Println("        Dump the site database (default: ./DOMAIN-TIMESTAMP.sql.gz)")
+		fmt.Println("  import DOMAIN FILE")
+		fmt.Println("        Load a dump into the site database")
+		fmt.Println("  rotate DOMAIN")
+		fmt.Println("        Give the site's database user a new random password")
+		fmt.Println("  tune")
+		fmt.Println("        Size MariaDB for the RAM of the server and the number of sites")
+		fmt.Println()
+		fmt.Println("Optional Flags:")
+		fmt.Println("  -o, --output FILE")
+		fmt.Println("        Export to FILE; .gz, .zst, .bz2 and .xz compress the dump")
+		fmt.Println("  --drop-tables")
+		fmt.Println("        Drop all tables before the import, so tables the dump lacks do")
+		fmt.Println("        not survive")
+		fmt.Println("  --yes")
+		fmt.Println("        Do not ask for confirmation before an import")
+		fmt.Println("  --no-snapshot")
+		fmt.Println("        Skip the safety snapshot before an import (see 'svp snapshot --help')")
+		fmt.Println("  --show")
+		fmt.Println("        Print the tuning file and the changes to the current one, without")
+		fmt.Println("        writing it")
+		fmt.Println("  --profile string")
+		fmt.Println("        Tuning profile: small, medium, large, or auto to pick one from the")
+		fmt.Println("        RAM size (default: auto). Saved in /etc/svp/database.conf for later")
+		fmt.Println("        runs of setup and verify.")
+		fmt.Println("  --debug")
+		fmt.Println("        Enable debug mode")
+		fmt.Println()
+		fmt.Println("Import file formats:")
+		fmt.Println("  • Plain SQL, or compressed with gzip, zstd, bzip2 or xz")
+		fmt.Println("  • tar (optionally compressed) or zip archives holding a single .sql file")
+		fmt.Println("  • pg_dump custom-format archives for PostgreSQL sites")
+		fmt.Println()
+		fmt.Println("What import does:")
+		fmt.Println("  • Snapshots the current database and settings")
+		fmt.Println("  • Strips DEFINER clauses and maps MySQL 8 collations MariaDB lacks")
+		fmt.Println("  • Shows the progress of the import")
+		fmt.Println("  • Runs 'drush updb' and 'drush cr' (Drupal) or 'wp cache flush' (WordPress)")
+		fmt.Println("    and checks the site responds")
+		fmt.Println()
+		fmt.Println("What tune does:")
+		fmt.Println("  • Writes /etc/mysql/mariadb.conf.d/90-svp-tuning.cnf with the InnoDB buffer")
+		fmt.Println("    pool, max_connections, temporary table sizes and the slow query log")
+		fmt.Println("  • Leaves memory for the PHP-FPM pool of every site")
+		fmt.Println("  • Restarts MariaDB if the file changed ('svp setup' writes the file only")
+		fmt.Println("    when it is missing and reports changed settings; 'svp verify' reports drift)")
+		fmt.Println()
+		fmt.Println("What rotate does:")
+		fmt.Println("  • Checks that the site bootstraps and, on MariaDB, that the current")
+		fmt.Println("    password logs in before changing anything")
+		fmt.Println("  • Changes the password of the database user (MariaDB or PostgreSQL) and,")
+		fmt.Println("    on MariaDB, logs in with the new one")
+		fmt.Println("  • Rewrites /etc/svp/sites/DOMAIN.db.txt and settings.svp.php (or the")
+		fmt.Println("    SVP block in settings.php) or wp-config.php, each replaced atomically")
+		fmt.Println("  • Reloads PHP-FPM and checks the site still bootstraps and responds")
+		fmt.Println("  • Puts the old password back everywhere if the check fails")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  # Export the database with zstd compression:")
+		fmt.Println("  svp db export example.com -o /root/example.sql.zst")
+		fmt.Println()
+		fmt.Println("  # Replace the database with a dump from another server:")
+		fmt.Println("  svp db import example.com /root/prod-dump.tar.gz --drop-tables")
+		fmt.Println()
+		fmt.Println("  # Rotate the database password after a staff change:")
+		fmt.Println("  svp db rotate example.com")
+		fmt.Println()
+		fmt.Println("  # Preview the MariaDB tuning, then use the large profile:")
+		fmt.Println("  svp db tune --show")
+		fmt.Println("  svp db tune --profile large")
+		fmt.Println()
+		fmt.Printf("Documentation: %s\n", documentationURL)
+	}
+
+	// Check if help is requested or the action is missing
+	if len(os.Args) < 3 || os.Args[2] == "--help" || os.Args[2] == "-help" {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	cfg.DBAction = os.Args[2]
+	args := os.Args[3:]
+	var positional []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	fs.Parse(args)
+
+	// Enable debug mode if requested
+	if cfg.Debug {
+		os.Setenv("DEBUG", "1")
+		fmt.Println("DEBUG MODE ENABLED")
+	}
+
+	switch {
+	case (cfg.DBAction == "rotate" || cfg.DBAction == "export") && len(positional) == 1:
+		cfg.PrimaryDomain = positional[0]
+	case cfg.DBAction == "import" && len(positional) == 2:
+		cfg.PrimaryDomain = positional[0]
+		cfg.DBImport = positional[1]
+	case cfg.DBAction == "tune" && len(positional) == 0:
+	default:
+		utils.Err("Invalid db arguments")
+		fmt.Println("\nUsage: svp db export DOMAIN [-o FILE] | svp db import DOMAIN FILE | svp db rotate DOMAIN | svp db tune")
+		fmt.Println("Run 'svp db --help' for more information")
+		os.Exit(1)
+	}
+
+	if err := cmd.DB(cfg); err != nil {
+		utils.Err("Database %s failed: %v", cfg.DBAction, err)
+		os.Exit(1)
+	}
+}
+
+func listCommand() {
+	cfg := &types.Config{Mode: "list"}
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+
+	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
+
+	fs.Usage = func() {
+		fmt.Printf("Simple VPS Provisioner (svp) v%s - List Command\n\n", version)
+		fmt.Println("Usage:")
+		fmt.Println("  svp list [options]")
+		fmt.Println()
+		fmt.Println("Description:")
+		fmt.Println("  List configured sites with CMS, PHP version, SSL, isolation and the")
+		fmt.Println("  status of their last backup.")
+		fmt.Println()
+		fmt.Println("Flags:")
+		fmt.Println("  --debug")
+		fmt.Println("        Enable debug mode")
+		fmt.Println()
+		fmt.Println("Sites that are scheduled or were backed up before are marked STALE when")
+		fmt.Println("their last successful backup is older than STALE_AFTER_HOURS in")
+		fmt.Println("/etc/svp/backup.conf (default: 26).")
+		fmt.Println()
+		fmt.Println("Example:")
+		fmt.Println("  svp list")
+		fmt.Println()
+		fmt.Printf("Documentation: %s\n", documentationURL)
+	}
+
+	fs.Parse(os.Args[2:])
+
+	// Enable debug mode if requested
+	if cfg.Debug {
+		os.Setenv("DEBUG", "1")
+		fmt.Println("DEBUG MODE ENABLED")
+	}
+
+	if err := cmd.List(cfg); err != nil {
+		utils.Err("List failed: %v", err)
+		os.Exit(1)
+	}
+}
+
+func perfCommand() {
+	cfg := &types.Config{Mode: "perf"}
+	fs := flag.NewFlagSet("perf", flag.ExitOnError)
+
+	fs.StringVar(&cfg.PerfSince, "since", "24h", "Time window, e.g. 30m, 24h or 7d")
+	fs.IntVar(&cfg.PerfLimit, "limit", 10, "Entries per section (0 for all)")
+	fs.BoolVar(&cfg.PerfJSON, "json", false, "Print the report as JSON")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
+
+	fs.Usage = func() {
+		fmt.Printf("Simple VPS Provisioner (svp) v%s - Perf Command\n\n", version)
+		fmt.Println("Usage:")
+		fmt.Println("  svp perf DOMAIN [options]")
+		fmt.Println()
+		fmt.Println("Description:")
+		fmt.Println("  Summarize what made a site slow: the slowest queries of its database")
+		fmt.Println("  and the stack traces of slow requests in its PHP-FPM pool.")
+		fmt.Println()
+		fmt.Println("Arguments:")
+		fmt.Println("  DOMAIN")
+		fmt.Println("        Domain of the site (required)")
+		fmt.Println()
+		fmt.Println("Optional Flags:")
+		fmt.Println("  --since string")
+		fmt.Println("        Time window to report on, e.g. 30m, 24h or 7d (default \"24h\")")
+		fmt.Println("  --limit int")
+		fmt.Println("        Entries per section, 0 for all (default 10)")
+		fmt.Println("  --json")
+		fmt.Println("        Print the report as JSON")
+		fmt.Println("  --debug")
+		fmt.Println("        Enable debug mode")
+		fmt.Println()
+		fmt.Println("Sources:")
+		fmt.Println("  • MariaDB slow query log (/var/log/mysql/mariadb-slow.log, queries over")
+		fmt.Println("    2s, enabled by 'svp db tune'), filtered to the site's database and user.")
+		fmt.Println("    Queries differing only in their values are grouped, the most total")
+		fmt.Println("    time first.")
+		fmt.Println("  • PHP-FPM slowlog of the site's pool")
+		fmt.Println("    (/var/log/phpVERSION-fpm-DOMAIN-slow.log, requests over 5s). Identical")
+		fmt.Println("    stack traces are grouped, the most frequent first.")
+		fmt.Println("  Rotated copies of both logs are read too.")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  # What was slow today:")
+		fmt.Println("  svp perf example.com")
+		fmt.Println()
+		fmt.Println("  # The last week, for a monitoring script:")
+		fmt.Println("  svp perf example.com --since 7d --limit 0 --json")
+		fmt.Println()
+		fmt.Printf("Documentation: %s\n", documentationURL)
+	}
+
+	// Check if help is requested
+	if len(os.Args) < 3 || os.Args[2] == "--help" || os.Args[2] == "-help" {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	// Parse domain from positional argument
+	cfg.PrimaryDomain = os.Args[2]
+	fs.Parse(os.Args[3:])
+
+	// Enable debug mode if requested
+	if cfg.Debug {
+		os.Setenv("DEBUG", "1")
+		fmt.Println("DEBUG MODE ENABLED")
+	}
+
+	if err := cmd.Perf(cfg); err != nil {
+		utils.Err("Perf failed: %v", err)
+		os.Exit(1)
+	}
+}
+
+func cacheCommand() {
+	cfg := &types.Config{Mode: "cache"}
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+
+	fs.StringVar(&cfg.CacheSince, "since", "24h", "Time window of stats, e.g. 30m, 24h or 7d")
+	fs.BoolVar(&cfg.CacheJSON, "json", false, "Print stats as JSON")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
+
+	fs.Usage = func() {
+		fmt.Printf("Simple VPS Provisioner (svp) v%s - Cache Command\n\n", version)
+		fmt.Println("Usage:")
+		fmt.Println("  svp cache enable DOMAIN redis|page")
+		fmt.Println("  svp cache disable DOMAIN page")
+		fmt.Println("  svp cache purge DOMAIN [PATH]")
+		fmt.Println("  svp cache stats DOMAIN [options]")
+		fmt.Println()
+		fmt.Println("Description:")
+		fmt.Println("  Keep a site's Drupal or WordPress cache in Redis instead of the database,")
+		fmt.Println("  and let nginx serve the pages of anonymous visitors without PHP.")
+		fmt.Println()
+		fmt.Println("Actions:")
+		fmt.Println("  enable DOMAIN BACKEND")
+		fmt.Println("        Give the site a cache: redis (object cache) or page (page cache)")
+		fmt.Println("  disable DOMAIN page")
+		fmt.Println("        Remove the page cache from the vhost and delete the cached pages")
+		fmt.Println("  purge DOMAIN [PATH]")
+		fmt.Println("        Delete all cached pages, or those of one path (/blog/) or URL")
+		fmt.Println("  stats DOMAIN")
+		fmt.Println("        Show the size and hit ratio of the page cache")
+		fmt.Println()
+		fmt.Println("Optional Flags:")
+		fmt.Println("  --since string")
+		fmt.Println("        Time window of stats, e.g. 30m, 24h or 7d (default \"24h\")")
+		fmt.Println("  --json")
+		fmt.Println("        Print stats as JSON")
+		fmt.Println("  --debug")
+		fmt.Println("        Enable debug mode")
+		fmt.Println()
+		fmt.Println("What enable DOMAIN redis does:")
+		fmt.Println("  1. Installs redis-server listening on 127.0.0.1 only, with the default")
+		fmt.Println("     user disabled and an LRU memory limit of a tenth of the RAM")
+		fmt.Println("  2. Gives the site its own Redis database, key prefix and ACL user that")
+		fmt.Println("     may only touch keys under the prefix (/etc/svp/sites/DOMAIN.cache.txt)")
+		fmt.Println("  3. Installs the redis extension of the site's PHP version")
+		fmt.Println("  4. Drupal: adds drupal/redis with composer, enables it and sets the cache")
+		fmt.Println("     backend in settings.svp.php")
+		fmt.Println("     WordPress: installs the Redis Object Cache plugin and its drop-in,")
+		fmt.Println("     with the connection in wp-config.php")
+		fmt.Println("  5. Requests the site and checks that its keys appear in Redis")
+		fmt.Println()
+		fmt.Println("  Running it again repairs the configuration and keeps the credentials.")
+		fmt.Println()
+		fmt.Println("What enable DOMAIN page does:")
+		fmt.Println("  1. Adds a FastCGI cache zone to the site's vhost (/var/cache/nginx/svp/DOMAIN,")
+		fmt.Println("     up to 256 MB) caching anonymous GET requests for 10 minutes")
+		fmt.Println("  2. Bypasses the cache for POST requests, query strings, admin and login")
+		fmt.Println("     paths and the session cookies of logged-in users (WordPress and Drupal")
+		fmt.Println("     rules); responses setting a cookie are never cached")
+		fmt.Println("  3. Adds an X-Cache-Status header and logs each status to")
+		fmt.Println("     /var/log/nginx/DOMAIN-cache.log for 'svp cache stats'")
+		fmt.Println("  4. Requests the home page until it is served from the cache")
+		fmt.Println()
+		fmt.Println("  'svp verify' checks that every site with a cache still uses it.")
+		fmt.Println("  Restores, imports and migrations purge the page cache.")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  svp cache enable example.com redis")
+		fmt.Println("  svp cache enable example.com page")
+		fmt.Println()
+		fmt.Println("  # After publishing a post:")
+		fmt.Println("  svp cache purge example.com /blog/")
+		fmt.Println()
+		fmt.Println("  # How well the page cache did this week:")
+		fmt.Println("  svp cache stats example.com --since 7d")
+		fmt.Println()
+		fmt.Println("  # At setup time:")
+		fmt.Println("  svp setup example.com --cms wordpress --cache redis,page")
+		fmt.Println()
+		fmt.Printf("Documentation: %s\n", documentationURL)
+	}
+
+	// Check if help is requested or the action is missing
+	if len(os.Args) < 3 || os.Args[2] == "--help" || os.Args[2] == "-help" {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	cfg.CacheAction = os.Args[2]
+	args := os.Args[3:]
+	var positional []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	fs.Parse(args)
+
+	// Enable debug mode if requested
+	if cfg.Debug {
+		os.Setenv("DEBUG", "1")
+		fmt.Println("DEBUG MODE ENABLED")
+	}
+
+	switch {
+	case cfg.CacheAction == "enable" && len(positional) == 2 && (positional[1] == "redis" || positional[1] == "page"):
+		cfg.PrimaryDomain = positional[0]
+		cfg.Cache = positional[1]
+	case cfg.CacheAction == "disable" && len(positional) == 2 && positional[1] == "page":
+		cfg.PrimaryDomain = positional[0]
+		cfg.Cache = positional[1]
+	case cfg.CacheAction == "purge" && (len(positional) == 1 || len(positional) == 2):
+		cfg.PrimaryDomain = positional[0]
+		if len(positional) == 2 {
+			cfg.CachePath = positional[1]
+		}
+	case cfg.CacheAction == "stats" && len(positional) == 1:
+		cfg.PrimaryDomain = positional[0]
+	default:
+		utils.Err("Invalid cache arguments")
+		fmt.Println("\nUsage: svp cache enable DOMAIN redis|page")
+		fmt.Println("       svp cache disable DOMAIN page")
+		fmt.Println("       svp cache purge DOMAIN [PATH]")
+		fmt.Println("       svp cache stats DOMAIN [--since 24h] [--json]")
+		fmt.Println("Run 'svp cache --help' for more information")
+		os.Exit(1)
+	}
+
+	if err := cmd.Cache(cfg); err != nil {
+		utils.Err("Cache %s failed: %v", cfg.CacheAction, err)
+		os.Exit(1)
+	}
+}
+
+func ratelimitCommand() {
+	cfg := &types.Config{Mode: "ratelimit"}
+	fs := flag.NewFlagSet("ratelimit", flag.ExitOnError)
+
+	fs.StringVar(&cfg.RateLimitRate, "rate", "", "Requests per client IP, e.g. 10r/s")
+	fs.StringVar(&cfg.RateLimitLoginRate, "login-rate", "", "Requests per client IP to login paths, e.g. 5r/m")
+	fs.IntVar(&cfg.RateLimitConnections, "connections", 0, "Connections per client IP")
+	fs.StringVar(&cfg.RateLimitPaths, "paths", "", "Comma-separated path prefixes to limit like logins, or none")
+	fs.StringVar(&cfg.RateLimitAgents, "block-agents", "", "Comma-separated user agents to block, or none")
+	fs.StringVar(&cfg.RateLimitSince, "since", "24h", "Time window of check, e.g. 30m, 24h or 7d")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
+
+	fs.Usage = func() {
+		fmt.Printf("Simple VPS Provisioner (svp) v%s - Rate Limit Command\n\n", version)
+		fmt.Println("Usage:")
+		fmt.Println("  svp ratelimit DOMAIN ACTION [options]")
+		fmt.Println()
+		fmt.Println("Description:")
+		fmt.Println("  Limit how fast each client IP may request a site, with stricter limits")
+		fmt.Println("  on login paths, and block user agents. The limits are part of the vhost")
+		fmt.Println("  svp generates, so they survive its regeneration.")
+		fmt.Println()
+		fmt.Println("Arguments:")
+		fmt.Println("  DOMAIN")
+		fmt.Println("        Domain of the site (required)")
+		fmt.Println("  ACTION")
+		fmt.Println("        Action to perform (required)")
+		fmt.Println("        - set:     Enable the limits, changing those given as flags")
+		fmt.Println("        - disable: Remove the limits from the vhost")
+		fmt.Println("        - check:   Show the limits and the requests they rejected")
+		fmt.Println()
+		fmt.Println("Optional Flags:")
+		fmt.Println("  --rate string")
+		fmt.Println("        Requests per client IP, with bursts of 50 (default \"10r/s\")")
+		fmt.Println("  --login-rate string")
+		fmt.Println("        Requests per client IP to login paths, with bursts of 5 (default \"5r/m\")")
+		fmt.Println("  --connections int")
+		fmt.Println("        Open connections per client IP (default 30)")
+		fmt.Println("  --paths string")
+		fmt.Println("        Comma-separated path prefixes limited like the login paths, e.g.")
+		fmt.Println("        /search,/contact; none removes them")
+		fmt.Println("  --block-agents string")
+		fmt.Println("        Comma-separated user agent substrings answered with 403 (case-")
+		fmt.Println("        insensitive), e.g. AhrefsBot,MJ12bot; none removes them")
+		fmt.Println("  --since string")
+		fmt.Println("        Time window of check, e.g. 30m, 24h or 7d (default \"24h\")")
+		fmt.Println("  --debug")
+		fmt.Println("        Enable debug mode")
+		fmt.Println()
+		fmt.Println("Login paths limited by default:")
+		fmt.Println("  WordPress: /wp-login.php and /xmlrpc.php")
+		fmt.Println("  Drupal:    /user/login, /user/password, /user/register and /xmlrpc.php")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  # Enable the default limits:")
+		fmt.Println("  svp ratelimit example.com set")
+		fmt.Println()
+		fmt.Println("  # Also limit the search page and block two crawlers:")
+		fmt.Println("  svp ratelimit example.com set --paths /search --block-agents AhrefsBot,MJ12bot")
+		fmt.Println()
+		fmt.Println("  # Who was rejected this week:")
+		fmt.Println("  svp ratelimit example.com check --since 7d")
+		fmt.Println()
+		fmt.Println("Notes:")
+		fmt.Println("  - Requests over a limit get HTTP 429 and are logged to the site's error log")
+		fmt.Println("  - set keeps the limits and lists not given; disable keeps them for the next set")
+		fmt.Println()
+		fmt.Printf("Documentation: %s\n", documentationURL)
+	}
+
+	// Check if help is requested or arguments are missing
+	if len(os.Args) < 4 || os.Args[2] == "--help" || os.Args[2] == "-help" {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	// Parse domain and action from positional arguments
+	cfg.PrimaryDomain = os.Args[2]
+	cfg.RateLimitAction = os.Args[3]
+	fs.Parse(os.Args[4:])
+
+	// Enable debug mode if requested
+	if cfg.Debug {
+		os.Setenv("DEBUG", "1")
+		fmt.Println("DEBUG MODE ENABLED")
+	}
+
+	// Validate action
+	validActions := map[string]bool{
+		"set":     true,
+		"disable": true,
+		"check":   true,
+	}
+	if !validActions[cfg.RateLimitAction] {
+		utils.Err("Invalid action: %s", cfg.RateLimitAction)
+		fmt.Println("\nValid actions: set, disable, check")
+		fmt.Println("Run 'svp ratelimit --help' for more information")
+		os.Exit(1)
+	}
+
+	if err := cmd.RateLimit(cfg); err != nil {
+		utils.Err("Rate limit %s failed: %v", cfg.RateLimitAction, err)
+		os.Exit(1)
+	}
+}
+
+func nginxCommand() {
+	cfg := &types.Config{Mode: "nginx"}
+	fs := flag.NewFlagSet("nginx", flag.ExitOnError)
+
+	fs.BoolVar(&cfg.NginxHTTP, "http", false, "Edit an http level snippet instead of a server level one")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Enable debug mode")
+
+	fs.Usage = func() {
+		fmt.Printf("Simple VPS Provisioner (svp) v%s - Nginx Command\n\n", version)
+		fmt.Println("Usage:")
+		fmt.Println("  svp nginx edit DOMAIN [NAME] [options]")
+		fmt.Println()
+		fmt.Println("Description:")
+		fmt.Println("  Add redirects, headers or location blocks to a site in snippets that the")
+		fmt.Println("  generated vhost includes. svp rewrites the vhost on setup, php-update and")
+		fmt.Println("  other commands; the snippets are kept.")
+		fmt.Println()
+		fmt.Println("Actions:")
+		fmt.Println("  edit DOMAIN [NAME]")
+		fmt.Println("        Open snippet NAME (default \"custom\") in $VISUAL, $EDITOR or nano,")
+		fmt.Println("        test the result with nginx -t and reload nginx. A rejected edit is")
+		fmt.Println("        rolled back and kept as NAME.conf.rejected. Emptying a snippet")
+		fmt.Println("        removes it.")
+		fmt.Println()
+		fmt.Println("Optional Flags:")
+		fmt.Println("  --http")
+		fmt.Println("        Edit an http level snippet (maps, upstreams) instead of one included")
+		fmt.Println("        in the server blocks")
+		fmt.Println("  --debug")
+		fmt.Println("        Enable debug mode")
+		fmt.Println()
+		fmt.Println("Snippet directories:")
+		fmt.Println("  /etc/svp/sites/DOMAIN.d/server/*.conf  included in each server block of")
+		fmt.Println("                                         the site, HTTP and HTTPS")
+		fmt.Println("  /etc/svp/sites/DOMAIN.d/http/*.conf    included at http level")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  svp nginx edit example.com")
+		fmt.Println("  svp nginx edit example.com redirects")
+		fmt.Println("  svp nginx edit example.com maps --http")
+		fmt.Println()
+		fmt.Printf("Documentation: %s\n", documentationURL)
+	}
+
+	// Check if help is requested or the action is missing
+	if len(os.Args) < 3 || os.Args[2] == "--help" || os.Args[2] == "-help" {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	cfg.NginxAction = os.Args[2]
+	args := os.Args[3:]
+	var positional []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	fs.Parse(args)
+
+	// Enable debug mode if requested
+	if cfg.Debug {
+		os.Setenv("DEBUG", "1")
+		fmt.Println("DEBUG MODE ENABLED")
+	}
+
+	switch {
+	case cfg.NginxAction == "edit" && (len(positional) == 1 || len(positional) == 2):
+		cfg.PrimaryDomain = positional[0]
+		cfg.NginxSnippet = "custom"
+		if len(positional) == 2 {
+			cfg.NginxSnippet = positional[1]
+		}
+	default:
+		utils.Err("Invalid nginx arguments")
+		fmt.Println("\nUsage: svp nginx edit DOMAIN [NAME] [--http]")
+		fmt.Println("Run 'svp nginx --help' for more information")
+		os.Exit(1)
+	}
+
+	if err := cmd.Nginx(cfg); err != nil {
+		utils.Err("Nginx %s failed: %v", cfg.NginxAction, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,400 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"svp/pkg/utils"
+	"svp/types"
+	"time"
+)
+
+// Root holds one directory per site with its backup sets
+const Root = "/var/backups/svp"
+
+// FormatVersion is the backup set layout version written to manifest.json.
+// Version 2 added age-encrypted archives.
+const FormatVersion = 2
+
+// TimeFormat names backup set directories, e.g. 20240131-030000
+const TimeFormat = "20060102-150405"
+
+// Backup set layout (/var/backups/svp/DOMAIN/TIMESTAMP/):
+//
+//	manifest.json     Manifest with checksums of the files below
+//	database.sql.gz   Database dump
+//	uploads.tar.zst   Upload directories, relative to the site directory
+//	config.tar.zst    svp site config and credentials, nginx vhost, PHP-FPM pool
+//
+// Encrypted sets carry the archives with an .age suffix.
+const (
+	ManifestFile = "manifest.json"
+	DatabaseFile = "database.sql.gz"
+	UploadsFile  = "uploads.tar.zst"
+	ConfigFile   = "config.tar.zst"
+)
+
+// FileInfo records a file of a backup set
+type FileInfo struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest describes a backup set. It is written last, so a set without
+// a manifest is incomplete.
+type Manifest struct {
+	FormatVersion int        `json:"format_version"`
+	Domain        string     `json:"domain"`
+	CMS           string     `json:"cms"`
+	PHPVersion    string     `json:"php_version"`
+	Webroot       string     `json:"webroot"`
+	SiteDir       string     `json:"site_dir"`
+	Database      string     `json:"database,omitempty"`  // database name
+	DBEngine      string     `json:"db_engine,omitempty"` // mariadb or postgresql
+	Uploads       []string   `json:"uploads,omitempty"`   // relative to the site directory
+	Files         []FileInfo `json:"files"`
+	Size          int64      `json:"size"`
+	Host          string     `json:"host"`
+	Created       string     `json:"created"`
+	Encrypted     bool       `json:"encrypted,omitempty"` // archives are age-encrypted
+	Reason        string     `json:"reason,omitempty"`    // snapshots: the command that took it
+}
+
+// Set is a backup set, local or on an offsite target
+type Set struct {
+	ID       string // directory name (timestamp)
+	Domain   string
+	Dir      string // local sets only
+	Time     time.Time
+	Manifest *Manifest // nil for incomplete and remote sets
+	Complete bool      // the manifest was written, so all files are present
+}
+
+// SiteDir returns the directory holding the backup sets of a site
+func SiteDir(domain string) string {
+	return filepath.Join(Root, domain)
+}
+
+// NewSetDir creates the directory for a new backup set of a site
+func NewSetDir(domain string, t time.Time) (string, error) {
+	return newSetDirIn(Root, domain, t)
+}
+
+// newSetDirIn creates ROOT/DOMAIN/TIMESTAMP, keeping root private
+func newSetDirIn(root, domain string, t time.Time) (string, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", root, err)
+	}
+	_ = os.Chmod(root, 0700)
+
+	dir := filepath.Join(root, domain, t.Format(TimeFormat))
+	if utils.CheckDirExists(dir) {
+		return "", fmt.Errorf("backup set already exists: %s", dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %v", err)
+	}
+	return dir, nil
+}
+
+// ArchivePaths writes paths (relative to baseDir) to a zstd-compressed tar
+func ArchivePaths(outFile, baseDir string, paths []string) error {
+	args := append([]string{"--zstd", "-cf", outFile, "-C", baseDir}, paths...)
+	if _, err := utils.RunCommand("tar", args...); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Base(outFile), err)
+	}
+	_ = os.Chmod(outFile, 0600)
+	return nil
+}
+
+// Finalize records size and checksum of every file in the set and writes
+// the manifest, marking the set complete
+func Finalize(dir string, m *Manifest) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read backup directory: %v", err)
+	}
+
+	m.FormatVersion = FormatVersion
+	m.Files = nil
+	m.Size = 0
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == ManifestFile {
+			continue
+		}
+		info, err := fileInfo(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, *info)
+		m.Size += info.Size
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ManifestFile), append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest of a backup set
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("incomplete backup set (manifest.json missing): %s", dir)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	if m.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("backup format %d is newer than this svp supports (%d) - update svp first", m.FormatVersion, FormatVersion)
+	}
+	return &m, nil
+}
+
+// FindSet resolves a backup set given as an ID of the site or a directory
+func FindSet(domain, from string) (string, *Manifest, error) {
+	dir := from
+	if !utils.CheckDirExists(dir) {
+		if _, err := time.Parse(TimeFormat, from); err != nil {
+			return "", nil, fmt.Errorf("backup set not found: %s", from)
+		}
+		dir = filepath.Join(SiteDir(domain), from)
+		if !utils.CheckDirExists(dir) {
+			return "", nil, fmt.Errorf("backup set not found: %s", dir)
+		}
+	}
+
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	if m.Domain != domain {
+		return "", nil, fmt.Errorf("backup set %s belongs to %s, not %s", dir, m.Domain, domain)
+	}
+	return dir, m, nil
+}
+
+// LatestSet returns the newest complete backup set of a site
+func LatestSet(domain string) (*Set, error) {
+	sets, err := ListSets(domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range sets {
+		if set.Complete {
+			return set, nil
+		}
+	}
+	return nil, fmt.Errorf("no complete backup set of %s in %s", domain, SiteDir(domain))
+}
+
+// TestArchive reads a plaintext archive of a set end to end: gzip dumps
+// with gzip -t, zstd tarballs by listing them
+func TestArchive(path string) error {
+	var err error
+	if filepath.Ext(path) == ".gz" {
+		_, err = utils.RunCommand("gzip", "-t", path)
+	} else {
+		_, err = utils.RunShell(fmt.Sprintf("tar --zstd -tf %s > /dev/null", path))
+	}
+	if err != nil {
+		return fmt.Errorf("%s is damaged: %v", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// VerifyChecksums checks every file of a set against its manifest
+func VerifyChecksums(dir string, m *Manifest) error {
+	for _, file := range m.Files {
+		info, err := fileInfo(filepath.Join(dir, file.Name))
+		if err != nil {
+			return err
+		}
+		if info.Size != file.Size || info.SHA256 != file.SHA256 {
+			return fmt.Errorf("checksum mismatch: %s is damaged", file.Name)
+		}
+	}
+	return nil
+}
+
+// FileName returns the name of an archive in the set, with the .age
+// suffix if the set is encrypted
+func (m *Manifest) FileName(name string) string {
+	if m.Encrypted {
+		return name + EncryptedSuffix
+	}
+	return name
+}
+
+// Engine returns the database engine of the dump. Sets written before
+// PostgreSQL support hold MariaDB dumps.
+func (m *Manifest) Engine() string {
+	if m.DBEngine == "" {
+		return "mariadb"
+	}
+	return m.DBEngine
+}
+
+// HasFile reports whether a set contains an archive
+func (m *Manifest) HasFile(name string) bool {
+	for _, file := range m.Files {
+		if file.Name == m.FileName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListSets returns the backup sets of a site, newest first
+func ListSets(domain string) ([]*Set, error) {
+	return listSetsIn(Root, domain)
+}
+
+// listSetsIn lists the sets of a site below root (ROOT/DOMAIN/TIMESTAMP)
+func listSetsIn(root, domain string) ([]*Set, error) {
+	siteDir := filepath.Join(root, domain)
+	entries, err := os.ReadDir(siteDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read backups of %s: %v", domain, err)
+	}
+
+	var sets []*Set
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		set := newSet(domain, entry.Name())
+		if set == nil {
+			continue
+		}
+		set.Dir = filepath.Join(siteDir, entry.Name())
+		set.Manifest, _ = ReadManifest(set.Dir)
+		set.Complete = set.Manifest != nil
+		sets = append(sets, set)
+	}
+
+	sortSets(sets)
+	return sets, nil
+}
+
+// newSet returns a set for a timestamp ID, or nil if id is not one
+func newSet(domain, id string) *Set {
+	t, err := time.ParseInLocation(TimeFormat, id, time.Local)
+	if err != nil {
+		return nil
+	}
+	return &Set{ID: id, Domain: domain, Time: t}
+}
+
+// sortSets orders sets newest first
+func sortSets(sets []*Set) {
+	sort.Slice(sets, func(i, j int) bool { return sets[i].Time.After(sets[j].Time) })
+}
+
+// IncompleteGrace is how long an incomplete set is left alone: it may be
+// one that another backup run is still writing or uploading
+const IncompleteGrace = 24 * time.Hour
+
+// Retained selects the sets to keep: the newest complete set of each of the
+// last KeepDaily days, KeepWeekly ISO weeks and KeepMonthly months. The
+// newest complete set is always kept, and so are incomplete sets started
+// less than IncompleteGrace before now. sets must be sorted newest first.
+func Retained(sets []*Set, keep *types.BackupConfig, now time.Time) map[string]bool {
+	retained := make(map[string]bool)
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	months := make(map[string]bool)
+	newest := ""
+
+	for _, set := range sets {
+		if !set.Complete {
+			if now.Sub(set.Time) < IncompleteGrace {
+				retained[set.ID] = true
+			}
+			continue
+		}
+		if newest == "" {
+			newest = set.ID
+			retained[set.ID] = true
+		}
+
+		day := set.Time.Format("2006-01-02")
+		if !days[day] && len(days) < keep.KeepDaily {
+			days[day] = true
+			retained[set.ID] = true
+		}
+
+		year, week := set.Time.ISOWeek()
+		weekKey := fmt.Sprintf("%d-W%02d", year, week)
+		if !weeks[weekKey] && len(weeks) < keep.KeepWeekly {
+			weeks[weekKey] = true
+			retained[set.ID] = true
+		}
+
+		month := set.Time.Format("2006-01")
+		if !months[month] && len(months) < keep.KeepMonthly {
+			months[month] = true
+			retained[set.ID] = true
+		}
+	}
+
+	return retained
+}
+
+// Prune removes the sets of a site that fall outside the retention policy,
+// including incomplete sets left by failed runs once they are older than
+// IncompleteGrace. It returns the removed IDs.
+func Prune(domain string, keep *types.BackupConfig) ([]string, error) {
+	sets, err := ListSets(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	retained := Retained(sets, keep, time.Now())
+	var removed []string
+	for _, set := range sets {
+		if retained[set.ID] {
+			continue
+		}
+		if err := os.RemoveAll(set.Dir); err != nil {
+			return removed, fmt.Errorf("failed to remove backup set %s: %v", set.Dir, err)
+		}
+		removed = append(removed, set.ID)
+	}
+	return removed, nil
+}
+
+func fileInfo(path string) (*FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum %s: %v", path, err)
+	}
+
+	return &FileInfo{
+		Name:   filepath.Base(path),
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"sort"
+	"strings"
+	"svp/types"
+	"testing"
+	"time"
+)
+
+// testSets returns sets for the given IDs, newest first. IDs ending in "!"
+// are incomplete sets.
+func testSets(t *testing.T, ids ...string) []*Set {
+	var sets []*Set
+	for _, id := range ids {
+		complete := !strings.HasSuffix(id, "!")
+		set := newSet("example.com", strings.TrimSuffix(id, "!"))
+		if set == nil {
+			t.Fatalf("bad set ID %q", id)
+		}
+		set.Complete = complete
+		sets = append(sets, set)
+	}
+	sortSets(sets)
+	return sets
+}
+
+func TestRetained(t *testing.T) {
+	now := time.Date(2026, 3, 15, 12, 0, 0, 0, time.Local)
+	sets := []string{
+		"20260315-113000!", // still being written
+		"20260315-030000",
+		"20260314-030000",
+		"20260313-030000",
+		"20260310-030000!", // left by a failed run
+		"20260308-030000",
+		"20260301-030000",
+		"20260228-030000",
+		"20260131-030000",
+	}
+
+	tests := []struct {
+		name string
+		sets []string
+		keep types.BackupConfig
+		want []string
+	}{
+		{
+			name: "daily",
+			sets: sets,
+			keep: types.BackupConfig{KeepDaily: 2},
+			want: []string{"20260314-030000", "20260315-030000", "20260315-113000"},
+		},
+		{
+			name: "weekly",
+			sets: sets,
+			keep: types.BackupConfig{KeepDaily: 1, KeepWeekly: 3},
+			want: []string{"20260301-030000", "20260308-030000", "20260315-030000", "20260315-113000"},
+		},
+		{
+			name: "monthly",
+			sets: sets,
+			keep: types.BackupConfig{KeepMonthly: 3},
+			want: []string{"20260131-030000", "20260228-030000", "20260315-030000", "20260315-113000"},
+		},
+		{
+			name: "newest complete always kept",
+			sets: sets,
+			keep: types.BackupConfig{},
+			want: []string{"20260315-030000", "20260315-113000"},
+		},
+		{
+			name: "newest day keeps its newest set",
+			sets: []string{"20260315-030000", "20260315-020000", "20260314-030000"},
+			keep: types.BackupConfig{KeepDaily: 7},
+			want: []string{"20260314-030000", "20260315-030000"},
+		},
+		{
+			name: "only old incomplete sets",
+			sets: []string{"20260314-030000!", "20260313-030000!"},
+			keep: types.BackupConfig{KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 12},
+			want: nil,
+		},
+		{
+			name: "incomplete within grace period",
+			sets: []string{"20260314-130000!", "20260314-110000!"},
+			keep: types.BackupConfig{KeepDaily: 7},
+			want: []string{"20260314-130000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retained := Retained(testSets(t, tt.sets...), &tt.keep, now)
+			var got []string
+			for id := range retained {
+				got = append(got, id)
+			}
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
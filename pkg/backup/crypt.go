@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"svp/pkg/utils"
+)
+
+// EncryptedSuffix is appended to archives encrypted with age
+const EncryptedSuffix = ".age"
+
+// CheckRecipient validates an age recipient (an age1... key or an SSH
+// public key) by encrypting an empty input to it
+func CheckRecipient(recipient string) error {
+	if _, err := utils.RunCommandWithInput("", "age", "-r", recipient, "-o", "/dev/null"); err != nil {
+		return fmt.Errorf("invalid recipient %q: %v", recipient, err)
+	}
+	return nil
+}
+
+// EncryptFile encrypts a file to the recipients in recipientsFile and
+// removes the plaintext. It returns the path of the encrypted file.
+func EncryptFile(path, recipientsFile string) (string, error) {
+	encrypted := path + EncryptedSuffix
+	if _, err := utils.RunCommand("age", "-R", recipientsFile, "-o", encrypted, path); err != nil {
+		_ = os.Remove(encrypted)
+		return "", fmt.Errorf("failed to encrypt %s: %v", filepath.Base(path), err)
+	}
+	_ = os.Chmod(encrypted, 0600)
+
+	if err := os.Remove(path); err != nil {
+		return "", fmt.Errorf("failed to remove plaintext %s: %v", filepath.Base(path), err)
+	}
+	return encrypted, nil
+}
+
+// DecryptSet decrypts every archive of an encrypted set into destDir,
+// under its plaintext name. age authenticates its payload, so a set that
+// decrypts completely is intact and readable with the identity.
+func DecryptSet(dir string, m *Manifest, identityFile, destDir string) error {
+	if !utils.CheckFileExists(identityFile) {
+		return fmt.Errorf("identity file not found: %s", identityFile)
+	}
+
+	for _, file := range m.Files {
+		if !strings.HasSuffix(file.Name, EncryptedSuffix) {
+			continue
+		}
+		out := filepath.Join(destDir, strings.TrimSuffix(file.Name, EncryptedSuffix))
+		if _, err := utils.RunCommand("age", "-d", "-i", identityFile, "-o", out, filepath.Join(dir, file.Name)); err != nil {
+			return fmt.Errorf("failed to decrypt %s: %v", file.Name, err)
+		}
+		_ = os.Chmod(out, 0600)
+		utils.Verify("%s decrypts", file.Name)
+	}
+	return nil
+}
@@ -0,0 +1,503 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"svp/types"
+	"time"
+)
+
+// Files larger than one part are uploaded with multipart upload. S3 needs
+// at least 5 MiB per part and allows 10,000 parts.
+const (
+	s3PartSize   = 16 * 1024 * 1024
+	s3MaxRetries = 3
+)
+
+// s3Target talks to S3-compatible object storage (AWS, MinIO, Backblaze B2,
+// Wasabi, ...) with Signature Version 4. Every request body is signed with
+// its SHA-256 and carries a Content-MD5, so the server rejects corrupted
+// uploads.
+type s3Target struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3InitiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+func newS3Target(t *types.BackupTarget) (Target, error) {
+	if t.Endpoint == "" || t.Bucket == "" {
+		return nil, fmt.Errorf("s3 backup target %s needs an endpoint and a bucket", t.Name)
+	}
+	if t.AccessKey == "" || t.SecretKey == "" {
+		return nil, fmt.Errorf("s3 backup target %s has no credentials", t.Name)
+	}
+
+	endpoint := t.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint %s: %v", t.Endpoint, err)
+	}
+
+	region := t.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3Target{
+		endpoint:  u,
+		region:    region,
+		bucket:    t.Bucket,
+		prefix:    strings.Trim(t.Path, "/"),
+		accessKey: t.AccessKey,
+		secretKey: t.SecretKey,
+		pathStyle: t.PathStyle,
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+// key returns the object key for a path below the target prefix
+func (s *s3Target) key(parts ...string) string {
+	if s.prefix != "" {
+		parts = append([]string{s.prefix}, parts...)
+	}
+	return path.Join(parts...)
+}
+
+func (s *s3Target) Upload(set *Set) error {
+	files, err := uploadOrder(set)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		localPath := filepath.Join(set.Dir, file.Name)
+		key := s.key(set.Domain, set.ID, file.Name)
+		if file.Size > s3PartSize {
+			err = s.putMultipart(localPath, key, file)
+		} else {
+			err = s.putObject(localPath, key, file)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %v", file.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *s3Target) putObject(localPath, key string, file FileInfo) error {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{"x-amz-meta-sha256": file.SHA256}
+	_, err = s.requestWithRetry("PUT", key, nil, data, headers)
+	return err
+}
+
+func (s *s3Target) putMultipart(localPath, key string, file FileInfo) error {
+	body, err := s.requestWithRetry("POST", key, url.Values{"uploads": {""}}, nil, map[string]string{"x-amz-meta-sha256": file.SHA256})
+	if err != nil {
+		return err
+	}
+	var initiated s3InitiateResult
+	if err := xml.Unmarshal(body, &initiated); err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("invalid CreateMultipartUpload response: %s", body)
+	}
+	uploadID := initiated.UploadID
+
+	parts, err := s.uploadParts(localPath, key, uploadID)
+	if err != nil {
+		// Unfinished uploads are billed until aborted
+		_, _ = s.request("DELETE", key, url.Values{"uploadId": {uploadID}}, nil, nil)
+		return err
+	}
+
+	complete, err := xml.Marshal(s3CompleteUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	body, err = s.requestWithRetry("POST", key, url.Values{"uploadId": {uploadID}}, complete, nil)
+	if err != nil {
+		_, _ = s.request("DELETE", key, url.Values{"uploadId": {uploadID}}, nil, nil)
+		return err
+	}
+	// CompleteMultipartUpload can fail with status 200 and an error body
+	if bytes.Contains(body, []byte("<Error>")) {
+		return parseS3Error(http.StatusOK, body)
+	}
+	return nil
+}
+
+func (s *s3Target) uploadParts(localPath, key, uploadID string) ([]s3CompletePart, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var parts []s3CompletePart
+	buf := make([]byte, s3PartSize)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(f, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {uploadID}}
+		resp, err := s.doWithRetry("PUT", key, query, buf[:n], nil)
+		if err != nil {
+			return nil, fmt.Errorf("part %d: %v", number, err)
+		}
+		parts = append(parts, s3CompletePart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		if n < s3PartSize {
+			break
+		}
+	}
+	return parts, nil
+}
+
+func (s *s3Target) List(domain string) ([]*Set, error) {
+	sitePrefix := s.key(domain) + "/"
+	keys, err := s.listKeys(sitePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups of %s: %v", domain, err)
+	}
+
+	found := make(map[string]*Set)
+	for _, key := range keys {
+		id, name, ok := strings.Cut(strings.TrimPrefix(key, sitePrefix), "/")
+		if !ok {
+			continue
+		}
+		set := found[id]
+		if set == nil {
+			if set = newSet(domain, id); set == nil {
+				continue
+			}
+			found[id] = set
+		}
+		if name == ManifestFile {
+			set.Complete = true
+		}
+	}
+
+	var sets []*Set
+	for _, set := range found {
+		sets = append(sets, set)
+	}
+	sortSets(sets)
+	return sets, nil
+}
+
+func (s *s3Target) Delete(domain, id string) error {
+	keys, err := s.listKeys(s.key(domain, id) + "/")
+	if err != nil {
+		return fmt.Errorf("failed to list backup set %s: %v", id, err)
+	}
+
+	// The manifest goes first, so a partly deleted set counts as incomplete
+	isManifest := func(i int) bool { return strings.HasSuffix(keys[i], "/"+ManifestFile) }
+	sort.SliceStable(keys, func(i, j int) bool { return isManifest(i) && !isManifest(j) })
+	for _, key := range keys {
+		if _, err := s.requestWithRetry("DELETE", key, nil, nil, nil); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// listKeys returns all object keys below prefix, following ListObjectsV2
+// pagination
+func (s *s3Target) listKeys(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := s.requestWithRetry("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("invalid ListObjectsV2 response: %v", err)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Target) Check() error {
+	key := s.key(".svp-check")
+	if _, err := s.requestWithRetry("PUT", key, nil, []byte("ok\n"), nil); err != nil {
+		return err
+	}
+	_, err := s.requestWithRetry("DELETE", key, nil, nil, nil)
+	return err
+}
+
+// requestWithRetry sends a request and returns the response body
+func (s *s3Target) requestWithRetry(method, key string, query url.Values, body []byte, headers map[string]string) ([]byte, error) {
+	resp, err := s.doWithRetry(method, key, query, body, headers)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// doWithRetry retries network errors and 5xx responses with backoff. The
+// returned response body is already buffered.
+func (s *s3Target) doWithRetry(method, key string, query url.Values, body []byte, headers map[string]string) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt < s3MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt*attempt) * time.Second)
+		}
+		resp, respBody, err := s.do(method, key, query, body, headers)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			lastErr = parseS3Error(resp.StatusCode, respBody)
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return nil, parseS3Error(resp.StatusCode, respBody)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// request sends a single request without retries
+func (s *s3Target) request(method, key string, query url.Values, body []byte, headers map[string]string) ([]byte, error) {
+	resp, respBody, err := s.do(method, key, query, body, headers)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, parseS3Error(resp.StatusCode, respBody)
+	}
+	return respBody, nil
+}
+
+func (s *s3Target) do(method, key string, query url.Values, body []byte, headers map[string]string) (*http.Response, []byte, error) {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket
+		if key != "" {
+			u.Path += "/" + key
+		}
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, respBody, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header
+func (s *s3Target) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	// Host and every x-amz-* and content header are signed
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-md5" || lower == "content-type" {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var names []string
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, signed[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func parseS3Error(status int, body []byte) error {
+	var e s3Error
+	if err := xml.Unmarshal(body, &e); err == nil && e.Code != "" {
+		return fmt.Errorf("s3 error %d %s: %s", status, e.Code, e.Message)
+	}
+	return fmt.Errorf("s3 error %d: %s", status, strings.TrimSpace(string(body)))
+}
+
+// s3EscapePath URI-encodes each path segment as SigV4 requires
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery encodes query parameters sorted by name
+func s3CanonicalQuery(query url.Values) string {
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, s3Escape(name)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything except unreserved characters
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
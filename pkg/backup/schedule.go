@@ -0,0 +1,134 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"svp/pkg/utils"
+)
+
+var timerCalendar = regexp.MustCompile(`(?m)^OnCalendar=(.+)$`)
+
+// TimerName returns the systemd unit name (without suffix) of a site's
+// scheduled backup
+func TimerName(domain string) string {
+	return fmt.Sprintf("svp-backup-%s", domain)
+}
+
+// DailyCalendar converts HH:MM into a systemd OnCalendar expression
+func DailyCalendar(hhmm string) (string, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(hhmm, "%d:%d", &hour, &minute); err != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return "", fmt.Errorf("invalid time: %s (use HH:MM, e.g. 03:00)", hhmm)
+	}
+	return fmt.Sprintf("*-*-* %02d:%02d:00", hour, minute), nil
+}
+
+// InstallSchedule writes and starts a systemd service and timer pair that
+// runs 'svp backup DOMAIN' on the given calendar, followed by a trial
+// restore of the new set with verify
+func InstallSchedule(domain, onCalendar, svpPath string, verify bool) error {
+	name := TimerName(domain)
+	serviceFile := fmt.Sprintf("/etc/systemd/system/%s.service", name)
+	timerFile := fmt.Sprintf("/etc/systemd/system/%s.timer", name)
+
+	// Reject expressions systemd cannot parse before installing anything
+	if _, err := utils.RunCommand("systemd-analyze", "calendar", onCalendar); err != nil {
+		return fmt.Errorf("invalid schedule %q: %v", onCalendar, err)
+	}
+
+	// A oneshot service runs ExecStart lines in order and stops at the
+	// first failure, so a failed backup is not verified
+	execStart := fmt.Sprintf("ExecStart=%s backup %s", svpPath, domain)
+	if verify {
+		execStart += fmt.Sprintf("\nExecStart=%s backup verify %s", svpPath, domain)
+	}
+
+	serviceContent := fmt.Sprintf(`[Unit]
+Description=svp backup of %s
+After=network-online.target mariadb.service
+Wants=network-online.target
+
+[Service]
+Type=oneshot
+%s
+Nice=10
+IOSchedulingClass=best-effort
+IOSchedulingPriority=7
+StandardOutput=journal
+StandardError=journal
+SyslogIdentifier=%s
+Environment=PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin
+`, domain, execStart, name)
+
+	timerContent := fmt.Sprintf(`[Unit]
+Description=Scheduled svp backup of %s
+
+[Timer]
+OnCalendar=%s
+RandomizedDelaySec=300
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`, domain, onCalendar)
+
+	utils.Log("Creating systemd service: %s", serviceFile)
+	if err := os.WriteFile(serviceFile, []byte(serviceContent), 0644); err != nil {
+		return fmt.Errorf("failed to write systemd service file: %v", err)
+	}
+	utils.Log("Creating systemd timer: %s", timerFile)
+	if err := os.WriteFile(timerFile, []byte(timerContent), 0644); err != nil {
+		return fmt.Errorf("failed to write systemd timer file: %v", err)
+	}
+
+	utils.Log("Reloading systemd daemon...")
+	if _, err := utils.RunCommand("systemctl", "daemon-reload"); err != nil {
+		return fmt.Errorf("failed to reload systemd: %v", err)
+	}
+
+	utils.Log("Enabling timer %s...", name)
+	if _, err := utils.RunCommand("systemctl", "enable", "--now", name+".timer"); err != nil {
+		return fmt.Errorf("failed to enable timer: %v", err)
+	}
+	// Pick up a changed OnCalendar on an already running timer
+	_, _ = utils.RunCommand("systemctl", "restart", name+".timer")
+
+	return nil
+}
+
+// RemoveSchedule stops and deletes a site's backup timer and service
+func RemoveSchedule(domain string) error {
+	name := TimerName(domain)
+	if _, ok := ReadSchedule(domain); !ok {
+		utils.Skip("No backup schedule for %s", domain)
+		return nil
+	}
+
+	_, _ = utils.RunCommand("systemctl", "disable", "--now", name+".timer")
+	for _, suffix := range []string{".timer", ".service"} {
+		unitFile := fmt.Sprintf("/etc/systemd/system/%s%s", name, suffix)
+		if err := os.Remove(unitFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", unitFile, err)
+		}
+	}
+
+	if _, err := utils.RunCommand("systemctl", "daemon-reload"); err != nil {
+		return fmt.Errorf("failed to reload systemd: %v", err)
+	}
+	return nil
+}
+
+// ReadSchedule returns the OnCalendar expression of a site's backup timer
+func ReadSchedule(domain string) (string, bool) {
+	content, err := os.ReadFile(fmt.Sprintf("/etc/systemd/system/%s.timer", TimerName(domain)))
+	if err != nil {
+		return "", false
+	}
+	match := timerCalendar.FindStringSubmatch(string(content))
+	if match == nil {
+		return "", false
+	}
+	return strings.TrimSpace(match[1]), true
+}
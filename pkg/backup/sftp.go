@@ -0,0 +1,154 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"svp/pkg/utils"
+	"svp/types"
+)
+
+// sftpTarget uploads sets with the OpenSSH sftp client in batch mode. It
+// needs key-based login and works with SFTP-only (chrooted) accounts.
+type sftpTarget struct {
+	host     string // user@host
+	port     string
+	identity string
+	path     string
+}
+
+func newSFTPTarget(t *types.BackupTarget) (Target, error) {
+	if t.Host == "" {
+		return nil, fmt.Errorf("sftp backup target %s has no host", t.Name)
+	}
+	target := &sftpTarget{host: t.Host, port: t.Port, identity: t.IdentityFile, path: t.Path}
+	if t.User != "" {
+		target.host = t.User + "@" + t.Host
+	}
+	if target.port == "" {
+		target.port = "22"
+	}
+	if target.path == "" {
+		target.path = "."
+	}
+	return target, nil
+}
+
+// batch runs sftp commands; a leading "-" lets a command fail without
+// aborting the batch
+func (s *sftpTarget) batch(commands []string) (string, error) {
+	args := []string{"-b", "-", "-P", s.port, "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=accept-new"}
+	if s.identity != "" {
+		args = append(args, "-i", s.identity)
+	}
+	args = append(args, s.host)
+
+	out, err := utils.RunCommandWithInput(strings.Join(commands, "\n")+"\n", "sftp", args...)
+	if err != nil {
+		return "", fmt.Errorf("sftp to %s failed: %v", s.host, err)
+	}
+
+	// Batch mode echoes each command as "sftp> ..."
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "sftp>") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (s *sftpTarget) Upload(set *Set) error {
+	files, err := uploadOrder(set)
+	if err != nil {
+		return err
+	}
+
+	siteDir := path.Join(s.path, set.Domain)
+	setDir := path.Join(siteDir, set.ID)
+	commands := []string{"-mkdir " + quoteSFTP(s.path), "-mkdir " + quoteSFTP(siteDir), "-mkdir " + quoteSFTP(setDir)}
+	for _, file := range files {
+		remote := path.Join(setDir, file.Name)
+		commands = append(commands,
+			fmt.Sprintf("put %s %s", quoteSFTP(filepath.Join(set.Dir, file.Name)), quoteSFTP(remote+".part")),
+			fmt.Sprintf("rename %s %s", quoteSFTP(remote+".part"), quoteSFTP(remote)))
+	}
+	commands = append(commands, "ls -ln "+quoteSFTP(setDir))
+
+	out, err := s.batch(commands)
+	if err != nil {
+		return err
+	}
+
+	// SSH protects the transfer itself; the sizes catch truncated files
+	sizes := make(map[string]int64)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 9 {
+			continue
+		}
+		if size, err := strconv.ParseInt(fields[4], 10, 64); err == nil {
+			sizes[path.Base(fields[len(fields)-1])] = size
+		}
+	}
+	for _, file := range files {
+		if size, ok := sizes[file.Name]; !ok || size != file.Size {
+			return fmt.Errorf("size mismatch after uploading %s (local %d, remote %d)", file.Name, file.Size, size)
+		}
+	}
+	return nil
+}
+
+func (s *sftpTarget) List(domain string) ([]*Set, error) {
+	siteDir := path.Join(s.path, domain)
+	out, err := s.batch([]string{
+		"-ls -1 " + quoteSFTP(siteDir),
+		"-ls -1 " + quoteSFTP(siteDir+"/*/"+ManifestFile),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]*Set)
+	complete := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasSuffix(line, "/"+ManifestFile) {
+			complete[path.Base(path.Dir(line))] = true
+			continue
+		}
+		id := path.Base(line)
+		if set := newSet(domain, id); set != nil {
+			found[id] = set
+		}
+	}
+
+	var sets []*Set
+	for id, set := range found {
+		set.Complete = complete[id]
+		sets = append(sets, set)
+	}
+	sortSets(sets)
+	return sets, nil
+}
+
+func (s *sftpTarget) Delete(domain, id string) error {
+	setDir := path.Join(s.path, domain, id)
+	_, err := s.batch([]string{"-rm " + quoteSFTP(setDir+"/*"), "rmdir " + quoteSFTP(setDir)})
+	if err != nil {
+		return fmt.Errorf("failed to remove backup set %s: %v", id, err)
+	}
+	return nil
+}
+
+func (s *sftpTarget) Check() error {
+	probe := path.Join(s.path, ".svp-check")
+	_, err := s.batch([]string{"-mkdir " + quoteSFTP(s.path), "put /dev/null " + quoteSFTP(probe), "rm " + quoteSFTP(probe)})
+	return err
+}
+
+// quoteSFTP quotes a path for an sftp batch command
+func quoteSFTP(p string) string {
+	return `"` + strings.ReplaceAll(p, `"`, `\"`) + `"`
+}
@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SnapshotRoot holds the safety snapshots svp takes before destructive
+// operations, one directory per site like Root
+const SnapshotRoot = "/var/backups/svp-snapshots"
+
+// SiteFile is the archive of the whole site directory in a snapshot, taken
+// when the operation may delete the site's files. It is stored relative to
+// the parent of the site directory.
+const SiteFile = "site.tar.zst"
+
+// Snapshots use the backup set layout with a Reason in the manifest and
+// are never encrypted, so an undo needs no private key:
+//
+//	manifest.json     Manifest with checksums of the files below
+//	database.sql.gz   Database dump
+//	config.tar.zst    svp site config and credentials, nginx vhost, PHP-FPM
+//	                  pools and CMS settings files
+//	site.tar.zst      Site directory (optional)
+
+// NewSnapshotDir creates the directory for a new snapshot of a site
+func NewSnapshotDir(domain string, t time.Time) (string, error) {
+	return newSetDirIn(SnapshotRoot, domain, t)
+}
+
+// ListSnapshots returns the snapshots of a site, newest first
+func ListSnapshots(domain string) ([]*Set, error) {
+	return listSetsIn(SnapshotRoot, domain)
+}
+
+// ListAllSnapshots returns the snapshots of every site, newest first
+func ListAllSnapshots() ([]*Set, error) {
+	entries, err := os.ReadDir(SnapshotRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %v", SnapshotRoot, err)
+	}
+
+	var all []*Set
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		sets, err := ListSnapshots(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, sets...)
+	}
+	sortSets(all)
+	return all, nil
+}
+
+// FindSnapshot returns a complete snapshot of a site by ID, or the newest
+// one if id is empty
+func FindSnapshot(domain, id string) (*Set, error) {
+	sets, err := ListSnapshots(domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range sets {
+		switch {
+		case id == "" && set.Complete, id == set.ID && set.Complete:
+			return set, nil
+		case id == set.ID:
+			return nil, fmt.Errorf("incomplete snapshot (manifest.json missing): %s", set.Dir)
+		}
+	}
+	if id != "" {
+		return nil, fmt.Errorf("snapshot not found: %s", filepath.Join(SnapshotRoot, domain, id))
+	}
+	return nil, fmt.Errorf("no snapshots of %s in %s", domain, filepath.Join(SnapshotRoot, domain))
+}
+
+// PruneSnapshots keeps the newest keep complete snapshots of a site and
+// removes the rest, including incomplete ones older than IncompleteGrace.
+// It returns the removed IDs.
+func PruneSnapshots(domain string, keep int) ([]string, error) {
+	sets, err := ListSnapshots(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	kept := 0
+	for _, set := range sets {
+		if set.Complete && kept < keep {
+			kept++
+			continue
+		}
+		if !set.Complete && time.Since(set.Time) < IncompleteGrace {
+			continue
+		}
+		if err := os.RemoveAll(set.Dir); err != nil {
+			return removed, fmt.Errorf("failed to remove snapshot %s: %v", set.Dir, err)
+		}
+		removed = append(removed, set.ID)
+	}
+	return removed, nil
+}
@@ -0,0 +1,146 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StatusFile records the outcome of the last backup run of a site
+const StatusFile = "status.json"
+
+// Status is the last run record of a site's backups
+type Status struct {
+	LastRun     string `json:"last_run"`
+	Result      string `json:"result"` // "ok" or "failed"
+	Error       string `json:"error,omitempty"`
+	LastSuccess string `json:"last_success,omitempty"`
+	LastSet     string `json:"last_set,omitempty"`
+	LastSize    int64  `json:"last_size"`
+
+	// Offsite upload of the last set: "ok", "failed" or empty if no
+	// targets are configured
+	Offsite      string `json:"offsite,omitempty"`
+	OffsiteError string `json:"offsite_error,omitempty"`
+
+	// Last trial restore ('svp backup verify')
+	LastVerify   string `json:"last_verify,omitempty"`
+	VerifyResult string `json:"verify_result,omitempty"` // "ok", "checksums" or "failed"
+	VerifySet    string `json:"verify_set,omitempty"`
+	VerifyError  string `json:"verify_error,omitempty"`
+}
+
+// ReadStatus reads the last run record of a site. It returns nil if the
+// site has never been backed up.
+func ReadStatus(domain string) (*Status, error) {
+	data, err := os.ReadFile(filepath.Join(SiteDir(domain), StatusFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read backup status: %v", err)
+	}
+
+	var status Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("failed to parse backup status: %v", err)
+	}
+	return &status, nil
+}
+
+// RecordStatus updates the last run record of a site. A failed run keeps
+// the details of the last successful one.
+func RecordStatus(domain string, set *Set, runErr error) error {
+	status, _ := ReadStatus(domain)
+	if status == nil {
+		status = &Status{}
+	}
+
+	status.LastRun = time.Now().Format(time.RFC3339)
+	if runErr != nil {
+		status.Result = "failed"
+		status.Error = runErr.Error()
+	} else {
+		status.Result = "ok"
+		status.Error = ""
+		status.LastSuccess = status.LastRun
+		status.LastSet = set.ID
+		if set.Manifest != nil {
+			status.LastSize = set.Manifest.Size
+		}
+	}
+
+	return writeStatus(domain, status)
+}
+
+// RecordOffsite records the outcome of uploading the last set to the
+// offsite targets
+func RecordOffsite(domain string, offsiteErr error) error {
+	status, _ := ReadStatus(domain)
+	if status == nil {
+		status = &Status{}
+	}
+
+	if offsiteErr != nil {
+		status.Offsite = "failed"
+		status.OffsiteError = offsiteErr.Error()
+	} else {
+		status.Offsite = "ok"
+		status.OffsiteError = ""
+	}
+	return writeStatus(domain, status)
+}
+
+// RecordVerify records the outcome of a trial restore of a set.
+// checksumsOnly records a check of an encrypted set without its key, which
+// compared the checksums but restored nothing.
+func RecordVerify(domain, id string, checksumsOnly bool, verifyErr error) error {
+	status, _ := ReadStatus(domain)
+	if status == nil {
+		status = &Status{}
+	}
+
+	status.LastVerify = time.Now().Format(time.RFC3339)
+	status.VerifySet = id
+	switch {
+	case verifyErr != nil:
+		status.VerifyResult = "failed"
+		status.VerifyError = verifyErr.Error()
+	case checksumsOnly:
+		status.VerifyResult = "checksums"
+		status.VerifyError = ""
+	default:
+		status.VerifyResult = "ok"
+		status.VerifyError = ""
+	}
+	return writeStatus(domain, status)
+}
+
+func writeStatus(domain string, status *Status) error {
+	if err := os.MkdirAll(SiteDir(domain), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", SiteDir(domain), err)
+	}
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode backup status: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(SiteDir(domain), StatusFile), append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write backup status: %v", err)
+	}
+	return nil
+}
+
+// LastSuccessAge returns the time since the last successful backup, or
+// false if there is none
+func (s *Status) LastSuccessAge() (time.Duration, bool) {
+	if s == nil || s.LastSuccess == "" {
+		return 0, false
+	}
+	t, err := time.Parse(time.RFC3339, s.LastSuccess)
+	if err != nil {
+		return 0, false
+	}
+	return time.Since(t), true
+}
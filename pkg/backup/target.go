@@ -0,0 +1,164 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"svp/types"
+	"time"
+)
+
+// Target is an offsite destination for backup sets. Sets are stored as
+// PATH/DOMAIN/TIMESTAMP/FILE, the same layout as /var/backups/svp.
+type Target interface {
+	// Upload copies a complete local set. The manifest is uploaded last,
+	// so an interrupted upload leaves an incomplete set behind.
+	Upload(set *Set) error
+
+	// List returns the sets of a site on the target, newest first
+	List(domain string) ([]*Set, error)
+
+	// Delete removes a set from the target
+	Delete(domain, id string) error
+
+	// Check verifies that the target is reachable and writable
+	Check() error
+}
+
+// NewTarget returns the client for a configured backup target
+func NewTarget(t *types.BackupTarget) (Target, error) {
+	switch t.Type {
+	case "s3":
+		return newS3Target(t)
+	case "sftp":
+		return newSFTPTarget(t)
+	case "local":
+		return newLocalTarget(t)
+	default:
+		return nil, fmt.Errorf("unknown backup target type: %s (must be s3, sftp or local)", t.Type)
+	}
+}
+
+// PruneTarget applies the retention policy to the sets of a site on a target
+func PruneTarget(target Target, domain string, keep *types.BackupConfig) ([]string, error) {
+	sets, err := target.List(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	retained := Retained(sets, keep, time.Now())
+	var removed []string
+	for _, set := range sets {
+		if retained[set.ID] {
+			continue
+		}
+		if err := target.Delete(domain, set.ID); err != nil {
+			return removed, err
+		}
+		removed = append(removed, set.ID)
+	}
+	return removed, nil
+}
+
+// uploadOrder returns the files of a local set with the manifest last
+func uploadOrder(set *Set) ([]FileInfo, error) {
+	if set.Manifest == nil {
+		return nil, fmt.Errorf("backup set %s is incomplete", set.ID)
+	}
+
+	files := append([]FileInfo{}, set.Manifest.Files...)
+	manifestInfo, err := fileInfo(filepath.Join(set.Dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	return append(files, *manifestInfo), nil
+}
+
+// localTarget copies sets to a directory, e.g. a mounted network share or
+// a second disk
+type localTarget struct {
+	path string
+}
+
+func newLocalTarget(t *types.BackupTarget) (Target, error) {
+	if !filepath.IsAbs(t.Path) {
+		return nil, fmt.Errorf("local backup target %s needs an absolute path", t.Name)
+	}
+	return &localTarget{path: t.Path}, nil
+}
+
+func (l *localTarget) Upload(set *Set) error {
+	files, err := uploadOrder(set)
+	if err != nil {
+		return err
+	}
+
+	destDir := filepath.Join(l.path, set.Domain, set.ID)
+	if err := os.MkdirAll(destDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", destDir, err)
+	}
+
+	for _, file := range files {
+		dest := filepath.Join(destDir, file.Name)
+		if err := copyFile(filepath.Join(set.Dir, file.Name), dest+".part"); err != nil {
+			return err
+		}
+		// Re-read the copy so a bad disk or share is caught now, not at restore
+		copied, err := fileInfo(dest + ".part")
+		if err != nil {
+			return err
+		}
+		if copied.SHA256 != file.SHA256 {
+			_ = os.Remove(dest + ".part")
+			return fmt.Errorf("checksum mismatch after copying %s", file.Name)
+		}
+		if err := os.Rename(dest+".part", dest); err != nil {
+			return fmt.Errorf("failed to move %s into place: %v", file.Name, err)
+		}
+	}
+	return nil
+}
+
+func (l *localTarget) List(domain string) ([]*Set, error) {
+	return listSetsIn(l.path, domain)
+}
+
+func (l *localTarget) Delete(domain, id string) error {
+	if err := os.RemoveAll(filepath.Join(l.path, domain, id)); err != nil {
+		return fmt.Errorf("failed to remove backup set %s: %v", id, err)
+	}
+	return nil
+}
+
+func (l *localTarget) Check() error {
+	if err := os.MkdirAll(l.path, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", l.path, err)
+	}
+	probe := filepath.Join(l.path, ".svp-check")
+	if err := os.WriteFile(probe, []byte("ok\n"), 0600); err != nil {
+		return fmt.Errorf("%s is not writable: %v", l.path, err)
+	}
+	return os.Remove(probe)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", dest, err)
+	}
+	if _, err := out.ReadFrom(in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to flush %s: %v", dest, err)
+	}
+	return out.Close()
+}
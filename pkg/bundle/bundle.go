@@ -0,0 +1,143 @@
+package bundle
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"svp/pkg/utils"
+)
+
+// FormatVersion is the bundle layout version written to manifest.json
+const FormatVersion = 1
+
+// Bundle layout (tar archive compressed with zstd):
+//
+//	manifest.json     Manifest describing the site
+//	database.sql      Database dump (if the site has a database)
+//	config/           svp site config, nginx vhost, PHP-FPM pool, .htpasswd
+//	code/             Site directory (full bundles)
+//	uploads/          Upload directories, relative to the site directory (git bundles)
+const (
+	ManifestFile = "manifest.json"
+	DatabaseFile = "database.sql"
+	ConfigDir    = "config"
+	CodeDir      = "code"
+	UploadsDir   = "uploads"
+)
+
+// GitSource records where the codebase of a git bundle comes from
+type GitSource struct {
+	Remote string `json:"remote"`
+	Branch string `json:"branch,omitempty"`
+	Commit string `json:"commit"`
+}
+
+// Manifest describes the site contained in a bundle
+type Manifest struct {
+	FormatVersion   int        `json:"format_version"`
+	Domain          string     `json:"domain"`
+	CMS             string     `json:"cms"`
+	PHPVersion      string     `json:"php_version"`
+	Webroot         string     `json:"webroot"` // relative to the site directory
+	Aliases         []string   `json:"aliases,omitempty"`
+	CanonicalHost   string     `json:"canonical_host,omitempty"`
+	CanonicalPolicy string     `json:"canonical_policy,omitempty"`
+	SSL             bool       `json:"ssl"`
+	Isolated        bool       `json:"isolated"`
+	BasicAuth       bool       `json:"basic_auth"`
+	Code            string     `json:"code"` // "full" or "git"
+	Git             *GitSource `json:"git,omitempty"`
+	Database        string     `json:"database,omitempty"`
+	DBEngine        string     `json:"db_engine,omitempty"` // mariadb (default) or postgresql
+	Uploads         []string   `json:"uploads,omitempty"`   // relative to the site directory
+	SourceHost      string     `json:"source_host"`
+	Created         string     `json:"created"`
+}
+
+// WriteManifest writes manifest.json into dir
+func WriteManifest(dir string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ManifestFile), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// ReadManifest reads manifest.json from an extracted bundle
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("not an svp site bundle (manifest.json missing): %v", err)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+
+	if m.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("bundle format %d is newer than this svp supports (%d) - update svp first", m.FormatVersion, FormatVersion)
+	}
+	if m.Domain == "" || m.CMS == "" {
+		return nil, fmt.Errorf("manifest is missing domain or cms")
+	}
+
+	return &m, nil
+}
+
+// Pack writes the bundle to outFile. stagingDir holds manifest.json,
+// database.sql and config/; siteDir is added as code/ (full bundles) or only
+// its upload directories are added under uploads/ (git bundles).
+func Pack(outFile, stagingDir, siteDir string, fullCode bool, uploads []string) error {
+	tarFile := filepath.Join(stagingDir, "bundle.tar")
+
+	members := []string{ManifestFile, ConfigDir}
+	if utils.CheckFileExists(filepath.Join(stagingDir, DatabaseFile)) {
+		members = append(members, DatabaseFile)
+	}
+	args := append([]string{"-cf", tarFile, "-C", stagingDir}, members...)
+	if _, err := utils.RunCommand("tar", args...); err != nil {
+		return fmt.Errorf("failed to create bundle: %v", err)
+	}
+
+	if fullCode {
+		utils.Log("Adding codebase from %s...", siteDir)
+		transform := fmt.Sprintf("s|^%s|%s|", regexp.QuoteMeta(filepath.Base(siteDir)), CodeDir)
+		_, err := utils.RunCommand("tar", "-rf", tarFile, "-C", filepath.Dir(siteDir), "--transform", transform, filepath.Base(siteDir))
+		if err != nil {
+			return fmt.Errorf("failed to add codebase to bundle: %v", err)
+		}
+	} else if len(uploads) > 0 {
+		utils.Log("Adding upload directories...")
+		args := append([]string{"-rf", tarFile, "-C", siteDir, "--transform", fmt.Sprintf("s|^|%s/|", UploadsDir)}, uploads...)
+		if _, err := utils.RunCommand("tar", args...); err != nil {
+			return fmt.Errorf("failed to add uploads to bundle: %v", err)
+		}
+	}
+
+	utils.Log("Compressing bundle...")
+	if _, err := utils.RunCommand("zstd", "-q", "-f", "-T0", "--rm", tarFile, "-o", outFile); err != nil {
+		return fmt.Errorf("failed to compress bundle: %v", err)
+	}
+
+	return nil
+}
+
+// Unpack extracts a bundle into destDir
+func Unpack(bundleFile, destDir string) error {
+	if !utils.CheckFileExists(bundleFile) {
+		return fmt.Errorf("bundle not found: %s", bundleFile)
+	}
+
+	utils.Log("Extracting %s...", bundleFile)
+	if _, err := utils.RunCommand("tar", "--zstd", "-xpf", bundleFile, "-C", destDir); err != nil {
+		return fmt.Errorf("failed to extract bundle: %v", err)
+	}
+
+	return nil
+}
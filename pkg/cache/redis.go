@@ -0,0 +1,305 @@
+package cache
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"svp/pkg/database"
+	"svp/pkg/system"
+	"svp/pkg/utils"
+	"time"
+)
+
+// Redis server files. svp.conf is included at the end of the Debian
+// redis.conf, so its settings win.
+const (
+	RedisConfigFile = "/etc/redis/redis.conf"
+	RedisSVPConfig  = "/etc/redis/svp.conf"
+	RedisACLFile    = "/etc/redis/users.acl"
+)
+
+// RedisAdminFile holds the password of the ACL user svp manages the server
+// with
+const RedisAdminFile = "/etc/svp/redis-admin.txt"
+
+// Redis listens on the loopback interface only
+const (
+	RedisHost = "127.0.0.1"
+	RedisPort = "6379"
+)
+
+// redisAdminUser is the ACL user of svp itself; the default user is
+// disabled
+const redisAdminUser = "svp-admin"
+
+// redisTimeout bounds connecting to Redis and every command
+const redisTimeout = 5 * time.Second
+
+// InstallRedis installs redis-server and locks it down: loopback only, the
+// default user disabled and one ACL user per site (see WriteRedisUsers)
+func InstallRedis(verifyOnly bool) error {
+	if utils.CheckPackageInstalled("redis-server") {
+		utils.Verify("Redis already installed")
+		if err := system.EnsureServiceRunning("redis-server", verifyOnly); err != nil {
+			return err
+		}
+	} else {
+		if verifyOnly {
+			utils.Fail("Redis not installed")
+			return fmt.Errorf("redis-server not installed")
+		}
+
+		utils.Log("Installing Redis...")
+		if _, err := utils.RunCommand("apt-get", "install", "-y", "redis-server"); err != nil {
+			return fmt.Errorf("failed to install Redis: %v", err)
+		}
+		if err := system.EnableService("redis-server"); err != nil {
+			return err
+		}
+		utils.Ok("Redis installed")
+	}
+
+	config := redisServerConfig()
+	current, _ := os.ReadFile(RedisSVPConfig)
+	mainConfig, err := os.ReadFile(RedisConfigFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", RedisConfigFile, err)
+	}
+	included := strings.Contains(string(mainConfig), "include "+RedisSVPConfig)
+	if string(current) == config && included && utils.CheckFileExists(RedisACLFile) {
+		utils.Verify("Redis hardening in place")
+		return nil
+	}
+	if verifyOnly {
+		utils.Fail("Redis hardening missing or outdated: %s", RedisSVPConfig)
+		return fmt.Errorf("redis is not hardened")
+	}
+
+	utils.Log("Hardening Redis...")
+	if err := os.WriteFile(RedisSVPConfig, []byte(config), 0640); err != nil {
+		return fmt.Errorf("failed to write %s: %v", RedisSVPConfig, err)
+	}
+	_, _ = utils.RunCommand("chown", "redis:redis", RedisSVPConfig)
+	if !included {
+		if err := appendLine(RedisConfigFile, "\n# Managed by svp\ninclude "+RedisSVPConfig+"\n"); err != nil {
+			return fmt.Errorf("failed to include %s: %v", RedisSVPConfig, err)
+		}
+	}
+	if err := writeRedisACL(); err != nil {
+		return err
+	}
+	if err := system.RestartService("redis-server"); err != nil {
+		return err
+	}
+
+	utils.Ok("Redis hardened")
+	return nil
+}
+
+// redisServerConfig returns svp.conf. Redis gets a tenth of the RAM and
+// evicts the least recently used keys when it is full, like a cache should.
+func redisServerConfig() string {
+	maxMemoryMB := 64
+	if ramMB, err := database.TotalMemoryMB(); err == nil && ramMB/10 > maxMemoryMB {
+		maxMemoryMB = ramMB / 10
+	}
+	return fmt.Sprintf(`# Managed by svp - local connections only, one ACL user per site
+bind 127.0.0.1 -::1
+protected-mode yes
+port %s
+aclfile %s
+maxmemory %dmb
+maxmemory-policy allkeys-lru
+`, RedisPort, RedisACLFile, maxMemoryMB)
+}
+
+// WriteRedisUsers rewrites the ACL file from the sites with a Redis cache
+// and makes the running server load it
+func WriteRedisUsers() error {
+	if err := writeRedisACL(); err != nil {
+		return err
+	}
+	adminPass, err := redisAdminPassword()
+	if err != nil {
+		return err
+	}
+	conn, err := dialRedis(redisAdminUser, adminPass)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.do("ACL", "LOAD"); err != nil {
+		return fmt.Errorf("failed to load %s: %v", RedisACLFile, err)
+	}
+	return nil
+}
+
+// writeRedisACL writes the ACL file: the disabled default user, the svp
+// admin and one user per site that may only touch keys under the prefix
+// of its site. Dangerous commands such as FLUSHALL, KEYS and CONFIG are
+// denied to site users.
+func writeRedisACL() error {
+	adminPass, err := redisAdminPassword()
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	b.WriteString("user default off resetkeys resetchannels -@all\n")
+	fmt.Fprintf(&b, "user %s on #%s ~* &* +@all\n", redisAdminUser, aclHash(adminPass))
+	for _, sc := range ListSiteCaches() {
+		fmt.Fprintf(&b, "user %s on #%s resetchannels ~%s:* +@all -@dangerous +info\n",
+			sc.Username, aclHash(sc.Password), sc.Prefix)
+	}
+
+	if err := utils.WriteFileAtomic(RedisACLFile, []byte(b.String()), 0640); err != nil {
+		return err
+	}
+	_, _ = utils.RunCommand("chown", "redis:redis", RedisACLFile)
+	return nil
+}
+
+// redisAdminPassword returns the password of the svp admin user, creating
+// it on first use
+func redisAdminPassword() (string, error) {
+	if content, err := os.ReadFile(RedisAdminFile); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if pass, found := strings.CutPrefix(line, "Password: "); found {
+				pass = strings.TrimSpace(pass)
+				utils.RegisterSecret(pass)
+				return pass, nil
+			}
+		}
+	}
+
+	pass, err := database.GeneratePassword(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate password: %v", err)
+	}
+	content := fmt.Sprintf("Username: %s\nPassword: %s\n", redisAdminUser, pass)
+	if err := os.WriteFile(RedisAdminFile, []byte(content), 0600); err != nil {
+		return "", fmt.Errorf("failed to save Redis admin password: %v", err)
+	}
+	utils.RegisterSecret(pass)
+	return pass, nil
+}
+
+// aclHash returns the SHA-256 form of a password for the ACL file, which
+// keeps the password itself out of it
+func aclHash(pass string) string {
+	sum := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(sum[:])
+}
+
+// appendLine appends text to a file
+func appendLine(path, text string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(text); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisConn is a connection speaking the Redis protocol (RESP). svp needs
+// a handful of commands, and unlike redis-cli this keeps passwords off
+// command lines.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialRedis connects to the local Redis server as an ACL user
+func dialRedis(user, pass string) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(RedisHost, RedisPort), redisTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if _, err := c.do("AUTH", user, pass); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to log in to Redis as %s: %v", user, err)
+	}
+	return c, nil
+}
+
+// Close closes the connection
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a command and returns its reply: a string, an int64, nil or a
+// []interface{} of those
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply from Redis")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply from Redis: %q", line)
+}
@@ -0,0 +1,204 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"svp/pkg/config"
+	"svp/pkg/database"
+	"svp/pkg/utils"
+)
+
+// Cache backends for --cache and 'svp cache enable': the Redis object cache
+// and the nginx FastCGI page cache
+const (
+	BackendRedis = "redis"
+	BackendPage  = "page"
+)
+
+// ParseBackends splits a comma-separated list of cache backends such as
+// "redis,page"
+func ParseBackends(list string) ([]string, error) {
+	var backends []string
+	for _, backend := range strings.Split(list, ",") {
+		backend = strings.TrimSpace(backend)
+		switch backend {
+		case "":
+			continue
+		case BackendRedis, BackendPage:
+			backends = append(backends, backend)
+		default:
+			return nil, fmt.Errorf("invalid cache backend: %s (must be 'redis' or 'page')", backend)
+		}
+	}
+	return backends, nil
+}
+
+// SitesDir holds the cache registry files (DOMAIN.cache.txt) next to the
+// site configs and database credentials
+const SitesDir = "/etc/svp/sites"
+
+// redisDatabases is the number of logical databases of a default Redis
+// server. Database 0 is left to anything outside svp.
+const redisDatabases = 16
+
+// SiteCache is the Redis cache of a site: its logical database, the prefix
+// of its keys and the ACL user that may only access keys under the prefix
+type SiteCache struct {
+	Domain   string
+	Backend  string
+	Host     string
+	Port     string
+	Database int
+	Prefix   string
+	Username string
+	Password string
+}
+
+// siteCacheFile returns the registry file of a site's cache
+func siteCacheFile(domain string) string {
+	return filepath.Join(SitesDir, domain+".cache.txt")
+}
+
+// ReadSiteCache returns the cache of a site, or false if it has none
+func ReadSiteCache(domain string) (*SiteCache, bool) {
+	content, err := os.ReadFile(siteCacheFile(domain))
+	if err != nil {
+		return nil, false
+	}
+
+	sc := &SiteCache{Domain: domain}
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, found := strings.Cut(line, ": ")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Backend":
+			sc.Backend = value
+		case "Host":
+			sc.Host = value
+		case "Port":
+			sc.Port = value
+		case "Database":
+			sc.Database, _ = strconv.Atoi(value)
+		case "Prefix":
+			sc.Prefix = value
+		case "Username":
+			sc.Username = value
+		case "Password":
+			sc.Password = value
+			utils.RegisterSecret(value)
+		}
+	}
+	if sc.Backend == "" || sc.Username == "" || sc.Password == "" || sc.Prefix == "" {
+		return nil, false
+	}
+	return sc, true
+}
+
+// ListSiteCaches returns the caches of all sites
+func ListSiteCaches() []*SiteCache {
+	files, _ := filepath.Glob(filepath.Join(SitesDir, "*.cache.txt"))
+	var caches []*SiteCache
+	for _, file := range files {
+		domain := strings.TrimSuffix(filepath.Base(file), ".cache.txt")
+		if sc, ok := ReadSiteCache(domain); ok {
+			caches = append(caches, sc)
+		}
+	}
+	return caches
+}
+
+// EnableSiteRedis gives a site its own Redis database, key prefix and ACL
+// user, or returns the ones it already has. Redis must be installed.
+func EnableSiteRedis(domain string) (*SiteCache, error) {
+	if sc, ok := ReadSiteCache(domain); ok {
+		utils.Verify("Redis cache already provisioned for %s (database %d, prefix %s)", domain, sc.Database, sc.Prefix)
+		return sc, WriteRedisUsers()
+	}
+
+	prefix := config.DomainSlug(domain)
+	pass, err := database.GeneratePassword(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate password: %v", err)
+	}
+	sc := &SiteCache{
+		Domain:   domain,
+		Backend:  BackendRedis,
+		Host:     RedisHost,
+		Port:     RedisPort,
+		Database: freeRedisDatabase(),
+		Prefix:   prefix,
+		Username: "svp_" + prefix,
+		Password: pass,
+	}
+
+	content := fmt.Sprintf(`Backend: %s
+Host: %s
+Port: %s
+Database: %d
+Prefix: %s
+Username: %s
+Password: %s
+`, sc.Backend, sc.Host, sc.Port, sc.Database, sc.Prefix, sc.Username, sc.Password)
+	if err := os.WriteFile(siteCacheFile(domain), []byte(content), 0600); err != nil {
+		return nil, fmt.Errorf("failed to save cache credentials: %v", err)
+	}
+	if err := WriteRedisUsers(); err != nil {
+		return nil, err
+	}
+
+	utils.Ok("Redis cache provisioned for %s (database %d, prefix %s, user %s)", domain, sc.Database, sc.Prefix, sc.Username)
+	return sc, nil
+}
+
+// freeRedisDatabase returns the lowest logical database no site uses. Once
+// all are taken, sites share them; their prefixes keep them apart.
+func freeRedisDatabase() int {
+	used := make(map[int]bool)
+	for _, sc := range ListSiteCaches() {
+		used[sc.Database] = true
+	}
+	for db := 1; db < redisDatabases; db++ {
+		if !used[db] {
+			return db
+		}
+	}
+	return len(used)%(redisDatabases-1) + 1
+}
+
+// HasKeys logs in as the site's ACL user and reports whether its database
+// holds keys under the site's prefix, i.e. whether the site writes to its
+// cache
+func (sc *SiteCache) HasKeys() (bool, error) {
+	conn, err := dialRedis(sc.Username, sc.Password)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.do("SELECT", strconv.Itoa(sc.Database)); err != nil {
+		return false, fmt.Errorf("failed to select Redis database %d: %v", sc.Database, err)
+	}
+	cursor := "0"
+	for {
+		reply, err := conn.do("SCAN", cursor, "MATCH", sc.Prefix+":*", "COUNT", "1000")
+		if err != nil {
+			return false, fmt.Errorf("failed to scan Redis database %d: %v", sc.Database, err)
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return false, fmt.Errorf("unexpected SCAN reply from Redis")
+		}
+		if keys, ok := parts[1].([]interface{}); ok && len(keys) > 0 {
+			return true, nil
+		}
+		if cursor, _ = parts[0].(string); cursor == "0" || cursor == "" {
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package cms
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"svp/pkg/cache"
+	"svp/pkg/utils"
+)
+
+// Markers of the svp-managed Redis settings in settings.svp.php and
+// wp-config.php
+const (
+	redisBlockBegin = "// BEGIN SVP REDIS - managed by 'svp cache enable'"
+	redisBlockEnd   = "// END SVP REDIS"
+)
+
+// redisBlockPattern matches the managed block including its line break
+var redisBlockPattern = regexp.MustCompile(`(?s)// BEGIN SVP REDIS[^\n]*\n.*?// END SVP REDIS\n?`)
+
+// EnableDrupalRedis installs the Drupal redis module and points the cache
+// backend of a site at its Redis database. webroot is the Drupal docroot.
+func EnableDrupalRedis(domain, webroot, runUser string, sc *cache.SiteCache) error {
+	projectDir, err := drupalProjectDir(webroot)
+	if err != nil {
+		return err
+	}
+	drushCmd := fmt.Sprintf("drush-%s", domain)
+	if !utils.CommandExists(drushCmd) {
+		return fmt.Errorf("%s not found - run 'svp setup %s' first", drushCmd, domain)
+	}
+
+	composerJSON, err := os.ReadFile(filepath.Join(projectDir, "composer.json"))
+	if err != nil {
+		return fmt.Errorf("failed to read composer.json: %v", err)
+	}
+	if strings.Contains(string(composerJSON), `"drupal/redis"`) {
+		utils.Verify("drupal/redis already in composer.json")
+	} else {
+		utils.Log("Adding drupal/redis with composer...")
+		cmd := fmt.Sprintf("cd %s && sudo -u %s composer require drupal/redis --no-interaction", projectDir, runUser)
+		if _, err := utils.RunShell(cmd); err != nil {
+			return fmt.Errorf("failed to require drupal/redis: %v", err)
+		}
+		utils.Ok("drupal/redis added to composer.json")
+	}
+
+	// The module must be enabled before the settings name its cache backend
+	if _, err := utils.RunCommand(drushCmd, "pm:enable", "redis", "-y"); err != nil {
+		return fmt.Errorf("failed to enable the redis module: %v", err)
+	}
+	utils.Ok("Drupal redis module enabled")
+
+	sitesDefaultDir := filepath.Join(webroot, "sites", "default")
+	settingsFile, err := drupalSettingsFile(sitesDefaultDir)
+	if err != nil {
+		return err
+	}
+	// Keys are PREFIX:BIN:CID, which the site's ACL user is limited to. The
+	// password is the username and password pair of Redis ACLs.
+	block := fmt.Sprintf(`%s
+if (extension_loaded('redis') && file_exists($app_root . '/modules/contrib/redis/redis.services.yml')) {
+  $settings['redis.connection']['interface'] = 'PhpRedis';
+  $settings['redis.connection']['host'] = '%s';
+  $settings['redis.connection']['port'] = %s;
+  $settings['redis.connection']['base'] = %d;
+  $settings['redis.connection']['password'] = ['%s', '%s'];
+  $settings['cache_prefix'] = '%s';
+  $settings['cache']['default'] = 'cache.backend.redis';
+  $settings['container_yamls'][] = 'modules/contrib/redis/example.services.yml';
+}
+%s
+`, redisBlockBegin, sc.Host, sc.Port, sc.Database, sc.Username, sc.Password, sc.Prefix, redisBlockEnd)
+
+	changed, err := writeRedisBlock(settingsFile, block, func() {
+		_, _ = utils.RunCommand("chmod", "u+w", sitesDefaultDir)
+		_, _ = utils.RunCommand("chmod", "u+w", settingsFile)
+	})
+	_, _ = utils.RunCommand("chmod", "444", settingsFile)
+	_, _ = utils.RunCommand("chmod", "555", sitesDefaultDir)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		utils.Verify("Drupal Redis settings already up to date")
+		return nil
+	}
+	utils.Ok("Drupal Redis settings written to %s", filepath.Base(settingsFile))
+
+	if _, err := utils.RunCommand(drushCmd, "cache:rebuild"); err != nil {
+		return fmt.Errorf("failed to rebuild the Drupal cache: %v", err)
+	}
+	return nil
+}
+
+// EnableWordPressRedis installs the Redis Object Cache plugin and its
+// object-cache.php drop-in, connecting to the site's Redis database
+func EnableWordPressRedis(siteDir, runUser string, sc *cache.SiteCache) error {
+	configFile := filepath.Join(siteDir, "wp-config.php")
+	if !utils.CheckFileExists(configFile) {
+		return fmt.Errorf("wp-config.php not found in %s", siteDir)
+	}
+
+	// Written directly rather than with wp config set, which would put the
+	// password on the command line. The prefix ends with a colon so every
+	// key falls under the site's ACL pattern.
+	block := fmt.Sprintf(`%s
+define( 'WP_REDIS_HOST', '%s' );
+define( 'WP_REDIS_PORT', %s );
+define( 'WP_REDIS_DATABASE', %d );
+define( 'WP_REDIS_PASSWORD', [ '%s', '%s' ] );
+define( 'WP_REDIS_PREFIX', '%s:' );
+define( 'WP_REDIS_SELECTIVE_FLUSH', true );
+define( 'WP_REDIS_TIMEOUT', 1 );
+define( 'WP_REDIS_READ_TIMEOUT', 1 );
+%s
+`, redisBlockBegin, sc.Host, sc.Port, sc.Database, sc.Username, sc.Password, sc.Prefix, redisBlockEnd)
+
+	changed, err := writeRedisBlock(configFile, block, nil,
+		"/* That's all, stop editing!", "require_once ABSPATH . 'wp-settings.php';")
+	if err != nil {
+		return err
+	}
+	if changed {
+		utils.Ok("Redis settings written to wp-config.php")
+	} else {
+		utils.Verify("WordPress Redis settings already up to date")
+	}
+
+	wp := fmt.Sprintf("cd %s && sudo -u %s wp", siteDir, runUser)
+	if _, err := utils.RunShell(wp + " plugin is-active redis-cache"); err == nil {
+		utils.Verify("Redis Object Cache plugin already active")
+	} else {
+		utils.Log("Installing the Redis Object Cache plugin...")
+		if _, err := utils.RunShell(wp + " plugin install redis-cache --activate"); err != nil {
+			return fmt.Errorf("failed to install the redis-cache plugin: %v", err)
+		}
+		utils.Ok("Redis Object Cache plugin installed")
+	}
+
+	if utils.CheckFileExists(filepath.Join(siteDir, "wp-content", "object-cache.php")) {
+		utils.Verify("Object cache drop-in already installed")
+	} else {
+		if _, err := utils.RunShell(wp + " redis enable"); err != nil {
+			return fmt.Errorf("failed to install the object cache drop-in: %v", err)
+		}
+		utils.Ok("Object cache drop-in installed")
+	}
+
+	if _, err := utils.RunShell(wp + " cache flush"); err != nil {
+		utils.Warn("Failed to flush the WordPress object cache: %v", err)
+	}
+	return nil
+}
+
+// writeRedisBlock replaces the managed Redis block of a PHP file, or adds
+// it before the first line starting with one of the anchors (at the end if
+// none is found). unlock runs before the file is written. It reports
+// whether the file changed.
+func writeRedisBlock(path, block string, unlock func(), anchors ...string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	var updated string
+	if redisBlockPattern.Match(content) {
+		updated = redisBlockPattern.ReplaceAllLiteralString(string(content), block)
+	} else {
+		for _, anchor := range anchors {
+			if strings.Contains(string(content), "\n"+anchor) {
+				updated = strings.Replace(string(content), "\n"+anchor, "\n"+block+"\n"+anchor, 1)
+				break
+			}
+		}
+		if updated == "" {
+			updated = strings.TrimRight(string(content), "\n") + "\n\n" + block
+		}
+	}
+	if updated == string(content) {
+		return false, nil
+	}
+
+	if unlock != nil {
+		unlock()
+	}
+	// Requests served during the update must never see a half-written file
+	if err := utils.WriteFileAtomic(path, []byte(updated), info.Mode().Perm()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// drupalProjectDir returns the Composer project of a Drupal docroot: the
+// nearest directory at or above it holding composer.json
+func drupalProjectDir(webroot string) (string, error) {
+	for dir := webroot; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if utils.CheckFileExists(filepath.Join(dir, "composer.json")) {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("composer.json not found at or above %s", webroot)
+}
@@ -0,0 +1,29 @@
+package cms
+
+import (
+	"path/filepath"
+	"svp/pkg/utils"
+)
+
+// UploadDirs returns the existing user upload directories of a site:
+// sites/*/files for Drupal, wp-content/uploads for WordPress
+func UploadDirs(cmsType, webroot string) []string {
+	var patterns []string
+	switch cmsType {
+	case "drupal":
+		patterns = []string{filepath.Join(webroot, "sites", "*", "files")}
+	case "wordpress":
+		patterns = []string{filepath.Join(webroot, "wp-content", "uploads")}
+	}
+
+	var dirs []string
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, dir := range matches {
+			if utils.CheckDirExists(dir) {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs
+}
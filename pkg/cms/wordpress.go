@@ -2,14 +2,16 @@ package cms
 
 import (
 	"fmt"
+	"os"
 	"svp/pkg/database"
 	"svp/pkg/utils"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
 // InstallWordPress installs a WordPress site for a domain
-func InstallWordPress(domain, webroot, gitRepo, gitBranch string, sitesDir string) error {
+func InstallWordPress(domain, webroot, gitRepo, gitBranch string, sitesDir string, dbServer database.Server, dbImport string, reuseFiles bool) error {
 	utils.Section("Installing WordPress for " + domain)
 
 	// Get admin username from www-data group
@@ -28,7 +30,8 @@ func InstallWordPress(domain, webroot, gitRepo, gitBranch string, sitesDir strin
 	domainDir := filepath.Join(webroot, domain)
 
 	// Check if directory exists and is not empty
-	if utils.CheckDirExists(domainDir) {
+	// (files put in place by 'svp site import' are reused as they are)
+	if utils.CheckDirExists(domainDir) && !reuseFiles {
 		entries, err := utils.RunShell(fmt.Sprintf("ls -A %s | wc -l", domainDir))
 		if err == nil && strings.TrimSpace(entries) != "0" {
 			utils.Warn("Directory %s is not empty", domainDir)
@@ -100,7 +103,7 @@ func InstallWordPress(domain, webroot, gitRepo, gitBranch string, sitesDir strin
 	}
 
 	// Create database
-	dbName, dbUser, dbPass, err := database.CreateDatabase(domain, sitesDir)
+	dbName, dbUser, dbPass, err := database.CreateDatabase(domain, sitesDir, database.EngineMariaDB, dbServer)
 	if err != nil {
 		return fmt.Errorf("failed to create database: %v", err)
 	}
@@ -126,10 +129,10 @@ func InstallWordPress(domain, webroot, gitRepo, gitBranch string, sitesDir strin
 define( 'DB_NAME', '%s' );
 define( 'DB_USER', '%s' );
 define( 'DB_PASSWORD', '%s' );
-define( 'DB_HOST', 'localhost' );
+define( 'DB_HOST', '%s' );
 define( 'DB_CHARSET', 'utf8mb4' );
 define( 'DB_COLLATE', '' );
-
+%s
 // ** Authentication Unique Keys and Salts ** //
 %s
 
@@ -146,16 +149,28 @@ if ( ! defined( 'ABSPATH' ) ) {
 
 // ** Sets up WordPress vars and included files ** //
 require_once ABSPATH . 'wp-settings.php';
-`, dbName, dbUser, dbPass, salts)
+`, dbName, dbUser, dbPass, wordpressDBHost(dbServer), wordpressClientFlags(dbServer), salts)
 
-		_, err = utils.RunShell(fmt.Sprintf("cat > %s <<'WPEOF'\n%s\nWPEOF", wpConfig, wpConfigContent))
-		if err != nil {
+		// Written directly, so the password never appears on a command line
+		if err := os.WriteFile(wpConfig, []byte(wpConfigContent+"\n"), 0644); err != nil {
 			return fmt.Errorf("failed to write wp-config.php: %v", err)
 		}
 
 		utils.Ok("wp-config.php created")
 	} else {
-		utils.Verify("wp-config.php already exists")
+		// The database was just (re)created with a new password, so
+		// point the existing wp-config.php at it
+		utils.Log("wp-config.php already exists - updating database credentials")
+		if err := UpdateWordPressDatabaseCredentials(domainDir, dbName, dbUser, dbPass, dbServer); err != nil {
+			return err
+		}
+	}
+
+	// Import database if provided
+	if dbImport != "" {
+		if err := database.ImportDatabase(database.EngineMariaDB, dbServer, dbImport, dbName, dbUser, dbPass); err != nil {
+			return err
+		}
 	}
 
 	// Set proper ownership and permissions
@@ -167,6 +182,105 @@ require_once ABSPATH . 'wp-settings.php';
 	return nil
 }
 
+// UpdateWordPressDatabaseCredentials points wp-config.php at a (re)created
+// database
+func UpdateWordPressDatabaseCredentials(siteDir, dbName, dbUser, dbPass string, dbServer database.Server) error {
+	for key, value := range map[string]string{"DB_NAME": dbName, "DB_USER": dbUser, "DB_HOST": wordpressDBHost(dbServer)} {
+		cmd := fmt.Sprintf("cd %s && wp config set %s %s --allow-root --quiet", utils.ShellQuote(siteDir), key, utils.ShellQuote(value))
+		if _, err := utils.RunShell(cmd); err != nil {
+			return fmt.Errorf("failed to update %s in wp-config.php: %v", key, err)
+		}
+	}
+	if dbServer.TLS {
+		cmd := fmt.Sprintf("cd %s && wp config set MYSQL_CLIENT_FLAGS MYSQLI_CLIENT_SSL --raw --allow-root --quiet", utils.ShellQuote(siteDir))
+		if _, err := utils.RunShell(cmd); err != nil {
+			return fmt.Errorf("failed to update MYSQL_CLIENT_FLAGS in wp-config.php: %v", err)
+		}
+	}
+	// The password is not passed to wp config set, which would put it on
+	// the command line
+	if err := UpdateWordPressDatabasePassword(siteDir, dbPass); err != nil {
+		return err
+	}
+	utils.Ok("wp-config.php database credentials updated")
+	return nil
+}
+
+// wordpressDBHost returns the DB_HOST of a database server: localhost, or
+// host:port of an external server
+func wordpressDBHost(dbServer database.Server) string {
+	if !dbServer.IsRemote() {
+		return "localhost"
+	}
+	return dbServer.String()
+}
+
+// wordpressClientFlags returns the MYSQL_CLIENT_FLAGS define connecting to a
+// database server with TLS. mysqli checks the certificate against the
+// system CA bundle.
+func wordpressClientFlags(dbServer database.Server) string {
+	if !dbServer.TLS {
+		return ""
+	}
+	return "define( 'MYSQL_CLIENT_FLAGS', MYSQLI_CLIENT_SSL );\n"
+}
+
+// wpPasswordPattern matches the DB_PASSWORD define in wp-config.php
+var wpPasswordPattern = regexp.MustCompile(`(define\(\s*['"]DB_PASSWORD['"]\s*,\s*)(['"])[^'"]*['"]`)
+
+// UpdateWordPressDatabasePassword replaces the database password in
+// wp-config.php. The file is replaced atomically, unlike with wp config set.
+func UpdateWordPressDatabasePassword(siteDir, dbPass string) error {
+	configFile := filepath.Join(siteDir, "wp-config.php")
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return fmt.Errorf("wp-config.php not found in %s", siteDir)
+	}
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", configFile, err)
+	}
+
+	if !wpPasswordPattern.Match(content) {
+		return fmt.Errorf("no DB_PASSWORD define found in %s", configFile)
+	}
+	updated := wpPasswordPattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		parts := wpPasswordPattern.FindSubmatch(match)
+		return []byte(string(parts[1]) + string(parts[2]) + dbPass + string(parts[2]))
+	})
+
+	if err := utils.WriteFileAtomic(configFile, updated, info.Mode().Perm()); err != nil {
+		return err
+	}
+	utils.Ok("wp-config.php database password updated")
+	return nil
+}
+
+// UpdateWordPressURL points the WordPress home and siteurl options at a new
+// base URL (e.g., https://www.example.com)
+func UpdateWordPressURL(siteDir, adminUser, url string) error {
+	if !utils.CheckFileExists(filepath.Join(siteDir, "wp-config.php")) {
+		return fmt.Errorf("wp-config.php not found in %s", siteDir)
+	}
+
+	current, err := utils.RunShell(fmt.Sprintf("cd %s && sudo -u %s wp option get home", siteDir, adminUser))
+	if err == nil && strings.TrimSpace(current) == url {
+		utils.Verify("WordPress URL already set to %s", url)
+		return nil
+	}
+
+	utils.Log("Updating WordPress URL to %s...", url)
+	for _, option := range []string{"home", "siteurl"} {
+		cmd := fmt.Sprintf("cd %s && sudo -u %s wp option update %s '%s'", siteDir, adminUser, option, url)
+		if _, err := utils.RunShell(cmd); err != nil {
+			return fmt.Errorf("failed to update WordPress %s: %v", option, err)
+		}
+	}
+
+	utils.Ok("WordPress URL updated to %s", url)
+	return nil
+}
+
 // InstallWPCLI installs WP-CLI globally
 func InstallWPCLI(verifyOnly bool) error {
 	if utils.CheckFileExists("/usr/local/bin/wp") {
@@ -0,0 +1,228 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"svp/pkg/utils"
+	"svp/types"
+)
+
+// BackupConfigFile holds the backup settings shared by all sites
+const BackupConfigFile = "/etc/svp/backup.conf"
+
+// DefaultBackupConfig returns the retention used when backup.conf is missing
+func DefaultBackupConfig() *types.BackupConfig {
+	return &types.BackupConfig{
+		KeepDaily:       7,
+		KeepWeekly:      4,
+		KeepMonthly:     6,
+		StaleAfterHours: 26,
+		SnapshotKeep:    5,
+	}
+}
+
+// ReadBackupConfig reads /etc/svp/backup.conf, falling back to the defaults
+// for missing or invalid values
+func ReadBackupConfig() *types.BackupConfig {
+	backupCfg := DefaultBackupConfig()
+
+	content, err := os.ReadFile(BackupConfigFile)
+	if err != nil {
+		return backupCfg
+	}
+
+	values := parseConfigValues(string(content))
+	readInt := func(key string, target *int) {
+		if n, err := strconv.Atoi(values[key]); err == nil && n >= 0 {
+			*target = n
+		}
+	}
+	readInt("KEEP_DAILY", &backupCfg.KeepDaily)
+	readInt("KEEP_WEEKLY", &backupCfg.KeepWeekly)
+	readInt("KEEP_MONTHLY", &backupCfg.KeepMonthly)
+	readInt("STALE_AFTER_HOURS", &backupCfg.StaleAfterHours)
+	readInt("SNAPSHOT_KEEP", &backupCfg.SnapshotKeep)
+
+	return backupCfg
+}
+
+// SaveBackupConfig writes /etc/svp/backup.conf
+func SaveBackupConfig(backupCfg *types.BackupConfig) error {
+	var b strings.Builder
+	b.WriteString("# svp backup settings\n")
+	b.WriteString("# Backup sets kept per site: the newest set of each day, ISO week and month\n")
+	fmt.Fprintf(&b, "KEEP_DAILY='%d'\n", backupCfg.KeepDaily)
+	fmt.Fprintf(&b, "KEEP_WEEKLY='%d'\n", backupCfg.KeepWeekly)
+	fmt.Fprintf(&b, "KEEP_MONTHLY='%d'\n", backupCfg.KeepMonthly)
+	b.WriteString("# 'svp list' and 'svp verify' flag sites without a successful backup in this many hours\n")
+	fmt.Fprintf(&b, "STALE_AFTER_HOURS='%d'\n", backupCfg.StaleAfterHours)
+	b.WriteString("# Safety snapshots taken before destructive operations, kept per site\n")
+	fmt.Fprintf(&b, "SNAPSHOT_KEEP='%d'\n", backupCfg.SnapshotKeep)
+
+	if err := os.WriteFile(BackupConfigFile, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write backup config: %v", err)
+	}
+	return nil
+}
+
+// EnsureBackupConfig writes backup.conf with the defaults if it is missing,
+// so the retention settings are easy to find and edit
+func EnsureBackupConfig() error {
+	if utils.CheckFileExists(BackupConfigFile) {
+		return nil
+	}
+	return SaveBackupConfig(DefaultBackupConfig())
+}
+
+// BackupTargetsDir holds one root-only config file per offsite backup target
+const BackupTargetsDir = "/etc/svp/backup-targets"
+
+// ReadBackupTarget reads an offsite backup target by name
+func ReadBackupTarget(name string) (*types.BackupTarget, error) {
+	content, err := os.ReadFile(fmt.Sprintf("%s/%s.conf", BackupTargetsDir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("backup target not found: %s", name)
+		}
+		return nil, fmt.Errorf("failed to read backup target %s: %v", name, err)
+	}
+
+	values := parseConfigValues(string(content))
+	utils.RegisterSecret(values["SECRET_KEY"])
+	return &types.BackupTarget{
+		Name:         name,
+		Type:         values["TYPE"],
+		Endpoint:     values["ENDPOINT"],
+		Region:       values["REGION"],
+		Bucket:       values["BUCKET"],
+		AccessKey:    values["ACCESS_KEY"],
+		SecretKey:    values["SECRET_KEY"],
+		PathStyle:    values["PATH_STYLE"] != "no",
+		Host:         values["HOST"],
+		Port:         values["PORT"],
+		User:         values["USER"],
+		IdentityFile: values["IDENTITY_FILE"],
+		Path:         values["PATH"],
+	}, nil
+}
+
+// SaveBackupTarget writes an offsite backup target. The file holds
+// credentials, so it and its directory are readable by root only.
+func SaveBackupTarget(target *types.BackupTarget) error {
+	if err := os.MkdirAll(BackupTargetsDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", BackupTargetsDir, err)
+	}
+	_ = os.Chmod(BackupTargetsDir, 0700)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Offsite backup target %s\n", target.Name)
+	writeValue := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s='%s'\n", key, value)
+		}
+	}
+	writeValue("TYPE", target.Type)
+	writeValue("ENDPOINT", target.Endpoint)
+	writeValue("REGION", target.Region)
+	writeValue("BUCKET", target.Bucket)
+	writeValue("ACCESS_KEY", target.AccessKey)
+	writeValue("SECRET_KEY", target.SecretKey)
+	if target.Type == "s3" && !target.PathStyle {
+		writeValue("PATH_STYLE", "no")
+	}
+	writeValue("HOST", target.Host)
+	writeValue("PORT", target.Port)
+	writeValue("USER", target.User)
+	writeValue("IDENTITY_FILE", target.IdentityFile)
+	writeValue("PATH", target.Path)
+
+	configPath := fmt.Sprintf("%s/%s.conf", BackupTargetsDir, target.Name)
+	if err := os.WriteFile(configPath, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write backup target: %v", err)
+	}
+	// WriteFile keeps the mode of an existing file
+	_ = os.Chmod(configPath, 0600)
+	return nil
+}
+
+// RemoveBackupTarget deletes an offsite backup target config
+func RemoveBackupTarget(name string) error {
+	if err := os.Remove(fmt.Sprintf("%s/%s.conf", BackupTargetsDir, name)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("backup target not found: %s", name)
+		}
+		return fmt.Errorf("failed to remove backup target %s: %v", name, err)
+	}
+	return nil
+}
+
+// ListBackupTargets returns all configured offsite backup targets
+func ListBackupTargets() ([]*types.BackupTarget, error) {
+	entries, err := os.ReadDir(BackupTargetsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read backup targets: %v", err)
+	}
+
+	var targets []*types.BackupTarget
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".conf") {
+			continue
+		}
+		target, err := ReadBackupTarget(strings.TrimSuffix(name, ".conf"))
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// BackupRecipientsFile lists the public keys (age recipients) backups are
+// encrypted to. Without it, backups are not encrypted.
+const BackupRecipientsFile = "/etc/svp/backup-recipients.txt"
+
+// ReadBackupRecipients returns the configured backup recipients
+func ReadBackupRecipients() []string {
+	content, err := os.ReadFile(BackupRecipientsFile)
+	if err != nil {
+		return nil
+	}
+
+	var recipients []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			recipients = append(recipients, line)
+		}
+	}
+	return recipients
+}
+
+// SaveBackupRecipients writes the backup recipients file
+func SaveBackupRecipients(recipients []string) error {
+	var b strings.Builder
+	b.WriteString("# svp backups are encrypted to these public keys (one per line).\n")
+	b.WriteString("# Keep the matching private keys off this server.\n")
+	for _, recipient := range recipients {
+		b.WriteString(recipient + "\n")
+	}
+
+	if err := os.WriteFile(BackupRecipientsFile, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", BackupRecipientsFile, err)
+	}
+	return nil
+}
+
+// RemoveBackupRecipients turns off backup encryption
+func RemoveBackupRecipients() error {
+	if err := os.Remove(BackupRecipientsFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %v", BackupRecipientsFile, err)
+	}
+	return nil
+}
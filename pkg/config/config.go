@@ -1,8 +1,12 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"svp/pkg/database"
 	"svp/pkg/utils"
@@ -43,14 +47,29 @@ func ReadSiteConfig(domain string) (*types.SiteConfig, error) {
 		Domain: domain,
 	}
 
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "PHP_VERSION=") {
-			config.PHPVersion = strings.Trim(strings.TrimPrefix(line, "PHP_VERSION="), "'\"")
-		} else if strings.HasPrefix(line, "WEBROOT=") {
-			config.Webroot = strings.Trim(strings.TrimPrefix(line, "WEBROOT="), "'\"")
-		}
+	values := parseConfigValues(string(content))
+	config.PHPVersion = values["PHP_VERSION"]
+	config.Webroot = values["WEBROOT"]
+	config.CMS = values["CMS"]
+	config.CanonicalHost = values["CANONICAL_HOST"]
+	config.CanonicalPolicy = values["CANONICAL_POLICY"]
+	config.SiteUser = values["SITE_USER"]
+	config.Created = values["CREATED"]
+	config.Aliases = splitList(values["ALIASES"])
+	config.PageCache = values["PAGE_CACHE"] == "on"
+	config.RateLimit = values["RATE_LIMIT"] == "on"
+	config.RateLimitRate = values["RATE_LIMIT_RATE"]
+	config.RateLimitLoginRate = values["RATE_LIMIT_LOGIN_RATE"]
+	config.RateLimitConnections, _ = strconv.Atoi(values["RATE_LIMIT_CONNECTIONS"])
+	config.RateLimitPaths = splitList(values["RATE_LIMIT_PATHS"])
+	config.BlockedAgents = splitList(values["BLOCKED_AGENTS"])
+
+	// Sites provisioned before SSL was tracked here had nginx configured by
+	// certbot, so an existing certificate means SSL is enabled
+	if ssl, ok := values["SSL"]; ok {
+		config.SSLEnabled = ssl == "on"
+	} else {
+		config.SSLEnabled = utils.CheckFileExists(fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", domain))
 	}
 
 	if config.PHPVersion == "" || config.Webroot == "" {
@@ -60,27 +79,207 @@ func ReadSiteConfig(domain string) (*types.SiteConfig, error) {
 	return config, nil
 }
 
-// WriteSiteConfig writes configuration for a site
+// WriteSiteConfig writes configuration for a site, keeping any other
+// settings already recorded for it
 func WriteSiteConfig(domain, phpVersion, webroot string) error {
-	configPath := fmt.Sprintf("%s/%s.conf", SitesDir, domain)
+	site, err := ReadSiteConfig(domain)
+	if err != nil {
+		site = &types.SiteConfig{Domain: domain}
+	}
 
-	dateStr, _ := utils.RunShell("date")
-	configContent := fmt.Sprintf(`# Site configuration for %s
-DOMAIN='%s'
-PHP_VERSION='%s'
-WEBROOT='%s'
-CREATED='%s'
-`, domain, domain, phpVersion, webroot, dateStr)
+	site.PHPVersion = phpVersion
+	site.Webroot = webroot
+	return SaveSiteConfig(site)
+}
 
-	_, err := utils.RunShell(fmt.Sprintf("cat > %s <<'EOF'\n%s\nEOF", configPath, configContent))
-	if err != nil {
+// SaveSiteConfig writes the full configuration for a site
+func SaveSiteConfig(site *types.SiteConfig) error {
+	configPath := fmt.Sprintf("%s/%s.conf", SitesDir, site.Domain)
+
+	if site.Created == "" {
+		dateStr, _ := utils.RunShell("date")
+		site.Created = strings.TrimSpace(dateStr)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Site configuration for %s\n", site.Domain)
+	writeValue := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s='%s'\n", key, value)
+		}
+	}
+	writeValue("DOMAIN", site.Domain)
+	writeValue("PHP_VERSION", site.PHPVersion)
+	writeValue("WEBROOT", site.Webroot)
+	writeValue("CMS", site.CMS)
+	writeValue("ALIASES", strings.Join(site.Aliases, ","))
+	writeValue("CANONICAL_HOST", site.CanonicalHost)
+	writeValue("CANONICAL_POLICY", site.CanonicalPolicy)
+	writeValue("SITE_USER", site.SiteUser)
+	if site.SSLEnabled {
+		writeValue("SSL", "on")
+	} else {
+		writeValue("SSL", "off")
+	}
+	if site.PageCache {
+		writeValue("PAGE_CACHE", "on")
+	}
+	if site.RateLimit {
+		writeValue("RATE_LIMIT", "on")
+	}
+	writeValue("RATE_LIMIT_RATE", site.RateLimitRate)
+	writeValue("RATE_LIMIT_LOGIN_RATE", site.RateLimitLoginRate)
+	if site.RateLimitConnections > 0 {
+		writeValue("RATE_LIMIT_CONNECTIONS", strconv.Itoa(site.RateLimitConnections))
+	}
+	writeValue("RATE_LIMIT_PATHS", strings.Join(site.RateLimitPaths, ","))
+	writeValue("BLOCKED_AGENTS", strings.Join(site.BlockedAgents, ","))
+	writeValue("CREATED", site.Created)
+
+	if err := os.WriteFile(configPath, []byte(b.String()), 0644); err != nil {
 		return fmt.Errorf("failed to write site config: %v", err)
 	}
 
-	_, _ = utils.RunCommand("chmod", "0644", configPath)
 	return nil
 }
 
+// ApplyCanonicalPolicy applies a www/non-www policy to a site
+// "apex" redirects www.DOMAIN to DOMAIN, "www" redirects DOMAIN to
+// www.DOMAIN, and "none" serves both names without redirects
+// The counterpart hostname is added as an alias when missing
+func ApplyCanonicalPolicy(site *types.SiteConfig, policy string) error {
+	apex := strings.TrimPrefix(site.Domain, "www.")
+	www := "www." + apex
+
+	var target string
+	switch policy {
+	case "apex":
+		target = apex
+	case "www":
+		target = www
+	case "none":
+		// Only clear redirects that a policy put in place
+		if site.CanonicalHost == apex || site.CanonicalHost == www {
+			site.CanonicalHost = ""
+		}
+		site.CanonicalPolicy = "none"
+		return nil
+	default:
+		return fmt.Errorf("invalid canonical host policy: %s (must be apex, www, or none)", policy)
+	}
+
+	for _, name := range []string{apex, www} {
+		found := false
+		for _, existing := range site.Hostnames() {
+			if existing == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			site.Aliases = append(site.Aliases, name)
+		}
+	}
+
+	site.CanonicalHost = target
+	site.CanonicalPolicy = policy
+	return nil
+}
+
+// ListSites returns the domains that have a site config
+func ListSites() ([]string, error) {
+	entries, err := os.ReadDir(SitesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read sites directory: %v", err)
+	}
+
+	var domains []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".conf") {
+			continue
+		}
+		domains = append(domains, strings.TrimSuffix(name, ".conf"))
+	}
+
+	return domains, nil
+}
+
+// hostnameRegex matches a lowercase hostname: dot-separated labels of
+// letters, digits and inner dashes
+var hostnameRegex = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidHostname reports whether a lowercase name can be used as a site
+// domain or alias. Names end up in nginx server_name, shell commands and the
+// Drupal trusted_host_patterns, so nothing else is allowed.
+func ValidHostname(name string) bool {
+	return len(name) <= 253 && hostnameRegex.MatchString(name)
+}
+
+// DomainSlug returns a name for a site made of letters, digits and
+// underscores, for Redis key prefixes and nginx zones: the domain with dots
+// and dashes as underscores plus a short hash of the domain, since the
+// replacement alone maps a-b.com and a.b.com to the same name
+func DomainSlug(domain string) string {
+	sum := sha256.Sum256([]byte(domain))
+	return strings.NewReplacer(".", "_", "-", "_").Replace(domain) + "_" + hex.EncodeToString(sum[:3])
+}
+
+// FindSiteByHostname returns the site that serves a hostname, either as
+// its primary domain or as an alias
+func FindSiteByHostname(hostname string) (*types.SiteConfig, error) {
+	domains, err := ListSites()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, domain := range domains {
+		site, err := ReadSiteConfig(domain)
+		if err != nil {
+			continue
+		}
+		for _, name := range site.Hostnames() {
+			if name == hostname {
+				return site, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// parseConfigValues parses KEY='value' lines from an svp config file
+func parseConfigValues(content string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), "'\"")
+	}
+	return values
+}
+
+// splitList splits a comma-separated config value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // ReadPHPVersions reads current and previous PHP versions from config
 func ReadPHPVersions() (types.PHPVersions, error) {
 	var versions types.PHPVersions
@@ -137,6 +336,30 @@ func SetCurrentPHPIfEmpty(defaultVersion string) error {
 	return nil
 }
 
+// GetAdminUser returns the admin user (first non-www-data member of the
+// www-data group), falling back to "admin"
+func GetAdminUser() string {
+	output, err := utils.RunShell("getent group www-data | cut -d: -f4")
+	if err == nil {
+		members := strings.Split(strings.TrimSpace(output), ",")
+		for _, member := range members {
+			if member != "" && member != "www-data" {
+				return member
+			}
+		}
+	}
+	return "admin"
+}
+
+// SiteRunUser returns the user to run CLI tools (wp, drush) as for a site:
+// its own system user when isolated, the admin user otherwise
+func SiteRunUser(site *types.SiteConfig) string {
+	if site.SiteUser != "" {
+		return site.SiteUser
+	}
+	return GetAdminUser()
+}
+
 // EnsureAdminUser creates an admin user if it doesn't exist
 func EnsureAdminUser(verifyOnly bool) error {
 	// Prompt for username if not exists
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"fmt"
+	"os"
+)
+
+// DatabaseConfigFile holds the database server settings shared by all sites
+const DatabaseConfigFile = "/etc/svp/database.conf"
+
+// ReadTuningProfile returns the MariaDB tuning profile set with
+// 'svp db tune --profile', or "auto"
+func ReadTuningProfile() string {
+	content, err := os.ReadFile(DatabaseConfigFile)
+	if err != nil {
+		return "auto"
+	}
+	if profile := parseConfigValues(string(content))["TUNING_PROFILE"]; profile != "" {
+		return profile
+	}
+	return "auto"
+}
+
+// SaveTuningProfile writes the MariaDB tuning profile to database.conf
+func SaveTuningProfile(profile string) error {
+	content := fmt.Sprintf("# svp database settings\n"+
+		"# MariaDB tuning profile: auto (from the RAM size), small, medium or large\n"+
+		"TUNING_PROFILE='%s'\n", profile)
+	if err := os.WriteFile(DatabaseConfigFile, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write database config: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package database
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MariaDBSocket is the unix socket of the local MariaDB server. root
+// authenticates over it with unix_socket, without a password.
+const MariaDBSocket = "/run/mysqld/mysqld.sock"
+
+// Errors of the MariaDB client. They wrap the message of the server, so
+// test for them with errors.Is.
+var (
+	ErrUnreachable     = errors.New("database server unreachable")
+	ErrAccessDenied    = errors.New("access denied")
+	ErrUserExists      = errors.New("database user already exists")
+	ErrUnknownUser     = errors.New("database user does not exist")
+	ErrUnknownDatabase = errors.New("unknown database")
+)
+
+// MariaDB error numbers classifyError maps to the errors above
+const (
+	erDBAccessDenied       = 1044
+	erAccessDenied         = 1045
+	erBadDB                = 1049
+	erTableAccessDenied    = 1142
+	erSpecificAccessDenied = 1227
+	erCannotUser           = 1396
+	erAccessDeniedNoPass   = 1698
+)
+
+// connectTimeout bounds how long a connection attempt may take, so an
+// unreachable external server fails fast instead of hanging setup
+const connectTimeout = 10 * time.Second
+
+// classifyError turns a driver error into one of the client errors
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case erDBAccessDenied, erAccessDenied, erTableAccessDenied, erSpecificAccessDenied, erAccessDeniedNoPass:
+			return fmt.Errorf("%w: %s", ErrAccessDenied, myErr.Message)
+		case erBadDB:
+			return fmt.Errorf("%w: %s", ErrUnknownDatabase, myErr.Message)
+		case erCannotUser:
+			// "Operation CREATE USER failed" when the user exists, ALTER or
+			// DROP USER when it does not
+			if strings.Contains(myErr.Message, "CREATE USER") {
+				return fmt.Errorf("%w: %s", ErrUserExists, myErr.Message)
+			}
+			return fmt.Errorf("%w: %s", ErrUnknownUser, myErr.Message)
+		}
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, mysql.ErrInvalidConn) {
+		return fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	return err
+}
+
+// quoteIdentifier quotes a database, table or column name
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// openMariaDB connects to a server as a user: over the socket locally, over
+// TCP (with TLS if the server requires it) to an external one. The
+// connection is checked before it is returned.
+//
+// Query arguments are escaped by the client, so placeholders also work in
+// statements the server cannot prepare, such as CREATE USER ?@?.
+func openMariaDB(srv Server, user, pass, dbName string) (*sql.DB, error) {
+	cfg := mysql.NewConfig()
+	cfg.User = user
+	cfg.Passwd = pass
+	cfg.DBName = dbName
+	cfg.InterpolateParams = true
+	cfg.Timeout = connectTimeout
+	if srv.IsRemote() {
+		cfg.Net = "tcp"
+		cfg.Addr = net.JoinHostPort(srv.Host, srv.PortFor(EngineMariaDB))
+		if srv.TLS {
+			tlsConfig, err := serverTLSConfig(srv)
+			if err != nil {
+				return nil, err
+			}
+			cfg.TLS = tlsConfig
+		}
+	} else {
+		cfg.Net = "unix"
+		cfg.Addr = MariaDBSocket
+	}
+
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection settings for %s: %v", srv, err)
+	}
+	db := sql.OpenDB(connector)
+	// Session settings such as FOREIGN_KEY_CHECKS must apply to every query
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to %s as %s: %w", srv, user, classifyError(err))
+	}
+	return db, nil
+}
+
+// openMariaDBAdmin connects to a server as an administrator: root over the
+// socket locally, the account saved in the admin file of an external server
+func openMariaDBAdmin(srv Server) (*sql.DB, error) {
+	if !srv.IsRemote() {
+		return openMariaDB(srv, "root", "", "")
+	}
+
+	options, err := readOptionFile(srv.AdminFile())
+	if err != nil {
+		return nil, err
+	}
+	return openMariaDB(srv, options["user"], options["password"], "")
+}
+
+// serverTLSConfig verifies the certificate of an external server against
+// its CA bundle
+func serverTLSConfig(srv Server) (*tls.Config, error) {
+	pem, err := os.ReadFile(srv.CAFile())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", srv.CAFile())
+	}
+	return &tls.Config{RootCAs: pool, ServerName: srv.Host, MinVersion: tls.VersionTLS12}, nil
+}
+
+// readOptionFile returns the [client] options of a MySQL option file
+func readOptionFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	options := make(map[string]string)
+	section := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			section = strings.Trim(line, "[]")
+			continue
+		case section != "client":
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if found && len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(value[1 : len(value)-1])
+		}
+		options[key] = value
+	}
+	return options, nil
+}
+
+// execAll runs statements in order and stops at the first error
+func execAll(db *sql.DB, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return classifyError(err)
+		}
+	}
+	return nil
+}
+
+// queryStrings returns the first column of the rows of a query
+func queryStrings(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// CheckSiteConnection logs in to a site database with its own credentials,
+// the way the CMS does
+func CheckSiteConnection(srv Server, dbName, dbUser, dbPass string) error {
+	db, err := openMariaDB(srv, dbUser, dbPass, dbName)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
@@ -0,0 +1,271 @@
+package database
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"svp/pkg/system"
+	"svp/pkg/utils"
+)
+
+// compressors maps the magic bytes of a compressed file to the command that
+// decompresses stdin and the package providing it
+var compressors = []struct {
+	magic      []byte
+	name       string
+	decompress string
+	pkg        string
+}{
+	{[]byte{0x1f, 0x8b}, "gzip", "gzip -dc", "gzip"},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, "zstd", "zstd -dcq", "zstd"},
+	{[]byte("BZh"), "bzip2", "bzip2 -dc", "bzip2"},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, "xz", "xz -dc", "xz-utils"},
+}
+
+// zipMagic starts every zip archive
+var zipMagic = []byte("PK\x03\x04")
+
+// dumpSource is a database dump to import: a plain or compressed SQL file
+// (gzip, zstd, bzip2 or xz), or a tar or zip archive holding one .sql file
+type dumpSource struct {
+	file       string
+	format     string // for messages, e.g. "tar (zstd)"
+	decompress string // shell command decompressing stdin, empty for none
+	tarMember  string
+	zipMember  string
+}
+
+// openDumpSource inspects a dump file and installs the decompressor it needs
+func openDumpSource(dumpFile string) (*dumpSource, error) {
+	f, err := os.Open(dumpFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", dumpFile, err)
+	}
+	magic := make([]byte, 6)
+	n, _ := io.ReadFull(f, magic)
+	magic = magic[:n]
+	f.Close()
+
+	src := &dumpSource{file: dumpFile, format: "sql"}
+	if bytes.HasPrefix(magic, zipMagic) {
+		src.format = "zip"
+		src.zipMember, err = zipSQLMember(dumpFile)
+		if err != nil {
+			return nil, err
+		}
+		return src, nil
+	}
+
+	for _, c := range compressors {
+		if bytes.HasPrefix(magic, c.magic) {
+			if err := ensureCommand(c.decompress, c.pkg); err != nil {
+				return nil, err
+			}
+			src.format = c.name
+			src.decompress = c.decompress
+			break
+		}
+	}
+
+	if isTarName(dumpFile) {
+		src.tarMember, err = tarSQLMember(dumpFile)
+		if err != nil {
+			return nil, err
+		}
+		if src.decompress != "" {
+			src.format = fmt.Sprintf("tar (%s)", src.format)
+		} else {
+			src.format = "tar"
+		}
+	}
+	return src, nil
+}
+
+// isTarName reports whether a file name has a tar extension
+func isTarName(name string) bool {
+	name = strings.ToLower(filepath.Base(name))
+	for _, ext := range []string{".tar", ".tgz", ".tbz2", ".txz", ".tzst"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return strings.Contains(name, ".tar.")
+}
+
+// tarSQLMember returns the only .sql file in a tar archive. GNU tar detects
+// the compression of a regular file by itself.
+func tarSQLMember(archive string) (string, error) {
+	out, err := utils.RunCommand("tar", "-tf", archive)
+	if err != nil {
+		return "", fmt.Errorf("failed to list %s: %v", archive, err)
+	}
+	return singleSQLMember(archive, strings.Split(out, "\n"))
+}
+
+// zipSQLMember returns the only .sql file in a zip archive
+func zipSQLMember(archive string) (string, error) {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", archive, err)
+	}
+	defer r.Close()
+
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	return singleSQLMember(archive, names)
+}
+
+func singleSQLMember(archive string, names []string) (string, error) {
+	var members []string
+	for _, name := range names {
+		if strings.HasSuffix(strings.ToLower(strings.TrimSpace(name)), ".sql") {
+			members = append(members, strings.TrimSpace(name))
+		}
+	}
+	switch len(members) {
+	case 0:
+		return "", fmt.Errorf("no .sql file found in %s", archive)
+	case 1:
+		return members[0], nil
+	default:
+		return "", fmt.Errorf("%s holds %d .sql files (%s) - extract the one to import", archive, len(members), strings.Join(members, ", "))
+	}
+}
+
+// open returns the stream to feed to readCommand and its size. For zip
+// archives this is the uncompressed .sql member; otherwise the file itself.
+func (s *dumpSource) open() (io.ReadCloser, int64, error) {
+	if s.zipMember == "" {
+		f, err := os.Open(s.file)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to open %s: %v", s.file, err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, fmt.Errorf("failed to stat %s: %v", s.file, err)
+		}
+		return f, info.Size(), nil
+	}
+
+	r, err := zip.OpenReader(s.file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read %s: %v", s.file, err)
+	}
+	for _, f := range r.File {
+		if f.Name != s.zipMember {
+			continue
+		}
+		member, err := f.Open()
+		if err != nil {
+			r.Close()
+			return nil, 0, fmt.Errorf("failed to read %s from %s: %v", s.zipMember, s.file, err)
+		}
+		return &zipMemberReader{member, r}, int64(f.UncompressedSize64), nil
+	}
+	r.Close()
+	return nil, 0, fmt.Errorf("%s not found in %s", s.zipMember, s.file)
+}
+
+// zipMemberReader closes the archive along with the member
+type zipMemberReader struct {
+	io.ReadCloser
+	archive *zip.ReadCloser
+}
+
+func (z *zipMemberReader) Close() error {
+	z.ReadCloser.Close()
+	return z.archive.Close()
+}
+
+// readCommand returns the shell pipeline that turns the stream from open
+// into plain SQL (or a pg_dump archive) on stdout
+func (s *dumpSource) readCommand() string {
+	var stages []string
+	if s.decompress != "" {
+		stages = append(stages, s.decompress)
+	}
+	if s.tarMember != "" {
+		stages = append(stages, "tar -xOf - "+utils.ShellQuote(s.tarMember))
+	}
+	if len(stages) == 0 {
+		return "cat"
+	}
+	return strings.Join(stages, " | ")
+}
+
+// mariaDBImportFilter rewrites a mysqldump for the local server: DEFINER
+// clauses naming users that do not exist here are dropped (the importing
+// user becomes the definer), MySQL 8 collations MariaDB lacks are mapped
+// to utf8mb4_general_ci, and the sandbox mode line of newer MariaDB dumps,
+// which older clients reject, is removed
+const mariaDBImportFilter = "sed -E" +
+	" -e 's/DEFINER=`[^`]+`@`[^`]+` ?//g'" +
+	" -e 's/utf8mb4_0900_[a-z_]+/utf8mb4_general_ci/g'" +
+	" -e '1{\\%^/\\*M!999999\\\\- enable the sandbox mode \\*/$%d}'"
+
+// run feeds the dump to a shell command that reads SQL on stdin, showing
+// the progress of the import
+func (s *dumpSource) run(command string) error {
+	stream, total, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	progress := utils.NewProgressReader(stream, total, "Importing")
+	pipeline := fmt.Sprintf("set -o pipefail; %s | %s", s.readCommand(), command)
+	_, err = utils.RunCommandWithStdin(progress, "bash", "-c", pipeline)
+	progress.Done()
+	return err
+}
+
+// peek returns the first n bytes of the decompressed dump
+func (s *dumpSource) peek(n int) ([]byte, error) {
+	stream, _, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	// head exits early, so the pipeline fails with SIGPIPE by design
+	out, _ := utils.RunCommandWithStdin(stream, "bash", "-c", fmt.Sprintf("%s | head -c %d", s.readCommand(), n))
+	return []byte(out), nil
+}
+
+// compressCommand returns the command compressing stdin for a dump file
+// name (.gz, .zst, .bz2 or .xz), or an empty string for plain SQL
+func compressCommand(outFile string) (string, error) {
+	var command, pkg string
+	switch strings.ToLower(filepath.Ext(outFile)) {
+	case ".gz":
+		command, pkg = "gzip", "gzip"
+	case ".zst":
+		command, pkg = "zstd -q -T0", "zstd"
+	case ".bz2":
+		command, pkg = "bzip2", "bzip2"
+	case ".xz":
+		command, pkg = "xz -T0", "xz-utils"
+	default:
+		return "", nil
+	}
+	if err := ensureCommand(command, pkg); err != nil {
+		return "", err
+	}
+	return command, nil
+}
+
+// ensureCommand installs the package providing a command line's program
+// if it is missing
+func ensureCommand(command, pkg string) error {
+	if utils.CommandExists(strings.Fields(command)[0]) {
+		return nil
+	}
+	return system.EnsurePackage(pkg)
+}
@@ -1,14 +1,36 @@
 package database
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
-	"svp/pkg/system"
-	"svp/pkg/utils"
 	"math/big"
+	"os"
 	"strings"
+	"svp/pkg/system"
+	"svp/pkg/utils"
 )
 
+// Database engines for --db-engine and the Engine line of DOMAIN.db.txt
+const (
+	EngineMariaDB    = "mariadb"
+	EnginePostgreSQL = "postgresql"
+	EngineNone       = "none"
+)
+
+// InstallEngine installs and hardens the server of a database engine
+func InstallEngine(dbEngine string, verifyOnly bool) error {
+	switch dbEngine {
+	case EngineMariaDB:
+		return InstallMariaDB(dbEngine, verifyOnly)
+	case EnginePostgreSQL:
+		return InstallPostgreSQL(dbEngine, verifyOnly)
+	default:
+		utils.Skip("Database installation disabled by config")
+		return nil
+	}
+}
+
 // InstallMariaDB installs and configures MariaDB
 func InstallMariaDB(dbEngine string, verifyOnly bool) error {
 	if dbEngine != "mariadb" {
@@ -44,13 +66,7 @@ func InstallMariaDB(dbEngine string, verifyOnly bool) error {
 
 		// Harden MariaDB
 		utils.Log("Hardening MariaDB...")
-		secureSQL := `DELETE FROM mysql.user WHERE User='';
-DROP DATABASE IF EXISTS test;
-DELETE FROM mysql.db WHERE Db='test' OR Db='test_%';
-FLUSH PRIVILEGES;`
-
-		_, err = utils.RunShell(fmt.Sprintf("mariadb -e \"%s\"", secureSQL))
-		if err != nil {
+		if err := hardenMariaDB(); err != nil {
 			utils.Warn("MariaDB hardening partially failed: %v", err)
 		}
 
@@ -60,20 +76,48 @@ FLUSH PRIVILEGES;`
 	return nil
 }
 
+// hardenMariaDB removes the anonymous users and the test database
+func hardenMariaDB() error {
+	db, err := openMariaDBAdmin(Server{})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return execAll(db,
+		"DELETE FROM mysql.user WHERE User = ''",
+		"DROP DATABASE IF EXISTS test",
+		"DELETE FROM mysql.db WHERE Db = 'test' OR Db = 'test\\_%'",
+		"FLUSH PRIVILEGES",
+	)
+}
+
 // GeneratePassword generates a random password
 func GeneratePassword(length int) (string, error) {
-	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
-	password := make([]byte, length)
+	password, err := randomString(length, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789")
+	if err != nil {
+		return "", err
+	}
+
+	utils.RegisterSecret(password)
+	return password, nil
+}
 
-	for i := range password {
+// randomString returns length random characters of charset. Unlike
+// GeneratePassword it does not register the result as a secret, so it
+// shows up in debug output.
+func randomString(length int, charset string) (string, error) {
+	result := make([]byte, length)
+
+	for i := range result {
 		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
 		if err != nil {
 			return "", err
 		}
-		password[i] = charset[n.Int64()]
+		result[i] = charset[n.Int64()]
 	}
 
-	return string(password), nil
+	return string(result), nil
 }
 
 // ReadDatabaseCredentials reads existing database credentials from file
@@ -105,6 +149,7 @@ func ReadDatabaseCredentials(domain string, sitesDir string) (dbName, dbUser, db
 	}
 	
 	if dbName != "" && dbUser != "" && dbPass != "" {
+		utils.RegisterSecret(dbPass)
 		utils.Ok("Using existing database: %s", dbName)
 		return dbName, dbUser, dbPass, true
 	}
@@ -112,8 +157,25 @@ func ReadDatabaseCredentials(domain string, sitesDir string) (dbName, dbUser, db
 	return "", "", "", false
 }
 
-// CreateDatabase creates a database and user for a domain
-func CreateDatabase(domain string, sitesDir string) (dbName, dbUser, dbPass string, err error) {
+// ReadDatabaseEngine returns the engine of a site database from its
+// credentials file. Files written before PostgreSQL support have no Engine
+// line and are MariaDB.
+func ReadDatabaseEngine(domain string, sitesDir string) string {
+	content, err := os.ReadFile(fmt.Sprintf("%s/%s.db.txt", sitesDir, domain))
+	if err != nil {
+		return EngineMariaDB
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "Engine: ") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Engine: "))
+		}
+	}
+	return EngineMariaDB
+}
+
+// CreateDatabase creates a database and user for a domain on a server. On
+// an external server the user is granted access from srv.GrantHost.
+func CreateDatabase(domain string, sitesDir string, dbEngine string, srv Server) (dbName, dbUser, dbPass string, err error) {
 	// Sanitize database name (remove dots and dashes, keep only alphanumeric and underscore)
 	dbName = "drupal_" + strings.Map(func(r rune) rune {
 		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
@@ -130,45 +192,38 @@ func CreateDatabase(domain string, sitesDir string) (dbName, dbUser, dbPass stri
 
 	utils.Log("Creating database and user for %s...", domain)
 
-	// Create database
-	createDBSQL := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;", dbName)
-	_, err = utils.RunShell(fmt.Sprintf("mariadb -e \"%s\"", createDBSQL))
-	if err != nil {
-		return "", "", "", fmt.Errorf("failed to create database: %v", err)
+	if dbEngine != EnginePostgreSQL {
+		dbEngine = EngineMariaDB
 	}
-	utils.Ok("Database created: %s", dbName)
-
-	// Create user and grant privileges
-	// Drop user first to ensure clean state
-	_, _ = utils.RunShell(fmt.Sprintf("mariadb -e \"DROP USER IF EXISTS '%s'@'localhost';\"", dbUser))
-	
-	createUserSQL := fmt.Sprintf("CREATE USER '%s'@'localhost' IDENTIFIED BY '%s';", dbUser, dbPass)
-	_, err = utils.RunShell(fmt.Sprintf("mariadb -e \"%s\"", createUserSQL))
-	if err != nil {
-		return "", "", "", fmt.Errorf("failed to create database user: %v", err)
+	if dbEngine == EnginePostgreSQL {
+		// Unquoted PostgreSQL identifiers are folded to lower case
+		dbName = strings.ToLower(dbName)
+		dbUser = dbName
+		if err := createPostgresDatabase(dbName, dbUser, dbPass); err != nil {
+			return "", "", "", err
+		}
+	} else if err := createMariaDBDatabase(srv, dbName, dbUser, dbPass); err != nil {
+		return "", "", "", err
 	}
 
-	grantSQL := fmt.Sprintf("GRANT ALL PRIVILEGES ON %s.* TO '%s'@'localhost';", dbName, dbUser)
-	_, err = utils.RunShell(fmt.Sprintf("mariadb -e \"%s\"", grantSQL))
-	if err != nil {
-		return "", "", "", fmt.Errorf("failed to grant privileges: %v", err)
-	}
-	
-	// Flush privileges
-	_, _ = utils.RunShell("mariadb -e 'FLUSH PRIVILEGES;'")
-	utils.Ok("Database user created: %s", dbUser)
-
 	// Save credentials to secure file
 	credsFile := fmt.Sprintf("%s/%s.db.txt", sitesDir, domain)
 	credsContent := fmt.Sprintf(`Database: %s
 Username: %s
 Password: %s
-Host: localhost
-Port: 3306
-`, dbName, dbUser, dbPass)
+Host: %s
+Port: %s
+Engine: %s
+`, dbName, dbUser, dbPass, srv.HostName(), srv.PortFor(dbEngine), dbEngine)
+	if srv.IsRemote() {
+		credsContent += fmt.Sprintf("Grant Host: %s\n", srv.GrantHost)
+		if srv.TLS {
+			credsContent += fmt.Sprintf("TLS: yes\nCA: %s\n", srv.CAFile())
+		}
+	}
 
-	_, err = utils.RunShell(fmt.Sprintf("cat > %s <<'EOF'\n%s\nEOF", credsFile, credsContent))
-	if err != nil {
+	// Written directly, so the password never appears on a command line
+	if err := os.WriteFile(credsFile, []byte(credsContent), 0600); err != nil {
 		return "", "", "", fmt.Errorf("failed to save credentials: %v", err)
 	}
 
@@ -178,6 +233,51 @@ Port: 3306
 	return dbName, dbUser, dbPass, nil
 }
 
+// createMariaDBDatabase creates a MariaDB database and a user with all
+// privileges on it
+func createMariaDBDatabase(srv Server, dbName, dbUser, dbPass string) error {
+	db, err := openMariaDBAdmin(srv)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	userHost := srv.userHost()
+
+	// Create database
+	createDBSQL := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci", quoteIdentifier(dbName))
+	if _, err := db.Exec(createDBSQL); err != nil {
+		return fmt.Errorf("failed to create database: %w", classifyError(err))
+	}
+	utils.Ok("Database created: %s", dbName)
+
+	// Create user and grant privileges
+	// Drop user first to ensure clean state
+	if _, err := db.Exec("DROP USER IF EXISTS ?@?", dbUser, userHost); err != nil {
+		return fmt.Errorf("failed to drop existing database user: %w", classifyError(err))
+	}
+
+	createUserSQL := "CREATE USER ?@? IDENTIFIED BY ?"
+	if srv.TLS {
+		createUserSQL += " REQUIRE SSL"
+	}
+	if _, err := db.Exec(createUserSQL, dbUser, userHost, dbPass); err != nil {
+		return fmt.Errorf("failed to create database user: %w", classifyError(err))
+	}
+
+	grantSQL := fmt.Sprintf("GRANT ALL PRIVILEGES ON %s.* TO ?@?", quoteIdentifier(dbName))
+	if _, err := db.Exec(grantSQL, dbUser, userHost); err != nil {
+		return fmt.Errorf("failed to grant privileges: %w", classifyError(err))
+	}
+
+	if srv.IsRemote() {
+		utils.Ok("Database user created: %s@%s on %s", dbUser, userHost, srv)
+	} else {
+		utils.Ok("Database user created: %s", dbUser)
+	}
+
+	return nil
+}
+
 // DropDatabase drops a database and its user completely
 func DropDatabase(domain string, sitesDir string) error {
 	// Read existing credentials
@@ -188,25 +288,36 @@ func DropDatabase(domain string, sitesDir string) error {
 	}
 	
 	utils.Log("Dropping database %s and user %s...", dbName, dbUser)
+	srv := ReadDatabaseServer(domain, sitesDir)
+
+	if ReadDatabaseEngine(domain, sitesDir) == EnginePostgreSQL {
+		if err := dropPostgresDatabase(dbName, dbUser); err != nil {
+			return err
+		}
+		return removeCredentials(domain, sitesDir, dbName)
+	}
 	
-	// Drop database
-	dropDBSQL := fmt.Sprintf("DROP DATABASE IF EXISTS %s;", dbName)
-	_, err := utils.RunShell(fmt.Sprintf("mariadb -e \"%s\"", dropDBSQL))
+	db, err := openMariaDBAdmin(srv)
 	if err != nil {
-		return fmt.Errorf("failed to drop database: %v", err)
+		return err
 	}
-	
+	defer db.Close()
+
+	// Drop database
+	if _, err := db.Exec("DROP DATABASE IF EXISTS " + quoteIdentifier(dbName)); err != nil {
+		return fmt.Errorf("failed to drop database: %w", classifyError(err))
+	}
+
 	// Drop user
-	dropUserSQL := fmt.Sprintf("DROP USER IF EXISTS '%s'@'localhost';", dbUser)
-	_, err = utils.RunShell(fmt.Sprintf("mariadb -e \"%s\"", dropUserSQL))
-	if err != nil {
-		return fmt.Errorf("failed to drop user: %v", err)
+	if _, err := db.Exec("DROP USER IF EXISTS ?@?", dbUser, srv.userHost()); err != nil {
+		return fmt.Errorf("failed to drop user: %w", classifyError(err))
 	}
-	
-	// Flush privileges
-	_, _ = utils.RunShell("mariadb -e 'FLUSH PRIVILEGES;'")
-	
-	// Remove credentials file
+
+	return removeCredentials(domain, sitesDir, dbName)
+}
+
+// removeCredentials removes the credentials file of a dropped database
+func removeCredentials(domain, sitesDir, dbName string) error {
 	credsFile := fmt.Sprintf("%s/%s.db.txt", sitesDir, domain)
 	if utils.CheckFileExists(credsFile) {
 		_, _ = utils.RunCommand("rm", "-f", credsFile)
@@ -215,3 +326,334 @@ func DropDatabase(domain string, sitesDir string) error {
 	utils.Ok("Database and user dropped: %s", dbName)
 	return nil
 }
+
+// RecreateDatabase drops a database and recreates it empty, with its user
+// and the given password. Unlike CreateDatabase it keeps the credentials,
+// so settings files that already hold them stay valid.
+func RecreateDatabase(dbEngine string, srv Server, dbName, dbUser, dbPass string) error {
+	utils.Log("Recreating database %s...", dbName)
+
+	if dbEngine == EnginePostgreSQL {
+		if err := dropPostgresDatabase(dbName, dbUser); err != nil {
+			return err
+		}
+		return createPostgresDatabase(dbName, dbUser, dbPass)
+	}
+
+	db, err := openMariaDBAdmin(srv)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DROP DATABASE IF EXISTS " + quoteIdentifier(dbName))
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("failed to recreate database %s: %w", dbName, classifyError(err))
+	}
+	if err := createMariaDBDatabase(srv, dbName, dbUser, dbPass); err != nil {
+		return fmt.Errorf("failed to recreate database %s: %v", dbName, err)
+	}
+
+	utils.Ok("Database recreated: %s", dbName)
+	return nil
+}
+
+// SetUserPassword changes the password of a site database user
+func SetUserPassword(dbEngine string, srv Server, dbUser, dbPass string) error {
+	if dbEngine == EnginePostgreSQL {
+		if _, err := psqlAdmin("postgres", fmt.Sprintf("ALTER ROLE %s PASSWORD %s;", pgIdentifier(dbUser), pgLiteral(dbPass))); err != nil {
+			return fmt.Errorf("failed to change the password of %s: %v", dbUser, err)
+		}
+		return nil
+	}
+
+	db, err := openMariaDBAdmin(srv)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("ALTER USER ?@? IDENTIFIED BY ?", dbUser, srv.userHost(), dbPass); err != nil {
+		return fmt.Errorf("failed to change the password of %s: %w", dbUser, classifyError(err))
+	}
+	return nil
+}
+
+// UpdateCredentialsPassword replaces the password in a site's credentials
+// file. The file is replaced atomically and keeps its other lines.
+func UpdateCredentialsPassword(domain, sitesDir, dbPass string) error {
+	credsFile := fmt.Sprintf("%s/%s.db.txt", sitesDir, domain)
+	content, err := os.ReadFile(credsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", credsFile, err)
+	}
+
+	lines := strings.Split(string(content), "\n")
+	found := false
+	for i, line := range lines {
+		if strings.HasPrefix(line, "Password: ") {
+			lines[i] = "Password: " + dbPass
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no Password line in %s", credsFile)
+	}
+
+	return utils.WriteFileAtomic(credsFile, []byte(strings.Join(lines, "\n")), 0600)
+}
+
+// DumpDatabase writes a consistent SQL dump of a site database to outFile
+// A .gz, .zst, .bz2 or .xz suffix compresses the dump
+func DumpDatabase(dbEngine string, srv Server, dbName, dbUser, dbPass, outFile string) error {
+	utils.Log("Dumping database %s...", dbName)
+
+	compress, err := compressCommand(outFile)
+	if err != nil {
+		return err
+	}
+
+	if dbEngine == EnginePostgreSQL {
+		if err := dumpPostgresDatabase(dbName, dbUser, dbPass, outFile, compress); err != nil {
+			return err
+		}
+		_, _ = utils.RunCommand("chmod", "600", outFile)
+		utils.Ok("Database dumped: %s", dbName)
+		return nil
+	}
+
+	optionFile, err := srv.clientOptionFile(dbUser, dbPass)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(optionFile)
+
+	dumpCmd := fmt.Sprintf("mysqldump --defaults-extra-file=%s --single-transaction --quick --routines --triggers --no-tablespaces %s", optionFile, dbName)
+	if compress != "" {
+		dumpCmd = fmt.Sprintf("set -o pipefail; %s | %s > %s", dumpCmd, compress, utils.ShellQuote(outFile))
+	} else {
+		dumpCmd = fmt.Sprintf("%s > %s", dumpCmd, utils.ShellQuote(outFile))
+	}
+
+	if _, err := utils.RunShell(dumpCmd); err != nil {
+		return fmt.Errorf("failed to dump database %s: %v", dbName, err)
+	}
+
+	_, _ = utils.RunCommand("chmod", "600", outFile)
+	utils.Ok("Database dumped: %s", dbName)
+	return nil
+}
+
+// ImportDatabase loads an SQL dump into a site database. The dump may be
+// compressed (gzip, zstd, bzip2, xz) or the only .sql file in a tar or zip
+// archive. PostgreSQL also takes pg_dump custom-format archives.
+func ImportDatabase(dbEngine string, srv Server, dumpFile, dbName, dbUser, dbPass string) error {
+	if !utils.CheckFileExists(dumpFile) {
+		return fmt.Errorf("database file not found: %s", dumpFile)
+	}
+
+	src, err := openDumpSource(dumpFile)
+	if err != nil {
+		return err
+	}
+	utils.Log("Importing database from %s (%s)...", dumpFile, src.format)
+
+	if dbEngine == EnginePostgreSQL {
+		if err := importPostgresDatabase(src, dbName, dbUser, dbPass); err != nil {
+			return err
+		}
+		utils.Ok("Database imported successfully")
+		return nil
+	}
+
+	optionFile, err := srv.clientOptionFile(dbUser, dbPass)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(optionFile)
+
+	// The client and the dump may disagree on the default character set
+	client := fmt.Sprintf("%s | mysql --defaults-extra-file=%s --default-character-set=utf8mb4 %s", mariaDBImportFilter, optionFile, dbName)
+	if err := src.run(client); err != nil {
+		return fmt.Errorf("database import failed: %v", err)
+	}
+
+	utils.Ok("Database imported successfully")
+	return nil
+}
+
+// CreateScratchDatabase creates an empty, uniquely named database for trial
+// restores. Drop it with DropScratchDatabase.
+func CreateScratchDatabase(dbEngine string) (string, error) {
+	suffix, err := randomString(8, "abcdefghijklmnopqrstuvwxyz0123456789")
+	if err != nil {
+		return "", fmt.Errorf("failed to generate database name: %v", err)
+	}
+	dbName := "svp_verify_" + suffix
+
+	if dbEngine == EnginePostgreSQL {
+		_, err = psqlAdmin("postgres", fmt.Sprintf("CREATE DATABASE %s ENCODING 'UTF8' TEMPLATE template0;", pgIdentifier(dbName)))
+	} else {
+		err = localMariaDBExec(fmt.Sprintf("CREATE DATABASE %s CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci", quoteIdentifier(dbName)))
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create scratch database: %v", err)
+	}
+	return dbName, nil
+}
+
+// DropScratchDatabase drops a database created by CreateScratchDatabase
+func DropScratchDatabase(dbEngine, dbName string) error {
+	if !strings.HasPrefix(dbName, "svp_verify_") {
+		return fmt.Errorf("refusing to drop %s: not a scratch database", dbName)
+	}
+	var err error
+	if dbEngine == EnginePostgreSQL {
+		_, err = psqlAdmin("postgres", fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (FORCE);", pgIdentifier(dbName)))
+	} else {
+		err = localMariaDBExec("DROP DATABASE IF EXISTS " + quoteIdentifier(dbName))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to drop scratch database %s: %v", dbName, err)
+	}
+	return nil
+}
+
+// localMariaDBExec runs a statement as root on the local server
+func localMariaDBExec(statement string) error {
+	db, err := openMariaDBAdmin(Server{})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return execAll(db, statement)
+}
+
+// ImportScratchDatabase loads an SQL dump into a scratch database as root
+// (or the postgres superuser). The dump may be compressed or archived like
+// one passed to ImportDatabase.
+func ImportScratchDatabase(dbEngine, dumpFile, dbName string) error {
+	src, err := openDumpSource(dumpFile)
+	if err != nil {
+		return err
+	}
+
+	client := fmt.Sprintf("%s | mariadb --default-character-set=utf8mb4 %s", mariaDBImportFilter, utils.ShellQuote(dbName))
+	if dbEngine == EnginePostgreSQL {
+		client = fmt.Sprintf("%s | runuser -u postgres -- psql -X -q -v ON_ERROR_STOP=1 -d %s > /dev/null", postgresImportFilter, utils.ShellQuote(dbName))
+	}
+	if err := src.run(client); err != nil {
+		return fmt.Errorf("trial import failed: %v", err)
+	}
+	return nil
+}
+
+// ListTables returns the tables of a database (the public schema on
+// PostgreSQL)
+func ListTables(dbEngine string, srv Server, dbName string) ([]string, error) {
+	if dbEngine != EnginePostgreSQL {
+		db, err := openMariaDBAdmin(srv)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+
+		tables, err := queryStrings(db, "SHOW TABLES FROM "+quoteIdentifier(dbName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tables of %s: %w", dbName, err)
+		}
+		return tables, nil
+	}
+
+	out, err := psqlAdmin(dbName, "SELECT tablename FROM pg_tables WHERE schemaname = 'public' ORDER BY tablename")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables of %s: %v", dbName, err)
+	}
+	var tables []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			tables = append(tables, line)
+		}
+	}
+	return tables, nil
+}
+
+// CountRows returns the exact number of rows in a table
+func CountRows(dbEngine, dbName, table string) (int64, error) {
+	var count int64
+	if dbEngine != EnginePostgreSQL {
+		db, err := openMariaDBAdmin(Server{})
+		if err != nil {
+			return 0, err
+		}
+		defer db.Close()
+
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s.%s", quoteIdentifier(dbName), quoteIdentifier(table))
+		if err := db.QueryRow(query).Scan(&count); err != nil {
+			return 0, fmt.Errorf("failed to count rows of %s: %w", table, classifyError(err))
+		}
+		return count, nil
+	}
+
+	out, err := psqlAdmin(dbName, "SELECT COUNT(*) FROM public." + pgIdentifier(table))
+	if err != nil {
+		return 0, fmt.Errorf("failed to count rows of %s: %v", table, err)
+	}
+	if _, err := fmt.Sscan(strings.TrimSpace(out), &count); err != nil {
+		return 0, fmt.Errorf("unexpected row count for %s: %q", table, out)
+	}
+	return count, nil
+}
+
+// DropAllTables empties a site database but keeps the database, its user
+// and their credentials
+func DropAllTables(dbEngine string, srv Server, dbName, dbUser, dbPass string) error {
+	if dbEngine == EnginePostgreSQL {
+		sql := fmt.Sprintf("DROP SCHEMA IF EXISTS public CASCADE; CREATE SCHEMA public AUTHORIZATION %s;", pgIdentifier(dbUser))
+		if _, err := psqlAdmin(dbName, sql); err != nil {
+			return fmt.Errorf("failed to drop tables: %v", err)
+		}
+		// Dropping the schema dropped the extensions in it
+		return createPostgresExtensions(dbName)
+	}
+
+	db, err := openMariaDB(srv, dbUser, dbPass, dbName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Foreign key checks are per session, so all statements share one
+	// connection
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to drop tables: %w", classifyError(err))
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, "SELECT table_name FROM information_schema.tables WHERE table_schema = ?", dbName)
+	if err != nil {
+		return fmt.Errorf("failed to list tables of %s: %w", dbName, classifyError(err))
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to list tables of %s: %v", dbName, err)
+		}
+		tables = append(tables, quoteIdentifier(table))
+	}
+	rows.Close()
+	if len(tables) == 0 {
+		return nil
+	}
+
+	if _, err := conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 0"); err != nil {
+		return fmt.Errorf("failed to drop tables: %w", classifyError(err))
+	}
+	if _, err := conn.ExecContext(ctx, "DROP TABLE IF EXISTS "+strings.Join(tables, ", ")); err != nil {
+		return fmt.Errorf("failed to drop tables: %w", classifyError(err))
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"svp/pkg/system"
+	"svp/pkg/utils"
+)
+
+// postgresHardeningFile is the name of the svp drop-in in the conf.d
+// directory of the PostgreSQL cluster
+const postgresHardeningFile = "svp.conf"
+
+// postgresHardening keeps PostgreSQL on the loopback interface with SCRAM
+// passwords; the Debian pg_hba.conf already requires passwords over TCP
+const postgresHardening = `# Managed by svp - local connections only, SCRAM password hashes
+listen_addresses = 'localhost'
+password_encryption = 'scram-sha-256'
+`
+
+// InstallPostgreSQL installs and hardens PostgreSQL
+func InstallPostgreSQL(dbEngine string, verifyOnly bool) error {
+	if dbEngine != EnginePostgreSQL {
+		utils.Skip("PostgreSQL not selected")
+		return nil
+	}
+
+	if utils.CheckPackageInstalled("postgresql") {
+		utils.Verify("PostgreSQL already installed")
+
+		if err := system.EnsureServiceRunning("postgresql", verifyOnly); err != nil {
+			return err
+		}
+	} else {
+		if verifyOnly {
+			utils.Fail("PostgreSQL not installed")
+			return fmt.Errorf("postgresql not installed")
+		}
+
+		utils.Log("Installing PostgreSQL...")
+		if _, err := utils.RunCommand("apt-get", "install", "-y", "postgresql", "postgresql-client"); err != nil {
+			return fmt.Errorf("failed to install PostgreSQL: %v", err)
+		}
+
+		if err := system.EnableService("postgresql"); err != nil {
+			return err
+		}
+		if err := system.StartService("postgresql"); err != nil {
+			return err
+		}
+		utils.Ok("PostgreSQL installed")
+	}
+
+	confDir, err := postgresConfDir()
+	if err != nil {
+		return err
+	}
+	hardeningFile := filepath.Join(confDir, postgresHardeningFile)
+	if content, err := os.ReadFile(hardeningFile); err == nil && string(content) == postgresHardening {
+		utils.Verify("PostgreSQL hardening in place")
+		return nil
+	}
+	if verifyOnly {
+		utils.Fail("PostgreSQL hardening missing: %s", hardeningFile)
+		return fmt.Errorf("postgresql is not hardened")
+	}
+
+	utils.Log("Hardening PostgreSQL...")
+	if err := os.WriteFile(hardeningFile, []byte(postgresHardening), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", hardeningFile, err)
+	}
+	if err := system.RestartService("postgresql"); err != nil {
+		return err
+	}
+
+	utils.Ok("PostgreSQL hardened")
+	return nil
+}
+
+// postgresConfDir returns the conf.d directory of the newest PostgreSQL
+// cluster (/etc/postgresql/VERSION/main/conf.d)
+func postgresConfDir() (string, error) {
+	clusters, _ := filepath.Glob("/etc/postgresql/*/main")
+	if len(clusters) == 0 {
+		return "", fmt.Errorf("no PostgreSQL cluster found in /etc/postgresql")
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		vi, _ := strconv.ParseFloat(filepath.Base(filepath.Dir(clusters[i])), 64)
+		vj, _ := strconv.ParseFloat(filepath.Base(filepath.Dir(clusters[j])), 64)
+		return vi < vj
+	})
+
+	confDir := filepath.Join(clusters[len(clusters)-1], "conf.d")
+	if err := utils.EnsureDir(confDir); err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", confDir, err)
+	}
+	return confDir, nil
+}
+
+// psqlAdmin runs SQL as the postgres superuser and returns the unaligned,
+// tuples-only output
+func psqlAdmin(dbName, sql string) (string, error) {
+	// SQL is passed on stdin, since it may set passwords
+	return utils.RunCommandWithInput(sql, "runuser", "-u", "postgres", "--",
+		"psql", "-X", "-q", "-t", "-A", "-v", "ON_ERROR_STOP=1", "-d", dbName)
+}
+
+// pgIdentifier quotes a role, database or table name
+func pgIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// pgLiteral quotes a string constant such as a password. Backslashes need
+// no escaping, since standard_conforming_strings is on.
+func pgLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// postgresExists runs a SELECT 1 query and reports whether it returned a row
+func postgresExists(query string) (bool, error) {
+	out, err := psqlAdmin("postgres", query)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) == "1", nil
+}
+
+// createPostgresDatabase creates a login role and a database owned by it.
+// Other roles cannot connect to the database.
+func createPostgresDatabase(dbName, dbUser, dbPass string) error {
+	roleExists, err := postgresExists("SELECT 1 FROM pg_roles WHERE rolname = " + pgLiteral(dbUser))
+	if err != nil {
+		return fmt.Errorf("failed to look up role %s: %v", dbUser, err)
+	}
+	roleSQL := fmt.Sprintf("CREATE ROLE %s LOGIN PASSWORD %s;", pgIdentifier(dbUser), pgLiteral(dbPass))
+	if roleExists {
+		roleSQL = fmt.Sprintf("ALTER ROLE %s LOGIN PASSWORD %s;", pgIdentifier(dbUser), pgLiteral(dbPass))
+	}
+	if _, err := psqlAdmin("postgres", roleSQL); err != nil {
+		return fmt.Errorf("failed to create database role: %v", err)
+	}
+	utils.Ok("Database role created: %s", dbUser)
+
+	dbExists, err := postgresExists("SELECT 1 FROM pg_database WHERE datname = " + pgLiteral(dbName))
+	if err != nil {
+		return fmt.Errorf("failed to look up database %s: %v", dbName, err)
+	}
+	if !dbExists {
+		createSQL := fmt.Sprintf("CREATE DATABASE %s OWNER %s ENCODING 'UTF8' TEMPLATE template0;", pgIdentifier(dbName), pgIdentifier(dbUser))
+		if _, err := psqlAdmin("postgres", createSQL); err != nil {
+			return fmt.Errorf("failed to create database: %v", err)
+		}
+	}
+
+	grantSQL := fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM PUBLIC; GRANT ALL ON DATABASE %s TO %s;",
+		pgIdentifier(dbName), pgIdentifier(dbName), pgIdentifier(dbUser))
+	if _, err := psqlAdmin("postgres", grantSQL); err != nil {
+		return fmt.Errorf("failed to grant privileges: %v", err)
+	}
+	// Before PostgreSQL 15 every role may create objects in the public
+	// schema of template0, so hand it to the site role alone
+	schemaSQL := fmt.Sprintf("REVOKE ALL ON SCHEMA public FROM PUBLIC; ALTER SCHEMA public OWNER TO %s;", pgIdentifier(dbUser))
+	if _, err := psqlAdmin(dbName, schemaSQL); err != nil {
+		return fmt.Errorf("failed to restrict the public schema: %v", err)
+	}
+	if err := createPostgresExtensions(dbName); err != nil {
+		return err
+	}
+	utils.Ok("Database created: %s", dbName)
+	return nil
+}
+
+// createPostgresExtensions adds the extensions Drupal requires on
+// PostgreSQL (pg_trgm) to a database
+func createPostgresExtensions(dbName string) error {
+	if _, err := psqlAdmin(dbName, "CREATE EXTENSION IF NOT EXISTS pg_trgm;"); err != nil {
+		return fmt.Errorf("failed to create the pg_trgm extension: %v", err)
+	}
+	return nil
+}
+
+// dropPostgresDatabase drops a site database and its role
+func dropPostgresDatabase(dbName, dbUser string) error {
+	if _, err := psqlAdmin("postgres", fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (FORCE);", pgIdentifier(dbName))); err != nil {
+		return fmt.Errorf("failed to drop database: %v", err)
+	}
+	if _, err := psqlAdmin("postgres", fmt.Sprintf("DROP ROLE IF EXISTS %s;", pgIdentifier(dbUser))); err != nil {
+		return fmt.Errorf("failed to drop role: %v", err)
+	}
+	return nil
+}
+
+// postgresClient returns the shell command line of a client program
+// connecting as a site role over TCP, with the password in a passfile
+func postgresClient(program, dbUser, passFile string) string {
+	return fmt.Sprintf("PGPASSFILE=%s %s -h 127.0.0.1 -U %s", utils.ShellQuote(passFile), program, utils.ShellQuote(dbUser))
+}
+
+// postgresPassFile writes a site role's password to a temporary root-only
+// passfile, so it stays off the command line and out of the environment.
+// The caller removes the file.
+func postgresPassFile(dbPass string) (string, error) {
+	f, err := os.CreateTemp("", "svp-pgpass-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create passfile: %v", err)
+	}
+	defer f.Close()
+	escaped := strings.NewReplacer(`\`, `\\`, ":", `\:`).Replace(dbPass)
+	if _, err := fmt.Fprintf(f, "*:*:*:*:%s\n", escaped); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write passfile: %v", err)
+	}
+	return f.Name(), nil
+}
+
+// dumpPostgresDatabase writes a plain SQL dump, piped through compress
+// unless it is empty
+func dumpPostgresDatabase(dbName, dbUser, dbPass, outFile, compress string) error {
+	passFile, err := postgresPassFile(dbPass)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(passFile)
+
+	// Without owners and grants the dump imports into any role
+	dumpCmd := fmt.Sprintf("%s --no-owner --no-acl %s", postgresClient("pg_dump", dbUser, passFile), utils.ShellQuote(dbName))
+	if compress != "" {
+		dumpCmd = fmt.Sprintf("set -o pipefail; %s | %s > %s", dumpCmd, compress, utils.ShellQuote(outFile))
+	} else {
+		dumpCmd = fmt.Sprintf("%s > %s", dumpCmd, utils.ShellQuote(outFile))
+	}
+
+	if _, err := utils.RunShell(dumpCmd); err != nil {
+		return fmt.Errorf("failed to dump database %s: %v", dbName, err)
+	}
+	return nil
+}
+
+// postgresImportFilter drops the ownership and privilege statements of a
+// plain pg_dump, e.g. ALTER TABLE public.node OWNER TO drupal;
+const postgresImportFilter = "sed -E" +
+	" -e '/^ALTER .* OWNER TO /d'" +
+	" -e '/^ALTER DEFAULT PRIVILEGES /d'" +
+	" -e '/^(GRANT|REVOKE) /d'"
+
+// importPostgresDatabase loads a pg_dump custom-format archive (which
+// starts with PGDMP) or a plain SQL dump. Ownership and privilege
+// statements of plain dumps are skipped, since the roles of the source
+// rarely exist.
+func importPostgresDatabase(src *dumpSource, dbName, dbUser, dbPass string) error {
+	magic, err := src.peek(5)
+	if err != nil {
+		return err
+	}
+
+	passFile, err := postgresPassFile(dbPass)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(passFile)
+
+	var client string
+	if string(magic) == "PGDMP" {
+		utils.Log("Detected a pg_dump custom-format archive")
+		client = fmt.Sprintf("%s --no-owner --no-acl --exit-on-error -d %s", postgresClient("pg_restore", dbUser, passFile), utils.ShellQuote(dbName))
+	} else {
+		client = fmt.Sprintf("%s | %s -X -q -v ON_ERROR_STOP=1 -d %s > /dev/null",
+			postgresImportFilter, postgresClient("psql", dbUser, passFile), utils.ShellQuote(dbName))
+	}
+
+	if err := src.run(client); err != nil {
+		return fmt.Errorf("database import failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// pgDumpSample is the shape of a plain pg_dump of a Drupal site taken
+// without --no-owner and --no-acl
+const pgDumpSample = `--
+-- PostgreSQL database dump
+--
+
+SET statement_timeout = 0;
+SET client_encoding = 'UTF8';
+SELECT pg_catalog.set_config('search_path', '', false);
+
+CREATE SCHEMA public;
+
+
+ALTER SCHEMA public OWNER TO pg_database_owner;
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm WITH SCHEMA public;
+
+SET default_table_access_method = heap;
+
+CREATE TABLE public.node (
+    nid integer NOT NULL,
+    type character varying(32) NOT NULL,
+    langcode character varying(12) NOT NULL
+);
+
+
+ALTER TABLE public.node OWNER TO drupal;
+
+CREATE SEQUENCE public.node_nid_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1;
+
+
+ALTER SEQUENCE public.node_nid_seq OWNER TO drupal;
+
+ALTER SEQUENCE public.node_nid_seq OWNED BY public.node.nid;
+
+CREATE FUNCTION public.concat(anynonarray, anynonarray) RETURNS text
+    LANGUAGE sql
+    AS $_$SELECT CAST($1 AS text) || CAST($2 AS text);$_$;
+
+
+ALTER FUNCTION public.concat(anynonarray, anynonarray) OWNER TO drupal;
+
+CREATE VIEW public.node_types AS
+ SELECT DISTINCT type FROM public.node;
+
+
+ALTER VIEW public.node_types OWNER TO "Drupal Admin";
+
+ALTER TABLE ONLY public.node ALTER COLUMN nid SET DEFAULT nextval('public.node_nid_seq'::regclass);
+
+COPY public.node (nid, type, langcode) FROM stdin;
+1	page	en
+2	article	en
+\.
+
+ALTER TABLE ONLY public.node
+    ADD CONSTRAINT node____pkey PRIMARY KEY (nid);
+
+REVOKE USAGE ON SCHEMA public FROM PUBLIC;
+GRANT ALL ON SCHEMA public TO drupal;
+GRANT SELECT ON TABLE public.node TO reporting;
+
+ALTER DEFAULT PRIVILEGES FOR ROLE drupal IN SCHEMA public GRANT SELECT ON TABLES TO reporting;
+
+--
+-- PostgreSQL database dump complete
+--
+`
+
+func TestPostgresImportFilter(t *testing.T) {
+	cmd := exec.Command("bash", "-c", postgresImportFilter)
+	cmd.Stdin = strings.NewReader(pgDumpSample)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("filter failed: %v", err)
+	}
+	filtered := string(out)
+
+	for _, line := range strings.Split(filtered, "\n") {
+		if strings.Contains(line, "OWNER TO") || strings.HasPrefix(line, "GRANT ") ||
+			strings.HasPrefix(line, "REVOKE ") || strings.HasPrefix(line, "ALTER DEFAULT PRIVILEGES ") {
+			t.Errorf("statement not filtered: %s", line)
+		}
+	}
+
+	kept := []string{
+		"CREATE TABLE public.node (",
+		"ALTER SEQUENCE public.node_nid_seq OWNED BY public.node.nid;",
+		"ALTER TABLE ONLY public.node ALTER COLUMN nid SET DEFAULT nextval('public.node_nid_seq'::regclass);",
+		"ALTER TABLE ONLY public.node\n    ADD CONSTRAINT node____pkey PRIMARY KEY (nid);",
+		"COPY public.node (nid, type, langcode) FROM stdin;\n1\tpage\ten\n2\tarticle\ten\n\\.\n",
+		"AS $_$SELECT CAST($1 AS text) || CAST($2 AS text);$_$;",
+	}
+	for _, want := range kept {
+		if !strings.Contains(filtered, want) {
+			t.Errorf("filter removed %q", want)
+		}
+	}
+}
+
+func TestPostgresQuoting(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{pgIdentifier("drupal_example_com"), `"drupal_example_com"`},
+		{pgIdentifier(`a"b`), `"a""b"`},
+		{pgLiteral("s3cret"), `'s3cret'`},
+		{pgLiteral(`it's; DROP ROLE x; --`), `'it''s; DROP ROLE x; --'`},
+		{pgLiteral(`back\slash`), `'back\slash'`},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %s, want %s", tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"svp/pkg/utils"
+)
+
+// DatabaseServersDir holds the admin option files of external database
+// servers, one per host and port
+const DatabaseServersDir = "/etc/svp/db-servers"
+
+// DefaultCAFile is the system CA bundle, which verifies the certificates of
+// managed database services unless --db-ca names another one
+const DefaultCAFile = "/etc/ssl/certs/ca-certificates.crt"
+
+// Server is the database server a site database lives on. The zero value
+// is the local server, reached as root over its socket.
+type Server struct {
+	Host string
+	Port string
+
+	// Connect with TLS, verifying the server certificate against CA
+	TLS bool
+	CA  string
+
+	// GrantHost is the host part of site users on an external server: the
+	// address this VPS connects from, as the server sees it
+	GrantHost string
+}
+
+// IsRemote reports whether the server is an external one
+func (s Server) IsRemote() bool {
+	return s.Host != "" && s.Host != "localhost"
+}
+
+// HostName returns the host PHP connects to
+func (s Server) HostName() string {
+	if !s.IsRemote() {
+		return "localhost"
+	}
+	return s.Host
+}
+
+// PortFor returns the port of the server, or the default port of an engine
+func (s Server) PortFor(dbEngine string) string {
+	if s.Port != "" {
+		return s.Port
+	}
+	if dbEngine == EnginePostgreSQL {
+		return "5432"
+	}
+	return "3306"
+}
+
+// String returns host:port of an external server, or "localhost"
+func (s Server) String() string {
+	if !s.IsRemote() {
+		return "localhost"
+	}
+	return s.Host + ":" + s.PortFor(EngineMariaDB)
+}
+
+// userHost returns the host part of site database users
+func (s Server) userHost() string {
+	if !s.IsRemote() {
+		return "localhost"
+	}
+	return s.GrantHost
+}
+
+// AdminFile returns the option file holding the admin credentials of an
+// external server
+func (s Server) AdminFile() string {
+	return filepath.Join(DatabaseServersDir, fmt.Sprintf("%s-%s.cnf", s.Host, s.PortFor(EngineMariaDB)))
+}
+
+// optionFile returns the [client] section of a MySQL option file connecting
+// as a user to the server
+func (s Server) optionFile(user, pass string) string {
+	var b strings.Builder
+	b.WriteString("[client]\n")
+	if s.IsRemote() {
+		fmt.Fprintf(&b, "host = %s\n", s.Host)
+		fmt.Fprintf(&b, "port = %s\n", s.PortFor(EngineMariaDB))
+	}
+	fmt.Fprintf(&b, "user = %s\n", user)
+	fmt.Fprintf(&b, "password = \"%s\"\n", strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(pass))
+	if s.IsRemote() && s.TLS {
+		fmt.Fprintf(&b, "ssl-ca = %s\n", s.CAFile())
+		b.WriteString("ssl-verify-server-cert\n")
+	}
+	return b.String()
+}
+
+// clientOptionFile writes the credentials of a site user to a temporary
+// root-only option file for mysql and mysqldump, so the password stays off
+// their command lines. The caller removes the file.
+func (s Server) clientOptionFile(dbUser, dbPass string) (string, error) {
+	f, err := os.CreateTemp("", "svp-client-*.cnf")
+	if err != nil {
+		return "", fmt.Errorf("failed to create client option file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(s.optionFile(dbUser, dbPass)); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write client option file: %v", err)
+	}
+	return f.Name(), nil
+}
+
+// CAFile returns the CA bundle verifying the server certificate
+func (s Server) CAFile() string {
+	if s.CA == "" {
+		return DefaultCAFile
+	}
+	return s.CA
+}
+
+// HasServerAdmin reports whether admin credentials are saved for a server
+func HasServerAdmin(srv Server) bool {
+	return utils.CheckFileExists(srv.AdminFile())
+}
+
+// SaveServerAdmin writes the admin credentials of an external server to a
+// root-only option file, along with how to connect to it
+func SaveServerAdmin(srv Server, adminUser, adminPass string) error {
+	if err := os.MkdirAll(DatabaseServersDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", DatabaseServersDir, err)
+	}
+
+	content := fmt.Sprintf("# Admin account svp creates site databases with on %s\n", srv) + srv.optionFile(adminUser, adminPass)
+	if err := utils.WriteFileAtomic(srv.AdminFile(), []byte(content), 0600); err != nil {
+		return fmt.Errorf("failed to save admin credentials: %v", err)
+	}
+	return nil
+}
+
+// ConnectServer checks the admin connection to an external server and sets
+// the host site users are granted access from. The server sees this VPS by
+// the address it connects from, which may differ from its public IP behind
+// NAT or on a private network.
+func ConnectServer(srv *Server) error {
+	if !HasServerAdmin(*srv) {
+		return fmt.Errorf("no admin credentials saved for %s - pass --db-admin-user and --db-admin-pass", srv)
+	}
+	if srv.TLS && !utils.CheckFileExists(srv.CAFile()) {
+		return fmt.Errorf("CA file not found: %s", srv.CAFile())
+	}
+
+	db, err := openMariaDBAdmin(*srv)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var grantHost string
+	if err := db.QueryRow("SELECT SUBSTRING_INDEX(USER(), '@', -1)").Scan(&grantHost); err != nil {
+		return fmt.Errorf("failed to query %s: %w", srv, classifyError(err))
+	}
+	srv.GrantHost = grantHost
+	if srv.GrantHost == "" {
+		return fmt.Errorf("failed to detect the address %s sees this server as", srv)
+	}
+	return nil
+}
+
+// ReadDatabaseServer returns the server of a site database from its
+// credentials file
+func ReadDatabaseServer(domain string, sitesDir string) Server {
+	var srv Server
+	content, err := os.ReadFile(fmt.Sprintf("%s/%s.db.txt", sitesDir, domain))
+	if err != nil {
+		return srv
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, found := strings.Cut(line, ": ")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Host":
+			srv.Host = value
+		case "Port":
+			srv.Port = value
+		case "TLS":
+			srv.TLS = value == "yes"
+		case "CA":
+			srv.CA = value
+		case "Grant Host":
+			srv.GrantHost = value
+		}
+	}
+	return srv
+}
@@ -0,0 +1,152 @@
+package database
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"svp/pkg/utils"
+	"time"
+)
+
+// SlowQuery sums up the slow log entries of queries that differ only in
+// their literal values
+type SlowQuery struct {
+	Fingerprint  string    `json:"fingerprint"`
+	Example      string    `json:"example"`
+	Count        int       `json:"count"`
+	TotalSeconds float64   `json:"total_seconds"`
+	MaxSeconds   float64   `json:"max_seconds"`
+	RowsExamined int64     `json:"rows_examined"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// maxExampleLength truncates the example query of a SlowQuery
+const maxExampleLength = 1000
+
+var (
+	slowLogUser     = regexp.MustCompile(`^# User@Host: ([^\[\s]*)`)
+	slowLogSchema   = regexp.MustCompile(`\bSchema: (\S+)`)
+	slowLogTime     = regexp.MustCompile(`\bQuery_time: ([\d.]+)`)
+	slowLogExamined = regexp.MustCompile(`\bRows_examined: (\d+)`)
+	slowLogStamp    = regexp.MustCompile(`^SET timestamp=(\d+);$`)
+	slowLogUse      = regexp.MustCompile("^use `?([^`;]+)`?;$")
+
+	fingerprintString  = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.)*"`)
+	fingerprintNumber  = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	fingerprintList    = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	fingerprintSpacing = regexp.MustCompile(`\s+`)
+)
+
+// slowLogEntry is one query of the slow log
+type slowLogEntry struct {
+	user     string
+	schema   string
+	seconds  float64
+	examined int64
+	time     time.Time
+	query    []string
+}
+
+// SlowQueries reads the MariaDB slow query log, rotated copies included, and
+// returns the queries a site database ran since a time, the most total time
+// first. Entries count as the site's if they ran in its database or as its
+// user.
+func SlowQueries(dbName, dbUser string, since time.Time) ([]SlowQuery, error) {
+	byFingerprint := make(map[string]*SlowQuery)
+	var entry *slowLogEntry
+	flush := func() {
+		if entry == nil || len(entry.query) == 0 || entry.time.Before(since) {
+			return
+		}
+		if entry.schema != dbName && entry.user != dbUser {
+			return
+		}
+		query := strings.Join(entry.query, "\n")
+		fingerprint := queryFingerprint(query)
+		q := byFingerprint[fingerprint]
+		if q == nil {
+			q = &SlowQuery{Fingerprint: fingerprint}
+			byFingerprint[fingerprint] = q
+		}
+		q.Count++
+		q.TotalSeconds += entry.seconds
+		q.RowsExamined += entry.examined
+		if entry.seconds >= q.MaxSeconds {
+			q.MaxSeconds = entry.seconds
+			q.Example = truncate(query, maxExampleLength)
+		}
+		if entry.time.After(q.LastSeen) {
+			q.LastSeen = entry.time
+		}
+	}
+
+	// An entry starts at its User@Host line; "# Time:" lines only appear
+	// when the second changes and carry nothing SET timestamp does not
+	err := utils.ReadLogLines(MariaDBSlowLogFile, func(line string) {
+		switch {
+		case strings.HasPrefix(line, "# User@Host:"):
+			flush()
+			entry = &slowLogEntry{}
+			if m := slowLogUser.FindStringSubmatch(line); m != nil {
+				entry.user = m[1]
+			}
+		case entry == nil:
+			return
+		case strings.HasPrefix(line, "# Time:"):
+			flush()
+			entry = nil
+		case strings.HasPrefix(line, "#"):
+			if m := slowLogSchema.FindStringSubmatch(line); m != nil {
+				entry.schema = m[1]
+			}
+			if m := slowLogTime.FindStringSubmatch(line); m != nil {
+				entry.seconds, _ = strconv.ParseFloat(m[1], 64)
+			}
+			if m := slowLogExamined.FindStringSubmatch(line); m != nil {
+				entry.examined, _ = strconv.ParseInt(m[1], 10, 64)
+			}
+		case slowLogStamp.MatchString(line):
+			stamp, _ := strconv.ParseInt(slowLogStamp.FindStringSubmatch(line)[1], 10, 64)
+			entry.time = time.Unix(stamp, 0)
+		case slowLogUse.MatchString(line) && len(entry.query) == 0:
+			entry.schema = slowLogUse.FindStringSubmatch(line)[1]
+		case strings.Contains(line, ", Version: ") && strings.Contains(line, "started with:"):
+			// MariaDB restarted and wrote a new file header
+			flush()
+			entry = nil
+		default:
+			entry.query = append(entry.query, line)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	flush()
+
+	queries := make([]SlowQuery, 0, len(byFingerprint))
+	for _, q := range byFingerprint {
+		queries = append(queries, *q)
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		return queries[i].TotalSeconds > queries[j].TotalSeconds
+	})
+	return queries, nil
+}
+
+// queryFingerprint replaces the literal values of a query with ? and collapses
+// lists and whitespace, so queries differing only in their values match
+func queryFingerprint(query string) string {
+	fp := fingerprintString.ReplaceAllString(query, "?")
+	fp = fingerprintNumber.ReplaceAllString(fp, "?")
+	fp = fingerprintList.ReplaceAllString(fp, "(?+)")
+	fp = fingerprintSpacing.ReplaceAllString(fp, " ")
+	return strings.TrimSuffix(strings.TrimSpace(fp), ";")
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,307 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"svp/pkg/system"
+	"svp/pkg/utils"
+)
+
+// MariaDBTuningFile is the svp-managed MariaDB tuning file. The 90- prefix
+// sorts it after the Debian defaults in 50-server.cnf.
+const MariaDBTuningFile = "/etc/mysql/mariadb.conf.d/90-svp-tuning.cnf"
+
+// MariaDBSlowLogFile receives queries slower than long_query_time
+const MariaDBSlowLogFile = "/var/log/mysql/mariadb-slow.log"
+
+// Tuning profiles for --profile; ProfileAuto picks one from the RAM size
+const (
+	ProfileAuto   = "auto"
+	ProfileSmall  = "small"
+	ProfileMedium = "medium"
+	ProfileLarge  = "large"
+)
+
+// tuningProfile holds the base values of a profile before they are scaled
+// to the RAM and the number of sites
+type tuningProfile struct {
+	bufferPoolPercent int
+	maxConnections    int
+	tmpTableMB        int
+	tableOpenCache    int
+}
+
+var tuningProfiles = map[string]tuningProfile{
+	ProfileSmall:  {bufferPoolPercent: 20, maxConnections: 40, tmpTableMB: 16, tableOpenCache: 400},
+	ProfileMedium: {bufferPoolPercent: 30, maxConnections: 80, tmpTableMB: 32, tableOpenCache: 1000},
+	ProfileLarge:  {bufferPoolPercent: 45, maxConnections: 150, tmpTableMB: 64, tableOpenCache: 2000},
+}
+
+// phpReserveMB is the memory set aside for the PHP-FPM pool of every site
+// after the first before the buffer pool share is taken
+const phpReserveMB = 96
+
+// bufferPoolChunkMB is the default innodb_buffer_pool_chunk_size; MariaDB
+// rounds the buffer pool up to a multiple of it
+const bufferPoolChunkMB = 128
+
+// MariaDBTuning is a generated tuning file
+type MariaDBTuning struct {
+	Profile string
+	Auto    bool
+	RAMMB   int
+	Sites   int
+
+	settings []tuningSetting
+}
+
+// tuningSetting is one option of the [mysqld] section, with the value
+// SHOW GLOBAL VARIABLES reports once it is applied
+type tuningSetting struct {
+	key   string
+	value string
+	live  string
+}
+
+// ValidTuningProfile reports whether a --profile value is known
+func ValidTuningProfile(profile string) bool {
+	_, ok := tuningProfiles[profile]
+	return ok || profile == ProfileAuto
+}
+
+// NewMariaDBTuning sizes MariaDB for the RAM of the server and the number of
+// sites sharing it. profile is small, medium, large or auto.
+func NewMariaDBTuning(profile string, ramMB, sites int) *MariaDBTuning {
+	t := &MariaDBTuning{Profile: profile, RAMMB: ramMB, Sites: sites}
+	if profile == "" || profile == ProfileAuto {
+		t.Auto = true
+		switch {
+		case ramMB < 1536:
+			t.Profile = ProfileSmall
+		case ramMB < 6144:
+			t.Profile = ProfileMedium
+		default:
+			t.Profile = ProfileLarge
+		}
+	}
+	p := tuningProfiles[t.Profile]
+
+	extraSites := sites - 1
+	if extraSites < 0 {
+		extraSites = 0
+	}
+	available := ramMB - phpReserveMB*extraSites
+	bufferPool := available * p.bufferPoolPercent / 100 / bufferPoolChunkMB * bufferPoolChunkMB
+	if bufferPool < bufferPoolChunkMB {
+		bufferPool = bufferPoolChunkMB
+	}
+	logFile := bufferPool / 4
+	maxConnections := p.maxConnections + 10*extraSites
+	if maxConnections > 2*p.maxConnections {
+		maxConnections = 2 * p.maxConnections
+	}
+
+	t.settings = []tuningSetting{
+		sizeSetting("innodb_buffer_pool_size", bufferPool),
+		sizeSetting("innodb_log_file_size", logFile),
+		intSetting("max_connections", maxConnections),
+		sizeSetting("tmp_table_size", p.tmpTableMB),
+		sizeSetting("max_heap_table_size", p.tmpTableMB),
+		intSetting("table_open_cache", p.tableOpenCache),
+		{key: "performance_schema", value: "OFF", live: "OFF"},
+		{key: "slow_query_log", value: "1", live: "ON"},
+		{key: "slow_query_log_file", value: MariaDBSlowLogFile, live: MariaDBSlowLogFile},
+		{key: "long_query_time", value: "2", live: "2.000000"},
+	}
+	return t
+}
+
+// sizeSetting is a size in MB, which MariaDB reports in bytes
+func sizeSetting(key string, mb int) tuningSetting {
+	return tuningSetting{key: key, value: fmt.Sprintf("%dM", mb), live: strconv.Itoa(mb << 20)}
+}
+
+func intSetting(key string, n int) tuningSetting {
+	return tuningSetting{key: key, value: strconv.Itoa(n), live: strconv.Itoa(n)}
+}
+
+// Render returns the content of the tuning file
+func (t *MariaDBTuning) Render() string {
+	source := "set with 'svp db tune --profile'"
+	if t.Auto {
+		source = "picked from the RAM size"
+	}
+
+	var b strings.Builder
+	b.WriteString("# Managed by svp - regenerate with 'svp db tune', do not edit\n")
+	fmt.Fprintf(&b, "# Profile: %s (%s), %d MB RAM, %d site(s)\n", t.Profile, source, t.RAMMB, t.Sites)
+	b.WriteString("[mysqld]\n")
+	for _, s := range t.settings {
+		fmt.Fprintf(&b, "%s = %s\n", s.key, s.value)
+	}
+	return b.String()
+}
+
+// Drift compares the tuning file on disk with the profile and returns one
+// line per difference
+func (t *MariaDBTuning) Drift() []string {
+	content, err := os.ReadFile(MariaDBTuningFile)
+	if err != nil {
+		return []string{fmt.Sprintf("%s is missing", MariaDBTuningFile)}
+	}
+
+	current := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, found := strings.Cut(line, "=")
+		if found && !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			current[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	var drift []string
+	for _, s := range t.settings {
+		switch value, ok := current[s.key]; {
+		case !ok:
+			drift = append(drift, fmt.Sprintf("%s is not set (profile: %s)", s.key, s.value))
+		case value != s.value:
+			drift = append(drift, fmt.Sprintf("%s = %s (profile: %s)", s.key, value, s.value))
+		}
+	}
+	return drift
+}
+
+// PendingRestart returns the settings whose running value differs from the
+// profile, e.g. because MariaDB was not restarted after a change
+func (t *MariaDBTuning) PendingRestart() []string {
+	db, err := openMariaDBAdmin(Server{})
+	if err != nil {
+		return nil
+	}
+	defer db.Close()
+
+	var placeholders []string
+	var keys []interface{}
+	for _, s := range t.settings {
+		placeholders = append(placeholders, "?")
+		keys = append(keys, s.key)
+	}
+	rows, err := db.Query(fmt.Sprintf("SHOW GLOBAL VARIABLES WHERE Variable_name IN (%s)", strings.Join(placeholders, ",")), keys...)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	running := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil
+		}
+		running[key] = value
+	}
+	var pending []string
+	for _, s := range t.settings {
+		if value, ok := running[s.key]; ok && value != s.live {
+			pending = append(pending, s.key)
+		}
+	}
+	return pending
+}
+
+// TotalMemoryMB returns the RAM of the server from /proc/meminfo
+func TotalMemoryMB() (int, error) {
+	content, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read /proc/meminfo: %v", err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.Atoi(fields[1])
+			if err != nil {
+				break
+			}
+			return kb / 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
+}
+
+// TuneMariaDB writes the tuning file for a profile and restarts MariaDB if
+// it changed. In verify mode it reports drift instead.
+func TuneMariaDB(profile string, sites int, verifyOnly bool) error {
+	ramMB, err := TotalMemoryMB()
+	if err != nil {
+		return err
+	}
+	t := NewMariaDBTuning(profile, ramMB, sites)
+
+	drift := t.Drift()
+	if len(drift) == 0 {
+		utils.Verify("MariaDB tuned for the %s profile (%d MB RAM, %d site(s))", t.Profile, ramMB, sites)
+		if pending := t.PendingRestart(); len(pending) > 0 {
+			utils.Warn("MariaDB has not picked up %s - restart it with 'systemctl restart mariadb'", strings.Join(pending, ", "))
+		}
+		return nil
+	}
+
+	if verifyOnly {
+		for _, line := range drift {
+			utils.Fail("MariaDB tuning: %s", line)
+		}
+		return fmt.Errorf("MariaDB tuning drifted from the %s profile - run 'svp db tune'", t.Profile)
+	}
+
+	utils.Log("Tuning MariaDB for the %s profile (%d MB RAM, %d site(s))...", t.Profile, ramMB, sites)
+	if err := utils.EnsureDir("/var/log/mysql"); err != nil {
+		return fmt.Errorf("failed to create /var/log/mysql: %v", err)
+	}
+	_, _ = utils.RunCommand("chown", "mysql:adm", "/var/log/mysql")
+
+	previous, readErr := os.ReadFile(MariaDBTuningFile)
+	if err := os.WriteFile(MariaDBTuningFile, []byte(t.Render()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", MariaDBTuningFile, err)
+	}
+	// The buffer pool and log file sizes only change on a restart
+	if err := system.RestartService("mariadb"); err != nil {
+		if readErr == nil {
+			_ = os.WriteFile(MariaDBTuningFile, previous, 0644)
+		} else {
+			_ = os.Remove(MariaDBTuningFile)
+		}
+		_ = system.RestartService("mariadb")
+		return fmt.Errorf("MariaDB did not start with the new tuning, restored the previous one: %v", err)
+	}
+
+	utils.Ok("MariaDB tuned: %s", MariaDBTuningFile)
+	return nil
+}
+
+// TuneMariaDBIfMissing writes the tuning file on a server that has none
+// yet. An existing file is left alone, since rewriting it restarts MariaDB;
+// a changed recommendation (e.g. after adding a site) is only reported.
+func TuneMariaDBIfMissing(profile string, sites int, verifyOnly bool) error {
+	if verifyOnly || !utils.CheckFileExists(MariaDBTuningFile) {
+		return TuneMariaDB(profile, sites, verifyOnly)
+	}
+
+	ramMB, err := TotalMemoryMB()
+	if err != nil {
+		return err
+	}
+	t := NewMariaDBTuning(profile, ramMB, sites)
+	drift := t.Drift()
+	if len(drift) == 0 {
+		utils.Verify("MariaDB tuned for the %s profile (%d MB RAM, %d site(s))", t.Profile, ramMB, sites)
+		return nil
+	}
+
+	utils.Warn("The %s profile now recommends different MariaDB settings (%d MB RAM, %d site(s)):", t.Profile, ramMB, sites)
+	for _, line := range drift {
+		fmt.Printf("  • %s\n", line)
+	}
+	utils.Log("Apply them with 'svp db tune', which restarts MariaDB")
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"svp/pkg/system"
 	"svp/pkg/utils"
+	"svp/pkg/web"
 )
 
 // InstallCertbot installs certbot for Let's Encrypt
@@ -217,10 +218,20 @@ func promptUserAction(domain string) error {
 // Phase 1: Obtain certificate without modifying nginx (safer, won't break site if it fails)
 // Phase 2: Configure nginx (done by caller after verifying certificate exists)
 func ObtainCertificate(domain, email string) error {
+	return ObtainCertificateNames(domain, []string{domain}, email)
+}
+
+// ObtainCertificateNames obtains a certificate named certName covering all
+// of the given hostnames (phase 1 only - nginx is not modified)
+// If the certificate already exists it is expanded to cover any new names
+func ObtainCertificateNames(certName string, names []string, email string) error {
 	// Check if certificate already exists
-	certPath := fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", domain)
+	certPath := fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", certName)
 	if utils.CheckFileExists(certPath) {
-		utils.Verify("SSL certificate already exists for %s", domain)
+		utils.Verify("SSL certificate already exists for %s", certName)
+		if len(names) > 1 {
+			return ExpandCertificate(certName, names)
+		}
 		return nil
 	}
 
@@ -230,17 +241,22 @@ func ObtainCertificate(domain, email string) error {
 	}
 	
 	// Verify DNS before attempting certificate
-	if err := VerifyDNSAndPrompt(domain); err != nil {
-		return err
+	for _, name := range names {
+		if err := VerifyDNSAndPrompt(name); err != nil {
+			return err
+		}
 	}
 
-	utils.Log("Obtaining SSL certificate for %s", domain)
+	utils.Log("Obtaining SSL certificate for %s", strings.Join(names, ", "))
 
 	// PHASE 1: Obtain certificate ONLY - do not modify nginx
 	// This ensures that if certificate obtainment fails (e.g., rate limit),
 	// nginx configuration remains unchanged and the site continues to work over HTTP
-	cmd := fmt.Sprintf("certbot certonly --nginx -d %s --non-interactive --agree-tos --email %s --no-eff-email", domain, email)
-	_, err := utils.RunShell(cmd)
+	args := []string{"certonly", "--nginx", "--cert-name", certName, "--non-interactive", "--agree-tos", "--email", email, "--no-eff-email"}
+	for _, name := range names {
+		args = append(args, "-d", name)
+	}
+	_, err := utils.RunCommand("certbot", args...)
 	if err != nil {
 		return fmt.Errorf("failed to obtain certificate: %v", err)
 	}
@@ -250,7 +266,7 @@ func ObtainCertificate(domain, email string) error {
 		return fmt.Errorf("certificate file not found after obtainment: %s", certPath)
 	}
 
-	utils.Ok("SSL certificate obtained for %s", domain)
+	utils.Ok("SSL certificate obtained for %s", certName)
 	return nil
 }
 
@@ -277,6 +293,90 @@ func ConfigureNginxSSL(domain string) error {
 	return nil
 }
 
+// CertificateNames returns the hostnames covered by an existing certificate
+func CertificateNames(certName string) ([]string, error) {
+	certPath := fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", certName)
+	if !utils.CheckFileExists(certPath) {
+		return nil, fmt.Errorf("certificate not found: %s", certPath)
+	}
+
+	output, err := utils.RunCommand("openssl", "x509", "-in", certPath, "-noout", "-ext", "subjectAltName")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate names: %v", err)
+	}
+
+	var names []string
+	for _, field := range strings.FieldsFunc(output, func(r rune) bool { return r == ',' || r == '\n' }) {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, "DNS:") {
+			names = append(names, strings.TrimPrefix(field, "DNS:"))
+		}
+	}
+
+	return names, nil
+}
+
+// ExpandCertificate re-issues an existing certificate so that it covers
+// exactly the given hostnames (adding or removing names as needed)
+// Like ObtainCertificate, this does not modify nginx
+func ExpandCertificate(certName string, names []string) error {
+	current, err := CertificateNames(certName)
+	if err != nil {
+		return err
+	}
+
+	if sameNames(current, names) {
+		utils.Verify("SSL certificate already covers: %s", strings.Join(names, ", "))
+		return nil
+	}
+
+	// Every new name must point to this server before Let's Encrypt can validate it
+	for _, name := range names {
+		if containsName(current, name) {
+			continue
+		}
+		if err := VerifyDNSAndPrompt(name); err != nil {
+			return err
+		}
+	}
+
+	utils.Log("Updating SSL certificate %s to cover: %s", certName, strings.Join(names, ", "))
+
+	args := []string{"certonly", "--nginx", "--cert-name", certName, "--expand", "--non-interactive", "--agree-tos"}
+	for _, name := range names {
+		args = append(args, "-d", name)
+	}
+	if _, err := utils.RunCommand("certbot", args...); err != nil {
+		return fmt.Errorf("failed to update certificate: %v", err)
+	}
+
+	utils.Ok("SSL certificate updated for %s", certName)
+	return nil
+}
+
+// sameNames reports whether two hostname lists contain the same names
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, name := range b {
+		if !containsName(a, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsName reports whether a hostname list contains name
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 // SetupAutoRenewal configures automatic certificate renewal
 func SetupAutoRenewal(verifyOnly bool) error {
 	// Check if systemd timer exists
@@ -301,7 +401,7 @@ func SetupAutoRenewal(verifyOnly bool) error {
 	return nil
 }
 
-// FixSSLDocroot ensures the SSL server block uses the correct document root
+// FixSSLDocroot ensures the SSL server blocks use the correct document root
 func FixSSLDocroot(domain, webroot string) error {
 	vhostPath := fmt.Sprintf("/etc/nginx/sites-available/%s.conf", domain)
 	
@@ -311,66 +411,34 @@ func FixSSLDocroot(domain, webroot string) error {
 
 	utils.Log("Fixing SSL docroot for %s...", domain)
 
-	// Read current config
-	content, err := utils.RunShell(fmt.Sprintf("cat %s", vhostPath))
+	conf, err := web.ReadNginxConfig(vhostPath)
 	if err != nil {
-		return fmt.Errorf("failed to read vhost config: %v", err)
+		return err
 	}
 
-	// Check if SSL is configured (look for 443 listener or ssl directives)
-	if !strings.Contains(content, "listen 443") && !strings.Contains(content, "listen [::]:443") {
+	sslServers := conf.ServersListening("443")
+	if len(sslServers) == 0 {
 		utils.Skip("SSL not configured yet (no 443 listener), skipping docroot fix")
 		return nil
 	}
 
-	// Replace any incorrect root paths in the SSL server block (port 443)
-	// Strategy: Find the ssl server block and ensure it has the correct root directive
-	lines := strings.Split(content, "\n")
-	var result []string
-	inSSLBlock := false
+	// Redirect-only blocks have no root and keep none
 	rootFixed := false
-	
-	for i, line := range lines {
-		// Detect start of SSL server block
-		if strings.Contains(line, "listen 443") || strings.Contains(line, "listen [::]:443") {
-			inSSLBlock = true
-		}
-		
-		// Fix root directive in SSL block
-		if inSSLBlock && strings.Contains(line, "root ") && !strings.Contains(line, webroot) {
-			// Replace with correct root
-			indent := strings.Repeat(" ", len(line)-len(strings.TrimLeft(line, " ")))
-			result = append(result, fmt.Sprintf("%sroot %s;", indent, webroot))
+	for _, server := range sslServers {
+		root := server.FindOne("root")
+		if root != nil && (len(root.Args) != 1 || root.Args[0] != webroot) {
+			root.Args = []string{webroot}
 			rootFixed = true
 			utils.Log("Fixed root directive in SSL block")
-		} else {
-			result = append(result, line)
-		}
-		
-		// Detect end of server block
-		if inSSLBlock && strings.TrimSpace(line) == "}" {
-			// Check if this is the closing brace of the server block
-			// Count opening and closing braces up to this point
-			openBraces := 0
-			for j := 0; j <= i; j++ {
-				openBraces += strings.Count(lines[j], "{")
-				openBraces -= strings.Count(lines[j], "}")
-			}
-			if openBraces == 0 {
-				inSSLBlock = false
-			}
 		}
 	}
-	
+
 	if !rootFixed {
 		utils.Verify("SSL docroot already correct")
 		return nil
 	}
 
-	// Write fixed config
-	fixedContent := strings.Join(result, "\n")
-	_, err = utils.RunShell(fmt.Sprintf("cat > %s <<'EOF'\n%s\nEOF", vhostPath, fixedContent))
-	if err != nil {
+	if err := conf.WriteFile(vhostPath); err != nil {
 		return fmt.Errorf("failed to write fixed config: %v", err)
 	}
 
@@ -378,30 +446,8 @@ func FixSSLDocroot(domain, webroot string) error {
 	return nil
 }
 
-// ReconfigureSSL reconfigures SSL for a domain if certificate exists
-// This is useful after updating vhost configuration that removed SSL blocks
-func ReconfigureSSL(domain string) error {
-	// Check if certificate exists
-	certPath := fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", domain)
-	if !utils.CheckFileExists(certPath) {
-		utils.Skip("No SSL certificate found for %s", domain)
-		return nil
-	}
-
-	utils.Log("Reconfiguring SSL for %s...", domain)
-
-	// Use certbot install to reconfigure nginx
-	cmd := fmt.Sprintf("certbot install --nginx -d %s --cert-name %s --non-interactive --redirect", domain, domain)
-	_, err := utils.RunShell(cmd)
-	if err != nil {
-		return fmt.Errorf("failed to reconfigure SSL: %v", err)
-	}
-
-	utils.Ok("SSL reconfigured for %s", domain)
-	return nil
-}
-
-// EnhanceSSLConfig adds advanced security settings to nginx SSL configuration
+// EnhanceSSLConfig adds OCSP stapling and HSTS to the SSL server blocks of
+// a vhost that lack them, after their ssl_certificate_key
 func EnhanceSSLConfig(domain string) error {
 	vhostPath := fmt.Sprintf("/etc/nginx/sites-available/%s.conf", domain)
 	
@@ -411,54 +457,66 @@ func EnhanceSSLConfig(domain string) error {
 
 	utils.Log("Enhancing SSL configuration for %s...", domain)
 
-	// Read current config
-	content, err := utils.RunShell(fmt.Sprintf("cat %s", vhostPath))
+	conf, err := web.ReadNginxConfig(vhostPath)
 	if err != nil {
-		return fmt.Errorf("failed to read vhost config: %v", err)
-	}
-
-	// Check if already enhanced
-	if strings.Contains(content, "Strict-Transport-Security") {
-		utils.Verify("SSL configuration already enhanced")
-		return nil
+		return err
 	}
 
-	// Check if SSL is configured (look for 443 listener)
-	if !strings.Contains(content, "listen 443") && !strings.Contains(content, "listen [::]:443") {
+	sslServers := conf.ServersListening("443")
+	if len(sslServers) == 0 {
 		utils.Warn("SSL not configured yet (no 443 listener), skipping enhancement")
 		return nil
 	}
 
-	// Add enhanced SSL configuration after the ssl_certificate_key line
-	enhancedConfig := `
-    # Enhanced SSL Security Settings
-    ssl_stapling on;
-    ssl_stapling_verify on;
-    resolver 8.8.8.8 8.8.4.4 valid=300s;
-    resolver_timeout 5s;
-    
-    # HSTS (HTTP Strict Transport Security)
-    add_header Strict-Transport-Security "max-age=63072000; includeSubDomains; preload" always;
-`
-
-	// Find the ssl_certificate_key line and insert enhanced config after it
-	lines := strings.Split(content, "\n")
-	var result []string
-	for _, line := range lines {
-		result = append(result, line)
-		// After ssl_certificate_key line, add enhanced config
-		if strings.Contains(line, "ssl_certificate_key") && strings.Contains(line, ";") {
-			result = append(result, enhancedConfig)
+	enhanced := false
+	for _, server := range sslServers {
+		var added []*web.NginxDirective
+		for _, d := range []*web.NginxDirective{
+			web.NewNginxDirective("ssl_stapling", "on"),
+			web.NewNginxDirective("ssl_stapling_verify", "on"),
+			web.NewNginxDirective("resolver", "8.8.8.8", "8.8.4.4", "valid=300s"),
+			web.NewNginxDirective("resolver_timeout", "5s"),
+		} {
+			if server.FindOne(d.Name) == nil {
+				added = append(added, d)
+			}
 		}
+		if len(added) > 0 {
+			added[0].Comment = "Enhanced SSL Security Settings"
+		}
+		if !hasHSTS(server) {
+			hsts := web.NewNginxDirective("add_header", "Strict-Transport-Security", "max-age=63072000; includeSubDomains; preload", "always")
+			hsts.Comment = "HSTS (HTTP Strict Transport Security)"
+			added = append(added, hsts)
+		}
+		if len(added) == 0 {
+			continue
+		}
+
+		server.InsertAfter(server.FindOne("ssl_certificate_key"), added...)
+		enhanced = true
 	}
-	enhancedContent := strings.Join(result, "\n")
 
-	// Write enhanced config
-	_, err = utils.RunShell(fmt.Sprintf("cat > %s <<'EOF'\n%s\nEOF", vhostPath, enhancedContent))
-	if err != nil {
+	if !enhanced {
+		utils.Verify("SSL configuration already enhanced")
+		return nil
+	}
+
+	if err := conf.WriteFile(vhostPath); err != nil {
 		return fmt.Errorf("failed to write enhanced config: %v", err)
 	}
 
 	utils.Ok("SSL configuration enhanced for %s", domain)
 	return nil
 }
+
+// hasHSTS reports whether a server block sends a Strict-Transport-Security
+// header
+func hasHSTS(server *web.NginxDirective) bool {
+	for _, header := range server.Find("add_header") {
+		if len(header.Args) > 0 && strings.EqualFold(header.Args[0], "Strict-Transport-Security") {
+			return true
+		}
+	}
+	return false
+}
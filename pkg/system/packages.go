@@ -10,7 +10,7 @@ import (
 var BasePackages = []string{
 	"ca-certificates", "gnupg", "lsb-release", "curl", "wget",
 	"unzip", "git", "ufw", "apt-transport-https", "acl",
-	"nano", "jq", "htop", "bind9-dnsutils",
+	"nano", "jq", "htop", "bind9-dnsutils", "zstd", "rsync",
 }
 
 // AddPHPRepoIfNeeded adds the Sury PHP repository if not already configured
@@ -422,6 +422,22 @@ func EnsureBasePackages(verifyOnly bool) error {
 	return nil
 }
 
+// EnsurePackage installs a package on demand (for servers provisioned
+// before it was added to the base packages)
+func EnsurePackage(pkg string) error {
+	if utils.CheckPackageInstalled(pkg) {
+		return nil
+	}
+
+	utils.Log("Installing %s...", pkg)
+	if _, err := utils.RunCommand("apt-get", "install", "-y", "--no-install-recommends", pkg); err != nil {
+		return fmt.Errorf("failed to install %s: %v", pkg, err)
+	}
+
+	utils.Ok("%s installed", pkg)
+	return nil
+}
+
 // getSupportedSuryCodenameDebian maps Debian codenames to Sury-supported versions
 func getSupportedSuryCodenameDebian(codename string) string {
 	supportedDebianCodenames := map[string]string{
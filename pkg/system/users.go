@@ -0,0 +1,196 @@
+package system
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"svp/pkg/utils"
+)
+
+// SiteTempRoot holds the per-site temp and session directories of isolated sites
+const SiteTempRoot = "/var/lib/php/sites"
+
+// secretFiles are readable by the site user only, not by nginx
+var secretFiles = []string{"wp-config.php", "settings.php", "settings.svp.php", "settings.local.php", ".env"}
+
+var invalidUsernameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// SiteUsername derives the system user name for a site from its domain,
+// e.g. example.com -> web_example_com. Names longer than the 32 character
+// limit are shortened with a hash suffix so they stay unique.
+func SiteUsername(domain string) string {
+	name := "web_" + strings.Trim(invalidUsernameChars.ReplaceAllString(strings.ToLower(domain), "_"), "_")
+	if len(name) > 32 {
+		sum := fmt.Sprintf("%x", sha1.Sum([]byte(domain)))
+		name = name[:23] + "_" + sum[:8]
+	}
+	return name
+}
+
+// UserExists checks if a system user exists
+func UserExists(username string) bool {
+	_, err := utils.RunCommand("getent", "passwd", username)
+	return err == nil
+}
+
+// EnsureSiteUser creates the system user and group a site's PHP-FPM pool runs
+// as. The user has no login shell. The group is the user's alone: nginx
+// reads the webroot through ACLs (see SetSiteOwnership), since www-data also
+// runs the PHP of shared sites.
+func EnsureSiteUser(username, homeDir string) error {
+	if UserExists(username) {
+		utils.Verify("Site user already exists: %s", username)
+	} else {
+		utils.Log("Creating site user: %s", username)
+		_, err := utils.RunCommand("useradd", "--system", "--user-group",
+			"--home-dir", homeDir, "--no-create-home",
+			"--shell", "/usr/sbin/nologin", username)
+		if err != nil {
+			return fmt.Errorf("failed to create site user %s: %v", username, err)
+		}
+		utils.Ok("Site user created: %s", username)
+	}
+
+	// Sites isolated by earlier versions had www-data in the site group
+	if groupHasMember(username, "www-data") {
+		if _, err := utils.RunCommand("gpasswd", "-d", "www-data", username); err != nil {
+			return fmt.Errorf("failed to remove www-data from group %s: %v", username, err)
+		}
+		utils.Ok("www-data removed from group %s", username)
+	}
+
+	return EnsurePackage("acl")
+}
+
+// groupHasMember reports whether a user is a supplementary member of a group
+func groupHasMember(group, user string) bool {
+	output, err := utils.RunCommand("getent", "group", group)
+	if err != nil {
+		return false
+	}
+	fields := strings.Split(strings.TrimSpace(output), ":")
+	if len(fields) < 4 {
+		return false
+	}
+	for _, member := range strings.Split(fields[3], ",") {
+		if member == user {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSiteOwnership hands the files in dir (a site directory, or part of
+// one) to the site's system user. Other users get no access at all, except
+// nginx, which may read the webroot through ACLs. Files holding credentials
+// are restricted to the owner and carry no ACLs.
+func SetSiteOwnership(dir, webroot, username string) error {
+	utils.Log("Setting ownership of %s to %s", dir, username)
+
+	if _, err := utils.RunCommand("chown", "-R", fmt.Sprintf("%s:%s", username, username), dir); err != nil {
+		return fmt.Errorf("failed to set ownership of %s: %v", dir, err)
+	}
+
+	// X keeps execute bits on directories and already executable files (vendor/bin/drush)
+	if _, err := utils.RunCommand("chmod", "-R", "u=rwX,g=rX,o=", dir); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %v", dir, err)
+	}
+
+	if err := grantNginxRead(dir, webroot); err != nil {
+		return err
+	}
+
+	for _, name := range secretFiles {
+		findCmd := fmt.Sprintf("find %s -name %s -type f -not -path '*/vendor/*' -not -path '*/node_modules/*' -exec setfacl -b {} + -exec chmod 400 {} +", utils.ShellQuote(dir), name)
+		_, _ = utils.RunShell(findCmd)
+	}
+
+	utils.Ok("Site files owned by %s", username)
+	return nil
+}
+
+// grantNginxRead lets www-data (nginx) read the webroot of an isolated site
+// and pass through the directories between dir and the webroot. New files
+// in the webroot inherit the access through default ACLs.
+func grantNginxRead(dir, webroot string) error {
+	readDir := webroot
+	if isWithin(dir, webroot) {
+		// dir is the webroot or in it, e.g. a restored upload directory
+		readDir = dir
+	} else if isWithin(webroot, dir) {
+		for d := filepath.Dir(webroot); ; d = filepath.Dir(d) {
+			if _, err := utils.RunCommand("setfacl", "-m", "u:www-data:x", d); err != nil {
+				return fmt.Errorf("failed to let nginx into %s: %v", d, err)
+			}
+			if d == dir || d == filepath.Dir(d) {
+				break
+			}
+		}
+	} else {
+		return nil
+	}
+
+	if _, err := utils.RunCommand("setfacl", "-R", "-m", "u:www-data:rX", readDir); err != nil {
+		return fmt.Errorf("failed to let nginx read %s: %v", readDir, err)
+	}
+	findCmd := fmt.Sprintf("find %s -type d -exec setfacl -d -m u:www-data:rX {} +", utils.ShellQuote(readDir))
+	if _, err := utils.RunShell(findCmd); err != nil {
+		return fmt.Errorf("failed to set default ACLs in %s: %v", readDir, err)
+	}
+	return nil
+}
+
+// isWithin reports whether path is dir or inside it
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// SetSharedOwnership returns a site's files to the admin user and the
+// www-data group, the layout of sites that share the www-data pool
+func SetSharedOwnership(domainDir, adminUser string) error {
+	utils.Log("Restoring ownership of %s to %s:www-data", domainDir, adminUser)
+
+	// Drop the nginx ACLs of an isolated site
+	if utils.CommandExists("setfacl") {
+		_, _ = utils.RunCommand("setfacl", "-R", "-b", domainDir)
+	}
+
+	if _, err := utils.RunCommand("chown", "-R", fmt.Sprintf("%s:www-data", adminUser), domainDir); err != nil {
+		return fmt.Errorf("failed to set ownership of %s: %v", domainDir, err)
+	}
+
+	if _, err := utils.RunCommand("chmod", "-R", "ug=rwX,o=rX", domainDir); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %v", domainDir, err)
+	}
+
+	// Credentials stay read-only, as the CMS installers leave them
+	for _, name := range secretFiles {
+		findCmd := fmt.Sprintf("find %s -name %s -type f -not -path '*/vendor/*' -not -path '*/node_modules/*' -exec chmod 444 {} +", domainDir, name)
+		_, _ = utils.RunShell(findCmd)
+	}
+
+	utils.Ok("Site files owned by %s:www-data", adminUser)
+	return nil
+}
+
+// EnsureSiteTempDirs creates the private temp and session directories of an
+// isolated site and returns their parent directory
+func EnsureSiteTempDirs(domain, username string) (string, error) {
+	siteTmp := fmt.Sprintf("%s/%s", SiteTempRoot, domain)
+
+	for _, dir := range []string{siteTmp + "/tmp", siteTmp + "/sessions"} {
+		if err := utils.EnsureDir(dir); err != nil {
+			return "", fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+	}
+
+	if _, err := utils.RunCommand("chown", "-R", fmt.Sprintf("%s:%s", username, username), siteTmp); err != nil {
+		return "", fmt.Errorf("failed to set ownership of %s: %v", siteTmp, err)
+	}
+	_, _ = utils.RunCommand("chmod", "-R", "700", siteTmp)
+
+	return siteTmp, nil
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
@@ -13,7 +14,7 @@ func RunCommand(name string, args ...string) (string, error) {
 	cmd := exec.Command(name, args...)
 
 	if os.Getenv("DEBUG") == "1" {
-		fmt.Printf("[DEBUG] Running: %s %s\n", name, strings.Join(args, " "))
+		fmt.Printf("[DEBUG] Running: %s %s\n", name, Redact(strings.Join(args, " ")))
 	}
 
 	var stdout, stderr bytes.Buffer
@@ -33,6 +34,10 @@ func RunCommandWithInput(input, name string, args ...string) (string, error) {
 	cmd := exec.Command(name, args...)
 	cmd.Stdin = strings.NewReader(input)
 
+	if os.Getenv("DEBUG") == "1" {
+		fmt.Printf("[DEBUG] Running: %s %s\n", name, Redact(strings.Join(args, " ")))
+	}
+
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
@@ -45,11 +50,52 @@ func RunCommandWithInput(input, name string, args ...string) (string, error) {
 	return stdout.String(), nil
 }
 
+// RunCommandWithStdin executes a command reading stdin from a stream
+func RunCommandWithStdin(stdin io.Reader, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = stdin
+
+	if os.Getenv("DEBUG") == "1" {
+		fmt.Printf("[DEBUG] Running: %s %s\n", name, Redact(strings.Join(args, " ")))
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return stdout.String(), fmt.Errorf("%v: %s", err, stderr.String())
+	}
+
+	return stdout.String(), nil
+}
+
+// RunInteractive runs a command on the terminal, such as an editor, with
+// its input and output attached to svp's
+func RunInteractive(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if os.Getenv("DEBUG") == "1" {
+		fmt.Printf("[DEBUG] Running: %s %s\n", name, Redact(strings.Join(args, " ")))
+	}
+
+	return cmd.Run()
+}
+
 // RunShell executes a shell command via bash -c
 func RunShell(command string) (string, error) {
 	return RunCommand("bash", "-c", command)
 }
 
+// ShellQuote quotes a string for use as a single shell word
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 // CommandExists checks if a command is available in PATH
 func CommandExists(cmd string) bool {
 	_, err := exec.LookPath(cmd)
@@ -60,7 +106,7 @@ func CommandExists(cmd string) bool {
 func MustRunCommand(name string, args ...string) string {
 	output, err := RunCommand(name, args...)
 	if err != nil {
-		Err("Command failed: %s %s", name, strings.Join(args, " "))
+		Err("Command failed: %s %s", name, Redact(strings.Join(args, " ")))
 		Err("Error: %v", err)
 		os.Exit(1)
 	}
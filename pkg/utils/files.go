@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// WriteFileAtomic replaces a file by writing a temporary file next to it and
+// renaming it over the original, so readers see either the old or the new
+// content. The owner of an existing file is kept.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".svp-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmp.Name(), err)
+	}
+
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %v", tmp.Name(), err)
+	}
+	if info, err := os.Stat(path); err == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if err := os.Chown(tmp.Name(), int(stat.Uid), int(stat.Gid)); err != nil {
+				return fmt.Errorf("failed to set owner of %s: %v", tmp.Name(), err)
+			}
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+	return nil
+}
+
+// maxLogLine is the longest log line ReadLogLines accepts; slow query logs
+// hold whole queries on a line
+const maxLogLine = 16 << 20
+
+// ReadLogLines calls fn for each line of a log file and its rotated copies
+// (FILE.1, FILE.2.gz, ...), oldest first. It fails if none of them exist.
+func ReadLogLines(path string, fn func(line string)) error {
+	rotated, _ := filepath.Glob(path + ".*")
+	type logFile struct {
+		path string
+		age  int
+	}
+	var files []logFile
+	for _, file := range rotated {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(file, path+"."), ".gz")
+		if age, err := strconv.Atoi(suffix); err == nil {
+			files = append(files, logFile{file, age})
+		}
+	}
+	if CheckFileExists(path) {
+		files = append(files, logFile{path, 0})
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("%s not found", path)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].age > files[j].age })
+
+	for _, file := range files {
+		if err := readLines(file.path, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readLines(path string, fn func(line string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLine)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ProgressReader reports how much of a stream of known size has been read.
+// On a terminal the progress line is redrawn in place; otherwise a line is
+// printed every 10%.
+type ProgressReader struct {
+	r        io.Reader
+	label    string
+	total    int64
+	read     int64
+	tty      bool
+	lastDraw time.Time
+	lastStep int64
+}
+
+// NewProgressReader wraps r, which yields total bytes
+func NewProgressReader(r io.Reader, total int64, label string) *ProgressReader {
+	tty := false
+	if info, err := os.Stdout.Stat(); err == nil {
+		tty = info.Mode()&os.ModeCharDevice != 0
+	}
+	return &ProgressReader{r: r, label: label, total: total, tty: tty}
+}
+
+func (p *ProgressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.read += int64(n)
+
+	if p.tty {
+		if time.Since(p.lastDraw) >= 500*time.Millisecond {
+			p.lastDraw = time.Now()
+			fmt.Printf("\r    %s: %s", p.label, p.status())
+		}
+	} else if p.total > 0 {
+		if step := p.read * 10 / p.total; step > p.lastStep {
+			p.lastStep = step
+			fmt.Printf("    %s: %s\n", p.label, p.status())
+		}
+	}
+	return n, err
+}
+
+// Done ends the progress line
+func (p *ProgressReader) Done() {
+	if p.tty && !p.lastDraw.IsZero() {
+		fmt.Printf("\r    %s: %s\n", p.label, p.status())
+	}
+}
+
+func (p *ProgressReader) status() string {
+	if p.total <= 0 {
+		return fmt.Sprintf("%.1f MB", float64(p.read)/(1<<20))
+	}
+	percent := p.read * 100 / p.total
+	if percent > 100 {
+		percent = 100
+	}
+	return fmt.Sprintf("%3d%% (%.1f of %.1f MB)", percent, float64(p.read)/(1<<20), float64(p.total)/(1<<20))
+}
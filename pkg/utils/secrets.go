@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// secrets holds the passwords and keys svp has generated or read during
+// this run. Debug output never shows them.
+var secrets struct {
+	sync.Mutex
+	values []string
+}
+
+// minSecretLength keeps short values such as "admin" or "yes" from being
+// redacted all over the debug output
+const minSecretLength = 6
+
+// secretPatterns catch passwords on command lines even when svp never saw
+// the value itself, e.g. in a dump command built on a migration source
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`((?:MYSQL_PWD|PGPASSWORD|SVP_DB_ADMIN_PASSWORD)=)('[^']*'|\S+)`),
+	regexp.MustCompile(`(\s-u\S+\s+-p)(\S+)`),
+	regexp.MustCompile(`(--(?:password|db-admin-pass|account-pass)[= ])('[^']*'|\S+)`),
+	regexp.MustCompile(`((?:mysql|pgsql)://[^:/\s]+:)([^@\s]+)(@)`),
+}
+
+// RegisterSecret marks a value as secret so that Redact removes it
+func RegisterSecret(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, s := range secrets.values {
+		if s == secret {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, secret)
+	// Longest first, so a secret containing another is replaced whole
+	sort.Slice(secrets.values, func(i, j int) bool {
+		return len(secrets.values[i]) > len(secrets.values[j])
+	})
+}
+
+// Redact replaces registered secrets and passwords on command lines in s
+// with ***
+func Redact(s string) string {
+	secrets.Lock()
+	for _, secret := range secrets.values {
+		s = strings.ReplaceAll(s, secret, "***")
+	}
+	secrets.Unlock()
+
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, "${1}***${3}")
+	}
+	return s
+}
@@ -0,0 +1,76 @@
+package web
+
+import (
+	"fmt"
+	"path/filepath"
+	"svp/pkg/utils"
+)
+
+// siteIncludesDir holds the custom nginx snippets of each site in
+// DOMAIN.d/server (included in its server blocks) and DOMAIN.d/http
+// (included at http level), next to the site configs
+const siteIncludesDir = "/etc/svp/sites"
+
+// SiteIncludeDir returns the snippet directory of a site at one level,
+// "server" or "http"
+func SiteIncludeDir(domain, level string) string {
+	return filepath.Join(siteIncludesDir, domain+".d", level)
+}
+
+// EnsureSiteIncludeDirs creates the snippet directories of a site
+func EnsureSiteIncludeDirs(domain string) error {
+	for _, level := range []string{"server", "http"} {
+		if err := utils.EnsureDir(SiteIncludeDir(domain, level)); err != nil {
+			return fmt.Errorf("failed to create %s: %v", SiteIncludeDir(domain, level), err)
+		}
+	}
+	return nil
+}
+
+// siteHTTPInclude returns the http level include of a site's snippets.
+// A glob matching no file is not an error to nginx.
+func siteHTTPInclude(domain string) string {
+	return fmt.Sprintf(`# Custom http level directives (svp nginx edit %s --http)
+include %s/*.conf;
+
+`, domain, SiteIncludeDir(domain, "http"))
+}
+
+// siteServerInclude returns the server level include of a site's snippets
+func siteServerInclude(domain string) string {
+	return fmt.Sprintf(`    # Custom directives (svp nginx edit %s)
+    include %s/*.conf;
+
+`, domain, SiteIncludeDir(domain, "server"))
+}
+
+// VhostHasSiteIncludes reports whether a site's vhost includes its snippet
+// directories, i.e. was generated since they exist
+func VhostHasSiteIncludes(domain string) bool {
+	conf, err := ReadNginxConfig(fmt.Sprintf("/etc/nginx/sites-available/%s.conf", domain))
+	if err != nil {
+		return false
+	}
+	server, http := false, false
+	conf.Walk(func(d, parent *NginxDirective) bool {
+		if d.Name == "include" {
+			switch {
+			case d.HasArg(SiteIncludeDir(domain, "server") + "/*.conf"):
+				server = true
+			case d.HasArg(SiteIncludeDir(domain, "http") + "/*.conf"):
+				http = true
+			}
+		}
+		return true
+	})
+	return server && http
+}
+
+// TestNginxConfig runs nginx -t and returns its report as the error when
+// the configuration is invalid
+func TestNginxConfig() error {
+	if _, err := utils.RunCommand("nginx", "-t"); err != nil {
+		return fmt.Errorf("nginx config test failed: %v", err)
+	}
+	return nil
+}
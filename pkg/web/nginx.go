@@ -2,8 +2,11 @@ package web
 
 import (
 	"fmt"
+	"strings"
+	"svp/pkg/config"
 	"svp/pkg/system"
 	"svp/pkg/utils"
+	"svp/types"
 )
 
 // InstallNginx installs and configures Nginx
@@ -118,20 +121,150 @@ add_header X-XSS-Protection "1; mode=block" always;
 }
 
 // CreateNginxVhost creates an Nginx virtual host configuration
-func CreateNginxVhost(domain, webroot, phpVersion string) error {
+// The vhost answers on the site's domain and aliases; when a canonical
+// hostname is set, the other names get a dedicated 301 redirect block.
+// When SSL is enabled the HTTPS server blocks are generated here as well,
+// so regenerating the vhost never depends on certbot rewriting it
+func CreateNginxVhost(site *types.SiteConfig) error {
+	domain := site.Domain
 	vhostPath := fmt.Sprintf("/etc/nginx/sites-available/%s.conf", domain)
 	vhostLink := fmt.Sprintf("/etc/nginx/sites-enabled/%s.conf", domain)
 
-	// Sanitize pool name for PHP-FPM
-	poolName := domain
+	serverNames, redirectNames := splitServerNames(site)
+
+	// Redirect target for non-canonical names (or all names on HTTP when SSL is on)
+	target := site.CanonicalHost
+	if len(redirectNames) == 0 {
+		target = "$host"
+	}
 
-	vhostConfig := fmt.Sprintf(`# Nginx configuration for %s
+	certDir := fmt.Sprintf("/etc/letsencrypt/live/%s", domain)
+	useSSL := site.SSLEnabled && utils.CheckFileExists(certDir+"/fullchain.pem")
+	if site.SSLEnabled && !useSSL {
+		utils.Warn("SSL enabled for %s but certificate not found in %s - generating HTTP only vhost", domain, certDir)
+	}
+
+	vhostConfig := fmt.Sprintf("# Nginx configuration for %s\n", domain)
+
+	// Cache and rate limit zones are defined at http level, ahead of the
+	// server blocks
+	if site.PageCache {
+		if err := ensurePageCache(domain); err != nil {
+			return err
+		}
+		vhostConfig += pageCacheZoneConfig(domain)
+	}
+	if site.RateLimit {
+		vhostConfig += rateLimitZoneConfig(site)
+	}
+
+	// Snippets added with 'svp nginx edit' live outside the vhost, so
+	// regenerating it keeps them
+	if err := EnsureSiteIncludeDirs(domain); err != nil {
+		return err
+	}
+	vhostConfig += siteHTTPInclude(domain)
+
+	if useSSL {
+		vhostConfig += fmt.Sprintf(`# Redirect HTTP to HTTPS
 server {
     listen 80;
     listen [::]:80;
     server_name %s;
 
-    root %s;
+%s    location / {
+        return 301 https://%s$request_uri;
+    }
+}
+
+server {
+    listen 443 ssl;
+    listen [::]:443 ssl;
+    server_name %s;
+
+%s
+%s}
+`, strings.Join(site.Hostnames(), " "), siteServerInclude(domain), target, strings.Join(serverNames, " "), sslDirectives(certDir), siteServerBody(site))
+
+		if len(redirectNames) > 0 {
+			vhostConfig += fmt.Sprintf(`
+# Redirect non-canonical hostnames to %s
+server {
+    listen 443 ssl;
+    listen [::]:443 ssl;
+    server_name %s;
+
+%s
+    location / {
+        return 301 https://%s$request_uri;
+    }
+}
+`, site.CanonicalHost, strings.Join(redirectNames, " "), sslDirectives(certDir), site.CanonicalHost)
+		}
+	} else {
+		vhostConfig += fmt.Sprintf(`server {
+    listen 80;
+    listen [::]:80;
+    server_name %s;
+
+%s}
+`, strings.Join(serverNames, " "), siteServerBody(site))
+
+		if len(redirectNames) > 0 {
+			vhostConfig += fmt.Sprintf(`
+# Redirect non-canonical hostnames to %s
+server {
+    listen 80;
+    listen [::]:80;
+    server_name %s;
+
+    location / {
+        return 301 $scheme://%s$request_uri;
+    }
+}
+`, site.CanonicalHost, strings.Join(redirectNames, " "), site.CanonicalHost)
+		}
+	}
+
+	if utils.CheckFileExists(vhostPath) {
+		utils.Log("Updating Nginx vhost for %s", domain)
+	} else {
+		utils.Log("Creating Nginx vhost for %s", domain)
+	}
+	
+	_, err := utils.RunShell(fmt.Sprintf("cat > %s <<'EOF'\n%s\nEOF", vhostPath, vhostConfig))
+	if err != nil {
+		return fmt.Errorf("failed to create vhost config: %v", err)
+	}
+
+	// Enable site
+	if !utils.CheckFileExists(vhostLink) {
+		utils.Log("Enabling site %s", domain)
+		_, err := utils.RunCommand("ln", "-sf", vhostPath, vhostLink)
+		if err != nil {
+			return fmt.Errorf("failed to enable site: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// siteServerBody returns the directives shared by the HTTP and HTTPS
+// server blocks that serve a PHP site
+func siteServerBody(site *types.SiteConfig) string {
+	// Sanitize pool name for PHP-FPM
+	poolName := site.Domain
+
+	limits := ""
+	if site.RateLimit {
+		limits = rateLimitDirectives(site)
+	}
+	pageCache := ""
+	if site.PageCache {
+		pageCache = pageCacheDirectives(site)
+	}
+
+	return fmt.Sprintf(`    root %s;
     index index.php index.html index.htm;
 
     # Set pool variable for PHP-FPM
@@ -144,7 +277,7 @@ server {
     # Security headers
     include snippets/security-headers.conf;
 
-    # Main location block
+%s%s%s    # Main location block
     location / {
         try_files $uri $uri/ /index.php?$query_string;
     }
@@ -158,30 +291,67 @@ server {
         access_log off;
         log_not_found off;
     }
+`, site.Webroot, poolName, site.Domain, site.Domain, limits, pageCache, siteServerInclude(site.Domain), site.PHPVersion)
 }
-`, domain, domain, webroot, poolName, domain, domain, phpVersion)
 
-	if utils.CheckFileExists(vhostPath) {
-		utils.Log("Updating Nginx vhost for %s", domain)
-	} else {
-		utils.Log("Creating Nginx vhost for %s", domain)
+// siteZone returns the name of a site's nginx zones and variables, which
+// are shared by all vhosts: svp_ and the domain slug, e.g.
+// svp_example_com_a379a6
+func siteZone(domain string) string {
+	return "svp_" + config.DomainSlug(domain)
+}
+
+// sslDirectives returns the certificate and hardening directives for an
+// HTTPS server block using the certificate in certDir
+func sslDirectives(certDir string) string {
+	directives := fmt.Sprintf(`    # SSL certificate (managed by svp, issued by Let's Encrypt)
+    ssl_certificate %s/fullchain.pem;
+    ssl_certificate_key %s/privkey.pem;
+`, certDir, certDir)
+
+	// Reuse certbot's recommended TLS settings when available
+	if utils.CheckFileExists("/etc/letsencrypt/options-ssl-nginx.conf") {
+		directives += "    include /etc/letsencrypt/options-ssl-nginx.conf;\n"
 	}
-	
-	_, err := utils.RunShell(fmt.Sprintf("cat > %s <<'EOF'\n%s\nEOF", vhostPath, vhostConfig))
-	if err != nil {
-		return fmt.Errorf("failed to create vhost config: %v", err)
+	if utils.CheckFileExists("/etc/letsencrypt/ssl-dhparams.pem") {
+		directives += "    ssl_dhparam /etc/letsencrypt/ssl-dhparams.pem;\n"
 	}
 
-	// Enable site
-	if !utils.CheckFileExists(vhostLink) {
-		utils.Log("Enabling site %s", domain)
-		_, err := utils.RunCommand("ln", "-sf", vhostPath, vhostLink)
-		if err != nil {
-			return fmt.Errorf("failed to enable site: %v", err)
+	directives += `
+    # Enhanced SSL Security Settings
+    ssl_stapling on;
+    ssl_stapling_verify on;
+    resolver 8.8.8.8 8.8.4.4 valid=300s;
+    resolver_timeout 5s;
+
+    # HSTS (HTTP Strict Transport Security)
+    add_header Strict-Transport-Security "max-age=63072000; includeSubDomains; preload" always;
+`
+	return directives
+}
+
+// splitServerNames returns the hostnames served by the main server block and
+// the hostnames that should be redirected to the canonical host
+func splitServerNames(site *types.SiteConfig) (serverNames, redirectNames []string) {
+	hostnames := site.Hostnames()
+	if site.CanonicalHost == "" || len(hostnames) < 2 {
+		return hostnames, nil
+	}
+
+	for _, name := range hostnames {
+		if name == site.CanonicalHost {
+			serverNames = append(serverNames, name)
+		} else {
+			redirectNames = append(redirectNames, name)
 		}
 	}
 
-	return nil
+	// Canonical host no longer exists among the names - serve all of them
+	if len(serverNames) == 0 {
+		return hostnames, nil
+	}
+
+	return serverNames, redirectNames
 }
 
 // CreateNginxVhostNode creates an Nginx virtual host for a Node.js application
@@ -0,0 +1,512 @@
+package web
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"svp/pkg/utils"
+)
+
+// NginxConfig is a parsed nginx configuration file. Printing it gives back
+// the original text byte for byte, comments and layout included; only
+// directives that were changed or added are printed anew.
+type NginxConfig struct {
+	Directives []*NginxDirective
+
+	// trailing is the whitespace and comments after the last directive
+	trailing string
+}
+
+// NginxDirective is a simple directive (listen 80;) or a block directive
+// (server { ... }) of an nginx configuration
+type NginxDirective struct {
+	Name string
+	// Args are the parameters with quotes and escapes removed
+	Args []string
+	// Children are the directives of a block; nil for simple directives
+	Children []*NginxDirective
+	// Comment is printed on its own line above a directive added to a
+	// configuration. Parsed directives keep their comments as written.
+	Comment string
+
+	// Source text: the whitespace and comments before the directive, the
+	// directive itself up to its ; or {, a comment on the same line after
+	// its ; or }, and the whitespace and comments before the } of a block
+	leading  string
+	head     string
+	trailing string
+	inner    string
+
+	// The name and arguments head was parsed into, to detect changes
+	parsedName string
+	parsedArgs []string
+	block      bool
+}
+
+// nginxIndent is the indentation per block level of printed directives
+const nginxIndent = "    "
+
+// NewNginxDirective returns a simple directive to add to a configuration
+func NewNginxDirective(name string, args ...string) *NginxDirective {
+	return &NginxDirective{Name: name, Args: args}
+}
+
+// NewNginxBlock returns a block directive to add to a configuration
+func NewNginxBlock(name string, args []string, children ...*NginxDirective) *NginxDirective {
+	return &NginxDirective{Name: name, Args: args, Children: children, block: true}
+}
+
+// ReadNginxConfig parses an nginx configuration file
+func ReadNginxConfig(path string) (*NginxConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	conf, err := ParseNginxConfig(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return conf, nil
+}
+
+// WriteFile replaces an nginx configuration file with the printed config
+func (c *NginxConfig) WriteFile(path string) error {
+	return utils.WriteFileAtomic(path, []byte(c.String()), 0644)
+}
+
+// ParseNginxConfig parses the text of an nginx configuration file
+func ParseNginxConfig(src string) (*NginxConfig, error) {
+	p := &nginxParser{src: src}
+	directives, trailing, err := p.parseBlock(0)
+	if err != nil {
+		return nil, err
+	}
+	return &NginxConfig{Directives: directives, trailing: trailing}, nil
+}
+
+// String prints the configuration
+func (c *NginxConfig) String() string {
+	var b strings.Builder
+	for _, d := range c.Directives {
+		d.print(&b, 0)
+	}
+	b.WriteString(c.trailing)
+	return b.String()
+}
+
+// Walk calls fn for every directive, parents before their children, with
+// the block the directive is in (nil at the top level). Children of a
+// directive are skipped if fn returns false.
+func (c *NginxConfig) Walk(fn func(d, parent *NginxDirective) bool) {
+	walkNginx(c.Directives, nil, fn)
+}
+
+func walkNginx(directives []*NginxDirective, parent *NginxDirective, fn func(d, parent *NginxDirective) bool) {
+	for _, d := range directives {
+		if fn(d, parent) {
+			walkNginx(d.Children, d, fn)
+		}
+	}
+}
+
+// Servers returns the server blocks, at the top level (a sites-available
+// file) or inside http (nginx.conf)
+func (c *NginxConfig) Servers() []*NginxDirective {
+	var servers []*NginxDirective
+	c.Walk(func(d, parent *NginxDirective) bool {
+		if d.Name == "server" && d.IsBlock() {
+			servers = append(servers, d)
+			return false
+		}
+		return d.Name == "http"
+	})
+	return servers
+}
+
+// ServersListening returns the server blocks with a listen directive on a
+// port, e.g. "443"
+func (c *NginxConfig) ServersListening(port string) []*NginxDirective {
+	var servers []*NginxDirective
+	for _, server := range c.Servers() {
+		if server.ListensOn(port) {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// Remove deletes a directive, with the comments above it, wherever it is in
+// the configuration. It reports whether the directive was found.
+func (c *NginxConfig) Remove(target *NginxDirective) bool {
+	return removeNginx(&c.Directives, target)
+}
+
+func removeNginx(directives *[]*NginxDirective, target *NginxDirective) bool {
+	for i, d := range *directives {
+		if d == target {
+			*directives = append((*directives)[:i:i], (*directives)[i+1:]...)
+			return true
+		}
+		if removeNginx(&d.Children, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveAll deletes every directive for which match returns true and
+// returns how many were deleted
+func (c *NginxConfig) RemoveAll(match func(d *NginxDirective) bool) int {
+	return removeAllNginx(&c.Directives, match)
+}
+
+func removeAllNginx(directives *[]*NginxDirective, match func(d *NginxDirective) bool) int {
+	removed := 0
+	kept := (*directives)[:0:0]
+	for _, d := range *directives {
+		if match(d) {
+			removed++
+			continue
+		}
+		removed += removeAllNginx(&d.Children, match)
+		kept = append(kept, d)
+	}
+	*directives = kept
+	return removed
+}
+
+// IsBlock reports whether the directive has a { } block
+func (d *NginxDirective) IsBlock() bool {
+	return d.block || d.Children != nil
+}
+
+// Find returns the directives named name directly inside a block
+func (d *NginxDirective) Find(name string) []*NginxDirective {
+	var found []*NginxDirective
+	for _, child := range d.Children {
+		if child.Name == name {
+			found = append(found, child)
+		}
+	}
+	return found
+}
+
+// FindOne returns the first directive named name directly inside a block
+func (d *NginxDirective) FindOne(name string) *NginxDirective {
+	for _, child := range d.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// HasArg reports whether one of the arguments is arg
+func (d *NginxDirective) HasArg(arg string) bool {
+	for _, a := range d.Args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// ListensOn reports whether a server block has a listen directive on a port:
+// 443, *:443, 1.2.3.4:443 or [::]:443
+func (d *NginxDirective) ListensOn(port string) bool {
+	for _, listen := range d.Find("listen") {
+		if len(listen.Args) > 0 && (listen.Args[0] == port || strings.HasSuffix(listen.Args[0], ":"+port)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set gives the first directive named name in a block new arguments, or
+// appends the directive if there is none. It returns the directive.
+func (d *NginxDirective) Set(name string, args ...string) *NginxDirective {
+	if existing := d.FindOne(name); existing != nil {
+		existing.Args = args
+		return existing
+	}
+	added := NewNginxDirective(name, args...)
+	d.Append(added)
+	return added
+}
+
+// Append adds directives at the end of a block
+func (d *NginxDirective) Append(directives ...*NginxDirective) {
+	d.block = true
+	d.Children = append(d.Children, directives...)
+}
+
+// InsertAfter adds directives to a block after one of its directives, or at
+// the end if after is not in the block
+func (d *NginxDirective) InsertAfter(after *NginxDirective, directives ...*NginxDirective) {
+	for i, child := range d.Children {
+		if child == after {
+			rest := append(append([]*NginxDirective(nil), directives...), d.Children[i+1:]...)
+			d.Children = append(d.Children[:i+1:i+1], rest...)
+			return
+		}
+	}
+	d.Append(directives...)
+}
+
+// changed reports whether the name or arguments differ from the source
+func (d *NginxDirective) changed() bool {
+	if d.head == "" || d.Name != d.parsedName || len(d.Args) != len(d.parsedArgs) {
+		return true
+	}
+	for i, arg := range d.Args {
+		if arg != d.parsedArgs[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// print writes a directive at a block depth
+func (d *NginxDirective) print(b *strings.Builder, depth int) {
+	indent := strings.Repeat(nginxIndent, depth)
+	if d.head == "" {
+		// Added directive: own line, blocks at the top level set apart
+		if depth == 0 || d.Comment != "" {
+			b.WriteString("\n")
+		}
+		if d.Comment != "" {
+			b.WriteString("\n" + indent + "# " + d.Comment)
+		}
+		b.WriteString("\n" + indent)
+	} else {
+		b.WriteString(d.leading)
+	}
+
+	if d.changed() {
+		b.WriteString(d.Name)
+		for _, arg := range d.Args {
+			b.WriteString(" " + quoteNginxArg(arg))
+		}
+		if d.IsBlock() {
+			b.WriteString(" {")
+		} else {
+			b.WriteString(";")
+		}
+	} else {
+		b.WriteString(d.head)
+	}
+
+	if d.IsBlock() {
+		for _, child := range d.Children {
+			child.print(b, depth+1)
+		}
+		if d.head == "" {
+			b.WriteString("\n" + indent)
+		} else {
+			b.WriteString(d.inner)
+		}
+		b.WriteString("}")
+	}
+	b.WriteString(d.trailing)
+}
+
+// quoteNginxArg quotes an argument that would not survive as a bare word.
+// Backslashes of regular expressions (\.php$) are fine in bare words.
+func quoteNginxArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\r\n;{}#\"'") {
+		return arg
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg)
+	return `"` + escaped + `"`
+}
+
+// nginxParser reads directives the way nginx tokenizes its configuration:
+// words and quoted strings separated by whitespace, ended by ; or {, with
+// # comments running to the end of the line
+type nginxParser struct {
+	src string
+	pos int
+}
+
+// parseBlock reads directives up to the } closing a block at depth > 0, or
+// to the end of the file at depth 0. It returns them and the text before
+// the } or the end.
+func (p *nginxParser) parseBlock(depth int) ([]*NginxDirective, string, error) {
+	var directives []*NginxDirective
+	for {
+		leading := p.skipTrivia()
+		if p.pos >= len(p.src) {
+			if depth > 0 {
+				return nil, "", fmt.Errorf("line %d: unexpected end of file, expecting \"}\"", p.line())
+			}
+			return directives, leading, nil
+		}
+		if p.src[p.pos] == '}' {
+			if depth == 0 {
+				return nil, "", fmt.Errorf("line %d: unexpected \"}\"", p.line())
+			}
+			p.pos++
+			return directives, leading, nil
+		}
+
+		d, err := p.parseDirective(depth)
+		if err != nil {
+			return nil, "", err
+		}
+		d.leading = leading
+		directives = append(directives, d)
+	}
+}
+
+// parseDirective reads one directive, with its block
+func (p *nginxParser) parseDirective(depth int) (*NginxDirective, error) {
+	start := p.pos
+	var words []string
+	for {
+		p.skipTrivia()
+		if p.pos >= len(p.src) {
+			return nil, fmt.Errorf("line %d: unexpected end of file, expecting \";\" or \"{\"", p.line())
+		}
+		switch p.src[p.pos] {
+		case ';', '{':
+			if len(words) == 0 {
+				return nil, fmt.Errorf("line %d: unexpected %q", p.line(), p.src[p.pos])
+			}
+			open := p.src[p.pos] == '{'
+			p.pos++
+			d := &NginxDirective{
+				Name:       words[0],
+				Args:       words[1:],
+				head:       p.src[start:p.pos],
+				parsedName: words[0],
+				parsedArgs: append([]string(nil), words[1:]...),
+				block:      open,
+			}
+			if open {
+				children, inner, err := p.parseBlock(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				d.Children, d.inner = children, inner
+				if d.Children == nil {
+					d.Children = []*NginxDirective{}
+				}
+			}
+			d.trailing = p.sameLineComment()
+			return d, nil
+		case '}':
+			return nil, fmt.Errorf("line %d: unexpected \"}\"", p.line())
+		}
+
+		word, err := p.word()
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, word)
+	}
+}
+
+// word reads a bare word or a quoted string and returns it unescaped
+func (p *nginxParser) word() (string, error) {
+	var b strings.Builder
+	if quote := p.src[p.pos]; quote == '"' || quote == '\'' {
+		startLine := p.line()
+		p.pos++
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			switch {
+			case c == '\\' && p.pos+1 < len(p.src):
+				b.WriteString(unescapeNginx(p.src[p.pos+1]))
+				p.pos += 2
+			case c == quote:
+				p.pos++
+				return b.String(), nil
+			default:
+				b.WriteByte(c)
+				p.pos++
+			}
+		}
+		return "", fmt.Errorf("line %d: unterminated string", startLine)
+	}
+
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == ';' || c == '{' || c == '}':
+			return b.String(), nil
+		case c == '$' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '{':
+			// ${var} inside a word
+			end := strings.IndexByte(p.src[p.pos:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("line %d: unterminated variable", p.line())
+			}
+			b.WriteString(p.src[p.pos : p.pos+end+1])
+			p.pos += end + 1
+		case c == '\\' && p.pos+1 < len(p.src):
+			b.WriteString(unescapeNginx(p.src[p.pos+1]))
+			p.pos += 2
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return b.String(), nil
+}
+
+// unescapeNginx returns what nginx makes of a backslash and the character
+// after it: quotes, backslashes and \t \r \n are unescaped, anything else
+// (e.g. \. of a regular expression) is kept as written
+func unescapeNginx(c byte) string {
+	switch c {
+	case '"', '\'', '\\':
+		return string(c)
+	case 't':
+		return "\t"
+	case 'r':
+		return "\r"
+	case 'n':
+		return "\n"
+	}
+	return "\\" + string(c)
+}
+
+// skipTrivia skips whitespace and comments and returns them
+func (p *nginxParser) skipTrivia() string {
+	start := p.pos
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return p.src[start:p.pos]
+		}
+	}
+	return p.src[start:p.pos]
+}
+
+// sameLineComment returns the spaces and comment following a ; or } on the
+// same line (# managed by Certbot), or nothing if no comment follows
+func (p *nginxParser) sameLineComment() string {
+	end := p.pos
+	for end < len(p.src) && (p.src[end] == ' ' || p.src[end] == '\t') {
+		end++
+	}
+	if end >= len(p.src) || p.src[end] != '#' {
+		return ""
+	}
+	for end < len(p.src) && p.src[end] != '\n' {
+		end++
+	}
+	comment := p.src[p.pos:end]
+	p.pos = end
+	return comment
+}
+
+// line returns the line number of the current position
+func (p *nginxParser) line() int {
+	return strings.Count(p.src[:p.pos], "\n") + 1
+}
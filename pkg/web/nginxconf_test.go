@@ -0,0 +1,488 @@
+package web
+
+import (
+	"strings"
+	"svp/types"
+	"testing"
+)
+
+// generatedVhost returns a vhost the way CreateNginxVhost writes it, with
+// the page cache, rate limits and blocked user agents on
+func generatedVhost() string {
+	site := &types.SiteConfig{
+		Domain:        "example.com",
+		PHPVersion:    "8.3",
+		Webroot:       "/var/www/example.com/web",
+		CMS:           "drupal",
+		PageCache:     true,
+		RateLimit:     true,
+		BlockedAgents: []string{"AhrefsBot", "Mozilla/5.0 (compatible; Bot)"},
+	}
+	return "# Nginx configuration for example.com\n" +
+		pageCacheZoneConfig(site.Domain) +
+		rateLimitZoneConfig(site) +
+		siteHTTPInclude(site.Domain) +
+		"server {\n    listen 80;\n    listen [::]:80;\n    server_name example.com www.example.com;\n\n" +
+		siteServerBody(site) +
+		"}\n"
+}
+
+const certbotVhost = `# Nginx configuration for example.org
+server {
+    server_name example.org www.example.org;
+
+    root /var/www/example.org;
+    index index.php index.html;
+
+    location / {
+        try_files $uri $uri/ /index.php?$query_string;
+    }
+
+    listen [::]:443 ssl ipv6only=on; # managed by Certbot
+    listen 443 ssl; # managed by Certbot
+    ssl_certificate /etc/letsencrypt/live/example.org/fullchain.pem; # managed by Certbot
+    ssl_certificate_key /etc/letsencrypt/live/example.org/privkey.pem; # managed by Certbot
+    include /etc/letsencrypt/options-ssl-nginx.conf; # managed by Certbot
+    ssl_dhparam /etc/letsencrypt/ssl-dhparams.pem; # managed by Certbot
+
+}
+server {
+    if ($host = www.example.org) {
+        return 301 https://$host$request_uri;
+    } # managed by Certbot
+
+
+    if ($host = example.org) {
+        return 301 https://$host$request_uri;
+    } # managed by Certbot
+
+
+    listen 80;
+    listen [::]:80;
+    server_name example.org www.example.org;
+    return 404; # managed by Certbot
+
+
+
+
+}`
+
+const handWrittenVhost = `# Legacy vhost
+	# tab indented, CRLF line endings below
+server {	# opening comment
+	listen 80 default_server;
+	server_name _;
+	auth_basic "Restricted \"area\"";
+	auth_basic_user_file /etc/nginx/.htpasswd;
+	log_format  main  '$remote_addr - $remote_user [$time_local] "$request" '
+	                  '$status $body_bytes_sent';
+	set $path_info "";
+	add_header Content-Security-Policy "default-src 'self'; img-src *" always;
+	rewrite ^/old/(.*)$ /new/$1 permanent;
+	location ~ \.php$ {
+		fastcgi_split_path_info ^(.+\.php)(/.+)$;
+		fastcgi_param SCRIPT_FILENAME ${document_root}$fastcgi_script_name;
+		location ~ ^/admin {
+			allow 10.0.0.0/8;
+			deny all;
+			if ($request_method = POST) { return 405; }
+		}
+	}
+	location = /empty {}
+	# comment before the closing brace
+}
+` + "server {\r\n    listen 8080;\r\n    return 204;\r\n}\r\n# trailing comment without newline"
+
+func TestNginxConfigRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"empty", ""},
+		{"only comments", "# nothing here\n\n# at all\n"},
+		{"svp generated", generatedVhost()},
+		{"certbot rewritten", certbotVhost},
+		{"hand written", handWrittenVhost},
+		{"no trailing newline", "events {}\nhttp { include mime.types; }"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := ParseNginxConfig(tt.src)
+			if err != nil {
+				t.Fatalf("ParseNginxConfig: %v", err)
+			}
+			if got := conf.String(); got != tt.src {
+				t.Errorf("String() does not give back the source\ngot:\n%s\nwant:\n%s", got, tt.src)
+			}
+		})
+	}
+}
+
+func TestNginxConfigParse(t *testing.T) {
+	conf, err := ParseNginxConfig(handWrittenVhost)
+	if err != nil {
+		t.Fatalf("ParseNginxConfig: %v", err)
+	}
+	servers := conf.Servers()
+	if len(servers) != 2 {
+		t.Fatalf("got %d server blocks, want 2", len(servers))
+	}
+	server := servers[0]
+
+	args := func(name string) string {
+		d := server.FindOne(name)
+		if d == nil {
+			t.Fatalf("%s not found", name)
+		}
+		return strings.Join(d.Args, "|")
+	}
+	if got, want := args("auth_basic"), `Restricted "area"`; got != want {
+		t.Errorf("auth_basic = %q, want %q", got, want)
+	}
+	if got, want := args("log_format"), `main|$remote_addr - $remote_user [$time_local] "$request" |$status $body_bytes_sent`; got != want {
+		t.Errorf("log_format = %q, want %q", got, want)
+	}
+	if got, want := args("set"), `$path_info|`; got != want {
+		t.Errorf("set = %q, want %q", got, want)
+	}
+	if got, want := args("add_header"), `Content-Security-Policy|default-src 'self'; img-src *|always`; got != want {
+		t.Errorf("add_header = %q, want %q", got, want)
+	}
+
+	php := server.FindOne("location")
+	if php == nil || !php.HasArg(`\.php$`) {
+		t.Fatalf("first location = %v, want ~ \\.php$", php)
+	}
+	if got, want := strings.Join(php.FindOne("fastcgi_param").Args, "|"), `SCRIPT_FILENAME|${document_root}$fastcgi_script_name`; got != want {
+		t.Errorf("fastcgi_param = %q, want %q", got, want)
+	}
+	admin := php.FindOne("location")
+	if admin == nil || admin.FindOne("if") == nil || admin.FindOne("if").FindOne("return") == nil {
+		t.Fatal("nested location with if block not parsed")
+	}
+
+	if !servers[1].ListensOn("8080") || servers[1].ListensOn("80") {
+		t.Error("second server should listen on 8080 only")
+	}
+	if got := len(conf.ServersListening("80")); got != 1 {
+		t.Errorf("ServersListening(80) = %d servers, want 1", got)
+	}
+}
+
+func TestNginxConfigParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"unclosed block", "server {\n    listen 80;\n", "line 3: unexpected end of file"},
+		{"stray brace", "server {}\n}\n", "line 2: unexpected \"}\""},
+		{"missing semicolon", "server {\n    listen 80\n}\n", "line 3: unexpected \"}\""},
+		{"unterminated string", "server {\n    return 200 \"ok;\n}\n", "line 2: unterminated string"},
+		{"directive without name", "server {\n    ;\n}\n", "line 2: unexpected ';'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseNginxConfig(tt.src)
+			if err == nil {
+				t.Fatal("ParseNginxConfig succeeded, want an error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNginxConfigEdit(t *testing.T) {
+	const src = `# Site
+server {
+    listen 80;
+    server_name example.com; # primary
+
+    # Basic auth
+    auth_basic "Restricted";
+    auth_basic_user_file /etc/nginx/.htpasswd;
+
+    location / {
+        try_files $uri /index.php;
+    }
+}
+`
+	tests := []struct {
+		name string
+		edit func(t *testing.T, conf *NginxConfig)
+		want string
+	}{
+		{
+			name: "remove with comment above",
+			edit: func(t *testing.T, conf *NginxConfig) {
+				if !conf.Remove(conf.Servers()[0].FindOne("auth_basic")) {
+					t.Fatal("Remove did not find auth_basic")
+				}
+			},
+			want: `# Site
+server {
+    listen 80;
+    server_name example.com; # primary
+    auth_basic_user_file /etc/nginx/.htpasswd;
+
+    location / {
+        try_files $uri /index.php;
+    }
+}
+`,
+		},
+		{
+			name: "remove nested",
+			edit: func(t *testing.T, conf *NginxConfig) {
+				location := conf.Servers()[0].FindOne("location")
+				if !conf.Remove(location.FindOne("try_files")) {
+					t.Fatal("Remove did not find try_files")
+				}
+			},
+			want: `# Site
+server {
+    listen 80;
+    server_name example.com; # primary
+
+    # Basic auth
+    auth_basic "Restricted";
+    auth_basic_user_file /etc/nginx/.htpasswd;
+
+    location / {
+    }
+}
+`,
+		},
+		{
+			name: "remove missing",
+			edit: func(t *testing.T, conf *NginxConfig) {
+				if conf.Remove(NewNginxDirective("listen", "80")) {
+					t.Fatal("Remove found a directive that is not in the config")
+				}
+			},
+			want: src,
+		},
+		{
+			name: "remove all",
+			edit: func(t *testing.T, conf *NginxConfig) {
+				n := conf.RemoveAll(func(d *NginxDirective) bool { return strings.HasPrefix(d.Name, "auth_basic") })
+				if n != 2 {
+					t.Fatalf("RemoveAll removed %d directives, want 2", n)
+				}
+			},
+			want: `# Site
+server {
+    listen 80;
+    server_name example.com; # primary
+
+    location / {
+        try_files $uri /index.php;
+    }
+}
+`,
+		},
+		{
+			name: "set existing keeps layout and comment",
+			edit: func(t *testing.T, conf *NginxConfig) {
+				server := conf.Servers()[0]
+				server.Set("server_name", "example.com", "www.example.com")
+				server.Set("auth_basic", "Staff only")
+			},
+			want: `# Site
+server {
+    listen 80;
+    server_name example.com www.example.com; # primary
+
+    # Basic auth
+    auth_basic "Staff only";
+    auth_basic_user_file /etc/nginx/.htpasswd;
+
+    location / {
+        try_files $uri /index.php;
+    }
+}
+`,
+		},
+		{
+			name: "set unchanged",
+			edit: func(t *testing.T, conf *NginxConfig) {
+				conf.Servers()[0].Set("auth_basic", "Restricted")
+			},
+			want: src,
+		},
+		{
+			name: "set new appends",
+			edit: func(t *testing.T, conf *NginxConfig) {
+				conf.Servers()[0].Set("client_max_body_size", "64m")
+			},
+			want: `# Site
+server {
+    listen 80;
+    server_name example.com; # primary
+
+    # Basic auth
+    auth_basic "Restricted";
+    auth_basic_user_file /etc/nginx/.htpasswd;
+
+    location / {
+        try_files $uri /index.php;
+    }
+    client_max_body_size 64m;
+}
+`,
+		},
+		{
+			name: "insert after",
+			edit: func(t *testing.T, conf *NginxConfig) {
+				server := conf.Servers()[0]
+				server.InsertAfter(server.FindOne("server_name"),
+					NewNginxDirective("return", "301", "https://$host$request_uri"))
+			},
+			want: `# Site
+server {
+    listen 80;
+    server_name example.com; # primary
+    return 301 https://$host$request_uri;
+
+    # Basic auth
+    auth_basic "Restricted";
+    auth_basic_user_file /etc/nginx/.htpasswd;
+
+    location / {
+        try_files $uri /index.php;
+    }
+}
+`,
+		},
+		{
+			name: "insert after with comment and block",
+			edit: func(t *testing.T, conf *NginxConfig) {
+				server := conf.Servers()[0]
+				block := NewNginxBlock("location", []string{"=", "/health"}, NewNginxDirective("return", "200", "ok"))
+				block.Comment = "Health check"
+				server.InsertAfter(server.FindOne("listen"), block)
+			},
+			want: `# Site
+server {
+    listen 80;
+
+    # Health check
+    location = /health {
+        return 200 ok;
+    }
+    server_name example.com; # primary
+
+    # Basic auth
+    auth_basic "Restricted";
+    auth_basic_user_file /etc/nginx/.htpasswd;
+
+    location / {
+        try_files $uri /index.php;
+    }
+}
+`,
+		},
+		{
+			name: "insert after missing appends",
+			edit: func(t *testing.T, conf *NginxConfig) {
+				conf.Servers()[0].InsertAfter(NewNginxDirective("listen", "443"),
+					NewNginxDirective("add_header", "X-Frame-Options", "SAMEORIGIN"))
+			},
+			want: `# Site
+server {
+    listen 80;
+    server_name example.com; # primary
+
+    # Basic auth
+    auth_basic "Restricted";
+    auth_basic_user_file /etc/nginx/.htpasswd;
+
+    location / {
+        try_files $uri /index.php;
+    }
+    add_header X-Frame-Options SAMEORIGIN;
+}
+`,
+		},
+		{
+			name: "quoted arguments",
+			edit: func(t *testing.T, conf *NginxConfig) {
+				conf.Servers()[0].Set("add_header", "Content-Security-Policy", `default-src 'self'; script-src "x"`)
+			},
+			want: `# Site
+server {
+    listen 80;
+    server_name example.com; # primary
+
+    # Basic auth
+    auth_basic "Restricted";
+    auth_basic_user_file /etc/nginx/.htpasswd;
+
+    location / {
+        try_files $uri /index.php;
+    }
+    add_header Content-Security-Policy "default-src 'self'; script-src \"x\"";
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := ParseNginxConfig(src)
+			if err != nil {
+				t.Fatalf("ParseNginxConfig: %v", err)
+			}
+			tt.edit(t, conf)
+			got := conf.String()
+			if got != tt.want {
+				t.Errorf("String() after edit\ngot:\n%s\nwant:\n%s", got, tt.want)
+			}
+
+			// What was printed must parse back to the same text
+			again, err := ParseNginxConfig(got)
+			if err != nil {
+				t.Fatalf("edited config does not parse: %v", err)
+			}
+			if again.String() != got {
+				t.Error("edited config does not round-trip")
+			}
+		})
+	}
+}
+
+func TestNginxConfigAddServer(t *testing.T) {
+	conf, err := ParseNginxConfig("# Site\nserver {\n    listen 80;\n}\n")
+	if err != nil {
+		t.Fatalf("ParseNginxConfig: %v", err)
+	}
+	server := NewNginxBlock("server", nil,
+		NewNginxDirective("listen", "443", "ssl"),
+		NewNginxBlock("location", []string{"/"}, NewNginxDirective("return", "204")))
+	conf.Directives = append(conf.Directives, server)
+
+	want := "# Site\nserver {\n    listen 80;\n}\n\nserver {\n    listen 443 ssl;\n    location / {\n        return 204;\n    }\n}\n"
+	if got := conf.String(); got != want {
+		t.Errorf("String()\ngot:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestSiteZone(t *testing.T) {
+	if a, b := siteZone("a-b.com"), siteZone("a.b.com"); a == b {
+		t.Errorf("a-b.com and a.b.com share the zone %s", a)
+	}
+
+	// Rejections are read back from the error log by zone name
+	for _, limit := range []string{"req", "login", "conn"} {
+		line := `2026/10/18 12:00:00 [error] 12#12: *34 limiting requests, excess: 5.480 by zone "` +
+			siteZone("shop.example-site.com") + "_" + limit + `", client: 203.0.113.7, server: shop.example-site.com`
+		m := rejectionRegex.FindStringSubmatch(line)
+		if m == nil || m[2] != limit {
+			t.Errorf("rejection in the %s zone not recognised: %s", limit, line)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package web
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"svp/pkg/utils"
+	"svp/types"
+	"time"
+)
+
+// PageCacheDir holds the FastCGI cache of each site in a subdirectory
+const PageCacheDir = "/var/cache/nginx/svp"
+
+// pageCacheLogFormat is the access log format of the page cache, defined at
+// http level in pageCacheLogConf since vhosts cannot share a log_format
+const (
+	pageCacheLogFormat = "svp_cache"
+	pageCacheLogConf   = "/etc/nginx/conf.d/svp-page-cache.conf"
+)
+
+// Page cache sizing: anonymous pages are kept for pageCacheValid, and the
+// least recently used ones are evicted beyond pageCacheMaxSize
+const (
+	pageCacheValid   = "10m"
+	pageCacheMaxSize = "256m"
+)
+
+// pageCacheKey is the fastcgi_cache_key of every site. PurgePageCache
+// computes the same keys.
+const pageCacheKey = "$scheme$request_method$host$request_uri"
+
+// PageCachePath returns the cache directory of a site
+func PageCachePath(domain string) string {
+	return filepath.Join(PageCacheDir, domain)
+}
+
+// PageCacheLogFile returns the log of a site's cache statuses
+func PageCacheLogFile(domain string) string {
+	return fmt.Sprintf("/var/log/nginx/%s-cache.log", domain)
+}
+
+// ensurePageCache creates the cache directory of a site and the log format
+// of the cache log
+func ensurePageCache(domain string) error {
+	if err := utils.EnsureDir(PageCachePath(domain)); err != nil {
+		return fmt.Errorf("failed to create page cache directory: %v", err)
+	}
+	_, _ = utils.RunCommand("chown", "www-data:www-data", PageCachePath(domain))
+
+	logFormat := fmt.Sprintf(`# Managed by svp - access log format of the page cache (DOMAIN-cache.log)
+log_format %s '$time_iso8601 $upstream_cache_status $request_method $status "$request_uri"';
+`, pageCacheLogFormat)
+	if current, err := os.ReadFile(pageCacheLogConf); err == nil && string(current) == logFormat {
+		return nil
+	}
+	return utils.WriteFileAtomic(pageCacheLogConf, []byte(logFormat), 0644)
+}
+
+// pageCacheZoneConfig returns the fastcgi_cache_path of a site, at http
+// level in its vhost file
+func pageCacheZoneConfig(domain string) string {
+	return fmt.Sprintf(`# FastCGI page cache of %s (svp cache)
+fastcgi_cache_path %s levels=1:2 keys_zone=%s:10m max_size=%s inactive=1h use_temp_path=off;
+
+`, domain, PageCachePath(domain), siteZone(domain), pageCacheMaxSize)
+}
+
+// pageCacheBypass returns the rules that keep requests of logged-in users,
+// form posts and admin pages away from the cache, per CMS
+func pageCacheBypass(cms string) string {
+	switch cms {
+	case "wordpress":
+		return `    if ($request_uri ~* "/wp-admin/|/wp-json/|/xmlrpc\.php|/wp-[a-z-]+\.php|/feed/|sitemap(_index)?\.xml") {
+        set $skip_cache 1;
+    }
+    if ($http_cookie ~* "comment_author|wordpress_[a-f0-9]+|wp-postpass|wordpress_no_cache|wordpress_logged_in|woocommerce_items_in_cart") {
+        set $skip_cache 1;
+    }
+`
+	case "drupal":
+		return `    if ($request_uri ~* "^/(user|admin|batch|cron|update\.php|install\.php|core/|node/add|node/[0-9]+/(edit|delete)|system/)") {
+        set $skip_cache 1;
+    }
+    if ($http_cookie ~* "S?SESS[a-z0-9]+|NO_CACHE") {
+        set $skip_cache 1;
+    }
+`
+	}
+	return ""
+}
+
+// pageCacheDirectives returns the server directives caching a site's
+// anonymous GET requests. Responses that set cookies are never cached;
+// Cache-Control is ignored since Drupal sends no-cache by default.
+func pageCacheDirectives(site *types.SiteConfig) string {
+	return fmt.Sprintf(`    # FastCGI page cache (svp cache)
+    set $skip_cache 0;
+    if ($request_method !~ ^(GET|HEAD)$) {
+        set $skip_cache 1;
+    }
+    if ($query_string != "") {
+        set $skip_cache 1;
+    }
+%s    fastcgi_cache %s;
+    fastcgi_cache_key "%s";
+    fastcgi_cache_valid 200 301 302 %s;
+    fastcgi_cache_valid 404 1m;
+    fastcgi_cache_use_stale error timeout updating http_500 http_503;
+    fastcgi_cache_background_update on;
+    fastcgi_cache_lock on;
+    fastcgi_cache_bypass $skip_cache;
+    fastcgi_no_cache $skip_cache;
+    fastcgi_ignore_headers Cache-Control Expires;
+    add_header X-Cache-Status $upstream_cache_status always;
+    access_log %s %s;
+
+`, pageCacheBypass(site.CMS), siteZone(site.Domain), pageCacheKey, pageCacheValid,
+		PageCacheLogFile(site.Domain), pageCacheLogFormat)
+}
+
+// PurgePageCache removes a site's cached pages: all of them if target is
+// empty, otherwise those of one path (/blog/ or a full URL) for every
+// hostname, scheme and method. It returns how many entries were removed.
+func PurgePageCache(site *types.SiteConfig, target string) (int, error) {
+	cacheDir := PageCachePath(site.Domain)
+	if target == "" {
+		removed := 0
+		err := filepath.WalkDir(cacheDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+				removed++
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to purge %s: %v", cacheDir, err)
+		}
+		return removed, nil
+	}
+
+	hosts := site.Hostnames()
+	requestURI := target
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		hosts = []string{strings.ToLower(u.Hostname())}
+		requestURI = u.RequestURI()
+	}
+	if !strings.HasPrefix(requestURI, "/") {
+		return 0, fmt.Errorf("invalid path %q (use e.g. /blog/ or https://%s/blog/)", target, site.Domain)
+	}
+
+	removed := 0
+	for _, host := range hosts {
+		for _, scheme := range []string{"http", "https"} {
+			for _, method := range []string{"GET", "HEAD"} {
+				file := pageCacheFile(cacheDir, scheme+method+host+requestURI)
+				if err := os.Remove(file); err == nil {
+					removed++
+				} else if !os.IsNotExist(err) {
+					return removed, fmt.Errorf("failed to remove %s: %v", file, err)
+				}
+			}
+		}
+	}
+	return removed, nil
+}
+
+// pageCacheFile returns where nginx stores the entry of a cache key with
+// levels=1:2: the last character of its MD5, then the two before it
+func pageCacheFile(cacheDir, key string) string {
+	sum := md5.Sum([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(cacheDir, name[len(name)-1:], name[len(name)-3:len(name)-1], name)
+}
+
+// PageCacheStats sums up a site's page cache: what is stored and how
+// requests were answered
+type PageCacheStats struct {
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+	MaxSize string `json:"max_size"`
+
+	// Requests per $upstream_cache_status (HIT, MISS, BYPASS, EXPIRED,
+	// STALE, UPDATING, REVALIDATED); requests not passed to PHP, such as
+	// static files, are not counted
+	Statuses map[string]int `json:"statuses"`
+	HitRatio float64        `json:"hit_ratio"`
+
+	// The paths PHP rendered most often although they are cacheable (MISS
+	// or EXPIRED); bypassed paths such as admin pages are left out
+	TopMisses []PageCacheMiss `json:"top_misses"`
+}
+
+// PageCacheMiss is a path and how often it was not served from the cache
+type PageCacheMiss struct {
+	Path  string `json:"path"`
+	Count int    `json:"count"`
+}
+
+// maxTopMisses is how many paths PageCacheStats lists
+const maxTopMisses = 10
+
+// ReadPageCacheStats measures a site's cache directory and reads its cache
+// log, rotated copies included, since a time
+func ReadPageCacheStats(domain string, since time.Time) (*PageCacheStats, error) {
+	stats := &PageCacheStats{MaxSize: pageCacheMaxSize, Statuses: make(map[string]int)}
+	err := filepath.WalkDir(PageCachePath(domain), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				stats.Entries++
+				stats.Bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %v", PageCachePath(domain), err)
+	}
+
+	misses := make(map[string]int)
+	err = utils.ReadLogLines(PageCacheLogFile(domain), func(line string) {
+		// $time_iso8601 $upstream_cache_status $request_method $status "$request_uri"
+		fields := strings.SplitN(line, " ", 5)
+		if len(fields) < 5 {
+			return
+		}
+		stamp, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil || stamp.Before(since) || fields[1] == "-" {
+			return
+		}
+		stats.Statuses[fields[1]]++
+		if fields[1] == "MISS" || fields[1] == "EXPIRED" {
+			path, _ := strconv.Unquote(fields[4])
+			if i := strings.IndexByte(path, '?'); i >= 0 {
+				path = path[:i]
+			}
+			misses[path]++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	total, hits := 0, 0
+	for status, n := range stats.Statuses {
+		total += n
+		switch status {
+		case "HIT", "STALE", "UPDATING", "REVALIDATED":
+			hits += n
+		}
+	}
+	if total > 0 {
+		stats.HitRatio = float64(hits) / float64(total)
+	}
+
+	for path, n := range misses {
+		stats.TopMisses = append(stats.TopMisses, PageCacheMiss{Path: path, Count: n})
+	}
+	sort.Slice(stats.TopMisses, func(i, j int) bool {
+		if stats.TopMisses[i].Count != stats.TopMisses[j].Count {
+			return stats.TopMisses[i].Count > stats.TopMisses[j].Count
+		}
+		return stats.TopMisses[i].Path < stats.TopMisses[j].Path
+	})
+	if len(stats.TopMisses) > maxTopMisses {
+		stats.TopMisses = stats.TopMisses[:maxTopMisses]
+	}
+	return stats, nil
+}
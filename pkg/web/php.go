@@ -101,6 +101,30 @@ func InstallPHP(version string, verifyOnly bool) error {
 	return nil
 }
 
+// InstallPHPExtension installs an extension package (e.g., redis for
+// php8.4-redis) for a PHP version and restarts PHP-FPM to load it
+func InstallPHPExtension(version, extension string, verifyOnly bool) error {
+	pkg := fmt.Sprintf("php%s-%s", version, extension)
+	if utils.CheckPackageInstalled(pkg) {
+		utils.Verify("%s already installed", pkg)
+		return nil
+	}
+	if verifyOnly {
+		utils.Fail("%s not installed", pkg)
+		return fmt.Errorf("%s not installed", pkg)
+	}
+
+	utils.Log("Installing %s...", pkg)
+	if _, err := utils.RunCommand("apt-get", "install", "-y", "--no-install-recommends", pkg); err != nil {
+		return fmt.Errorf("failed to install %s: %v", pkg, err)
+	}
+	if err := system.RestartService(fmt.Sprintf("php%s-fpm", version)); err != nil {
+		return err
+	}
+	utils.Ok("%s installed", pkg)
+	return nil
+}
+
 // HardenPHPIni applies security hardening to PHP configuration
 func HardenPHPIni(version string, verifyOnly bool) error {
 	fpmIni := fmt.Sprintf("/etc/php/%s/fpm/php.ini", version)
@@ -155,7 +179,9 @@ func HardenPHPIni(version string, verifyOnly bool) error {
 }
 
 // CreatePHPPool creates a PHP-FPM pool for a specific site
-func CreatePHPPool(domain, version, webroot string) error {
+// With a siteUser the pool runs as that user and gets private temp and
+// session directories; otherwise it runs as www-data like every other site
+func CreatePHPPool(domain, version, webroot, siteUser string) error {
 	poolFile := fmt.Sprintf("/etc/php/%s/fpm/pool.d/%s.conf", version, domain)
 	socketPath := fmt.Sprintf("/run/php/php%s-fpm-%s.sock", version, domain)
 
@@ -167,10 +193,33 @@ func CreatePHPPool(domain, version, webroot string) error {
 		projectRoot = webroot[:len(webroot)-4]
 	}
 
+	poolUser := "www-data"
+	basedirTmp := "/tmp"
+	tmpDir := "/tmp"
+	sessionDir := "/tmp"
+	sessionGC := ""
+	if siteUser != "" {
+		siteTmp, err := system.EnsureSiteTempDirs(domain, siteUser)
+		if err != nil {
+			return err
+		}
+		poolUser = siteUser
+		basedirTmp = siteTmp
+		tmpDir = siteTmp + "/tmp"
+		sessionDir = siteTmp + "/sessions"
+		// Debian's session cleanup cron only knows the default save path
+		sessionGC = "php_admin_value[session.gc_probability] = 1\n"
+
+		// Workers write the error log themselves, so it must belong to the site user
+		errorLog := fmt.Sprintf("/var/log/php%s-fpm-%s-error.log", version, domain)
+		_, _ = utils.RunCommand("touch", errorLog)
+		_, _ = utils.RunCommand("chown", fmt.Sprintf("%s:%s", siteUser, siteUser), errorLog)
+	}
+
 	poolConfig := fmt.Sprintf(`; PHP-FPM pool for %s
 [%s]
-user = www-data
-group = www-data
+user = %s
+group = %s
 listen = %s
 listen.owner = www-data
 listen.group = www-data
@@ -186,20 +235,25 @@ pm.max_requests = 500
 ; Environment
 env[HOSTNAME] = $HOSTNAME
 env[PATH] = /usr/local/bin:/usr/bin:/bin
-env[TMP] = /tmp
-env[TMPDIR] = /tmp
-env[TEMP] = /tmp
+env[TMP] = %s
+env[TMPDIR] = %s
+env[TEMP] = %s
 
 ; PHP admin values
 php_admin_value[error_log] = /var/log/php%s-fpm-%s-error.log
 php_admin_flag[log_errors] = on
 php_admin_value[memory_limit] = 512M
 
+; Stack traces of slow requests ('svp perf')
+slowlog = %s
+request_slowlog_timeout = %s
+
 ; Security
-php_admin_value[open_basedir] = %s:/tmp:/usr/share/php
-php_admin_value[upload_tmp_dir] = /tmp
-php_admin_value[session.save_path] = /tmp
-`, domain, domain, socketPath, version, domain, projectRoot)
+php_admin_value[open_basedir] = %s:%s:/usr/share/php
+php_admin_value[upload_tmp_dir] = %s
+php_admin_value[sys_temp_dir] = %s
+php_admin_value[session.save_path] = %s
+%s`, domain, domain, poolUser, poolUser, socketPath, tmpDir, tmpDir, tmpDir, version, domain, PHPSlowLogFile(version, domain), PHPSlowlogTimeout, projectRoot, basedirTmp, tmpDir, tmpDir, sessionDir, sessionGC)
 
 	if utils.CheckFileExists(poolFile) {
 		utils.Log("Updating PHP %s pool for %s", version, domain)
@@ -213,6 +267,10 @@ php_admin_value[session.save_path] = /tmp
 		return fmt.Errorf("failed to create PHP pool: %v", err)
 	}
 
+	if err := ensureSlowlogRotation(); err != nil {
+		utils.Warn("%v", err)
+	}
+
 	// Always restart PHP-FPM to load/reload the pool and create the socket
 	serviceName := fmt.Sprintf("php%s-fpm", version)
 	utils.Log("Restarting %s to load pool...", serviceName)
@@ -0,0 +1,240 @@
+package web
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"svp/pkg/utils"
+	"svp/types"
+	"time"
+)
+
+// Default rate limits of 'svp ratelimit': every client IP may make
+// DefaultRequestRate requests to a site with bursts of rateLimitBurst, hold
+// DefaultConnections connections, and request login paths at
+// DefaultLoginRate with bursts of loginLimitBurst
+const (
+	DefaultRequestRate = "10r/s"
+	DefaultLoginRate   = "5r/m"
+	DefaultConnections = 30
+
+	rateLimitBurst  = 50
+	loginLimitBurst = 5
+)
+
+// commonLoginPaths are limited on every site; bots try them whatever the CMS
+var commonLoginPaths = []string{"/xmlrpc.php"}
+
+// cmsLoginPaths are the login and account endpoints of each CMS
+var cmsLoginPaths = map[string][]string{
+	"wordpress": {"/wp-login.php"},
+	"drupal":    {"/user/login", "/user/password", "/user/register"},
+}
+
+var (
+	rateRegex      = regexp.MustCompile(`^[1-9][0-9]*r/[sm]$`)
+	limitPathRegex = regexp.MustCompile(`^/[A-Za-z0-9._~%/-]*$`)
+	userAgentRegex = regexp.MustCompile(`^[A-Za-z0-9 ._/+:-]+$`)
+)
+
+// RateLimits are the effective rate limits of a site, defaults included
+type RateLimits struct {
+	Rate        string
+	LoginRate   string
+	Connections int
+
+	// Path prefixes limited to LoginRate: the CMS login paths and the
+	// site's own
+	Paths []string
+
+	// User agent substrings answered with 403, case-insensitive
+	BlockedAgents []string
+}
+
+// SiteRateLimits returns the rate limits of a site, filling in the defaults
+// of what it does not set
+func SiteRateLimits(site *types.SiteConfig) RateLimits {
+	limits := RateLimits{
+		Rate:          site.RateLimitRate,
+		LoginRate:     site.RateLimitLoginRate,
+		Connections:   site.RateLimitConnections,
+		BlockedAgents: site.BlockedAgents,
+	}
+	if limits.Rate == "" {
+		limits.Rate = DefaultRequestRate
+	}
+	if limits.LoginRate == "" {
+		limits.LoginRate = DefaultLoginRate
+	}
+	if limits.Connections <= 0 {
+		limits.Connections = DefaultConnections
+	}
+
+	seen := make(map[string]bool)
+	paths := append(append(append([]string{}, cmsLoginPaths[site.CMS]...), commonLoginPaths...), site.RateLimitPaths...)
+	for _, path := range paths {
+		if !seen[path] {
+			seen[path] = true
+			limits.Paths = append(limits.Paths, path)
+		}
+	}
+	return limits
+}
+
+// ValidateRate checks an nginx request rate such as 10r/s or 30r/m
+func ValidateRate(rate string) error {
+	if !rateRegex.MatchString(rate) {
+		return fmt.Errorf("invalid rate %q (use e.g. 10r/s or 30r/m)", rate)
+	}
+	return nil
+}
+
+// ValidateLimitPath checks a path prefix to limit, such as /search
+func ValidateLimitPath(path string) error {
+	if !limitPathRegex.MatchString(path) {
+		return fmt.Errorf("invalid path %q (must start with / and hold no spaces, quotes or query string)", path)
+	}
+	return nil
+}
+
+// ValidateUserAgent checks a user agent substring to block, such as
+// AhrefsBot. Letters, digits, spaces and ._/+:- are allowed, so it can be
+// written into the site config and the nginx regex as is.
+func ValidateUserAgent(agent string) error {
+	if !userAgentRegex.MatchString(agent) {
+		return fmt.Errorf("invalid user agent %q (letters, digits, spaces and ._/+:- only)", agent)
+	}
+	return nil
+}
+
+// rateLimitZoneConfig returns the zones of a site's rate limits, at http
+// level in its vhost file. Login paths are limited through a map: requests
+// to other paths get an empty key, which limit_req does not count.
+func rateLimitZoneConfig(site *types.SiteConfig) string {
+	limits := SiteRateLimits(site)
+	zone := siteZone(site.Domain)
+
+	config := fmt.Sprintf(`# Rate limits of %s (svp ratelimit)
+limit_req_zone $binary_remote_addr zone=%s_req:10m rate=%s;
+limit_conn_zone $binary_remote_addr zone=%s_conn:10m;
+`, site.Domain, zone, limits.Rate, zone)
+
+	if len(limits.Paths) > 0 {
+		config += fmt.Sprintf("map $uri $%s_login_key {\n    default \"\";\n", zone)
+		for _, path := range limits.Paths {
+			config += fmt.Sprintf("    \"~^%s\" $binary_remote_addr;\n", regexp.QuoteMeta(path))
+		}
+		config += fmt.Sprintf("}\nlimit_req_zone $%s_login_key zone=%s_login:10m rate=%s;\n", zone, zone, limits.LoginRate)
+	}
+	return config + "\n"
+}
+
+// rateLimitDirectives returns the server directives applying a site's rate
+// limits. Requests over a limit are answered with 429 and logged to the
+// site's error log.
+func rateLimitDirectives(site *types.SiteConfig) string {
+	limits := SiteRateLimits(site)
+	zone := siteZone(site.Domain)
+
+	directives := fmt.Sprintf(`    # Rate limits (svp ratelimit)
+    limit_req zone=%s_req burst=%d nodelay;
+`, zone, rateLimitBurst)
+	if len(limits.Paths) > 0 {
+		directives += fmt.Sprintf("    limit_req zone=%s_login burst=%d nodelay;\n", zone, loginLimitBurst)
+	}
+	directives += fmt.Sprintf(`    limit_conn %s_conn %d;
+    limit_req_status 429;
+    limit_conn_status 429;
+`, zone, limits.Connections)
+
+	if len(limits.BlockedAgents) > 0 {
+		agents := make([]string, len(limits.BlockedAgents))
+		for i, agent := range limits.BlockedAgents {
+			agents[i] = regexp.QuoteMeta(agent)
+		}
+		directives += fmt.Sprintf(`    if ($http_user_agent ~* "(%s)") {
+        return 403;
+    }
+`, strings.Join(agents, "|"))
+	}
+	return directives + "\n"
+}
+
+// VhostHasRateLimits reports whether a site's vhost defines its rate limit
+// zones, i.e. was generated with its rate limits
+func VhostHasRateLimits(domain string) bool {
+	conf, err := ReadNginxConfig(fmt.Sprintf("/etc/nginx/sites-available/%s.conf", domain))
+	if err != nil {
+		return false
+	}
+	for _, d := range conf.Directives {
+		if d.Name == "limit_req_zone" && d.HasArg("zone="+siteZone(domain)+"_req:10m") {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimitRejections counts the requests a site's rate limits turned away
+type RateLimitRejections struct {
+	// Rejections per limit: requests, login or connections
+	Limits map[string]int
+
+	// The client IPs rejected most often, most first
+	TopClients []RateLimitClient
+}
+
+// RateLimitClient is a client IP and how often it was rejected
+type RateLimitClient struct {
+	IP    string
+	Count int
+}
+
+// maxTopClients is how many client IPs RateLimitRejections lists
+const maxTopClients = 10
+
+// rejectionRegex matches the error log line of a rejected request, e.g.
+// 2026/10/18 12:00:00 [error] 12#12: *34 limiting requests, excess: 5.480
+// by zone "svp_example_com_a379a6_login", client: 203.0.113.7, ...
+var rejectionRegex = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) \[\w+\] .*limiting (?:requests|connections),? .*by zone "svp_[a-z0-9_]+_(req|login|conn)", client: ([0-9a-fA-F.:]+)`)
+
+// ReadRateLimitRejections reads a site's error log, rotated copies
+// included, for requests its rate limits rejected since a time
+func ReadRateLimitRejections(domain string, since time.Time) (*RateLimitRejections, error) {
+	rejections := &RateLimitRejections{Limits: make(map[string]int)}
+	clients := make(map[string]int)
+	limitNames := map[string]string{"req": "requests", "login": "login", "conn": "connections"}
+
+	logFile := fmt.Sprintf("/var/log/nginx/%s-error.log", domain)
+	err := utils.ReadLogLines(logFile, func(line string) {
+		m := rejectionRegex.FindStringSubmatch(line)
+		if m == nil {
+			return
+		}
+		// nginx writes the error log in local time
+		stamp, err := time.ParseInLocation("2006/01/02 15:04:05", m[1], time.Local)
+		if err != nil || stamp.Before(since) {
+			return
+		}
+		rejections.Limits[limitNames[m[2]]]++
+		clients[m[3]]++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for ip, n := range clients {
+		rejections.TopClients = append(rejections.TopClients, RateLimitClient{IP: ip, Count: n})
+	}
+	sort.Slice(rejections.TopClients, func(i, j int) bool {
+		if rejections.TopClients[i].Count != rejections.TopClients[j].Count {
+			return rejections.TopClients[i].Count > rejections.TopClients[j].Count
+		}
+		return rejections.TopClients[i].IP < rejections.TopClients[j].IP
+	})
+	if len(rejections.TopClients) > maxTopClients {
+		rejections.TopClients = rejections.TopClients[:maxTopClients]
+	}
+	return rejections, nil
+}
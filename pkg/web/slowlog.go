@@ -0,0 +1,118 @@
+package web
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"svp/pkg/utils"
+	"time"
+)
+
+// PHPSlowlogTimeout is how long a request runs before PHP-FPM logs its
+// stack trace to the slowlog of the pool
+const PHPSlowlogTimeout = "5s"
+
+// phpSlowlogRotation rotates the slowlogs of all pools. PHP-FPM keeps the
+// file open, so it is truncated in place.
+const phpSlowlogRotation = "/etc/logrotate.d/svp-php-slowlog"
+
+// PHPSlowLogFile returns the slowlog of a site's PHP-FPM pool
+func PHPSlowLogFile(version, domain string) string {
+	return fmt.Sprintf("/var/log/php%s-fpm-%s-slow.log", version, domain)
+}
+
+// SlowTrace sums up the slowlog entries with the same script and stack
+type SlowTrace struct {
+	Script   string    `json:"script"`
+	Frames   []string  `json:"frames"`
+	Count    int       `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+var (
+	slowlogHeader = regexp.MustCompile(`^\[(\d{2}-\w{3}-\d{4} \d{2}:\d{2}:\d{2})\]\s+\[pool [^\]]+\] pid \d+`)
+	slowlogFrame  = regexp.MustCompile(`^\[0x[0-9a-f]+\] (.+)$`)
+)
+
+// SlowTraces reads the slowlog of a site's pool, rotated copies included,
+// and returns the stack traces logged since a time, the most frequent
+// first. Every request in it ran longer than PHPSlowlogTimeout.
+func SlowTraces(version, domain string, since time.Time) ([]SlowTrace, error) {
+	byStack := make(map[string]*SlowTrace)
+	var current *SlowTrace
+	flush := func() {
+		if current == nil || current.LastSeen.Before(since) {
+			return
+		}
+		key := current.Script + "\n" + strings.Join(current.Frames, "\n")
+		trace := byStack[key]
+		if trace == nil {
+			trace = &SlowTrace{Script: current.Script, Frames: current.Frames}
+			byStack[key] = trace
+		}
+		trace.Count++
+		if current.LastSeen.After(trace.LastSeen) {
+			trace.LastSeen = current.LastSeen
+		}
+	}
+
+	err := utils.ReadLogLines(PHPSlowLogFile(version, domain), func(line string) {
+		if m := slowlogHeader.FindStringSubmatch(line); m != nil {
+			flush()
+			current = nil
+			if logged, err := time.ParseInLocation("02-Jan-2006 15:04:05", m[1], time.Local); err == nil {
+				current = &SlowTrace{LastSeen: logged}
+			}
+			return
+		}
+		if current == nil {
+			return
+		}
+		if script, found := strings.CutPrefix(line, "script_filename = "); found {
+			current.Script = script
+		} else if m := slowlogFrame.FindStringSubmatch(line); m != nil {
+			current.Frames = append(current.Frames, m[1])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	flush()
+
+	traces := make([]SlowTrace, 0, len(byStack))
+	for _, trace := range byStack {
+		traces = append(traces, *trace)
+	}
+	sort.Slice(traces, func(i, j int) bool {
+		if traces[i].Count != traces[j].Count {
+			return traces[i].Count > traces[j].Count
+		}
+		return traces[i].LastSeen.After(traces[j].LastSeen)
+	})
+	return traces, nil
+}
+
+// ensureSlowlogRotation keeps the slowlogs of the pools from growing
+// without bound
+func ensureSlowlogRotation() error {
+	if utils.CheckFileExists(phpSlowlogRotation) {
+		return nil
+	}
+	content := `# Managed by svp: slowlogs of the PHP-FPM pools
+/var/log/php*-fpm-*-slow.log {
+	weekly
+	rotate 4
+	missingok
+	notifempty
+	compress
+	delaycompress
+	copytruncate
+}
+`
+	if err := os.WriteFile(phpSlowlogRotation, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", phpSlowlogRotation, err)
+	}
+	return nil
+}
@@ -41,6 +41,19 @@ type Config struct {
 	// Database import file path
 	DBImport string
 
+	// External database server (empty: the local server) and its port
+	DBHost string
+	DBPort string
+
+	// Connect to the external server with TLS, verifying its certificate
+	// against DBCA (default: the system CA bundle)
+	DBTLS bool
+	DBCA  string
+
+	// Admin account that creates site databases on the external server
+	DBAdminUser string
+	DBAdminPass string
+
 	// Whether to create swap
 	CreateSwap string // "yes", "no", or "auto"
 
@@ -73,6 +86,159 @@ type Config struct {
 
 	// Keep existing database (reuse credentials and drop tables)
 	KeepExistingDB bool
+
+	// Domain action for domain command: add, remove, canonical, list
+	DomainAction string
+
+	// Alias hostname for domain command
+	DomainAlias string
+
+	// Make the alias the canonical hostname (domain add)
+	DomainCanonical bool
+
+	// www/non-www canonical host policy for setup: apex, www or none
+	CanonicalPolicy string
+
+	// Run each site's PHP-FPM pool as its own system user
+	IsolateSites bool
+
+	// Reuse files already in the site directory instead of prompting to delete them
+	ReuseFiles bool
+
+	// Apply the isolate command to every site
+	IsolateAll bool
+
+	// Revert the isolate command (back to the shared www-data pool)
+	IsolateRevert bool
+
+	// Site action for site command: export, import, migrate
+	SiteAction string
+
+	// Bundle file for site export/import
+	BundleFile string
+
+	// Export only the git remote and ref instead of the codebase
+	BundleGitOnly bool
+
+	// Domain to import a bundle as (defaults to the bundle's domain)
+	ImportDomain string
+
+	// Source server of a site migration (user@host)
+	MigrateFrom string
+
+	// SSH port of the migration source
+	MigrateSSHPort string
+
+	// Use sudo on the migration source to read files and svp configs
+	MigrateSudo bool
+
+	// Run the final delta sync of a migration
+	MigrateFinal bool
+
+	// Back up every configured site
+	BackupAll bool
+
+	// Backup action: empty (run a backup), schedule, target, encrypt or verify
+	BackupAction string
+
+	// Daily backup time (HH:MM) or systemd OnCalendar expression for schedule
+	BackupDaily    string
+	BackupCalendar string
+
+	// Verify each scheduled backup by trial restore
+	BackupVerify bool
+
+	// Remove a site's backup schedule, or turn off backup encryption
+	BackupDisable bool
+
+	// Public keys (age recipients) to encrypt backups to, comma-separated
+	BackupRecipients string
+
+	// Backup target action (add, remove, list, test) and the target it applies to
+	TargetAction string
+	Target       BackupTarget
+
+	// Skip uploading to offsite backup targets
+	BackupLocalOnly bool
+
+	// Retention overrides for backup pruning (-1 uses /etc/svp/backup.conf)
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+
+	// Backup set to restore or verify: an ID in /var/backups/svp/DOMAIN or a directory
+	RestoreFrom string
+
+	// Site to restore into (defaults to the backed up domain)
+	RestoreTo string
+
+	// Restore only the database or only the uploads
+	RestoreDBOnly    bool
+	RestoreFilesOnly bool
+
+	// Private key (age identity file) to decrypt encrypted backups with
+	IdentityFile string
+
+	// Skip confirmation prompts
+	AssumeYes bool
+
+	// Skip the safety snapshot before destructive operations
+	NoSnapshot bool
+
+	// Include the site directory in the safety snapshot of setup
+	SnapshotFiles bool
+
+	// Snapshot action: list or undo, and the snapshot ID to undo
+	SnapshotAction string
+	SnapshotID     string
+
+	// Database action: rotate, export, import or tune
+	DBAction string
+
+	// Output file of a database export (default: DOMAIN-TIMESTAMP.sql.gz)
+	DBExportFile string
+
+	// Drop all tables before a database import
+	DBDropTables bool
+
+	// MariaDB tuning profile override (small, medium, large or auto) and
+	// whether to only preview the tuning file
+	TuningProfile string
+	TuningShow    bool
+
+	// Time window of 'svp perf' (e.g. 24h or 7d), the number of entries per
+	// section and whether to print JSON
+	PerfSince string
+	PerfLimit int
+	PerfJSON  bool
+
+	// Cache backends of the sites (comma-separated "redis" and "page") and
+	// the action of the cache command
+	Cache       string
+	CacheAction string
+
+	// Path or URL to purge from the page cache (empty purges everything),
+	// and the time window and JSON output of 'svp cache stats'
+	CachePath  string
+	CacheSince string
+	CacheJSON  bool
+
+	// Action of the ratelimit command (set, disable or check), the limits
+	// and lists given to set ("none" clears a list) and the time window of
+	// check
+	RateLimitAction      string
+	RateLimitRate        string
+	RateLimitLoginRate   string
+	RateLimitConnections int
+	RateLimitPaths       string
+	RateLimitAgents      string
+	RateLimitSince       string
+
+	// Action of the nginx command (edit), the snippet to edit and whether
+	// it is included at http level instead of in the server blocks
+	NginxAction  string
+	NginxSnippet string
+	NginxHTTP    bool
 }
 
 // SiteConfig represents configuration for a single site
@@ -83,6 +249,47 @@ type SiteConfig struct {
 	DBName     string
 	DBUser     string
 	DBPass     string
+
+	// CMS type: "drupal" or "wordpress"
+	CMS string
+
+	// Additional hostnames served by the same vhost
+	Aliases []string
+
+	// Hostname the other names redirect to (empty means no redirects)
+	CanonicalHost string
+
+	// www/non-www policy: "apex", "www" or "none" (empty means none)
+	CanonicalPolicy string
+
+	// Whether the vhost serves HTTPS with the site's Let's Encrypt certificate
+	SSLEnabled bool
+
+	// System user the site's files and PHP-FPM pool belong to
+	// (empty means the shared www-data pool)
+	SiteUser string
+
+	// Whether nginx caches the site's anonymous pages (svp cache enable DOMAIN page)
+	PageCache bool
+
+	// Whether nginx rate limits the site (svp ratelimit DOMAIN set), with
+	// the overrides of the defaults: requests per IP, requests per IP to
+	// login paths, connections per IP, extra path prefixes to limit like
+	// logins and user agent substrings to block
+	RateLimit            bool
+	RateLimitRate        string
+	RateLimitLoginRate   string
+	RateLimitConnections int
+	RateLimitPaths       []string
+	BlockedAgents        []string
+
+	// Creation timestamp as recorded in the site config
+	Created string
+}
+
+// Hostnames returns the primary domain followed by its aliases
+func (s *SiteConfig) Hostnames() []string {
+	return append([]string{s.Domain}, s.Aliases...)
 }
 
 // PHPVersions tracks current and previous PHP versions
@@ -90,3 +297,43 @@ type PHPVersions struct {
 	Current  string
 	Previous string
 }
+
+// BackupConfig holds the backup settings from /etc/svp/backup.conf
+type BackupConfig struct {
+	// Number of daily, weekly and monthly backup sets kept per site
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+
+	// Hours after which the last successful backup counts as stale
+	StaleAfterHours int
+
+	// Number of safety snapshots kept per site
+	SnapshotKeep int
+}
+
+// BackupTarget is an offsite destination for backup sets, stored root-only
+// in /etc/svp/backup-targets/NAME.conf
+type BackupTarget struct {
+	Name string
+
+	// Target type: s3, sftp or local
+	Type string
+
+	// S3-compatible object storage
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+
+	// SFTP host
+	Host         string
+	Port         string
+	User         string
+	IdentityFile string
+
+	// Directory (sftp, local) or key prefix (s3) that holds the sites
+	Path string
+}